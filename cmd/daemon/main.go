@@ -1,99 +1,77 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"flag"
 	"log"
-	"net"
-	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"git.netflux.io/rob/solar-toolkit/inverter"
-)
-
-const (
-	httpUserAgent = "solar-toolkit (git.netflux.io)"
-	httpTimeout   = time.Second * 5
+	"git.netflux.io/rob/solar-toolkit/daemon"
 )
 
 func main() {
 	var (
+		configPath      string
 		inverterAddr    string
 		gatewayEndpoint string
 		gatewayUsername string
 		gatewayPassword string
+		spoolDir        string
+		metricsAddr     string
+		mqttBroker      string
 		pollInterval    time.Duration
 	)
 
+	flag.StringVar(&configPath, "config", "", "path to YAML config file, reloaded on SIGHUP. Overrides all other flags.")
 	flag.StringVar(&inverterAddr, "inverter-addr", "", "IP+port of solar inverter")
 	flag.StringVar(&gatewayEndpoint, "endpoint", "", "URL to post metrics to")
 	flag.StringVar(&gatewayUsername, "username", "", "HTTP basic auth username")
 	flag.StringVar(&gatewayPassword, "password", "", "HTTP basic auth password")
+	flag.StringVar(&spoolDir, "spool-dir", "", "directory in which to keep frames until the gateway accepts them")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "address on which to serve Prometheus metrics, example: :9942")
+	flag.StringVar(&mqttBroker, "mqtt-broker", "", "URL of MQTT broker to publish frames to, example: tcp://localhost:1883")
 	flag.DurationVar(&pollInterval, "pollInterval", time.Minute, "Poll interval, example: 60s")
 	flag.Parse()
 
-	if gatewayEndpoint == "" || inverterAddr == "" {
-		flag.Usage()
-		os.Exit(1)
-	}
-
-	conn, err := net.Dial("udp", inverterAddr)
-	if err != nil {
-		log.Fatalf("error dialing: %s", err)
-	}
-	defer conn.Close()
-
-	var inv inverter.ET
-
-	ticker := time.NewTicker(pollInterval)
-	defer ticker.Stop()
-
-	client := http.Client{Timeout: httpTimeout}
-
-	for ; true; <-ticker.C {
-		runtimeData, err := inv.RuntimeData(context.Background(), conn)
-		if err != nil {
-			log.Printf("error fetching runtime data: %s", err)
-			continue
+	var cfg *daemon.Config
+	if configPath != "" {
+		var err error
+		if cfg, err = daemon.LoadConfig(configPath); err != nil {
+			log.Fatal(err)
 		}
-
-		meterData, err := inv.MeterData(context.Background(), conn)
-		if err != nil {
-			log.Printf("error fetching meter data: %s", err)
-			continue
+	} else {
+		if (gatewayEndpoint == "" && metricsAddr == "" && mqttBroker == "") || inverterAddr == "" {
+			flag.Usage()
+			os.Exit(1)
 		}
 
-		frame := inverter.ETDataFrame{ETRuntimeData: runtimeData, ETMeterData: meterData}
-		reqBody, err := json.Marshal(frame)
-		if err != nil {
-			log.Printf("error encoding frame: %s", err)
-			continue
+		cfg = &daemon.Config{
+			PollInterval: pollInterval,
+			Inverters:    []daemon.InverterConfig{{Address: inverterAddr}},
+			Spool:        daemon.SpoolConfig{Dir: spoolDir},
+			Metrics:      daemon.MetricsConfig{Listen: metricsAddr},
+			MQTT:         daemon.MQTTConfig{Broker: mqttBroker},
 		}
-
-		req, err := http.NewRequest(http.MethodPost, gatewayEndpoint, bytes.NewReader(reqBody))
-		if err != nil {
-			log.Printf("error building request: %s", err)
-			continue
+		if gatewayEndpoint != "" {
+			cfg.Gateways = []daemon.GatewayConfig{{Endpoint: gatewayEndpoint, Username: gatewayUsername, Password: gatewayPassword}}
 		}
-
-		req.Header.Set("content-type", "application/json")
-		req.Header.Set("user-agent", httpUserAgent)
-		if gatewayUsername != "" && gatewayPassword != "" {
-			req.SetBasicAuth(gatewayUsername, gatewayPassword)
+		if err := cfg.Validate(); err != nil {
+			log.Fatal(err)
 		}
+	}
 
-		resp, err := client.Do(req)
-		if err != nil {
-			log.Printf("error sending request: %s", err)
-			continue
-		}
-		if resp.StatusCode != http.StatusOK {
-			log.Printf("unexpected HTTP response code: %d", resp.StatusCode)
-			continue
-		}
-		log.Printf("OK: %s", runtimeData.PVPower.String())
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	d := daemon.New(cfg)
+	if configPath != "" {
+		d.ReloadOnSIGHUP(ctx, configPath)
+	}
+
+	if err := d.Run(ctx); err != nil {
+		log.Fatal(err)
 	}
 }
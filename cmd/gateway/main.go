@@ -1,46 +1,77 @@
 package main
 
 import (
+	"context"
 	"log"
-	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
-	"git.netflux.io/rob/solar-toolkit/gateway/handler"
-	"git.netflux.io/rob/solar-toolkit/gateway/store"
-	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
+	"git.netflux.io/rob/solar-toolkit/gateway"
+	"git.netflux.io/rob/solar-toolkit/gateway/tariff"
+	"git.netflux.io/rob/solar-toolkit/validate"
 )
 
-const defaultBindAddr = ":8888"
-
 func main() {
 	databaseURL := os.Getenv("DATABASE_URL")
 	if databaseURL == "" {
 		log.Fatal("missing configuration DATABASE_URL")
 	}
 
-	bindAddr := os.Getenv("BIND_ADDR")
-	if bindAddr == "" {
-		bindAddr = defaultBindAddr
-	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
 
-	db, err := sqlx.Connect("postgres", databaseURL)
-	if err != nil {
-		log.Fatalf("could not connect to database: %s", err)
-	}
+	// solar-toolkit-gateway migrate up|down [n]|status
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		db, err := gateway.Connect(databaseURL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer db.Close()
 
-	store := store.NewSQL(db)
-	handler := handler.New(store)
-	srv := http.Server{
-		ReadTimeout:  time.Second * 3,
-		WriteTimeout: time.Second * 3,
-		Handler:      handler,
-		Addr:         bindAddr,
+		if err := gateway.Migrate(ctx, db, os.Stdout, os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	log.Printf("Listening on %s...", bindAddr)
-	if err := srv.ListenAndServe(); err != nil {
+	cfg := gateway.Config{
+		DatabaseURL:          databaseURL,
+		BindAddr:             os.Getenv("BIND_ADDR"),
+		AllowUnauthenticated: os.Getenv("ALLOW_UNAUTHENTICATED") == "true",
+		MigrateOnStartup:     os.Getenv("MIGRATE_ON_STARTUP") == "true",
+	}
+	if v := os.Getenv("RETENTION_DAYS"); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days < 0 {
+			log.Fatalf("invalid RETENTION_DAYS `%s`", v)
+		}
+		cfg.Retention = time.Duration(days) * 24 * time.Hour
+	}
+	if tz := os.Getenv("TIMEZONE"); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			log.Fatalf("invalid TIMEZONE: %s", err)
+		}
+		cfg.Location = loc
+	}
+	if path := os.Getenv("VALIDATION_RULES"); path != "" {
+		validation, err := validate.LoadConfig(path)
+		if err != nil {
+			log.Fatalf("invalid VALIDATION_RULES: %s", err)
+		}
+		cfg.Validation = *validation
+	}
+	if path := os.Getenv("TARIFFS"); path != "" {
+		tariffs, err := tariff.LoadConfig(path)
+		if err != nil {
+			log.Fatalf("invalid TARIFFS: %s", err)
+		}
+		cfg.Tariffs = *tariffs
+	}
+	if err := gateway.Run(ctx, cfg); err != nil {
 		log.Fatal(err)
 	}
 }
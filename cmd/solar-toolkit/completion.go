@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/template"
+)
+
+type completionCommand struct {
+	Name  string
+	Short string
+	Flags []string
+}
+
+func completionCommands() []completionCommand {
+	var result []completionCommand
+	for _, sc := range subcommands {
+		fs := flag.NewFlagSet(sc.name, flag.ContinueOnError)
+		var g globals
+		g.register(fs)
+		sc.setup(fs)
+
+		cc := completionCommand{Name: sc.name, Short: sc.short}
+		fs.VisitAll(func(f *flag.Flag) { cc.Flags = append(cc.Flags, f.Name) })
+		result = append(result, cc)
+	}
+	return result
+}
+
+func globalFlags() []string {
+	fs := flag.NewFlagSet(programName, flag.ContinueOnError)
+	var g globals
+	g.register(fs)
+
+	var names []string
+	fs.VisitAll(func(f *flag.Flag) { names = append(names, f.Name) })
+	return names
+}
+
+var completionTemplates = map[string]string{
+	"bash": `# bash completion for {{.Program}}
+_{{.Func}}() {
+  local cur cmd i
+  cur="${COMP_WORDS[COMP_CWORD]}"
+  for ((i = 1; i < COMP_CWORD; i++)); do
+    case "${COMP_WORDS[i]}" in
+      -*) ;;
+      *) cmd="${COMP_WORDS[i]}"; break ;;
+    esac
+  done
+
+  if [[ -z "$cmd" ]]; then
+    if [[ "$cur" == -* ]]; then
+      COMPREPLY=($(compgen -W "{{flags .Globals}}" -- "$cur"))
+    else
+      COMPREPLY=($(compgen -W "{{range .Commands}}{{.Name}} {{end}}" -- "$cur"))
+    fi
+    return
+  fi
+
+  case "$cmd" in
+{{- range .Commands}}
+    {{.Name}}) COMPREPLY=($(compgen -W "{{flags .Flags}}" -- "$cur")) ;;
+{{- end}}
+  esac
+}
+complete -o default -F _{{.Func}} {{.Program}}
+`,
+	"zsh": `#compdef {{.Program}}
+# zsh completion for {{.Program}}
+_{{.Func}}() {
+  local -a commands
+  commands=(
+{{- range .Commands}}
+    '{{.Name}}:{{.Short}}'
+{{- end}}
+  )
+
+  if (( CURRENT == 2 )); then
+    _describe 'command' commands
+    return
+  fi
+
+  case "${words[2]}" in
+{{- range .Commands}}
+    {{.Name}}) compadd -- {{flags .Flags}} ;;
+{{- end}}
+  esac
+}
+compdef _{{.Func}} {{.Program}}
+`,
+	"fish": `# fish completion for {{.Program}}
+complete -c {{.Program}} -f
+{{- range .Commands}}
+complete -c {{$.Program}} -n __fish_use_subcommand -a {{.Name}} -d '{{.Short}}'
+{{- $name := .Name}}
+{{- range .Flags}}
+complete -c {{$.Program}} -n '__fish_seen_subcommand_from {{$name}}' -o {{.}}
+{{- end}}
+{{- end}}
+`,
+}
+
+func setupCompletion(fs *flag.FlagSet) runFunc {
+	return func(_ context.Context, _ *globals, args []string) error {
+		if len(args) != 1 {
+			return errors.New("expected a shell: bash, zsh or fish")
+		}
+		return writeCompletion(os.Stdout, args[0])
+	}
+}
+
+func writeCompletion(w io.Writer, shell string) error {
+	text, ok := completionTemplates[shell]
+	if !ok {
+		return fmt.Errorf("unsupported shell `%s`", shell)
+	}
+
+	tmpl, err := template.New(shell).Funcs(template.FuncMap{
+		"flags": func(names []string) string {
+			var flags []string
+			for _, name := range names {
+				flags = append(flags, "-"+name)
+			}
+			return strings.Join(flags, " ")
+		},
+	}).Parse(text)
+	if err != nil {
+		return fmt.Errorf("error parsing template: %s", err)
+	}
+
+	return tmpl.Execute(w, struct {
+		Program  string
+		Func     string
+		Globals  []string
+		Commands []completionCommand
+	}{
+		Program:  programName,
+		Func:     strings.ReplaceAll(programName, "-", "_"),
+		Globals:  globalFlags(),
+		Commands: completionCommands(),
+	})
+}
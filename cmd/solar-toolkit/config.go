@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"git.netflux.io/rob/solar-toolkit/command"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	envConfig       = "SOLAR_TOOLKIT_CONFIG"
+	envInverterAddr = "SOLAR_TOOLKIT_INVERTER_ADDR"
+	envTransport    = "SOLAR_TOOLKIT_TRANSPORT"
+	envTimezone     = "SOLAR_TOOLKIT_TIMEZONE"
+
+	defaultTimezone = "Europe/Madrid"
+	defaultUDPPort  = "8899"
+	defaultTCPPort  = "502"
+)
+
+// globals holds the flags shared by all subcommands. Each value is resolved
+// from, in order of precedence, the command line, the environment and the
+// config file.
+type globals struct {
+	configPath   string
+	inverterAddr string
+	transport    string
+	timezone     string
+
+	// Resolved values:
+	Transport command.Transport
+	Location  *time.Location
+}
+
+// configFile is the format of the optional YAML config file.
+type configFile struct {
+	InverterAddr string `yaml:"inverter_addr"`
+	Transport    string `yaml:"transport"`
+	Timezone     string `yaml:"timezone"`
+}
+
+func (g *globals) register(fs *flag.FlagSet) {
+	fs.StringVar(&g.configPath, "config", g.configPath, "path to config file (env "+envConfig+")")
+	fs.StringVar(&g.inverterAddr, "inverter-addr", g.inverterAddr, "IP+port of solar inverter (env "+envInverterAddr+")")
+	fs.StringVar(&g.transport, "transport", g.transport, "inverter transport, udp or tcp (env "+envTransport+")")
+	fs.StringVar(&g.timezone, "timezone", g.timezone, "timezone of the inverter clock (env "+envTimezone+")")
+}
+
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, programName, "config.yaml")
+}
+
+func (g *globals) resolve() error {
+	fallback(&g.configPath, os.Getenv(envConfig))
+	explicitConfig := g.configPath != ""
+	fallback(&g.configPath, defaultConfigPath())
+
+	var cfg configFile
+	if g.configPath != "" {
+		p, err := os.ReadFile(g.configPath)
+		switch {
+		case errors.Is(err, fs.ErrNotExist) && !explicitConfig:
+		case err != nil:
+			return fmt.Errorf("error reading config file: %s", err)
+		default:
+			if err = yaml.Unmarshal(p, &cfg); err != nil {
+				return fmt.Errorf("error parsing config file %s: %s", g.configPath, err)
+			}
+		}
+	}
+
+	fallback(&g.inverterAddr, os.Getenv(envInverterAddr), cfg.InverterAddr)
+	fallback(&g.transport, os.Getenv(envTransport), cfg.Transport)
+	fallback(&g.timezone, os.Getenv(envTimezone), cfg.Timezone, defaultTimezone)
+
+	var err error
+	if g.Transport, err = command.ParseTransport(g.transport); err != nil {
+		return err
+	}
+	if g.Location, err = time.LoadLocation(g.timezone); err != nil {
+		return fmt.Errorf("invalid timezone: %s", err)
+	}
+
+	return nil
+}
+
+// fallback sets *s to the first non-empty value, if it is empty.
+func fallback(s *string, values ...string) {
+	for _, v := range values {
+		if *s != "" {
+			return
+		}
+		*s = v
+	}
+}
+
+// addr returns the inverter address, adding the default port for the
+// transport if none was provided.
+func (g *globals) addr() (string, error) {
+	if g.inverterAddr == "" {
+		return "", errors.New("missing inverter address, set -inverter-addr or " + envInverterAddr)
+	}
+
+	if _, _, err := net.SplitHostPort(g.inverterAddr); err == nil {
+		return g.inverterAddr, nil
+	}
+
+	port := defaultUDPPort
+	if g.Transport == command.TransportTCP {
+		port = defaultTCPPort
+	}
+	return net.JoinHostPort(g.inverterAddr, port), nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"git.netflux.io/rob/solar-toolkit/format"
+	"git.netflux.io/rob/solar-toolkit/gateway"
+	"git.netflux.io/rob/solar-toolkit/gateway/energy"
+	"git.netflux.io/rob/solar-toolkit/gateway/store"
+	"git.netflux.io/rob/solar-toolkit/gateway/tariff"
+)
+
+func setupCosts(fs *flag.FlagSet) runFunc {
+	databaseURL := fs.String("database-url", "", "database URL, postgres://... or sqlite:///path/to/file.db (env "+envDatabaseURL+")")
+	tariffsPath := fs.String("tariffs", "", "path to YAML file of device tariffs, required for update and rebuild (env "+envTariffs+")")
+	serialNumber := fs.String("serial", "", "serial number of the device, required for report")
+	month := fs.String("month", "", "month of the report, e.g. 2022-07 (default this month)")
+	outputFormat := fs.String("format", string(format.Table), "output format, one of: table, json, pretty-json")
+
+	return func(ctx context.Context, g *globals, args []string) error {
+		fallback(databaseURL, os.Getenv(envDatabaseURL))
+		if *databaseURL == "" {
+			return errors.New("missing database URL, set -database-url or " + envDatabaseURL)
+		}
+		command := "report"
+		if len(args) > 0 {
+			command = args[0]
+		}
+
+		db, err := gateway.Connect(*databaseURL)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		store := store.New(db)
+
+		switch command {
+		case "report":
+			if *serialNumber == "" {
+				return errors.New("missing device serial number, set -serial")
+			}
+
+			start := energy.Month.Start(time.Now(), g.Location)
+			if *month != "" {
+				if start, err = time.ParseInLocation("2006-01", *month, g.Location); err != nil {
+					return fmt.Errorf("invalid -month `%s`", *month)
+				}
+			}
+
+			days, err := store.Costs(*serialNumber, start, energy.Month.Next(start))
+			if err != nil {
+				return err
+			}
+			costs := tariff.Rollup(days, energy.Month, g.Location)
+			if len(costs) == 0 {
+				return fmt.Errorf("no costs of %s in %s, check its tariff and run `costs update`", *serialNumber, start.Format("January 2006"))
+			}
+			if format.Format(*outputFormat) != format.Table {
+				return writeRecords(os.Stdout, *outputFormat, costs[0])
+			}
+			return writeBill(os.Stdout, *serialNumber, costs[0], g.Location)
+		case "update", "rebuild":
+			fallback(tariffsPath, os.Getenv(envTariffs))
+			if *tariffsPath == "" {
+				return errors.New("missing tariffs, set -tariffs or " + envTariffs)
+			}
+			cfg, err := tariff.LoadConfig(*tariffsPath)
+			if err != nil {
+				return err
+			}
+
+			var serialNumbers []string
+			for serialNumber := range cfg.Tariffs {
+				serialNumbers = append(serialNumbers, serialNumber)
+			}
+			slices.Sort(serialNumbers)
+			if *serialNumber != "" {
+				if _, ok := cfg.Tariffs[*serialNumber]; !ok {
+					return fmt.Errorf("no tariff for device `%s`", *serialNumber)
+				}
+				serialNumbers = []string{*serialNumber}
+			}
+
+			update := tariff.Update
+			if command == "rebuild" {
+				update = tariff.Rebuild
+			}
+			for _, serialNumber := range serialNumbers {
+				if err := update(store, serialNumber, cfg.Tariffs[serialNumber], g.Location, time.Now()); err != nil {
+					return fmt.Errorf("error updating costs of %s: %s", serialNumber, err)
+				}
+				fmt.Fprintf(os.Stderr, "Updated costs of %s.\n", serialNumber)
+			}
+			return nil
+		default:
+			return fmt.Errorf("unknown costs command `%s`", command)
+		}
+	}
+}
+
+// writeBill writes the monthly cost as a bill, with a line for each rate.
+func writeBill(w io.Writer, serialNumber string, c tariff.Cost, loc *time.Location) error {
+	money := func(v float64) string {
+		return strings.TrimSpace(fmt.Sprintf("%.2f %s", v, c.Currency))
+	}
+	price := func(v float64) string {
+		return strings.TrimSpace(fmt.Sprintf("%.4f %s/kWh", v, c.Currency))
+	}
+
+	fmt.Fprintf(w, "Device %s, %s\n\n", serialNumber, c.Start.In(loc).Format("January 2006"))
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Standing charge\t\t%d days\t\t%s\n", c.Days, money(c.StandingCharge))
+	for _, charge := range c.Import {
+		fmt.Fprintf(tw, "Import\t%s\t%.1f kWh\t%s\t%s\n", charge.Rate, charge.Energy, price(charge.Price), money(charge.Amount))
+	}
+	for _, charge := range c.Export {
+		fmt.Fprintf(tw, "Export\t%s\t%.1f kWh\t%s\t%s\n", charge.Rate, charge.Energy, price(charge.Price), money(-charge.Amount))
+	}
+	fmt.Fprintf(tw, "Total\t\t\t\t%s\n", money(c.Total))
+	fmt.Fprintf(tw, "Savings\t\t\t\t%s\n", money(c.Savings))
+	return tw.Flush()
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"git.netflux.io/rob/solar-toolkit/format"
+	"git.netflux.io/rob/solar-toolkit/gateway"
+	"git.netflux.io/rob/solar-toolkit/gateway/energy"
+	"git.netflux.io/rob/solar-toolkit/gateway/store"
+)
+
+// energyRecord is a row of the energy report table.
+type energyRecord struct {
+	Start            string `json:"start"`
+	Generation       string `json:"generation"`
+	Export           string `json:"export"`
+	Import           string `json:"import"`
+	Consumption      string `json:"consumption"`
+	SelfConsumption  string `json:"self_consumption"`
+	SelfSufficiency  string `json:"self_sufficiency"`
+	BatteryCharge    string `json:"battery_charge"`
+	BatteryDischarge string `json:"battery_discharge"`
+}
+
+// periodLayouts are the layouts of the start of each period in the report
+// table.
+var periodLayouts = map[energy.Period]string{
+	energy.Day:   time.DateOnly,
+	energy.Month: "2006-01",
+	energy.Year:  "2006",
+}
+
+func setupEnergy(fs *flag.FlagSet) runFunc {
+	databaseURL := fs.String("database-url", "", "database URL, postgres://... or sqlite:///path/to/file.db (env "+envDatabaseURL+")")
+	serialNumber := fs.String("serial", "", "serial number of the device, required for report")
+	periodName := fs.String("period", string(energy.Day), "period of each row of the report: day, month or year")
+	fromDate := fs.String("from", "", "first date of the report, e.g. 2022-07-01 (default 1 year ago)")
+	toDate := fs.String("to", "", "last date of the report, e.g. 2022-07-31 (default today)")
+	outputFormat := fs.String("format", string(format.Table), "output format, one of: table, json, pretty-json")
+
+	return func(ctx context.Context, g *globals, args []string) error {
+		fallback(databaseURL, os.Getenv(envDatabaseURL))
+		if *databaseURL == "" {
+			return errors.New("missing database URL, set -database-url or " + envDatabaseURL)
+		}
+		command := "report"
+		if len(args) > 0 {
+			command = args[0]
+		}
+
+		db, err := gateway.Connect(*databaseURL)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		store := store.New(db)
+
+		switch command {
+		case "report":
+			if *serialNumber == "" {
+				return errors.New("missing device serial number, set -serial")
+			}
+			period, err := energy.ParsePeriod(*periodName)
+			if err != nil {
+				return err
+			}
+
+			now := time.Now().In(g.Location)
+			to := energy.Day.Next(energy.Day.Start(now, g.Location))
+			if *toDate != "" {
+				t, err := time.ParseInLocation(time.DateOnly, *toDate, g.Location)
+				if err != nil {
+					return fmt.Errorf("invalid -to date `%s`", *toDate)
+				}
+				to = energy.Day.Next(t)
+			}
+			from := to.AddDate(-1, 0, 0)
+			if *fromDate != "" {
+				if from, err = time.ParseInLocation(time.DateOnly, *fromDate, g.Location); err != nil {
+					return fmt.Errorf("invalid -from date `%s`", *fromDate)
+				}
+			}
+			// Include the summary of the period containing from.
+			from = period.Start(from, g.Location)
+
+			summaries, err := store.Summaries(*serialNumber, period, from, to)
+			if err != nil {
+				return err
+			}
+			if format.Format(*outputFormat) != format.Table {
+				return writeRecords(os.Stdout, *outputFormat, summaries)
+			}
+
+			records := make([]energyRecord, 0, len(summaries))
+			for _, s := range summaries {
+				records = append(records, energyRecord{
+					Start:            s.Start.In(g.Location).Format(periodLayouts[period]),
+					Generation:       fmt.Sprintf("%.1f kWh", s.Generation),
+					Export:           fmt.Sprintf("%.1f kWh", s.Export),
+					Import:           fmt.Sprintf("%.1f kWh", s.Import),
+					Consumption:      fmt.Sprintf("%.1f kWh", s.Consumption),
+					SelfConsumption:  fmt.Sprintf("%.1f kWh", s.SelfConsumption),
+					SelfSufficiency:  fmt.Sprintf("%.0f%%", s.SelfSufficiency*100),
+					BatteryCharge:    fmt.Sprintf("%.1f kWh", s.BatteryCharge),
+					BatteryDischarge: fmt.Sprintf("%.1f kWh", s.BatteryDischarge),
+				})
+			}
+			return writeRecords(os.Stdout, *outputFormat, records)
+		case "update", "rebuild":
+			serialNumbers := []string{*serialNumber}
+			if *serialNumber == "" {
+				if serialNumbers, err = store.SerialNumbers(); err != nil {
+					return err
+				}
+			}
+
+			update := energy.Update
+			if command == "rebuild" {
+				update = energy.Rebuild
+			}
+			for _, serialNumber := range serialNumbers {
+				if err := update(store, serialNumber, g.Location, time.Now()); err != nil {
+					return fmt.Errorf("error updating energy summaries of %s: %s", serialNumber, err)
+				}
+				fmt.Fprintf(os.Stderr, "Updated energy summaries of %s.\n", serialNumber)
+			}
+			return nil
+		default:
+			return fmt.Errorf("unknown energy command `%s`", command)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"git.netflux.io/rob/solar-toolkit/command"
+	"git.netflux.io/rob/solar-toolkit/format"
+	"git.netflux.io/rob/solar-toolkit/inverter"
+)
+
+func connect(g *globals) (net.Conn, inverter.ET, error) {
+	addr, err := g.addr()
+	if err != nil {
+		return nil, inverter.ET{}, err
+	}
+
+	conn, err := net.Dial(string(g.Transport), addr)
+	if err != nil {
+		return nil, inverter.ET{}, fmt.Errorf("error dialing: %s", err)
+	}
+
+	return conn, inverter.ET{Location: g.Location, Transport: g.Transport}, nil
+}
+
+// frameOptions holds the flags of subcommands which print a data frame.
+type frameOptions struct {
+	format string
+	fields string
+}
+
+func registerFrameOptions(fs *flag.FlagSet, defaultFields string) *frameOptions {
+	var opts frameOptions
+	var names []string
+	for _, f := range format.Formats {
+		names = append(names, string(f))
+	}
+	fs.StringVar(&opts.format, "format", string(format.Table), "output format, one of: "+strings.Join(names, ", "))
+	fs.StringVar(&opts.fields, "fields", defaultFields, "comma-separated list of fields to print, globs allowed")
+	return &opts
+}
+
+func (opts *frameOptions) write(w io.Writer, frame *inverter.ETDataFrame) error {
+	outFormat, err := format.Parse(opts.format)
+	if err != nil {
+		return err
+	}
+
+	var fields []inverter.Field
+	if opts.fields != "" {
+		if fields, err = inverter.MatchFields(strings.Split(opts.fields, ",")); err != nil {
+			return fmt.Errorf("error parsing fields: %s", err)
+		}
+	}
+
+	return format.Write(w, outFormat, frame, fields)
+}
+
+// frameCommand returns a runFunc which fetches the selected blocks of data
+// and prints them.
+func frameCommand(opts *frameOptions, runtime, meter bool) runFunc {
+	return func(ctx context.Context, g *globals, _ []string) error {
+		conn, inv, err := connect(g)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		var frame inverter.ETDataFrame
+		if runtime {
+			if frame.ETRuntimeData, err = inv.RuntimeData(ctx, conn); err != nil {
+				return fmt.Errorf("error fetching runtime data: %s", err)
+			}
+		}
+		if meter {
+			if frame.ETMeterData, err = inv.MeterData(ctx, conn); err != nil {
+				return fmt.Errorf("error fetching meter data: %s", err)
+			}
+		}
+
+		return opts.write(os.Stdout, &frame)
+	}
+}
+
+func setupStatus(fs *flag.FlagSet) runFunc {
+	return frameCommand(registerFrameOptions(fs, ""), true, true)
+}
+
+func setupMeter(fs *flag.FlagSet) runFunc {
+	return frameCommand(registerFrameOptions(fs, ""), false, true)
+}
+
+func setupBattery(fs *flag.FlagSet) runFunc {
+	return frameCommand(registerFrameOptions(fs, "battery_*"), true, false)
+}
+
+func setupInfo(fs *flag.FlagSet) runFunc {
+	outputFormat := fs.String("format", string(format.Table), "output format, one of: table, json, pretty-json")
+
+	return func(ctx context.Context, g *globals, _ []string) error {
+		conn, inv, err := connect(g)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		info, err := inv.DeviceInfo(ctx, conn)
+		if err != nil {
+			return fmt.Errorf("error fetching device info: %s", err)
+		}
+
+		return writeRecords(os.Stdout, *outputFormat, info)
+	}
+}
+
+type settingRecord struct {
+	Name     string  `json:"name"`
+	Value    float64 `json:"value"`
+	Unit     string  `json:"unit"`
+	Register uint16  `json:"register"`
+}
+
+func setupSettings(fs *flag.FlagSet) runFunc {
+	outputFormat := fs.String("format", string(format.Table), "output format, one of: table, json, pretty-json")
+
+	return func(ctx context.Context, g *globals, _ []string) error {
+		conn, inv, err := connect(g)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		settings, err := inv.Settings(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		records := make([]settingRecord, 0, len(settings))
+		for _, s := range settings {
+			records = append(records, settingRecord{Name: s.Name, Value: s.Value, Unit: s.Unit, Register: s.Register})
+		}
+
+		return writeRecords(os.Stdout, *outputFormat, records)
+	}
+}
+
+func setupDiscover(fs *flag.FlagSet) runFunc {
+	outputFormat := fs.String("format", string(format.Table), "output format, one of: table, json, pretty-json")
+	broadcastAddr := fs.String("broadcast-addr", command.DiscoveryAddr, "address to send the discovery request to")
+	timeout := fs.Duration("timeout", time.Second*3, "time to wait for responses")
+
+	return func(ctx context.Context, _ *globals, _ []string) error {
+		ctx, cancel := context.WithTimeout(ctx, *timeout)
+		defer cancel()
+
+		result, err := command.Discover(ctx, *broadcastAddr)
+		if err != nil {
+			return fmt.Errorf("error discovering inverters: %s", err)
+		}
+
+		return writeRecords(os.Stdout, *outputFormat, result)
+	}
+}
+
+type registerRecord struct {
+	Offset string `json:"offset"`
+	Value  uint16 `json:"value"`
+	Signed int16  `json:"signed"`
+	Hex    string `json:"hex"`
+}
+
+func setupRead(fs *flag.FlagSet) runFunc {
+	outputFormat := fs.String("format", string(format.Table), "output format, one of: table, json, pretty-json")
+	count := fs.Uint("count", 1, "number of registers to read")
+
+	return func(ctx context.Context, g *globals, args []string) error {
+		if len(args) != 1 {
+			return errors.New("expected a register offset, e.g. 0x891c")
+		}
+		offset, err := parseUint16(args[0])
+		if err != nil {
+			return fmt.Errorf("invalid offset: %s", err)
+		}
+		if *count == 0 || *count > 0x7d {
+			return errors.New("count must be between 1 and 125")
+		}
+
+		conn, inv, err := connect(g)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		registers, err := inv.ReadRegisters(ctx, conn, offset, uint16(*count))
+		if err != nil {
+			return err
+		}
+
+		records := make([]registerRecord, 0, len(registers))
+		for i, r := range registers {
+			records = append(records, registerRecord{
+				Offset: fmt.Sprintf("0x%04x", int(offset)+i),
+				Value:  r,
+				Signed: int16(r),
+				Hex:    fmt.Sprintf("0x%04x", r),
+			})
+		}
+
+		return writeRecords(os.Stdout, *outputFormat, records)
+	}
+}
+
+func setupWrite(fs *flag.FlagSet) runFunc {
+	return func(ctx context.Context, g *globals, args []string) error {
+		if len(args) != 2 {
+			return errors.New("expected a register offset and value")
+		}
+		offset, err := parseUint16(args[0])
+		if err != nil {
+			return fmt.Errorf("invalid offset: %s", err)
+		}
+		value, err := parseUint16(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid value: %s", err)
+		}
+
+		conn, inv, err := connect(g)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		if err := inv.WriteRegister(ctx, conn, offset, value); err != nil {
+			return err
+		}
+
+		fmt.Printf("OK: wrote %d to 0x%04x\n", value, offset)
+		return nil
+	}
+}
+
+// parseUint16 parses a decimal or 0x-prefixed hexadecimal value.
+func parseUint16(s string) (uint16, error) {
+	v, err := strconv.ParseUint(s, 0, 16)
+	if err != nil {
+		return 0, err
+	}
+	return uint16(v), nil
+}
+
+// writeRecords prints a struct, or a slice of structs, as JSON or a table.
+// Table columns are taken from the JSON field names.
+func writeRecords(w io.Writer, outputFormat string, v any) error {
+	switch format.Format(outputFormat) {
+	case format.JSON, format.PrettyJSON:
+		var p []byte
+		var err error
+		if format.Format(outputFormat) == format.PrettyJSON {
+			p, err = json.MarshalIndent(v, "", "  ")
+		} else {
+			p, err = json.Marshal(v)
+		}
+		if err != nil {
+			return fmt.Errorf("error encoding output: %s", err)
+		}
+		_, err = fmt.Fprintln(w, string(p))
+		return err
+	case format.Table:
+	default:
+		return fmt.Errorf("unsupported format `%s`", outputFormat)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() == reflect.Struct {
+		for i := 0; i < rv.NumField(); i++ {
+			fmt.Fprintf(tw, "%s\t%v\n", jsonName(rv.Type().Field(i)), rv.Field(i).Interface())
+		}
+		return tw.Flush()
+	}
+
+	elemType := rv.Type().Elem()
+	var header []string
+	for i := 0; i < elemType.NumField(); i++ {
+		header = append(header, strings.ToUpper(jsonName(elemType.Field(i))))
+	}
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for i := 0; i < rv.Len(); i++ {
+		var row []string
+		for j := 0; j < elemType.NumField(); j++ {
+			row = append(row, fmt.Sprint(rv.Index(i).Field(j).Interface()))
+		}
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+func jsonName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	if name == "" {
+		return f.Name
+	}
+	return name
+}
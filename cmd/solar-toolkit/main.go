@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+const programName = "solar-toolkit"
+
+// runFunc runs a subcommand with its remaining positional arguments.
+type runFunc func(ctx context.Context, g *globals, args []string) error
+
+// subcommand is a single subcommand of the CLI. setup registers the flags of
+// the subcommand and returns the function which runs it, allowing the flags
+// to be enumerated without running anything.
+type subcommand struct {
+	name  string
+	args  string
+	short string
+	setup func(fs *flag.FlagSet) runFunc
+}
+
+var subcommands []subcommand
+
+func init() {
+	subcommands = []subcommand{
+		{name: "info", short: "Print device information", setup: setupInfo},
+		{name: "status", short: "Print runtime and meter data", setup: setupStatus},
+		{name: "meter", short: "Print meter data", setup: setupMeter},
+		{name: "battery", short: "Print battery data", setup: setupBattery},
+		{name: "settings", short: "Print inverter settings", setup: setupSettings},
+		{name: "discover", short: "Discover inverters on the local network", setup: setupDiscover},
+		{name: "read", args: "<offset>", short: "Read raw registers", setup: setupRead},
+		{name: "write", args: "<offset> <value>", short: "Write a raw register", setup: setupWrite},
+		{name: "daemon", short: "Poll the inverter and send metrics to the gateway", setup: setupDaemon},
+		{name: "gateway", args: "[migrate up|down [n]|status]", short: "Run the gateway server", setup: setupGateway},
+		{name: "migrate", args: "up|down [n]|status", short: "Apply, revert or list database migrations", setup: setupMigrate},
+		{name: "token", args: "create|list|revoke [id]", short: "Manage gateway API tokens", setup: setupToken},
+		{name: "energy", args: "[report|update|rebuild]", short: "Print or recompute energy summaries", setup: setupEnergy},
+		{name: "costs", args: "[report|update|rebuild]", short: "Print a monthly bill or recompute costs", setup: setupCosts},
+		{name: "completion", args: "bash|zsh|fish", short: "Print a shell completion script", setup: setupCompletion},
+	}
+}
+
+func main() {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	err := run(ctx, os.Args[1:], os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", programName, err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string, stderr io.Writer) error {
+	var g globals
+
+	root := flag.NewFlagSet(programName, flag.ContinueOnError)
+	root.SetOutput(stderr)
+	g.register(root)
+	root.Usage = func() { usage(root) }
+	if err := root.Parse(args); err != nil {
+		return err
+	}
+
+	if root.NArg() == 0 {
+		root.Usage()
+		return flag.ErrHelp
+	}
+
+	name := root.Arg(0)
+	for _, sc := range subcommands {
+		if sc.name != name {
+			continue
+		}
+
+		fs := flag.NewFlagSet(programName+" "+sc.name, flag.ContinueOnError)
+		fs.SetOutput(stderr)
+		g.register(fs)
+		runFn := sc.setup(fs)
+		fs.Usage = func() {
+			fmt.Fprintf(fs.Output(), "Usage: %s %s [flags] %s\n\n%s.\n\nFlags:\n", programName, sc.name, sc.args, sc.short)
+			fs.PrintDefaults()
+		}
+		if err := fs.Parse(root.Args()[1:]); err != nil {
+			return err
+		}
+
+		if err := g.resolve(); err != nil {
+			return err
+		}
+
+		return runFn(ctx, &g, fs.Args())
+	}
+
+	root.Usage()
+	return fmt.Errorf("unknown command `%s`", name)
+}
+
+func usage(fs *flag.FlagSet) {
+	w := fs.Output()
+	fmt.Fprintf(w, "Usage: %s [flags] <command> [command flags]\n\nCommands:\n", programName)
+	for _, sc := range subcommands {
+		fmt.Fprintf(w, "  %-12s%s\n", sc.name, sc.short)
+	}
+	fmt.Fprintf(w, "\nGlobal flags, also accepted after the command:\n")
+	fs.PrintDefaults()
+	fmt.Fprintf(w, "\nGlobal flags fall back to the environment variables %s, %s and %s,\n", envInverterAddr, envTransport, envTimezone)
+	fmt.Fprintf(w, "and then to the config file (default %s).\n", defaultConfigPath())
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"git.netflux.io/rob/solar-toolkit/daemon"
+	"git.netflux.io/rob/solar-toolkit/gateway"
+	"git.netflux.io/rob/solar-toolkit/gateway/tariff"
+	"git.netflux.io/rob/solar-toolkit/validate"
+)
+
+const (
+	envGatewayEndpoint = "SOLAR_TOOLKIT_GATEWAY_ENDPOINT"
+	envGatewayUsername = "SOLAR_TOOLKIT_GATEWAY_USERNAME"
+	envGatewayPassword = "SOLAR_TOOLKIT_GATEWAY_PASSWORD"
+	envDatabaseURL     = "DATABASE_URL"
+	envBindAddr        = "BIND_ADDR"
+	envRetentionDays   = "RETENTION_DAYS"
+	envValidationRules = "VALIDATION_RULES"
+	envTariffs         = "TARIFFS"
+)
+
+func setupDaemon(fs *flag.FlagSet) runFunc {
+	var (
+		configPath   string
+		endpoint     string
+		username     string
+		password     string
+		spoolDir     string
+		metricsAddr  string
+		mqttBroker   string
+		pollInterval time.Duration
+	)
+	fs.StringVar(&configPath, "daemon-config", "", "path to daemon YAML config file, reloaded on SIGHUP. Overrides all other flags.")
+	fs.StringVar(&endpoint, "endpoint", "", "URL to post metrics to (env "+envGatewayEndpoint+")")
+	fs.StringVar(&username, "username", "", "HTTP basic auth username (env "+envGatewayUsername+")")
+	fs.StringVar(&password, "password", "", "HTTP basic auth password (env "+envGatewayPassword+")")
+	fs.StringVar(&spoolDir, "spool-dir", "", "directory in which to keep frames until the gateway accepts them")
+	fs.StringVar(&metricsAddr, "metrics-addr", "", "address on which to serve Prometheus metrics, example: :9942")
+	fs.StringVar(&mqttBroker, "mqtt-broker", "", "URL of MQTT broker to publish frames to, example: tcp://localhost:1883")
+	fs.DurationVar(&pollInterval, "poll-interval", time.Minute, "poll interval, example: 60s")
+
+	return func(ctx context.Context, g *globals, _ []string) error {
+		var cfg *daemon.Config
+		if configPath != "" {
+			var err error
+			if cfg, err = daemon.LoadConfig(configPath); err != nil {
+				return err
+			}
+		} else {
+			fallback(&endpoint, os.Getenv(envGatewayEndpoint))
+			fallback(&username, os.Getenv(envGatewayUsername))
+			fallback(&password, os.Getenv(envGatewayPassword))
+			if endpoint == "" && metricsAddr == "" && mqttBroker == "" {
+				return errors.New("missing gateway endpoint, set -endpoint or " + envGatewayEndpoint + ", or -metrics-addr or -mqtt-broker")
+			}
+
+			addr, err := g.addr()
+			if err != nil {
+				return err
+			}
+
+			cfg = &daemon.Config{
+				PollInterval: pollInterval,
+				Inverters:    []daemon.InverterConfig{{Address: addr, Transport: g.Transport, Timezone: g.timezone}},
+				Spool:        daemon.SpoolConfig{Dir: spoolDir},
+				Metrics:      daemon.MetricsConfig{Listen: metricsAddr},
+				MQTT:         daemon.MQTTConfig{Broker: mqttBroker},
+			}
+			if endpoint != "" {
+				cfg.Gateways = []daemon.GatewayConfig{{Endpoint: endpoint, Username: username, Password: password}}
+			}
+			if err := cfg.Validate(); err != nil {
+				return err
+			}
+		}
+
+		d := daemon.New(cfg)
+		if configPath != "" {
+			d.ReloadOnSIGHUP(ctx, configPath)
+		}
+
+		return d.Run(ctx)
+	}
+}
+
+func setupGateway(fs *flag.FlagSet) runFunc {
+	var cfg gateway.Config
+	fs.StringVar(&cfg.DatabaseURL, "database-url", "", "database URL, postgres://... or sqlite:///path/to/file.db (env "+envDatabaseURL+")")
+	fs.StringVar(&cfg.BindAddr, "bind-addr", "", "address to listen on (env "+envBindAddr+", default "+gateway.DefaultBindAddr+")")
+	fs.BoolVar(&cfg.AllowUnauthenticated, "allow-unauthenticated", false, "accept requests without an API token")
+	fs.BoolVar(&cfg.MigrateOnStartup, "migrate", false, "apply pending database migrations on startup")
+	retentionDays := fs.Int("retention-days", 0, "delete raw frames older than this many days once rolled up, 0 to keep forever (env "+envRetentionDays+")")
+	validationRules := fs.String("validation-rules", "", "path to YAML file of plausibility rules, in addition to the defaults (env "+envValidationRules+")")
+	tariffs := fs.String("tariffs", "", "path to YAML file of device tariffs, from which costs are computed (env "+envTariffs+")")
+
+	return func(ctx context.Context, g *globals, args []string) error {
+		fallback(&cfg.DatabaseURL, os.Getenv(envDatabaseURL))
+		fallback(&cfg.BindAddr, os.Getenv(envBindAddr))
+		cfg.Location = g.Location
+		if v := os.Getenv(envRetentionDays); v != "" && *retentionDays == 0 {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("invalid %s `%s`", envRetentionDays, v)
+			}
+			*retentionDays = n
+		}
+		if *retentionDays < 0 {
+			return errors.New("retention days must not be negative")
+		}
+		cfg.Retention = time.Duration(*retentionDays) * 24 * time.Hour
+		fallback(validationRules, os.Getenv(envValidationRules))
+		if *validationRules != "" {
+			validation, err := validate.LoadConfig(*validationRules)
+			if err != nil {
+				return err
+			}
+			cfg.Validation = *validation
+		}
+		fallback(tariffs, os.Getenv(envTariffs))
+		if *tariffs != "" {
+			t, err := tariff.LoadConfig(*tariffs)
+			if err != nil {
+				return err
+			}
+			cfg.Tariffs = *t
+		}
+		if cfg.DatabaseURL == "" {
+			return errors.New("missing database URL, set -database-url or " + envDatabaseURL)
+		}
+
+		if len(args) > 0 {
+			if args[0] != "migrate" {
+				return fmt.Errorf("unknown gateway command `%s`", args[0])
+			}
+
+			db, err := gateway.Connect(cfg.DatabaseURL)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+
+			return gateway.Migrate(ctx, db, os.Stdout, args[1:])
+		}
+
+		return gateway.Run(ctx, cfg)
+	}
+}
+
+func setupMigrate(fs *flag.FlagSet) runFunc {
+	databaseURL := fs.String("database-url", "", "database URL, postgres://... or sqlite:///path/to/file.db (env "+envDatabaseURL+")")
+
+	return func(ctx context.Context, _ *globals, args []string) error {
+		fallback(databaseURL, os.Getenv(envDatabaseURL))
+		if *databaseURL == "" {
+			return errors.New("missing database URL, set -database-url or " + envDatabaseURL)
+		}
+
+		db, err := gateway.Connect(*databaseURL)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		return gateway.Migrate(ctx, db, os.Stdout, args)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"git.netflux.io/rob/solar-toolkit/gateway"
+	"git.netflux.io/rob/solar-toolkit/gateway/auth"
+	"git.netflux.io/rob/solar-toolkit/gateway/store"
+)
+
+func setupToken(fs *flag.FlagSet) runFunc {
+	databaseURL := fs.String("database-url", "", "database URL, postgres://... or sqlite:///path/to/file.db (env "+envDatabaseURL+")")
+	serialNumber := fs.String("serial", "", "serial number of the device the token is valid for (create)")
+	name := fs.String("name", "", "description of the token (create)")
+	outputFormat := fs.String("format", "table", "output format of list: table or json")
+
+	return func(ctx context.Context, _ *globals, args []string) error {
+		fallback(databaseURL, os.Getenv(envDatabaseURL))
+		if *databaseURL == "" {
+			return errors.New("missing database URL, set -database-url or " + envDatabaseURL)
+		}
+		if len(args) == 0 {
+			return errors.New("expected create, list or revoke")
+		}
+
+		db, err := gateway.Connect(*databaseURL)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		store := store.New(db)
+
+		switch args[0] {
+		case "create":
+			if *serialNumber == "" {
+				return errors.New("missing device serial number, set -serial")
+			}
+
+			tokenString, hash, err := auth.GenerateToken()
+			if err != nil {
+				return err
+			}
+			token, err := store.CreateToken(*serialNumber, *name, hash)
+			if err != nil {
+				return err
+			}
+
+			// The token itself is not stored, so this is the only chance to
+			// see it.
+			fmt.Fprintf(os.Stderr, "Created token %d for device %s. It will not be shown again.\n", token.ID, token.SerialNumber)
+			fmt.Println(tokenString)
+			return nil
+		case "list":
+			tokens, err := store.ListTokens()
+			if err != nil {
+				return err
+			}
+			return writeRecords(os.Stdout, *outputFormat, tokens)
+		case "revoke":
+			if len(args) != 2 {
+				return errors.New("expected token ID")
+			}
+			id, err := strconv.ParseInt(args[1], 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid token ID `%s`", args[1])
+			}
+
+			ok, err := store.RevokeToken(id)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return fmt.Errorf("no active token with ID %d", id)
+			}
+			fmt.Fprintf(os.Stderr, "Revoked token %d.\n", id)
+			return nil
+		default:
+			return fmt.Errorf("unknown token command `%s`", args[0])
+		}
+	}
+}
@@ -2,23 +2,27 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"flag"
-	"fmt"
 	"log"
 	"net"
 	"os"
+	"strings"
 
+	"git.netflux.io/rob/solar-toolkit/format"
 	"git.netflux.io/rob/solar-toolkit/inverter"
 )
 
 func main() {
 	var inverterAddr string
 	var meterData bool
+	var outputFormat string
+	var fieldList string
 	var err error
 
 	flag.StringVar(&inverterAddr, "inverter-addr", "", "IP+port of solar inverter")
 	flag.BoolVar(&meterData, "meter-data", false, "print meter data, not sensors")
+	flag.StringVar(&outputFormat, "format", string(format.JSON), "output format, one of: "+formatNames())
+	flag.StringVar(&fieldList, "fields", "", "comma-separated list of fields to print, globs allowed (default all)")
 	flag.Parse()
 
 	if inverterAddr == "" {
@@ -26,6 +30,19 @@ func main() {
 		os.Exit(1)
 	}
 
+	outFormat, err := format.Parse(outputFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var fields []inverter.Field
+	if fieldList != "" {
+		fields, err = inverter.MatchFields(strings.Split(fieldList, ","))
+		if err != nil {
+			log.Fatalf("error parsing fields: %s", err)
+		}
+	}
+
 	conn, err := net.Dial("udp", inverterAddr)
 	if err != nil {
 		log.Fatalf("error dialing: %s", err)
@@ -33,29 +50,29 @@ func main() {
 	defer conn.Close()
 
 	var inv inverter.ET
-	var result []byte
+	var frame inverter.ETDataFrame
 
 	if meterData {
-		meterData, err := inv.MeterData(context.Background(), conn)
+		frame.ETMeterData, err = inv.MeterData(context.Background(), conn)
 		if err != nil {
 			log.Fatalf("error fetching meter data: %s", err)
 		}
-
-		result, err = json.Marshal(meterData)
-		if err != nil {
-			log.Fatalf("error encoding meter data: %s", err)
-		}
 	} else {
-		runtimeData, err := inv.RuntimeData(context.Background(), conn)
+		frame.ETRuntimeData, err = inv.RuntimeData(context.Background(), conn)
 		if err != nil {
 			log.Fatalf("error fetching runtime data: %s", err)
 		}
+	}
 
-		result, err = json.Marshal(runtimeData)
-		if err != nil {
-			log.Fatalf("error encoding runtime data: %s", err)
-		}
+	if err = format.Write(os.Stdout, outFormat, &frame, fields); err != nil {
+		log.Fatalf("error writing output: %s", err)
 	}
+}
 
-	fmt.Fprint(os.Stdout, string(result))
+func formatNames() string {
+	var names []string
+	for _, f := range format.Formats {
+		names = append(names, string(f))
+	}
+	return strings.Join(names, ", ")
 }
@@ -4,6 +4,7 @@ package command
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -20,6 +21,47 @@ type Conn interface {
 	SetDeadline(time.Time) error
 }
 
+// AttemptObserver may be implemented by a Conn to be notified of each failed
+// attempt to execute a command. retrying is false for the final attempt.
+type AttemptObserver interface {
+	AttemptFailed(err error, retrying bool)
+}
+
+// ErrChecksum is wrapped by errors caused by a response with an invalid
+// checksum, usually due to interference on the line.
+var ErrChecksum = errors.New("invalid CRC-16")
+
+// Transport is the network protocol used to communicate with an inverter.
+type Transport string
+
+const (
+	// TransportUDP is the default Goodwe protocol, usually on port 8899.
+	TransportUDP Transport = "udp"
+	// TransportTCP is Modbus TCP, usually on port 502.
+	TransportTCP Transport = "tcp"
+)
+
+// ParseTransport parses a transport name. The empty string is parsed as
+// TransportUDP.
+func ParseTransport(s string) (Transport, error) {
+	switch Transport(s) {
+	case "", TransportUDP:
+		return TransportUDP, nil
+	case TransportTCP:
+		return TransportTCP, nil
+	default:
+		return "", fmt.Errorf("unknown transport `%s`", s)
+	}
+}
+
+// NewModbusFor returns a Modbus command framed for the provided transport.
+func NewModbusFor(transport Transport, commandType ModbusCommandType, offset uint16, value uint16) Command {
+	if transport == TransportTCP {
+		return NewModbusTCP(commandType, offset, value)
+	}
+	return NewModbus(commandType, offset, value)
+}
+
 const (
 	maxAttempts         = 4
 	timeout             = time.Second * 10
@@ -39,7 +81,11 @@ func Send(cmd Command, conn Conn) ([]byte, error) {
 		if resp, err = tryRequest(cmd, conn); err != nil {
 			attempts++
 			log.Printf("error executing command (attempt %d): %s", attempts, err)
-			if attempts <= 3 {
+			retrying := attempts < maxAttempts
+			if o, ok := conn.(AttemptObserver); ok {
+				o.AttemptFailed(err, retrying)
+			}
+			if retrying {
 				continue
 			}
 			return nil, fmt.Errorf("error executing command: %s", err)
@@ -61,3 +61,36 @@ func TestSendFail(t *testing.T) {
 	_, err := command.Send(&cmd, &conn)
 	assert.EqualError(t, err, "error executing command: error reading from socket: i/o timeout 4")
 }
+
+type observedConn struct {
+	mockConn
+	retried, failed []error
+}
+
+func (c *observedConn) AttemptFailed(err error, retrying bool) {
+	if retrying {
+		c.retried = append(c.retried, err)
+	} else {
+		c.failed = append(c.failed, err)
+	}
+}
+
+func TestSendObserver(t *testing.T) {
+	var cmd mockCommand
+	conn := observedConn{
+		mockConn: mockConn{
+			readResults: []readResult{
+				{err: errors.New("i/o timeout 1")},
+				{err: errors.New("i/o timeout 2")},
+				{err: errors.New("i/o timeout 3")},
+				{err: errors.New("i/o timeout 4")},
+			},
+		},
+	}
+
+	_, err := command.Send(&cmd, &conn)
+	require.Error(t, err)
+	assert.Len(t, conn.retried, 3)
+	require.Len(t, conn.failed, 1)
+	assert.EqualError(t, conn.failed[0], "error reading from socket: i/o timeout 4")
+}
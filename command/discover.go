@@ -0,0 +1,93 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// DiscoveryAddr is the address to which discovery requests are broadcast.
+	DiscoveryAddr = "255.255.255.255:48899"
+
+	discoveryRequest        = "WIFIKIT-214028-READ"
+	defaultDiscoveryTimeout = time.Second * 3
+)
+
+// DiscoveredInverter is an inverter which responded to a discovery request.
+type DiscoveredInverter struct {
+	IP   string `json:"ip"`
+	MAC  string `json:"mac"`
+	Name string `json:"name"`
+}
+
+// Discover sends a discovery request to addr, which is usually DiscoveryAddr,
+// and collects responses until the context is done. If the context has no
+// deadline, responses are collected for three seconds.
+func Discover(ctx context.Context, addr string) ([]DiscoveredInverter, error) {
+	raddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving address: %s", err)
+	}
+
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, fmt.Errorf("error listening: %s", err)
+	}
+	defer conn.Close()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(defaultDiscoveryTimeout)
+	}
+	if err = conn.SetDeadline(deadline); err != nil {
+		return nil, fmt.Errorf("error setting deadline: %s", err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	if _, err = conn.WriteTo([]byte(discoveryRequest), raddr); err != nil {
+		return nil, fmt.Errorf("error writing to socket: %s", err)
+	}
+
+	var result []DiscoveredInverter
+	seen := make(map[string]bool)
+	p := make([]byte, readBufferSizeBytes)
+	for {
+		n, _, err := conn.ReadFrom(p)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return result, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading from socket: %s", err)
+		}
+
+		inv, ok := parseDiscoveryResponse(string(p[:n]))
+		if !ok || seen[inv.IP] {
+			continue
+		}
+		seen[inv.IP] = true
+		result = append(result, inv)
+	}
+}
+
+// parseDiscoveryResponse parses a response of the form "IP,MAC,NAME".
+func parseDiscoveryResponse(s string) (DiscoveredInverter, bool) {
+	parts := strings.Split(strings.TrimSpace(s), ",")
+	if len(parts) != 3 || net.ParseIP(parts[0]) == nil {
+		return DiscoveredInverter{}, false
+	}
+	return DiscoveredInverter{IP: parts[0], MAC: parts[1], Name: parts[2]}, true
+}
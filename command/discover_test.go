@@ -0,0 +1,36 @@
+package command_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"git.netflux.io/rob/solar-toolkit/command"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiscover(t *testing.T) {
+	responder, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer responder.Close()
+
+	go func() {
+		p := make([]byte, 64)
+		n, addr, err := responder.ReadFrom(p)
+		if err != nil || string(p[:n]) != "WIFIKIT-214028-READ" {
+			return
+		}
+		responder.WriteTo([]byte("192.168.1.10,289C6E05ABCD,Solar-WiFi123"), addr)
+		responder.WriteTo([]byte("garbage"), addr)
+		responder.WriteTo([]byte("192.168.1.10,289C6E05ABCD,Solar-WiFi123"), addr)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+
+	result, err := command.Discover(ctx, responder.LocalAddr().String())
+	require.NoError(t, err)
+	assert.Equal(t, []command.DiscoveredInverter{{IP: "192.168.1.10", MAC: "289C6E05ABCD", Name: "Solar-WiFi123"}}, result)
+}
@@ -53,12 +53,16 @@ const modbusComAddr byte = 0xf7
 type ModbusCommandType byte
 
 const (
-	ModbusCommandTypeRead ModbusCommandType = 0x03
-	// TODO: implement write commands.
-	ModbusCommandTypeWrite      ModbusCommandType = 0x06
+	ModbusCommandTypeRead  ModbusCommandType = 0x03
+	ModbusCommandTypeWrite ModbusCommandType = 0x06
+	// TODO: implement multiple register write commands.
 	ModbusCommandTypeWriteMulti ModbusCommandType = 0x10
 )
 
+// modbusWriteResponseLen is the length of a response to a single register
+// write, which echoes the register offset and value.
+const modbusWriteResponseLen = 10
+
 func NewModbus(commandType ModbusCommandType, offset uint16, value uint16) *ModbusCommand {
 	var p []byte
 	p = append(p, modbusComAddr)
@@ -109,8 +113,19 @@ func (cmd ModbusCommand) ValidateResponse(p []byte) ([]byte, error) {
 		if len(p) < expectedLen {
 			return nil, fmt.Errorf("invalid read length: expected %d, got %d", expectedLen, len(p))
 		}
-	case ModbusCommandTypeWrite, ModbusCommandTypeWriteMulti:
-		panic("unimplemented")
+	case ModbusCommandTypeWrite:
+		expectedLen = modbusWriteResponseLen
+		if len(p) < expectedLen {
+			return nil, fmt.Errorf("invalid write length: expected %d, got %d", expectedLen, len(p))
+		}
+		if offset := binary.BigEndian.Uint16(p[4:6]); offset != cmd.offset {
+			return nil, fmt.Errorf("unexpected write offset: expected %X, got %X", cmd.offset, offset)
+		}
+		if value := binary.BigEndian.Uint16(p[6:8]); value != cmd.value {
+			return nil, fmt.Errorf("unexpected write value: expected %d, got %d", cmd.value, value)
+		}
+	case ModbusCommandTypeWriteMulti:
+		return nil, fmt.Errorf("unsupported command type: %d", cmdType)
 	default:
 		expectedLen = len(p)
 	}
@@ -119,7 +134,7 @@ func (cmd ModbusCommand) ValidateResponse(p []byte) ([]byte, error) {
 	wantSum := modbusChecksum(p[2:offset])
 	gotSum := binary.LittleEndian.Uint16(p[offset:])
 	if wantSum != gotSum {
-		return nil, fmt.Errorf("invalid CRC-16: want `%X`, got `%X`", wantSum, gotSum)
+		return nil, fmt.Errorf("%w: want `%X`, got `%X`", ErrChecksum, wantSum, gotSum)
 	}
 
 	if p[3] != byte(cmd.commandType) {
@@ -127,5 +142,9 @@ func (cmd ModbusCommand) ValidateResponse(p []byte) ([]byte, error) {
 		return nil, fmt.Errorf("command failed with code: %d, error: %s", failureCode, failureCode.String())
 	}
 
+	if cmdType == ModbusCommandTypeWrite {
+		return p[4:offset], nil
+	}
+
 	return p[5:offset], nil
 }
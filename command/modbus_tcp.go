@@ -0,0 +1,89 @@
+package command
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	modbusTCPHeaderLen     = 7
+	modbusTCPTransactionID = 0x0001
+	modbusTCPErrorFlag     = 0x80
+)
+
+// ModbusTCPCommand is a Modbus command framed for Modbus TCP, which is
+// accepted by some inverters on port 502 as an alternative to the UDP
+// protocol implemented by ModbusCommand.
+type ModbusTCPCommand struct {
+	payload     []byte
+	commandType ModbusCommandType
+	offset      uint16
+	value       uint16
+}
+
+func NewModbusTCP(commandType ModbusCommandType, offset uint16, value uint16) *ModbusTCPCommand {
+	p := make([]byte, modbusTCPHeaderLen+5)
+	binary.BigEndian.PutUint16(p[0:], modbusTCPTransactionID)
+	binary.BigEndian.PutUint16(p[2:], 0) // protocol identifier
+	binary.BigEndian.PutUint16(p[4:], 6) // length of the remaining bytes
+	p[6] = modbusComAddr
+	p[7] = byte(commandType)
+	binary.BigEndian.PutUint16(p[8:], offset)
+	binary.BigEndian.PutUint16(p[10:], value)
+
+	return &ModbusTCPCommand{
+		payload:     p,
+		commandType: commandType,
+		offset:      offset,
+		value:       value,
+	}
+}
+
+func (cmd ModbusTCPCommand) String() string { return string(cmd.payload) }
+
+// ValidateResponse validates the entire response and if valid returns the
+// response body.
+func (cmd ModbusTCPCommand) ValidateResponse(p []byte) ([]byte, error) {
+	if len(p) <= modbusTCPHeaderLen+1 {
+		return nil, errors.New("invalid response: response too short")
+	}
+
+	expectedLen := int(binary.BigEndian.Uint16(p[4:6])) + 6
+	if len(p) < expectedLen {
+		return nil, fmt.Errorf("invalid response length: expected %d, got %d", expectedLen, len(p))
+	}
+
+	cmdType := ModbusCommandType(p[7])
+	if cmdType == cmd.commandType|modbusTCPErrorFlag {
+		failureCode := FailureCode(p[8])
+		return nil, fmt.Errorf("command failed with code: %d, error: %s", failureCode, failureCode.String())
+	}
+	if cmdType != cmd.commandType {
+		return nil, fmt.Errorf("unexpected command type: expected %d, got %d", cmd.commandType, cmdType)
+	}
+
+	switch cmdType {
+	case ModbusCommandTypeRead:
+		if uint16(p[8]) != cmd.value*2 {
+			return nil, fmt.Errorf("short response: expected %d, got %d", cmd.value*2, p[8])
+		}
+		if int(p[8])+modbusTCPHeaderLen+2 != expectedLen {
+			return nil, fmt.Errorf("invalid read length: expected %d, got %d", expectedLen, int(p[8])+modbusTCPHeaderLen+2)
+		}
+		return p[9:expectedLen], nil
+	case ModbusCommandTypeWrite:
+		if expectedLen != modbusTCPHeaderLen+5 {
+			return nil, fmt.Errorf("invalid write length: expected %d, got %d", modbusTCPHeaderLen+5, expectedLen)
+		}
+		if offset := binary.BigEndian.Uint16(p[8:10]); offset != cmd.offset {
+			return nil, fmt.Errorf("unexpected write offset: expected %X, got %X", cmd.offset, offset)
+		}
+		if value := binary.BigEndian.Uint16(p[10:12]); value != cmd.value {
+			return nil, fmt.Errorf("unexpected write value: expected %d, got %d", cmd.value, value)
+		}
+		return p[8:expectedLen], nil
+	default:
+		return nil, fmt.Errorf("unsupported command type: %d", cmdType)
+	}
+}
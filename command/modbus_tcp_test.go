@@ -0,0 +1,95 @@
+package command_test
+
+import (
+	"testing"
+
+	"git.netflux.io/rob/solar-toolkit/command"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestModbusTCPString(t *testing.T) {
+	cmd := command.NewModbusTCP(command.ModbusCommandTypeRead, 0x891c, 0x007d)
+	assert.Equal(t, []byte{0, 1, 0, 0, 0, 6, 0xf7, 0x03, 0x89, 0x1c, 0x00, 0x7d}, []byte(cmd.String()))
+}
+
+func TestModbusTCPValidateResponse(t *testing.T) {
+	testCases := []struct {
+		name        string
+		commandType command.ModbusCommandType
+		value       uint16
+		resp        []byte
+		wantBody    []byte
+		wantErr     string
+	}{
+		{
+			name:        "empty response",
+			commandType: command.ModbusCommandTypeRead,
+			value:       2,
+			wantErr:     "invalid response: response too short",
+		},
+		{
+			name:        "truncated response",
+			commandType: command.ModbusCommandTypeRead,
+			value:       2,
+			resp:        []byte{0, 1, 0, 0, 0, 7, 0xf7, 0x03, 4, 0, 1},
+			wantErr:     "invalid response length: expected 13, got 11",
+		},
+		{
+			name:        "short read",
+			commandType: command.ModbusCommandTypeRead,
+			value:       3,
+			resp:        []byte{0, 1, 0, 0, 0, 7, 0xf7, 0x03, 4, 0, 1, 0, 2},
+			wantErr:     "short response: expected 6, got 4",
+		},
+		{
+			name:        "failure code",
+			commandType: command.ModbusCommandTypeRead,
+			value:       2,
+			resp:        []byte{0, 1, 0, 0, 0, 3, 0xf7, 0x83, 2},
+			wantErr:     "command failed with code: 2, error: FailureCodeIllegalDataAddress",
+		},
+		{
+			name:        "valid read",
+			commandType: command.ModbusCommandTypeRead,
+			value:       2,
+			resp:        []byte{0, 1, 0, 0, 0, 7, 0xf7, 0x03, 4, 0, 1, 0, 2},
+			wantBody:    []byte{0, 1, 0, 2},
+		},
+		{
+			name:        "write with wrong value",
+			commandType: command.ModbusCommandTypeWrite,
+			value:       2,
+			resp:        []byte{0, 1, 0, 0, 0, 6, 0xf7, 0x06, 0x89, 0x1c, 0, 3},
+			wantErr:     "unexpected write value: expected 2, got 3",
+		},
+		{
+			name:        "valid write",
+			commandType: command.ModbusCommandTypeWrite,
+			value:       2,
+			resp:        []byte{0, 1, 0, 0, 0, 6, 0xf7, 0x06, 0x89, 0x1c, 0, 2},
+			wantBody:    []byte{0x89, 0x1c, 0, 2},
+		},
+		{
+			name:        "write multiple registers",
+			commandType: command.ModbusCommandTypeWriteMulti,
+			value:       1,
+			resp:        []byte{0, 1, 0, 0, 0, 6, 0xf7, 0x10, 0x89, 0x1c, 0, 1},
+			wantErr:     "unsupported command type: 16",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cmd := command.NewModbusTCP(tc.commandType, 0x891c, tc.value)
+			body, err := cmd.ValidateResponse(tc.resp)
+
+			if tc.wantErr == "" {
+				require.NoError(t, err)
+				assert.Equal(t, tc.wantBody, body)
+			} else {
+				require.EqualError(t, err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -38,6 +38,11 @@ func TestModbusValidateResponse(t *testing.T) {
 			resp:    failureCodeResponse,
 			wantErr: "command failed with code: 2, error: FailureCodeIllegalDataAddress",
 		},
+		{
+			name:    "write multiple registers",
+			resp:    []byte{170, 85, 247, 16, 137, 28, 0, 1, 0, 0},
+			wantErr: "unsupported command type: 16",
+		},
 		{
 			name: "valid response with extra bytes",
 			resp: validResponseWithExtraBytes,
@@ -61,3 +66,47 @@ func TestModbusValidateResponse(t *testing.T) {
 		})
 	}
 }
+
+func TestModbusValidateWriteResponse(t *testing.T) {
+	testCases := []struct {
+		name     string
+		resp     []byte
+		wantBody []byte
+		wantErr  string
+	}{
+		{
+			name:    "truncated response",
+			resp:    []byte{170, 85, 247, 6, 137, 28, 0, 2},
+			wantErr: "invalid write length: expected 10, got 8",
+		},
+		{
+			name:    "wrong value",
+			resp:    []byte{170, 85, 247, 6, 137, 28, 0, 3, 54, 199},
+			wantErr: "unexpected write value: expected 2, got 3",
+		},
+		{
+			name:    "invalid checksum",
+			resp:    []byte{170, 85, 247, 6, 137, 28, 0, 2, 247, 8},
+			wantErr: "invalid CRC-16: want `7F7`, got `8F7`",
+		},
+		{
+			name:     "valid response",
+			resp:     []byte{170, 85, 247, 6, 137, 28, 0, 2, 247, 7},
+			wantBody: []byte{137, 28, 0, 2},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cmd := command.NewModbus(command.ModbusCommandTypeWrite, 0x891c, 0x0002)
+			body, err := cmd.ValidateResponse(tc.resp)
+
+			if tc.wantErr == "" {
+				require.NoError(t, err)
+				require.Equal(t, tc.wantBody, body)
+			} else {
+				require.EqualError(t, err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,649 @@
+package daemon
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.netflux.io/rob/solar-toolkit/command"
+	"git.netflux.io/rob/solar-toolkit/integrate"
+	"git.netflux.io/rob/solar-toolkit/inverter"
+	"git.netflux.io/rob/solar-toolkit/output"
+	"git.netflux.io/rob/solar-toolkit/validate"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// BlockRuntime is the block of runtime data, which is always collected.
+	BlockRuntime = inverter.BlockRuntime
+	// BlockMeter is the block of meter data.
+	BlockMeter = inverter.BlockMeter
+
+	// OutputStdout writes frames to stdout as newline-delimited JSON.
+	OutputStdout = "stdout"
+	// OutputFile writes frames to a rotating local file as newline-delimited
+	// JSON.
+	OutputFile = "file"
+	// OutputWebhook posts frames to a URL, rendered with a JSON template.
+	OutputWebhook = "webhook"
+	// OutputInfluxDB writes frames in the line protocol to an InfluxDB v2
+	// write endpoint or a UDP listener.
+	OutputInfluxDB = "influxdb"
+
+	defaultTimezone     = "Europe/Madrid"
+	defaultPollInterval = time.Minute
+	defaultSpoolMaxSize = 64
+	defaultSpoolMaxAge  = 7 * 24 * time.Hour
+	defaultFileMaxSize  = 10
+	defaultFileMaxFiles = 5
+)
+
+// mqttSchemes are the URL schemes of the supported MQTT broker connections.
+var mqttSchemes = []string{"tcp", "ssl", "ws", "wss"}
+
+// Config holds the configuration of the daemon.
+//
+// PollInterval and Fields are the defaults for inverters which do not set
+// their own.
+type Config struct {
+	PollInterval time.Duration    `yaml:"poll_interval"`
+	Fields       FieldsConfig     `yaml:"fields"`
+	Inverters    []InverterConfig `yaml:"inverters"`
+	Gateways     []GatewayConfig  `yaml:"gateways"`
+	Outputs      []OutputConfig   `yaml:"outputs"`
+	Spool        SpoolConfig      `yaml:"spool"`
+	Metrics      MetricsConfig    `yaml:"metrics"`
+	MQTT         MQTTConfig       `yaml:"mqtt"`
+	// Validation holds the plausibility rules which each frame is checked
+	// against before it is written.
+	Validation  validate.Config   `yaml:"validation"`
+	Integration IntegrationConfig `yaml:"integration"`
+}
+
+// IntegrationConfig holds the configuration of the integration of power into
+// energy totals, which are added to each frame as its integrated block. It
+// is disabled unless Enabled is set.
+type IntegrationConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// StateFile is the path of the file in which the totals are persisted
+	// across restarts. They are kept in memory if it is empty.
+	StateFile string `yaml:"state_file"`
+	// MaxGap is the longest interval between frames which is integrated.
+	MaxGap time.Duration `yaml:"max_gap"`
+}
+
+// MQTTConfig holds the configuration of the MQTT publisher, which publishes
+// each frame along with Home Assistant discovery configs. It is disabled if
+// Broker is empty.
+type MQTTConfig struct {
+	// Broker is the URL of the broker, e.g. tcp://localhost:1883.
+	Broker       string `yaml:"broker"`
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password"`
+	PasswordFile string `yaml:"password_file"`
+	// ClientID defaults to solar-toolkit-<hostname>.
+	ClientID        string `yaml:"client_id"`
+	TopicPrefix     string `yaml:"topic_prefix"`
+	DiscoveryPrefix string `yaml:"discovery_prefix"`
+	Retain          bool   `yaml:"retain"`
+}
+
+// MetricsConfig holds the configuration of the Prometheus metrics endpoint,
+// which is served at /metrics on Listen. It is disabled if Listen is empty.
+type MetricsConfig struct {
+	Listen string `yaml:"listen"`
+}
+
+// OutputConfig holds the configuration of an output, to which frames are
+// written alongside the gateways.
+type OutputConfig struct {
+	// Type is one of OutputStdout, OutputFile, OutputWebhook or
+	// OutputInfluxDB.
+	Type string `yaml:"type"`
+
+	// Path, MaxSizeMB and MaxFiles configure file outputs. The file is
+	// rotated once it reaches MaxSizeMB, keeping MaxFiles rotated files.
+	Path      string `yaml:"path"`
+	MaxSizeMB int64  `yaml:"max_size_mb"`
+	MaxFiles  int    `yaml:"max_files"`
+
+	// URL, Template and Headers configure webhook outputs. Template is a Go
+	// template of the JSON request body, see output.WebhookData.
+	URL      string            `yaml:"url"`
+	Template string            `yaml:"template"`
+	Headers  map[string]string `yaml:"headers"`
+
+	// URL, Org, Bucket and Token configure InfluxDB outputs. URL is either
+	// the http(s) URL of the server or a udp:// URL of a UDP listener, in
+	// which case the other settings are ignored.
+	Org       string `yaml:"org"`
+	Bucket    string `yaml:"bucket"`
+	Token     string `yaml:"token"`
+	TokenFile string `yaml:"token_file"`
+
+	// Name is the name of the spool directory of webhook and InfluxDB
+	// outputs, see GatewayConfig.Name. It defaults to a hash of the URL.
+	Name string `yaml:"name"`
+}
+
+// spoolName returns the name of the output's spool directory.
+func (cfg *OutputConfig) spoolName() string {
+	if cfg.Name != "" {
+		return cfg.Name
+	}
+	return hashSpoolName(cfg.name())
+}
+
+// name returns the name identifying the output in logs, which is unique
+// among the outputs.
+func (cfg *OutputConfig) name() string {
+	switch cfg.Type {
+	case OutputFile:
+		return "file:" + cfg.Path
+	case OutputWebhook:
+		return "webhook:" + cfg.URL
+	case OutputInfluxDB:
+		return "influxdb:" + cfg.URL
+	default:
+		return cfg.Type
+	}
+}
+
+// SpoolConfig holds the configuration of the on-disk spool, in which frames
+// are kept until they have been accepted by each gateway. The spool is
+// disabled if Dir is empty.
+type SpoolConfig struct {
+	Dir       string        `yaml:"dir"`
+	MaxSizeMB int64         `yaml:"max_size_mb"`
+	MaxAge    time.Duration `yaml:"max_age"`
+}
+
+// InverterConfig holds the configuration of a single inverter connection.
+type InverterConfig struct {
+	Address      string            `yaml:"address"`
+	Transport    command.Transport `yaml:"transport"`
+	Timezone     string            `yaml:"timezone"`
+	Blocks       []string          `yaml:"blocks"`
+	PollInterval time.Duration     `yaml:"poll_interval"`
+	Fields       FieldsConfig      `yaml:"fields"`
+
+	// Location is resolved from Timezone.
+	Location *time.Location `yaml:"-"`
+	// Omit is resolved from Fields.
+	Omit []inverter.Field `yaml:"-"`
+}
+
+// FieldsConfig selects the fields collected from an inverter, by name or
+// glob pattern, e.g. "backup_*" or "*_l2_*". If Include is set, only the
+// matching fields are kept. Fields matching Exclude are then omitted.
+type FieldsConfig struct {
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+}
+
+// isZero returns true if no fields are selected or excluded.
+func (cfg *FieldsConfig) isZero() bool {
+	return len(cfg.Include) == 0 && len(cfg.Exclude) == 0
+}
+
+// omitted returns the fields to be omitted from frames. key is the config
+// key of cfg.
+func (cfg *FieldsConfig) omitted(key string, fail func(string, string, ...any)) []inverter.Field {
+	match := func(patterns []string, name string) []inverter.Field {
+		if len(patterns) == 0 {
+			return nil
+		}
+		fields, err := inverter.MatchFields(patterns)
+		if err != nil {
+			fail(key+"."+name, "%s", err)
+		}
+		return fields
+	}
+	include, exclude := match(cfg.Include, "include"), match(cfg.Exclude, "exclude")
+
+	contains := func(fields []inverter.Field, f inverter.Field) bool {
+		return slices.ContainsFunc(fields, func(g inverter.Field) bool { return g.Name == f.Name })
+	}
+	var omit []inverter.Field
+	for _, f := range inverter.Fields() {
+		if (len(cfg.Include) > 0 && !contains(include, f)) || contains(exclude, f) {
+			omit = append(omit, f)
+		}
+	}
+	return omit
+}
+
+// GatewayConfig holds the configuration of a single gateway endpoint.
+type GatewayConfig struct {
+	Endpoint     string `yaml:"endpoint"`
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password"`
+	PasswordFile string `yaml:"password_file"`
+	// Token is the gateway API token, sent as a bearer token. It takes
+	// precedence over Username and Password.
+	Token     string `yaml:"token"`
+	TokenFile string `yaml:"token_file"`
+	// Batch enables uploading spooled frames in batches, using the gateway's
+	// batch endpoint.
+	Batch bool `yaml:"batch"`
+	// Name is the name of the gateway's spool directory, so that spooled
+	// frames are kept if Endpoint changes. It defaults to a hash of Endpoint.
+	Name string `yaml:"name"`
+}
+
+// spoolName returns the name of the gateway's spool directory.
+func (cfg *GatewayConfig) spoolName() string {
+	if cfg.Name != "" {
+		return cfg.Name
+	}
+	return hashSpoolName(cfg.Endpoint)
+}
+
+// connKey returns the key identifying the inverter's connection.
+func (cfg *InverterConfig) connKey() connKey {
+	return connKey{transport: cfg.Transport, address: cfg.Address}
+}
+
+// hasBlock returns true if the data block is enabled for the inverter.
+func (cfg *InverterConfig) hasBlock(block string) bool {
+	return slices.Contains(cfg.Blocks, block)
+}
+
+// ConfigError is an error in the value of a specific config key.
+type ConfigError struct {
+	// Path is the path of the config file, if known.
+	Path string
+	// Line is the line of the offending key, if known.
+	Line int
+	// Key is the offending key, e.g. "inverters[0].address".
+	Key string
+	Err error
+}
+
+func (e *ConfigError) Error() string {
+	var b strings.Builder
+	if e.Path != "" {
+		b.WriteString(e.Path)
+		b.WriteByte(':')
+	}
+	if e.Line > 0 {
+		b.WriteString(strconv.Itoa(e.Line))
+		b.WriteByte(':')
+	}
+	if b.Len() > 0 {
+		b.WriteByte(' ')
+	}
+	fmt.Fprintf(&b, "%s: %s", e.Key, e.Err)
+	return b.String()
+}
+
+func (e *ConfigError) Unwrap() error { return e.Err }
+
+// LoadConfig reads, parses and validates the YAML config file at path.
+func LoadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening config file: %s", err)
+	}
+	defer f.Close()
+
+	cfg, err := ParseConfig(f)
+	if err != nil {
+		var found bool
+		for _, e := range unwrapAll(err) {
+			var cfgErr *ConfigError
+			if errors.As(e, &cfgErr) {
+				cfgErr.Path = path
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func unwrapAll(err error) []error {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		return joined.Unwrap()
+	}
+	return []error{err}
+}
+
+// ParseConfig parses and validates a YAML config. Unknown keys are rejected.
+func ParseConfig(r io.Reader) (*Config, error) {
+	p, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config: %s", err)
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(p, &root); err != nil {
+		return nil, fmt.Errorf("error parsing config: %s", err)
+	}
+
+	var cfg Config
+	dec := yaml.NewDecoder(bytes.NewReader(p))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("error parsing config: %s", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		for _, e := range unwrapAll(err) {
+			var cfgErr *ConfigError
+			if errors.As(e, &cfgErr) {
+				cfgErr.Line = keyLine(&root, cfgErr.Key)
+			}
+		}
+		return nil, err
+	}
+
+	return &cfg, nil
+}
+
+// Validate checks the config, resolves derived values and applies defaults.
+// Errors are returned as ConfigErrors, joined with errors.Join.
+func (cfg *Config) Validate() error {
+	var errs []error
+	fail := func(key string, format string, args ...any) {
+		errs = append(errs, &ConfigError{Key: key, Err: fmt.Errorf(format, args...)})
+	}
+
+	if cfg.PollInterval == 0 {
+		cfg.PollInterval = defaultPollInterval
+	} else if cfg.PollInterval < time.Second {
+		fail("poll_interval", "must be at least 1s")
+	}
+
+	defaultOmit := cfg.Fields.omitted("fields", fail)
+
+	if len(cfg.Inverters) == 0 {
+		fail("inverters", "at least one inverter is required")
+	}
+	seen := make(map[connKey]bool)
+	for i := range cfg.Inverters {
+		inv := &cfg.Inverters[i]
+		key := fmt.Sprintf("inverters[%d]", i)
+
+		if inv.Address == "" {
+			fail(key+".address", "required")
+		}
+
+		transport, err := command.ParseTransport(string(inv.Transport))
+		if err != nil {
+			fail(key+".transport", "%s", err)
+		}
+		inv.Transport = transport
+
+		if inv.Address != "" {
+			if seen[inv.connKey()] {
+				fail(key+".address", "duplicate inverter `%s`", inv.Address)
+			}
+			seen[inv.connKey()] = true
+		}
+
+		if inv.PollInterval == 0 {
+			inv.PollInterval = cfg.PollInterval
+		} else if inv.PollInterval < time.Second {
+			fail(key+".poll_interval", "must be at least 1s")
+		}
+
+		if inv.Fields.isZero() {
+			inv.Omit = defaultOmit
+		} else {
+			inv.Omit = inv.Fields.omitted(key+".fields", fail)
+		}
+
+		if inv.Timezone == "" {
+			inv.Timezone = defaultTimezone
+		}
+		if inv.Location, err = time.LoadLocation(inv.Timezone); err != nil {
+			fail(key+".timezone", "unknown timezone `%s`", inv.Timezone)
+		}
+
+		if len(inv.Blocks) == 0 {
+			inv.Blocks = []string{BlockRuntime, BlockMeter}
+		}
+		for j, block := range inv.Blocks {
+			if block != BlockRuntime && block != BlockMeter {
+				fail(fmt.Sprintf("%s.blocks[%d]", key, j), "unknown block `%s`", block)
+			}
+		}
+		if !inv.hasBlock(BlockRuntime) {
+			fail(key+".blocks", "the %s block is required", BlockRuntime)
+		}
+	}
+
+	// Gateways are optional if frames are written to another output, or the
+	// inverters are scraped by Prometheus instead.
+	if len(cfg.Gateways) == 0 && len(cfg.Outputs) == 0 && cfg.Metrics.Listen == "" && cfg.MQTT.Broker == "" {
+		fail("gateways", "at least one gateway or output is required, unless metrics.listen or mqtt.broker is set")
+	}
+	seenSpools := make(map[string]bool)
+	for i := range cfg.Gateways {
+		gw := &cfg.Gateways[i]
+		key := fmt.Sprintf("gateways[%d]", i)
+
+		if u, err := url.Parse(gw.Endpoint); gw.Endpoint == "" || err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			fail(key+".endpoint", "must be an http or https URL")
+		}
+
+		readSecret(&gw.Password, gw.PasswordFile, key, "password", fail)
+		readSecret(&gw.Token, gw.TokenFile, key, "token", fail)
+		checkSpoolName(gw.spoolName(), key, seenSpools, fail)
+	}
+
+	for i, gw := range cfg.Gateways {
+		if gw.Batch && cfg.Spool.Dir == "" {
+			fail(fmt.Sprintf("gateways[%d].batch", i), "requires spool.dir to be set")
+		}
+	}
+
+	seenOutputs := make(map[string]bool)
+	for i := range cfg.Outputs {
+		out := &cfg.Outputs[i]
+		key := fmt.Sprintf("outputs[%d]", i)
+
+		switch out.Type {
+		case OutputStdout:
+		case OutputFile:
+			if out.Path == "" {
+				fail(key+".path", "required")
+			}
+			if out.MaxSizeMB == 0 {
+				out.MaxSizeMB = defaultFileMaxSize
+			} else if out.MaxSizeMB < 0 {
+				fail(key+".max_size_mb", "must be positive")
+			}
+			if out.MaxFiles == 0 {
+				out.MaxFiles = defaultFileMaxFiles
+			} else if out.MaxFiles < 0 {
+				fail(key+".max_files", "must be positive")
+			}
+		case OutputWebhook:
+			if u, err := url.Parse(out.URL); out.URL == "" || err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				fail(key+".url", "must be an http or https URL")
+			}
+			if _, err := output.ParseWebhookTemplate(out.Template); err != nil {
+				fail(key+".template", "%s", err)
+			}
+		case OutputInfluxDB:
+			u, err := url.Parse(out.URL)
+			switch {
+			case out.URL == "" || err != nil || u.Host == "":
+				fail(key+".url", "must be an http, https or udp URL")
+			case u.Scheme == "http" || u.Scheme == "https":
+				if out.Bucket == "" {
+					fail(key+".bucket", "required")
+				}
+				readSecret(&out.Token, out.TokenFile, key, "token", fail)
+			case u.Scheme != "udp":
+				fail(key+".url", "must be an http, https or udp URL")
+			}
+		case "":
+			fail(key+".type", "required")
+			continue
+		default:
+			fail(key+".type", "unknown output type `%s`", out.Type)
+			continue
+		}
+
+		if seenOutputs[out.name()] {
+			fail(key, "duplicate output `%s`", out.name())
+		}
+		seenOutputs[out.name()] = true
+
+		if out.Type == OutputWebhook || out.Type == OutputInfluxDB {
+			checkSpoolName(out.spoolName(), key, seenSpools, fail)
+		} else if out.Name != "" {
+			fail(key+".name", "only webhook and influxdb outputs are spooled")
+		}
+	}
+
+	if cfg.Metrics.Listen != "" {
+		if _, _, err := net.SplitHostPort(cfg.Metrics.Listen); err != nil {
+			fail("metrics.listen", "invalid address `%s`", cfg.Metrics.Listen)
+		}
+	}
+
+	if cfg.MQTT.Broker != "" {
+		if u, err := url.Parse(cfg.MQTT.Broker); err != nil || !slices.Contains(mqttSchemes, u.Scheme) || u.Host == "" {
+			fail("mqtt.broker", "must be a tcp, ssl, ws or wss URL")
+		}
+		readSecret(&cfg.MQTT.Password, cfg.MQTT.PasswordFile, "mqtt", "password", fail)
+		if cfg.MQTT.ClientID == "" {
+			hostname, _ := os.Hostname()
+			cfg.MQTT.ClientID = "solar-toolkit-" + hostname
+		}
+	}
+
+	if err := cfg.Validation.Validate(); err != nil {
+		for _, err := range unwrapAll(err) {
+			var ruleErr *validate.RuleError
+			if errors.As(err, &ruleErr) {
+				fail("validation."+ruleErr.Key, "%s", ruleErr.Err)
+			} else {
+				fail("validation", "%s", err)
+			}
+		}
+	}
+
+	if cfg.Integration.MaxGap == 0 {
+		cfg.Integration.MaxGap = integrate.DefaultMaxGap
+	} else if cfg.Integration.MaxGap < 0 {
+		fail("integration.max_gap", "must be positive")
+	}
+
+	if cfg.Spool.Dir != "" {
+		if cfg.Spool.MaxSizeMB == 0 {
+			cfg.Spool.MaxSizeMB = defaultSpoolMaxSize
+		} else if cfg.Spool.MaxSizeMB < 0 {
+			fail("spool.max_size_mb", "must be positive")
+		}
+		if cfg.Spool.MaxAge == 0 {
+			cfg.Spool.MaxAge = defaultSpoolMaxAge
+		} else if cfg.Spool.MaxAge < 0 {
+			fail("spool.max_age", "must be positive")
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// spoolNameRegexp matches the names of spool directories.
+var spoolNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// checkSpoolName checks that the name of the spool directory of the gateway
+// or output at key is valid and unique among seen.
+func checkSpoolName(name, key string, seen map[string]bool, fail func(string, string, ...any)) {
+	if !spoolNameRegexp.MatchString(name) {
+		fail(key+".name", "must consist of letters, digits, `_`, `-` and `.`")
+	} else if seen[name] {
+		fail(key+".name", "duplicate name `%s`", name)
+	}
+	seen[name] = true
+}
+
+// hashSpoolName returns the default name of the spool directory of the
+// gateway or output identified by s.
+func hashSpoolName(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:8])
+}
+
+// readSecret reads the secret from path into dst, if path is set. name is the
+// key of the secret within its parent key, e.g. "password".
+func readSecret(dst *string, path, parent, name string, fail func(string, string, ...any)) {
+	if path == "" {
+		return
+	}
+	key := parent + "." + name + "_file"
+	if *dst != "" {
+		fail(key, "cannot be set together with %s", name)
+		return
+	}
+
+	p, err := os.ReadFile(path)
+	if err != nil {
+		fail(key, "%s", err)
+		return
+	}
+	*dst = strings.TrimSpace(string(p))
+}
+
+// keyLine returns the line of the node at key, e.g. "inverters[0].address",
+// or of its closest ancestor if it does not exist.
+func keyLine(root *yaml.Node, key string) int {
+	node := root
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	line := node.Line
+
+	for _, part := range strings.Split(key, ".") {
+		name, index, hasIndex := strings.Cut(strings.TrimSuffix(part, "]"), "[")
+
+		next := mappingValue(node, name)
+		if next == nil {
+			return line
+		}
+		node, line = next, next.Line
+
+		if hasIndex {
+			i, err := strconv.Atoi(index)
+			if err != nil || node.Kind != yaml.SequenceNode || i >= len(node.Content) {
+				return line
+			}
+			node, line = node.Content[i], node.Content[i].Line
+		}
+	}
+
+	return line
+}
+
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,439 @@
+package daemon_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"git.netflux.io/rob/solar-toolkit/command"
+	"git.netflux.io/rob/solar-toolkit/daemon"
+	"git.netflux.io/rob/solar-toolkit/inverter"
+	"git.netflux.io/rob/solar-toolkit/validate"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseConfig(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		cfg, err := daemon.ParseConfig(strings.NewReader(`
+inverters:
+  - address: 192.168.1.10:8899
+gateways:
+  - endpoint: https://example.com/gateway
+    username: user
+    password: secret
+`))
+		require.NoError(t, err)
+
+		assert.Equal(t, time.Minute, cfg.PollInterval)
+		require.Len(t, cfg.Inverters, 1)
+		assert.Equal(t, command.TransportUDP, cfg.Inverters[0].Transport)
+		assert.Equal(t, "Europe/Madrid", cfg.Inverters[0].Location.String())
+		assert.Equal(t, []string{daemon.BlockRuntime, daemon.BlockMeter}, cfg.Inverters[0].Blocks)
+		require.Len(t, cfg.Gateways, 1)
+		assert.Equal(t, "secret", cfg.Gateways[0].Password)
+		assert.Empty(t, cfg.Spool)
+	})
+
+	t.Run("full", func(t *testing.T) {
+		cfg, err := daemon.ParseConfig(strings.NewReader(`
+poll_interval: 30s
+inverters:
+  - address: 192.168.1.10:502
+    transport: tcp
+    timezone: UTC
+    blocks: [runtime]
+gateways:
+  - endpoint: http://localhost:8888/gateway
+spool:
+  dir: /var/lib/solar-toolkit/spool
+  max_age: 24h
+`))
+		require.NoError(t, err)
+
+		assert.Equal(t, 30*time.Second, cfg.PollInterval)
+		assert.Equal(t, command.TransportTCP, cfg.Inverters[0].Transport)
+		assert.Equal(t, time.UTC, cfg.Inverters[0].Location)
+		assert.Equal(t, []string{daemon.BlockRuntime}, cfg.Inverters[0].Blocks)
+		assert.Equal(t, daemon.SpoolConfig{Dir: "/var/lib/solar-toolkit/spool", MaxSizeMB: 64, MaxAge: 24 * time.Hour}, cfg.Spool)
+	})
+
+	t.Run("multiple inverters", func(t *testing.T) {
+		cfg, err := daemon.ParseConfig(strings.NewReader(`
+poll_interval: 30s
+inverters:
+  - address: 192.168.1.10:8899
+  - address: 192.168.1.11:8899
+    poll_interval: 10s
+  - address: 192.168.1.10:502
+    transport: tcp
+gateways:
+  - endpoint: https://example.com/gateway
+`))
+		require.NoError(t, err)
+
+		require.Len(t, cfg.Inverters, 3)
+		assert.Equal(t, 30*time.Second, cfg.Inverters[0].PollInterval)
+		assert.Equal(t, 10*time.Second, cfg.Inverters[1].PollInterval)
+		assert.Equal(t, 30*time.Second, cfg.Inverters[2].PollInterval)
+	})
+
+	t.Run("duplicate inverter", func(t *testing.T) {
+		_, err := daemon.ParseConfig(strings.NewReader(`inverters:
+  - address: 192.168.1.10:8899
+  - address: 192.168.1.10:8899
+    transport: udp
+gateways:
+  - endpoint: https://example.com/gateway
+`))
+		assert.EqualError(t, err, "3: inverters[1].address: duplicate inverter `192.168.1.10:8899`")
+	})
+
+	t.Run("unknown key", func(t *testing.T) {
+		_, err := daemon.ParseConfig(strings.NewReader(`
+inverters:
+  - address: 192.168.1.10:8899
+    adress: typo
+`))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "adress")
+	})
+
+	t.Run("invalid values", func(t *testing.T) {
+		_, err := daemon.ParseConfig(strings.NewReader(`inverters:
+  - address: 192.168.1.10:8899
+    transport: serial
+    blocks: [runtime, battery]
+gateways:
+  - endpoint: ftp://example.com
+`))
+		require.Error(t, err)
+
+		var cfgErr *daemon.ConfigError
+		require.True(t, errors.As(err, &cfgErr))
+		assert.Equal(t, "inverters[0].transport", cfgErr.Key)
+		assert.Equal(t, 3, cfgErr.Line)
+
+		assert.Contains(t, err.Error(), "4: inverters[0].blocks[1]: unknown block `battery`")
+		assert.Contains(t, err.Error(), "6: gateways[0].endpoint: must be an http or https URL")
+	})
+
+	t.Run("batch without spool", func(t *testing.T) {
+		_, err := daemon.ParseConfig(strings.NewReader(`inverters:
+  - address: 192.168.1.10:8899
+gateways:
+  - endpoint: https://example.com/gateway
+    batch: true
+`))
+		assert.EqualError(t, err, "5: gateways[0].batch: requires spool.dir to be set")
+	})
+
+	t.Run("spool names", func(t *testing.T) {
+		cfg, err := daemon.ParseConfig(strings.NewReader(`inverters:
+  - address: 192.168.1.10:8899
+gateways:
+  - endpoint: https://example.com/gateway
+    name: home
+outputs:
+  - type: webhook
+    url: https://example.com/hook
+spool:
+  dir: /var/lib/solar-toolkit/spool
+`))
+		require.NoError(t, err)
+		assert.Equal(t, "home", cfg.Gateways[0].Name)
+
+		_, err = daemon.ParseConfig(strings.NewReader(`inverters:
+  - address: 192.168.1.10:8899
+gateways:
+  - endpoint: https://example.com/gateway
+    name: ../home
+  - endpoint: https://example.org/gateway
+    name: home
+outputs:
+  - type: webhook
+    url: https://example.com/hook
+    name: home
+  - type: stdout
+    name: stdout
+`))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "5: gateways[0].name: must consist of letters, digits, `_`, `-` and `.`")
+		assert.Contains(t, err.Error(), "11: outputs[0].name: duplicate name `home`")
+		assert.Contains(t, err.Error(), "13: outputs[1].name: only webhook and influxdb outputs are spooled")
+	})
+
+	t.Run("metrics without gateways", func(t *testing.T) {
+		cfg, err := daemon.ParseConfig(strings.NewReader(`
+inverters:
+  - address: 192.168.1.10:8899
+metrics:
+  listen: ":9942"
+`))
+		require.NoError(t, err)
+		assert.Equal(t, ":9942", cfg.Metrics.Listen)
+		assert.Empty(t, cfg.Gateways)
+	})
+
+	t.Run("invalid metrics address", func(t *testing.T) {
+		_, err := daemon.ParseConfig(strings.NewReader(`inverters:
+  - address: 192.168.1.10:8899
+metrics:
+  listen: localhost
+`))
+		assert.EqualError(t, err, "4: metrics.listen: invalid address `localhost`")
+	})
+
+	t.Run("mqtt without gateways", func(t *testing.T) {
+		cfg, err := daemon.ParseConfig(strings.NewReader(`
+inverters:
+  - address: 192.168.1.10:8899
+mqtt:
+  broker: tcp://localhost:1883
+`))
+		require.NoError(t, err)
+		assert.Equal(t, "tcp://localhost:1883", cfg.MQTT.Broker)
+		assert.True(t, strings.HasPrefix(cfg.MQTT.ClientID, "solar-toolkit-"))
+		assert.Empty(t, cfg.Gateways)
+	})
+
+	t.Run("invalid mqtt broker", func(t *testing.T) {
+		_, err := daemon.ParseConfig(strings.NewReader(`inverters:
+  - address: 192.168.1.10:8899
+mqtt:
+  broker: localhost:1883
+`))
+		assert.EqualError(t, err, "4: mqtt.broker: must be a tcp, ssl, ws or wss URL")
+	})
+
+	t.Run("fields", func(t *testing.T) {
+		cfg, err := daemon.ParseConfig(strings.NewReader(`
+fields:
+  exclude: ["*_l2_*", "*_l3_*", "backup_*"]
+inverters:
+  - address: 192.168.1.10:8899
+  - address: 192.168.1.11:8899
+    fields:
+      include: [pv_power, "meter_*"]
+      exclude: [meter_type]
+gateways:
+  - endpoint: https://example.com/gateway
+`))
+		require.NoError(t, err)
+
+		names := func(fields []inverter.Field) []string {
+			var names []string
+			for _, f := range fields {
+				names = append(names, f.Name)
+			}
+			return names
+		}
+
+		omitted := names(cfg.Inverters[0].Omit)
+		assert.Contains(t, omitted, "on_grid_l2_voltage")
+		assert.Contains(t, omitted, "backup_l1_power")
+		assert.NotContains(t, omitted, "on_grid_l1_voltage")
+		assert.NotContains(t, omitted, "pv_power")
+
+		omitted = names(cfg.Inverters[1].Omit)
+		assert.Contains(t, omitted, "pv1_voltage")
+		assert.Contains(t, omitted, "meter_type")
+		assert.NotContains(t, omitted, "pv_power")
+		assert.NotContains(t, omitted, "meter_frequency")
+	})
+
+	t.Run("invalid fields", func(t *testing.T) {
+		_, err := daemon.ParseConfig(strings.NewReader(`fields:
+  include: [foo]
+inverters:
+  - address: 192.168.1.10:8899
+    fields:
+      exclude: ["pv["]
+gateways:
+  - endpoint: https://example.com/gateway
+`))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "2: fields.include: unknown field `foo`")
+		assert.Contains(t, err.Error(), "6: inverters[0].fields.exclude: invalid pattern `pv[`")
+	})
+
+	t.Run("validation", func(t *testing.T) {
+		cfg, err := daemon.ParseConfig(strings.NewReader(`
+inverters:
+  - address: 192.168.1.10:8899
+gateways:
+  - endpoint: https://example.com/gateway
+validation:
+  rules:
+    - fields: [battery_voltage]
+      min: 40
+      max: 60
+      policy: drop_frame
+`))
+		require.NoError(t, err)
+		require.Len(t, cfg.Validation.Rules, 1)
+		assert.Equal(t, validate.DropFrame, cfg.Validation.Rules[0].Policy)
+	})
+
+	t.Run("invalid validation rules", func(t *testing.T) {
+		_, err := daemon.ParseConfig(strings.NewReader(`inverters:
+  - address: 192.168.1.10:8899
+gateways:
+  - endpoint: https://example.com/gateway
+validation:
+  rules:
+    - fields: [foo]
+      max: 1
+    - fields: [pv1_voltage]
+      max: 1000
+      policy: ignore
+`))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "7: validation.rules[0].fields: unknown field `foo`")
+		assert.Contains(t, err.Error(), "11: validation.rules[1].policy: unknown policy `ignore`")
+	})
+
+	t.Run("integration", func(t *testing.T) {
+		cfg, err := daemon.ParseConfig(strings.NewReader(`
+inverters:
+  - address: 192.168.1.10:8899
+gateways:
+  - endpoint: https://example.com/gateway
+integration:
+  enabled: true
+  state_file: /var/lib/solar-toolkit/integration.json
+`))
+		require.NoError(t, err)
+		assert.Equal(t, daemon.IntegrationConfig{Enabled: true, StateFile: "/var/lib/solar-toolkit/integration.json", MaxGap: 5 * time.Minute}, cfg.Integration)
+
+		_, err = daemon.ParseConfig(strings.NewReader(`inverters:
+  - address: 192.168.1.10:8899
+gateways:
+  - endpoint: https://example.com/gateway
+integration:
+  max_gap: -1m
+`))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "6: integration.max_gap: must be positive")
+	})
+
+	t.Run("outputs", func(t *testing.T) {
+		cfg, err := daemon.ParseConfig(strings.NewReader(`
+inverters:
+  - address: 192.168.1.10:8899
+outputs:
+  - type: stdout
+  - type: file
+    path: /var/log/solar-toolkit/frames.ndjson
+  - type: webhook
+    url: https://example.com/hook
+    template: '{"power": {{.Fields.pv_power}}}'
+    headers:
+      authorization: Bearer secret
+  - type: influxdb
+    url: http://localhost:8086
+    org: home
+    bucket: solar
+    token: secret
+  - type: influxdb
+    url: udp://localhost:8089
+`))
+		require.NoError(t, err)
+		require.Len(t, cfg.Outputs, 5)
+		assert.Equal(t, daemon.OutputConfig{Type: daemon.OutputFile, Path: "/var/log/solar-toolkit/frames.ndjson", MaxSizeMB: 10, MaxFiles: 5}, cfg.Outputs[1])
+		assert.Equal(t, map[string]string{"authorization": "Bearer secret"}, cfg.Outputs[2].Headers)
+		assert.Equal(t, daemon.OutputConfig{Type: daemon.OutputInfluxDB, URL: "http://localhost:8086", Org: "home", Bucket: "solar", Token: "secret"}, cfg.Outputs[3])
+		assert.Empty(t, cfg.Gateways)
+	})
+
+	t.Run("invalid outputs", func(t *testing.T) {
+		_, err := daemon.ParseConfig(strings.NewReader(`inverters:
+  - address: 192.168.1.10:8899
+outputs:
+  - type: syslog
+  - type: file
+  - type: webhook
+    url: https://example.com/hook
+    template: '{{.Fields.pv_power'
+  - type: stdout
+  - type: stdout
+  - type: influxdb
+    url: http://localhost:8086
+  - type: influxdb
+    url: tcp://localhost:8089
+`))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "4: outputs[0].type: unknown output type `syslog`")
+		assert.Contains(t, err.Error(), "5: outputs[1].path: required")
+		assert.Contains(t, err.Error(), "8: outputs[2].template: error parsing template")
+		assert.Contains(t, err.Error(), "10: outputs[4]: duplicate output `stdout`")
+		assert.Contains(t, err.Error(), "11: outputs[5].bucket: required")
+		assert.Contains(t, err.Error(), "14: outputs[6].url: must be an http, https or udp URL")
+	})
+
+	t.Run("missing sections", func(t *testing.T) {
+		_, err := daemon.ParseConfig(strings.NewReader(`poll_interval: 1m`))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "inverters: at least one inverter is required")
+		assert.Contains(t, err.Error(), "gateways: at least one gateway or output is required")
+	})
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	passwordPath := filepath.Join(dir, "password")
+	require.NoError(t, os.WriteFile(passwordPath, []byte("secret\n"), 0600))
+
+	t.Run("password file", func(t *testing.T) {
+		path := filepath.Join(dir, "valid.yaml")
+		require.NoError(t, os.WriteFile(path, []byte(`
+inverters:
+  - address: 192.168.1.10:8899
+gateways:
+  - endpoint: https://example.com/gateway
+    username: user
+    password_file: `+passwordPath+`
+`), 0600))
+
+		cfg, err := daemon.LoadConfig(path)
+		require.NoError(t, err)
+		assert.Equal(t, "secret", cfg.Gateways[0].Password)
+	})
+
+	t.Run("token file", func(t *testing.T) {
+		path := filepath.Join(dir, "token.yaml")
+		require.NoError(t, os.WriteFile(path, []byte(`
+inverters:
+  - address: 192.168.1.10:8899
+gateways:
+  - endpoint: https://example.com/gateway
+    token_file: `+passwordPath+`
+`), 0600))
+
+		cfg, err := daemon.LoadConfig(path)
+		require.NoError(t, err)
+		assert.Equal(t, "secret", cfg.Gateways[0].Token)
+	})
+
+	t.Run("password and password file", func(t *testing.T) {
+		path := filepath.Join(dir, "invalid.yaml")
+		require.NoError(t, os.WriteFile(path, []byte(`inverters:
+  - address: 192.168.1.10:8899
+gateways:
+  - endpoint: https://example.com/gateway
+    password: secret
+    password_file: `+passwordPath+`
+`), 0600))
+
+		_, err := daemon.LoadConfig(path)
+		assert.EqualError(t, err, path+":6: gateways[0].password_file: cannot be set together with password")
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		_, err := daemon.LoadConfig(filepath.Join(dir, "missing.yaml"))
+		assert.ErrorContains(t, err, "error opening config file")
+	})
+}
@@ -0,0 +1,432 @@
+// Package daemon periodically polls inverters for metrics and writes them to
+// the gateway and other outputs.
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"git.netflux.io/rob/solar-toolkit/command"
+	"git.netflux.io/rob/solar-toolkit/integrate"
+	"git.netflux.io/rob/solar-toolkit/inverter"
+	"git.netflux.io/rob/solar-toolkit/output"
+	"git.netflux.io/rob/solar-toolkit/validate"
+)
+
+const (
+	httpTimeout = time.Second * 5
+	dialTimeout = time.Second * 5
+)
+
+// connKey identifies an inverter connection, which is kept open across
+// config reloads as long as it is still configured.
+type connKey struct {
+	transport command.Transport
+	address   string
+}
+
+func (k connKey) String() string { return string(k.transport) + "://" + k.address }
+
+// Daemon polls the configured inverters and writes the results to the
+// configured gateways and outputs.
+//
+// Each inverter is polled by its own goroutine, on its own connection and at
+// its own interval, so that an unreachable inverter does not delay the
+// others.
+type Daemon struct {
+	cfg       *Config
+	reload    chan *Config
+	client    *http.Client
+	validator *validate.Validator
+	metrics   *metrics
+	sinks     *output.Fanout
+
+	// integrator is nil unless integration is enabled. It is set by Run.
+	integrator *integrate.Integrator
+
+	// sinkSpecs holds the spec of each open sink. It is only accessed by
+	// Run.
+	sinkSpecs map[string]sinkSpec
+}
+
+// New returns a new Daemon. The config must have been validated.
+func New(cfg *Config) *Daemon {
+	validator := validate.New(cfg.Validation.AllRules())
+	return &Daemon{
+		cfg:       cfg,
+		reload:    make(chan *Config, 1),
+		client:    &http.Client{Timeout: httpTimeout},
+		validator: validator,
+		metrics:   newMetrics(validator),
+		sinks:     output.NewFanout(),
+		sinkSpecs: make(map[string]sinkSpec),
+	}
+}
+
+// Reload replaces the config of a running daemon. Connections to inverters
+// which remain configured are kept open. The config must have been
+// validated.
+func (d *Daemon) Reload(cfg *Config) {
+	// Discard any pending reload in favour of the newest config.
+	select {
+	case <-d.reload:
+	default:
+	}
+	d.reload <- cfg
+}
+
+// Run polls the inverters until the context is cancelled.
+func (d *Daemon) Run(ctx context.Context) error {
+	// Deferred first, so that the sinks and the integrator are closed after
+	// the pollers have stopped.
+	defer d.sinks.Close()
+	defer func() {
+		if d.integrator == nil {
+			return
+		}
+		if err := d.integrator.Close(); err != nil {
+			log.Print(err)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	pollers := make(map[connKey]*poller)
+	// stopping holds the done channels of pollers removed by a reload, which
+	// may still be finishing their last poll.
+	stopping := make(map[connKey]chan struct{})
+	defer func() {
+		for _, p := range pollers {
+			p.cancel()
+		}
+	}()
+
+	if d.cfg.Metrics.Listen != "" {
+		if err := d.serveMetrics(ctx, &wg, d.cfg.Metrics.Listen); err != nil {
+			return err
+		}
+	}
+
+	if d.cfg.Integration.Enabled {
+		integrator, err := integrate.New(d.cfg.Integration.MaxGap, d.cfg.Integration.StateFile)
+		if err != nil {
+			return err
+		}
+		d.integrator = integrator
+	}
+
+	if err := d.syncSinks(ctx, d.cfg); err != nil {
+		return err
+	}
+
+	start := func(invCfg InverterConfig) {
+		pctx, cancel := context.WithCancel(ctx)
+		p := &poller{
+			daemon:  d,
+			key:     invCfg.connKey(),
+			updates: make(chan InverterConfig, 1),
+			cancel:  cancel,
+			done:    make(chan struct{}),
+		}
+		pollers[p.key] = p
+		prev := stopping[p.key]
+		delete(stopping, p.key)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(p.done)
+
+			// An inverter which was removed and added again must not be polled
+			// by two pollers at once, so the new one waits for the old one to
+			// close its connection.
+			if prev != nil {
+				select {
+				case <-prev:
+				case <-pctx.Done():
+					return
+				}
+			}
+			p.run(pctx, invCfg)
+			d.metrics.remove(p.key)
+		}()
+	}
+
+	for _, invCfg := range d.cfg.Inverters {
+		start(invCfg)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case cfg := <-d.reload:
+			if err := checkReload(d.cfg, cfg); err != nil {
+				log.Printf("error reloading config: %s", err)
+				continue
+			}
+
+			keep := make(map[connKey]bool)
+			for _, invCfg := range cfg.Inverters {
+				key := invCfg.connKey()
+				keep[key] = true
+				if p, ok := pollers[key]; ok {
+					p.update(invCfg)
+				} else {
+					start(invCfg)
+				}
+			}
+			for key, p := range pollers {
+				if !keep[key] {
+					p.cancel()
+					stopping[key] = p.done
+					delete(pollers, key)
+				}
+			}
+
+			if err := d.syncSinks(ctx, cfg); err != nil {
+				log.Printf("error reloading outputs: %s", err)
+			}
+			d.validator.SetRules(cfg.Validation.AllRules())
+			d.cfg = cfg
+
+			log.Printf("Config reloaded")
+		}
+	}
+}
+
+// checkReload returns an error if the config changes settings which can only
+// be applied on restart.
+func checkReload(cur, next *Config) error {
+	if next.Metrics != cur.Metrics {
+		return errors.New("changes to metrics require a restart")
+	}
+	if next.Integration != cur.Integration {
+		return errors.New("changes to integration require a restart")
+	}
+	return nil
+}
+
+// poller polls a single inverter.
+type poller struct {
+	daemon  *Daemon
+	key     connKey
+	updates chan InverterConfig
+	cancel  context.CancelFunc
+	// done is closed once the poller has stopped and closed its connection.
+	done chan struct{}
+
+	conn             net.Conn
+	serialNumber     string
+	deviceRegistered bool
+}
+
+// update replaces the poller's config, keeping its connection open.
+func (p *poller) update(cfg InverterConfig) {
+	select {
+	case <-p.updates:
+	default:
+	}
+	p.updates <- cfg
+}
+
+func (p *poller) run(ctx context.Context, cfg InverterConfig) {
+	defer func() {
+		if p.conn != nil {
+			p.conn.Close()
+		}
+	}()
+
+	ticker := time.NewTicker(cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		start := time.Now()
+		err := p.poll(ctx, cfg)
+		p.daemon.metrics.update(p.key, func(s *inverterStats) {
+			s.polls++
+			s.pollDuration = time.Since(start)
+			if err != nil {
+				s.pollErrors++
+			} else {
+				s.lastSuccess = time.Now()
+			}
+		})
+		if err != nil {
+			log.Printf("%s: %s", p.key, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case cfg = <-p.updates:
+			ticker.Reset(cfg.PollInterval)
+		case <-ticker.C:
+		}
+	}
+}
+
+// dial opens the connection to the inverter, if it is not already open.
+func (p *poller) dial(ctx context.Context) error {
+	if p.conn != nil {
+		return nil
+	}
+
+	dialer := net.Dialer{Timeout: dialTimeout}
+	conn, err := dialer.DialContext(ctx, string(p.key.transport), p.key.address)
+	if err != nil {
+		return fmt.Errorf("error dialing: %s", err)
+	}
+	p.conn = conn
+
+	return nil
+}
+
+// closeStream closes a TCP connection after an error so that it is redialed
+// on the next poll. UDP sockets are kept open.
+func (p *poller) closeStream() {
+	if p.conn != nil && p.key.transport == command.TransportTCP {
+		p.conn.Close()
+		p.conn = nil
+	}
+}
+
+func (p *poller) poll(ctx context.Context, cfg InverterConfig) error {
+	if err := p.dial(ctx); err != nil {
+		return err
+	}
+
+	inv := inverter.ET{Location: cfg.Location, Transport: cfg.Transport}
+	conn := observedConn{Conn: p.conn, metrics: p.daemon.metrics, key: p.key}
+
+	if !p.deviceRegistered {
+		deviceInfo, err := inv.DeviceInfo(ctx, conn)
+		if err != nil {
+			p.closeStream()
+			return fmt.Errorf("error fetching device info: %s", err)
+		}
+		p.serialNumber = deviceInfo.SerialNumber
+		p.daemon.metrics.update(p.key, func(s *inverterStats) { s.deviceInfo = deviceInfo })
+
+		// Failure to register is not fatal, as the gateway registers unknown
+		// devices on first contact. Registration is retried on the next poll.
+		if err := p.daemon.sinks.RegisterDevice(ctx, deviceInfo); err != nil {
+			log.Printf("%s: error registering device: %s", p.serialNumber, err)
+		} else {
+			p.deviceRegistered = true
+		}
+	}
+
+	runtimeData, err := inv.RuntimeData(ctx, conn)
+	if err != nil {
+		p.closeStream()
+		return fmt.Errorf("error fetching runtime data: %s", err)
+	}
+
+	frame := inverter.ETDataFrame{SerialNumber: p.serialNumber, ETRuntimeData: runtimeData}
+	if cfg.hasBlock(BlockMeter) {
+		if frame.ETMeterData, err = inv.MeterData(ctx, conn); err != nil {
+			p.closeStream()
+			return fmt.Errorf("error fetching meter data: %s", err)
+		}
+	}
+
+	result := p.daemon.validator.Check(&frame)
+	if result.Drop {
+		log.Printf("%s: dropping implausible frame: %s", p.serialNumber, result)
+		return nil
+	}
+	if len(result.Violations) > 0 {
+		log.Printf("%s: implausible values: %s", p.serialNumber, result)
+	}
+
+	if p.daemon.integrator != nil {
+		if err := p.daemon.integrator.Add(&frame); err != nil {
+			log.Printf("%s: %s", p.serialNumber, err)
+		}
+	}
+
+	// Fields are omitted last, so that excluded fields are still checked and
+	// integrated.
+	frame.Omit(cfg.Omit...)
+
+	p.daemon.metrics.update(p.key, func(s *inverterStats) { s.frame = &frame })
+
+	// Sinks fail independently, so the frame has still been written to the
+	// other sinks if the poll fails here.
+	if err := p.daemon.sinks.Write(ctx, &frame); err != nil {
+		return fmt.Errorf("error writing frame: %s", err)
+	}
+	log.Printf("OK: %s: %s", p.serialNumber, runtimeData.PVPower.String())
+
+	return nil
+}
+
+// serveMetrics serves the Prometheus metrics endpoint on addr until the
+// context is cancelled.
+func (d *Daemon) serveMetrics(ctx context.Context, wg *sync.WaitGroup, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("error listening for metrics: %s", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", d.metrics)
+	srv := http.Server{Handler: mux, ReadHeaderTimeout: httpTimeout}
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		<-ctx.Done()
+		srv.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("error serving metrics: %s", err)
+		}
+	}()
+
+	log.Printf("Serving metrics on %s/metrics", ln.Addr())
+	return nil
+}
+
+// ReloadOnSIGHUP reloads the config file at path each time the process
+// receives SIGHUP, until the context is cancelled. Invalid configs are logged
+// and ignored, leaving the daemon running with its previous config.
+//
+// The signal is handled from when ReloadOnSIGHUP returns, so that a SIGHUP
+// received afterwards does not terminate the process. Reloads happen in a
+// separate goroutine.
+func (d *Daemon) ReloadOnSIGHUP(ctx context.Context, path string) {
+	sigC := make(chan os.Signal, 1)
+	signal.Notify(sigC, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(sigC)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sigC:
+				cfg, err := LoadConfig(path)
+				if err != nil {
+					log.Printf("error reloading config: %s", err)
+					continue
+				}
+				d.Reload(cfg)
+			}
+		}
+	}()
+}
@@ -0,0 +1,204 @@
+package daemon_test
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"git.netflux.io/rob/solar-toolkit/daemon"
+	"git.netflux.io/rob/solar-toolkit/spool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// logBuffer captures the log output of the daemon.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) count(s string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return strings.Count(b.buf.String(), s)
+}
+
+func captureLog(t *testing.T) *logBuffer {
+	t.Helper()
+
+	var b logBuffer
+	log.SetOutput(&b)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &b
+}
+
+// replyDelay is the delay before fakeInverter answers a request.
+const replyDelay = 100 * time.Millisecond
+
+// fakeInverter accepts TCP connections and answers every request with garbage
+// after replyDelay, so that each poll fails after a few retries. It sends the
+// time at which each connection receives its first request on opened.
+func fakeInverter(t *testing.T) (string, <-chan time.Time) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+
+	opened := make(chan time.Time, 16)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				p := make([]byte, 512)
+				for i := 0; ; i++ {
+					if _, err := conn.Read(p); err != nil {
+						return
+					}
+					if i == 0 {
+						opened <- time.Now()
+					}
+					time.AfterFunc(replyDelay, func() { conn.Write([]byte("garbage")) })
+				}
+			}()
+		}
+	}()
+
+	return ln.Addr().String(), opened
+}
+
+func TestRunReload(t *testing.T) {
+	logs := captureLog(t)
+	addr, opened := fakeInverter(t)
+
+	yaml := `
+inverters:
+  - address: ` + addr + `
+    transport: tcp
+metrics:
+  listen: 127.0.0.1:0
+`
+	cfg, err := daemon.ParseConfig(strings.NewReader(yaml))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d := daemon.New(cfg)
+	done := make(chan error)
+	go func() { done <- d.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	reload := func(cfg *daemon.Config) {
+		t.Helper()
+		n := logs.count("Config reloaded") + logs.count("error reloading config")
+		d.Reload(cfg)
+		require.Eventually(t, func() bool {
+			return logs.count("Config reloaded")+logs.count("error reloading config") > n
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	first := <-opened
+
+	t.Run("inverter removed and added back", func(t *testing.T) {
+		removed := *cfg
+		removed.Inverters = nil
+		reload(&removed)
+		reload(cfg)
+
+		// The first poll is still in progress when the inverter is added back,
+		// and the second poll only starts once it has made all its attempts.
+		select {
+		case second := <-opened:
+			assert.GreaterOrEqual(t, second.Sub(first), 4*replyDelay)
+		case <-time.After(5 * time.Second):
+			t.Fatal("inverter not polled after being added back")
+		}
+	})
+
+	t.Run("changed metrics", func(t *testing.T) {
+		changed := *cfg
+		changed.Metrics.Listen = "127.0.0.1:1"
+		reload(&changed)
+		assert.Equal(t, 1, logs.count("error reloading config: changes to metrics require a restart"))
+	})
+
+	t.Run("changed integration", func(t *testing.T) {
+		changed := *cfg
+		changed.Integration.Enabled = true
+		reload(&changed)
+		assert.Equal(t, 1, logs.count("error reloading config: changes to integration require a restart"))
+	})
+
+	t.Run("SIGHUP", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		require.NoError(t, os.WriteFile(path, []byte(yaml), 0o600))
+
+		// The signal is handled as soon as ReloadOnSIGHUP returns, rather than
+		// terminating the process.
+		n := logs.count("Config reloaded")
+		d.ReloadOnSIGHUP(ctx, path)
+		require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+		require.Eventually(t, func() bool {
+			return logs.count("Config reloaded") > n
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+}
+
+func TestRunUnusedSpool(t *testing.T) {
+	logs := captureLog(t)
+	addr, _ := fakeInverter(t)
+
+	dir := t.TempDir()
+	orphan, err := spool.Open(filepath.Join(dir, "0123456789abcdef"), 0, 0)
+	require.NoError(t, err)
+	require.NoError(t, orphan.Append([]byte("{}")))
+
+	cfg, err := daemon.ParseConfig(strings.NewReader(`
+inverters:
+  - address: ` + addr + `
+    transport: tcp
+gateways:
+  - endpoint: http://127.0.0.1:1/gateway
+    name: home
+spool:
+  dir: ` + dir + `
+`))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- daemon.New(cfg).Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	// The spool of a gateway whose endpoint changed is reported, along with
+	// the name which would upload it.
+	require.Eventually(t, func() bool {
+		return logs.count("Spool "+filepath.Join(dir, "0123456789abcdef")+" holds 1 frame(s) which no gateway or output will upload; set the name of the gateway or output to `0123456789abcdef` to upload them") == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.DirExists(t, filepath.Join(dir, "home"))
+	assert.Zero(t, logs.count("Spool "+filepath.Join(dir, "home")))
+}
@@ -0,0 +1,129 @@
+package daemon
+
+import (
+	"errors"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"git.netflux.io/rob/solar-toolkit/command"
+	"git.netflux.io/rob/solar-toolkit/inverter"
+	"git.netflux.io/rob/solar-toolkit/prometheus"
+	"git.netflux.io/rob/solar-toolkit/validate"
+)
+
+// inverterStats holds the latest data and the poll statistics of an
+// inverter, exposed by the metrics endpoint.
+type inverterStats struct {
+	deviceInfo   *inverter.DeviceInfo
+	frame        *inverter.ETDataFrame
+	polls        uint64
+	pollErrors   uint64
+	retries      uint64
+	crcErrors    uint64
+	pollDuration time.Duration
+	lastSuccess  time.Time
+}
+
+// metrics serves the latest data and poll statistics of every inverter, and
+// the values rejected by the validator, in the Prometheus text format.
+type metrics struct {
+	validator *validate.Validator
+
+	mu    sync.Mutex
+	stats map[connKey]*inverterStats
+}
+
+func newMetrics(validator *validate.Validator) *metrics {
+	return &metrics{validator: validator, stats: make(map[connKey]*inverterStats)}
+}
+
+// update calls fn with the stats of the inverter, holding the lock.
+func (m *metrics) update(key connKey, fn func(*inverterStats)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.stats[key]
+	if !ok {
+		s = &inverterStats{}
+		m.stats[key] = s
+	}
+	fn(s)
+}
+
+// remove discards the stats of an inverter which is no longer configured.
+func (m *metrics) remove(key connKey) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.stats, key)
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var set prometheus.Set
+
+	m.mu.Lock()
+	keys := slices.SortedFunc(maps.Keys(m.stats), func(a, b connKey) int { return strings.Compare(a.String(), b.String()) })
+	for _, key := range keys {
+		s := m.stats[key]
+		var serialNumber, model string
+		if s.deviceInfo != nil {
+			serialNumber, model = s.deviceInfo.SerialNumber, s.deviceInfo.ModelName
+			set.Add("solar_inverter_info", prometheus.Gauge, "Inverter device information.", 1,
+				prometheus.Label{Name: "serial", Value: serialNumber},
+				prometheus.Label{Name: "model", Value: model},
+				prometheus.Label{Name: "software_version", Value: s.deviceInfo.SoftwareVersion},
+				prometheus.Label{Name: "arm_version", Value: s.deviceInfo.ArmVersion},
+			)
+		}
+		if s.frame != nil && s.frame.ETRuntimeData != nil {
+			labels := []prometheus.Label{{Name: "serial", Value: serialNumber}, {Name: "model", Value: model}}
+			set.Add("solar_frame_timestamp_seconds", prometheus.Gauge, "Timestamp of the latest frame reported by the inverter.", float64(s.frame.Timestamp.UnixMilli())/1000, labels...)
+			set.AddFrame(s.frame, labels...)
+		}
+
+		labels := []prometheus.Label{{Name: "inverter", Value: key.String()}, {Name: "serial", Value: serialNumber}}
+		set.Add("solar_daemon_polls_total", prometheus.Counter, "Polls of the inverter.", float64(s.polls), labels...)
+		set.Add("solar_daemon_poll_errors_total", prometheus.Counter, "Polls of the inverter which failed.", float64(s.pollErrors), labels...)
+		set.Add("solar_daemon_poll_duration_seconds", prometheus.Gauge, "Duration of the latest poll of the inverter.", s.pollDuration.Seconds(), labels...)
+		set.Add("solar_daemon_command_retries_total", prometheus.Counter, "Commands sent to the inverter which were retried after an error.", float64(s.retries), labels...)
+		set.Add("solar_daemon_crc_errors_total", prometheus.Counter, "Responses from the inverter with an invalid CRC.", float64(s.crcErrors), labels...)
+		if !s.lastSuccess.IsZero() {
+			set.Add("solar_daemon_last_success_timestamp_seconds", prometheus.Gauge, "Time of the latest successful poll of the inverter.", float64(s.lastSuccess.UnixMilli())/1000, labels...)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, c := range m.validator.Rejected() {
+		set.Add("solar_daemon_rejected_values_total", prometheus.Counter, "Values rejected by the validation rules.", float64(c.N),
+			prometheus.Label{Name: "serial", Value: c.SerialNumber},
+			prometheus.Label{Name: "field", Value: c.Field},
+			prometheus.Label{Name: "policy", Value: string(c.Policy)},
+		)
+	}
+
+	w.Header().Set("content-type", prometheus.ContentType)
+	set.WriteTo(w)
+}
+
+// observedConn counts the failed attempts of commands sent to an inverter.
+type observedConn struct {
+	net.Conn
+	metrics *metrics
+	key     connKey
+}
+
+func (c observedConn) AttemptFailed(err error, retrying bool) {
+	c.metrics.update(c.key, func(s *inverterStats) {
+		if retrying {
+			s.retries++
+		}
+		if errors.Is(err, command.ErrChecksum) {
+			s.crcErrors++
+		}
+	})
+}
@@ -0,0 +1,191 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"git.netflux.io/rob/solar-toolkit/influx"
+	"git.netflux.io/rob/solar-toolkit/mqtt"
+	"git.netflux.io/rob/solar-toolkit/output"
+	"git.netflux.io/rob/solar-toolkit/spool"
+)
+
+const uploadBatchSize = 100
+
+// sinkSpec describes a sink to be opened. Its config and buffer are compared
+// across reloads, so that the sink is only reopened when they change.
+type sinkSpec struct {
+	config any
+	buffer output.BufferConfig
+	open   func() (output.Sink, error)
+}
+
+// sinkSpecs returns the sinks of the config, by name.
+func (d *Daemon) specs(cfg *Config) map[string]sinkSpec {
+	specs := make(map[string]sinkSpec)
+
+	// Each spooled sink has its own spool, as they may be unreachable
+	// independently.
+	spooled := func(spoolName string) output.BufferConfig {
+		if cfg.Spool.Dir == "" {
+			return output.BufferConfig{}
+		}
+		return output.BufferConfig{
+			SpoolDir:      filepath.Join(cfg.Spool.Dir, spoolName),
+			SpoolMaxBytes: cfg.Spool.MaxSizeMB << 20,
+			SpoolMaxAge:   cfg.Spool.MaxAge,
+		}
+	}
+
+	for _, gw := range cfg.Gateways {
+		buffer := spooled(gw.spoolName())
+		if gw.Batch {
+			buffer.BatchSize = uploadBatchSize
+		}
+		specs[gw.Endpoint] = sinkSpec{
+			config: gw,
+			buffer: buffer,
+			open: func() (output.Sink, error) {
+				return output.NewGateway(d.client, output.GatewayConfig{
+					Endpoint: gw.Endpoint,
+					Username: gw.Username,
+					Password: gw.Password,
+					Token:    gw.Token,
+				}), nil
+			},
+		}
+	}
+
+	for _, out := range cfg.Outputs {
+		spec := sinkSpec{config: out}
+		switch out.Type {
+		case OutputStdout:
+			spec.open = func() (output.Sink, error) { return output.NewNDJSON(os.Stdout), nil }
+		case OutputFile:
+			spec.open = func() (output.Sink, error) {
+				return output.OpenFile(out.Path, out.MaxSizeMB<<20, out.MaxFiles)
+			}
+		case OutputWebhook:
+			spec.buffer = spooled(out.spoolName())
+			spec.open = func() (output.Sink, error) {
+				return output.NewWebhook(d.client, output.WebhookConfig{URL: out.URL, Template: out.Template, Headers: out.Headers})
+			}
+		case OutputInfluxDB:
+			// UDP writes can not fail once sent, so there is nothing to
+			// spool.
+			if !strings.HasPrefix(out.URL, "udp:") {
+				spec.buffer = spooled(out.spoolName())
+			}
+			spec.buffer.BatchSize = uploadBatchSize
+			spec.open = func() (output.Sink, error) {
+				return influx.NewWriter(d.client, influx.Config{URL: out.URL, Org: out.Org, Bucket: out.Bucket, Token: out.Token})
+			}
+		}
+		specs[out.name()] = spec
+	}
+
+	// MQTT is not spooled, as stale values replayed later would be
+	// published as current.
+	if cfg.MQTT.Broker != "" {
+		specs["mqtt"] = sinkSpec{
+			config: cfg.MQTT,
+			open: func() (output.Sink, error) {
+				return mqtt.Connect(mqtt.Config{
+					Broker:          cfg.MQTT.Broker,
+					Username:        cfg.MQTT.Username,
+					Password:        cfg.MQTT.Password,
+					ClientID:        cfg.MQTT.ClientID,
+					TopicPrefix:     cfg.MQTT.TopicPrefix,
+					DiscoveryPrefix: cfg.MQTT.DiscoveryPrefix,
+					Retain:          cfg.MQTT.Retain,
+				})
+			},
+		}
+	}
+
+	return specs
+}
+
+// syncSinks opens, reopens and closes sinks to match cfg. It must only be
+// called from Run.
+func (d *Daemon) syncSinks(ctx context.Context, cfg *Config) error {
+	var errs []error
+	specs := d.specs(cfg)
+
+	for name, old := range d.sinkSpecs {
+		if spec, ok := specs[name]; !ok || spec.buffer != old.buffer || !reflect.DeepEqual(spec.config, old.config) {
+			// Closed before reopening, as a spool must not be open twice.
+			if err := d.sinks.Remove(name); err != nil {
+				errs = append(errs, err)
+			}
+			delete(d.sinkSpecs, name)
+		}
+	}
+
+	for name, spec := range specs {
+		if _, ok := d.sinkSpecs[name]; ok {
+			continue
+		}
+
+		sink, err := spec.open()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", name, err))
+			continue
+		}
+		buffer, err := output.NewBuffer(name, sink, spec.buffer)
+		if err != nil {
+			sink.Close()
+			errs = append(errs, fmt.Errorf("%s: %s", name, err))
+			continue
+		}
+
+		if err := d.sinks.Add(ctx, name, buffer); err != nil {
+			errs = append(errs, err)
+		}
+		d.sinkSpecs[name] = spec
+	}
+
+	if cfg.Spool.Dir != "" {
+		warnUnusedSpools(cfg.Spool.Dir, specs)
+	}
+
+	return errors.Join(errs...)
+}
+
+// warnUnusedSpools logs the spool directories in dir which hold frames but
+// are not used by any of the sinks, e.g. because the endpoint of a gateway
+// without a name has changed.
+func warnUnusedSpools(dir string, specs map[string]sinkSpec) {
+	used := make(map[string]bool)
+	for _, spec := range specs {
+		if spec.buffer.SpoolDir != "" {
+			used[filepath.Base(spec.buffer.SpoolDir)] = true
+		}
+	}
+
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Printf("error reading spool directory: %s", err)
+		return
+	}
+	for _, de := range dirEntries {
+		if !de.IsDir() || used[de.Name()] {
+			continue
+		}
+		path := filepath.Join(dir, de.Name())
+		n, err := spool.Pending(path)
+		if err != nil {
+			log.Printf("%s: %s", path, err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("Spool %s holds %d frame(s) which no gateway or output will upload; set the name of the gateway or output to `%s` to upload them", path, n, de.Name())
+		}
+	}
+}
@@ -0,0 +1,189 @@
+// Package format renders inverter data frames for humans and scripts.
+package format
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.netflux.io/rob/solar-toolkit/inverter"
+	"git.netflux.io/rob/solar-toolkit/prometheus"
+)
+
+// Format is an output format.
+type Format string
+
+const (
+	Table      Format = "table"
+	JSON       Format = "json"
+	PrettyJSON Format = "pretty-json"
+	CSV        Format = "csv"
+	Prometheus Format = "prometheus"
+)
+
+// Formats lists every supported format.
+var Formats = []Format{Table, JSON, PrettyJSON, CSV, Prometheus}
+
+// Parse parses a format name.
+func Parse(s string) (Format, error) {
+	for _, f := range Formats {
+		if string(f) == s {
+			return f, nil
+		}
+	}
+	return "", fmt.Errorf("unknown format `%s`", s)
+}
+
+// Write renders the provided fields of the frame to w. Fields which are
+// absent from the frame are skipped. If fields is nil, every field is
+// rendered.
+func Write(w io.Writer, format Format, frame *inverter.ETDataFrame, fields []inverter.Field) error {
+	if fields == nil {
+		fields = inverter.Fields()
+	}
+
+	var values []value
+	for _, f := range fields {
+		if v, ok := f.Value(frame); ok {
+			values = append(values, value{Field: f, v: v})
+		}
+	}
+
+	var ts time.Time
+	if frame != nil && frame.ETRuntimeData != nil {
+		ts = frame.Timestamp
+	}
+
+	switch format {
+	case Table:
+		return writeTable(w, ts, values)
+	case JSON:
+		return writeJSON(w, ts, values, false)
+	case PrettyJSON:
+		return writeJSON(w, ts, values, true)
+	case CSV:
+		return writeCSV(w, ts, values)
+	case Prometheus:
+		return writePrometheus(w, frame, fields)
+	default:
+		return fmt.Errorf("unknown format `%s`", format)
+	}
+}
+
+type value struct {
+	inverter.Field
+	v float64
+}
+
+func (v value) String() string {
+	return strconv.FormatFloat(v.v, 'f', -1, 64)
+}
+
+func writeTable(w io.Writer, ts time.Time, values []value) error {
+	// Widths are computed up front so that columns line up across sections.
+	var nameWidth, valueWidth int
+	for _, v := range values {
+		nameWidth = max(nameWidth, len(v.Name))
+		valueWidth = max(valueWidth, len(v.String()))
+	}
+
+	var buf bytes.Buffer
+	if !ts.IsZero() {
+		fmt.Fprintf(&buf, "timestamp: %s\n", ts.Format(time.RFC3339))
+	}
+
+	// Fields of a section are not necessarily contiguous, so group them
+	// while preserving the order in which sections first appear.
+	var sections []string
+	bySection := make(map[string][]value)
+	for _, v := range values {
+		if _, ok := bySection[v.Section]; !ok {
+			sections = append(sections, v.Section)
+		}
+		bySection[v.Section] = append(bySection[v.Section], v)
+	}
+
+	for _, section := range sections {
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		fmt.Fprintf(&buf, "%s\n", strings.ToUpper(section))
+		for _, v := range bySection[section] {
+			line := fmt.Sprintf("  %-*s  %*s  %s", nameWidth, v.Name, valueWidth, v.String(), v.Unit)
+			buf.WriteString(strings.TrimRight(line, " "))
+			buf.WriteByte('\n')
+		}
+	}
+
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+func writeJSON(w io.Writer, ts time.Time, values []value, pretty bool) error {
+	// Build the object by hand to preserve field order.
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	if !ts.IsZero() {
+		tsJSON, err := json.Marshal(ts)
+		if err != nil {
+			return fmt.Errorf("error encoding timestamp: %s", err)
+		}
+		buf.WriteString(`"timestamp":`)
+		buf.Write(tsJSON)
+	}
+	for i, v := range values {
+		if i > 0 || !ts.IsZero() {
+			buf.WriteByte(',')
+		}
+		if math.IsNaN(v.v) || math.IsInf(v.v, 0) {
+			fmt.Fprintf(&buf, "%q:null", v.Name)
+			continue
+		}
+		fmt.Fprintf(&buf, "%q:%s", v.Name, v.String())
+	}
+	buf.WriteByte('}')
+
+	if pretty {
+		var out bytes.Buffer
+		if err := json.Indent(&out, buf.Bytes(), "", "  "); err != nil {
+			return fmt.Errorf("error indenting JSON: %s", err)
+		}
+		out.WriteByte('\n')
+		buf = out
+	}
+
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+func writeCSV(w io.Writer, ts time.Time, values []value) error {
+	header := make([]string, 0, len(values)+1)
+	row := make([]string, 0, len(values)+1)
+	if !ts.IsZero() {
+		header = append(header, "timestamp")
+		row = append(row, ts.Format(time.RFC3339))
+	}
+	for _, v := range values {
+		header = append(header, v.Name)
+		row = append(row, v.String())
+	}
+
+	cw := csv.NewWriter(w)
+	cw.Write(header)
+	cw.Write(row)
+	cw.Flush()
+	return cw.Error()
+}
+
+func writePrometheus(w io.Writer, frame *inverter.ETDataFrame, fields []inverter.Field) error {
+	var set prometheus.Set
+	set.AddFields(frame, fields)
+	_, err := set.WriteTo(w)
+	return err
+}
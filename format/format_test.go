@@ -0,0 +1,99 @@
+package format_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"git.netflux.io/rob/solar-toolkit/format"
+	"git.netflux.io/rob/solar-toolkit/inverter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrite(t *testing.T) {
+	frame := inverter.ETDataFrame{
+		ETRuntimeData: &inverter.ETRuntimeData{
+			Timestamp:             time.Date(2022, 7, 13, 10, 35, 1, 0, time.UTC),
+			PV1Voltage:            316.4,
+			PV1Power:              1012,
+			EnergyGenerationTotal: 769.9,
+		},
+	}
+	fields, err := inverter.MatchFields([]string{"pv1_voltage", "pv1_power", "energy_generation_total", "meter_frequency"})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name   string
+		format format.Format
+		want   string
+	}{
+		{
+			name:   "table",
+			format: format.Table,
+			want: "timestamp: 2022-07-13T10:35:01Z\n" +
+				"\n" +
+				"PV\n" +
+				"  pv1_voltage              316.4  V\n" +
+				"  pv1_power                 1012  W\n" +
+				"\n" +
+				"ENERGY\n" +
+				"  energy_generation_total  769.9  kWh\n",
+		},
+		{
+			name:   "JSON",
+			format: format.JSON,
+			want:   `{"timestamp":"2022-07-13T10:35:01Z","pv1_voltage":316.4,"pv1_power":1012,"energy_generation_total":769.9}`,
+		},
+		{
+			name:   "pretty JSON",
+			format: format.PrettyJSON,
+			want:   "{\n  \"timestamp\": \"2022-07-13T10:35:01Z\",\n  \"pv1_voltage\": 316.4,\n  \"pv1_power\": 1012,\n  \"energy_generation_total\": 769.9\n}\n",
+		},
+		{
+			name:   "CSV",
+			format: format.CSV,
+			want:   "timestamp,pv1_voltage,pv1_power,energy_generation_total\n2022-07-13T10:35:01Z,316.4,1012,769.9\n",
+		},
+		{
+			name:   "Prometheus",
+			format: format.Prometheus,
+			want: "# HELP solar_pv_voltage_volts Inverter pv voltage in V.\n" +
+				"# TYPE solar_pv_voltage_volts gauge\n" +
+				"solar_pv_voltage_volts{string=\"1\"} 316.4\n" +
+				"# HELP solar_pv_power_watts Inverter pv power in W.\n" +
+				"# TYPE solar_pv_power_watts gauge\n" +
+				"solar_pv_power_watts{string=\"1\"} 1012\n" +
+				"# HELP solar_energy_generation_kilowatt_hours_total Inverter energy generation in kWh.\n" +
+				"# TYPE solar_energy_generation_kilowatt_hours_total counter\n" +
+				"solar_energy_generation_kilowatt_hours_total 769.9\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			require.NoError(t, format.Write(&buf, tc.format, &frame, fields))
+			assert.Equal(t, tc.want, buf.String())
+		})
+	}
+}
+
+func TestWriteAllFields(t *testing.T) {
+	frame := inverter.ETDataFrame{ETMeterData: &inverter.ETMeterData{MeterFrequency: 49.96}}
+
+	var buf bytes.Buffer
+	require.NoError(t, format.Write(&buf, format.JSON, &frame, nil))
+	assert.Contains(t, buf.String(), `"meter_frequency":49.96`)
+	assert.NotContains(t, buf.String(), "timestamp")
+	assert.NotContains(t, buf.String(), "pv1_voltage")
+}
+
+func TestParse(t *testing.T) {
+	f, err := format.Parse("csv")
+	require.NoError(t, err)
+	assert.Equal(t, format.CSV, f)
+
+	_, err = format.Parse("xml")
+	assert.EqualError(t, err, "unknown format `xml`")
+}
@@ -0,0 +1,40 @@
+// Package api defines the wire format shared by the gateway and its clients:
+// request headers, limits and the responses to ingest requests.
+//
+// It has no dependencies beyond the standard library, so that clients such
+// as the daemon do not depend on the gateway server.
+package api
+
+const (
+	// MaxBatchSize is the maximum number of frames accepted in a single batch.
+	MaxBatchSize = 1000
+
+	// IdempotencyKeyHeader is the request header containing an optional
+	// client-supplied key. A request repeated with the same key receives the
+	// stored response of the original request.
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotentReplayedHeader is set on responses replayed for a repeated
+	// idempotency key.
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+)
+
+// BatchResponse is the response to a batch request.
+type BatchResponse struct {
+	Accepted   int           `json:"accepted"`
+	Duplicates int           `json:"duplicates"`
+	Rejected   int           `json:"rejected"`
+	Results    []BatchResult `json:"results"`
+}
+
+// BatchResult is the result for a single frame of a batch request, in the
+// same order as the request.
+type BatchResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+const (
+	StatusAccepted  = "accepted"
+	StatusDuplicate = "duplicate"
+	StatusRejected  = "rejected"
+)
@@ -0,0 +1,65 @@
+// Package auth implements the API tokens used by daemons to authenticate with
+// the gateway.
+//
+// Each token is bound to a single device serial number. Only a SHA-256 hash of
+// the token is stored, which is sufficient because tokens are long random
+// strings rather than user-chosen passwords.
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// TokenPrefix is prepended to every token, to make them recognisable.
+const TokenPrefix = "stk_"
+
+const tokenBytes = 32
+
+// Token is a stored API token.
+type Token struct {
+	ID           int64      `db:"id" json:"id"`
+	Name         string     `db:"name" json:"name"`
+	SerialNumber string     `db:"serial_number" json:"serial_number"`
+	CreatedAt    time.Time  `db:"created_at" json:"created_at"`
+	RevokedAt    *time.Time `db:"revoked_at" json:"revoked_at,omitempty"`
+}
+
+// GenerateToken returns a new random token and its hash.
+func GenerateToken() (string, string, error) {
+	p := make([]byte, tokenBytes)
+	if _, err := rand.Read(p); err != nil {
+		return "", "", fmt.Errorf("error generating token: %s", err)
+	}
+
+	token := TokenPrefix + base64.RawURLEncoding.EncodeToString(p)
+	return token, HashToken(token), nil
+}
+
+// HashToken returns the hash of the token, as stored in the database.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// RequestToken returns the token sent with the request, either as a bearer
+// token or as the password of HTTP basic auth.
+func RequestToken(r *http.Request) (string, bool) {
+	if _, password, ok := r.BasicAuth(); ok && password != "" {
+		return password, true
+	}
+
+	scheme, token, ok := strings.Cut(r.Header.Get("authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+
+	return token, token != ""
+}
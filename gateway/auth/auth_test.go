@@ -0,0 +1,87 @@
+package auth_test
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"git.netflux.io/rob/solar-toolkit/gateway/auth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateToken(t *testing.T) {
+	token, hash, err := auth.GenerateToken()
+	require.NoError(t, err)
+
+	assert.True(t, strings.HasPrefix(token, auth.TokenPrefix))
+	assert.Len(t, token, len(auth.TokenPrefix)+43)
+	assert.Equal(t, auth.HashToken(token), hash)
+	assert.Len(t, hash, 64)
+
+	other, _, err := auth.GenerateToken()
+	require.NoError(t, err)
+	assert.NotEqual(t, token, other)
+}
+
+func TestRequestToken(t *testing.T) {
+	testCases := []struct {
+		name      string
+		header    string
+		username  string
+		password  string
+		wantToken string
+		wantOK    bool
+	}{
+		{
+			name: "none",
+		},
+		{
+			name:      "bearer",
+			header:    "Bearer stk_abc",
+			wantToken: "stk_abc",
+			wantOK:    true,
+		},
+		{
+			name:      "bearer, lower case",
+			header:    "bearer stk_abc",
+			wantToken: "stk_abc",
+			wantOK:    true,
+		},
+		{
+			name:   "bearer, empty",
+			header: "Bearer ",
+		},
+		{
+			name:   "other scheme",
+			header: "Token stk_abc",
+		},
+		{
+			name:      "basic auth",
+			username:  "solar",
+			password:  "stk_abc",
+			wantToken: "stk_abc",
+			wantOK:    true,
+		},
+		{
+			name:     "basic auth, empty password",
+			username: "solar",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/", nil)
+			if tc.header != "" {
+				req.Header.Set("authorization", tc.header)
+			}
+			if tc.username != "" {
+				req.SetBasicAuth(tc.username, tc.password)
+			}
+
+			token, ok := auth.RequestToken(req)
+			assert.Equal(t, tc.wantOK, ok)
+			assert.Equal(t, tc.wantToken, token)
+		})
+	}
+}
@@ -0,0 +1,257 @@
+// Package energy turns the cumulative energy counters of data frames into
+// daily, monthly and yearly energy balances.
+//
+// Energy is computed from the differences between consecutive readings of
+// the lifetime counters, rather than from the daily counters, since the
+// latter reset at inverter midnight and are lost entirely across gaps.
+package energy
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"git.netflux.io/rob/solar-toolkit/inverter"
+)
+
+// Period is the length of a summary.
+type Period string
+
+const (
+	Day   Period = "day"
+	Month Period = "month"
+	Year  Period = "year"
+)
+
+// ParsePeriod parses a period name.
+func ParsePeriod(s string) (Period, error) {
+	switch p := Period(s); p {
+	case Day, Month, Year:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown period `%s`", s)
+	}
+}
+
+// Start returns the start of the period containing t, in loc.
+func (p Period) Start(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	y, m, d := t.Date()
+	switch p {
+	case Day:
+		return time.Date(y, m, d, 0, 0, 0, 0, loc)
+	case Month:
+		return time.Date(y, m, 1, 0, 0, 0, 0, loc)
+	default:
+		return time.Date(y, 1, 1, 0, 0, 0, 0, loc)
+	}
+}
+
+// Next returns the start of the period following the one starting at start.
+func (p Period) Next(start time.Time) time.Time {
+	switch p {
+	case Day:
+		return start.AddDate(0, 0, 1)
+	case Month:
+		return start.AddDate(0, 1, 0)
+	default:
+		return start.AddDate(1, 0, 0)
+	}
+}
+
+// Summary is the energy balance of a device over a period. Energies are in
+// kWh.
+//
+// The battery charge and discharge are computed from the totals integrated
+// by the daemon, since the units of the inverter's own battery totals are
+// unconfirmed. They are zero for devices without integration enabled.
+type Summary struct {
+	Period           Period    `json:"period" db:"period"`
+	Start            time.Time `json:"start" db:"start"`
+	Generation       float64   `json:"generation" db:"generation"`
+	Export           float64   `json:"export" db:"export"`
+	Import           float64   `json:"import" db:"import"`
+	Consumption      float64   `json:"consumption" db:"consumption"`
+	BatteryCharge    float64   `json:"battery_charge" db:"battery_charge"`
+	BatteryDischarge float64   `json:"battery_discharge" db:"battery_discharge"`
+	// SelfConsumption is the energy generated which was not exported.
+	SelfConsumption float64 `json:"self_consumption" db:"self_consumption"`
+	// SelfSufficiency is the fraction of consumption which was not imported,
+	// between 0 and 1.
+	SelfSufficiency float64 `json:"self_sufficiency" db:"self_sufficiency"`
+}
+
+// MaxPower is the highest plausible average power in kW between two
+// readings. A counter increasing faster than this is assumed to have been
+// misread, and the increase is ignored.
+const MaxPower = 100
+
+// counter accumulates the increases of a lifetime counter into a summary.
+// name is the name of the field holding the counter, in kWh.
+type counter struct {
+	name string
+	add  func(*Summary, float64)
+}
+
+var counters = []counter{
+	{name: "energy_generation_total", add: func(s *Summary, v float64) { s.Generation += v }},
+	{name: "energy_export_total", add: func(s *Summary, v float64) { s.Export += v }},
+	{name: "energy_import_total", add: func(s *Summary, v float64) { s.Import += v }},
+	{name: "energy_load_total", add: func(s *Summary, v float64) { s.Consumption += v }},
+	// Not the inverter's battery_charge_total and battery_discharge_total,
+	// see Summary.
+	{name: "battery_charge_energy_total", add: func(s *Summary, v float64) { s.BatteryCharge += v }},
+	{name: "battery_discharge_energy_total", add: func(s *Summary, v float64) { s.BatteryDischarge += v }},
+}
+
+// Summarize computes the daily summaries of the frames, which must be
+// ordered by timestamp, with days starting at midnight in loc.
+//
+// Each increase of a counter between two readings is attributed to the days
+// between them in proportion to time, so that gaps spanning midnight are
+// split rather than counted entirely on one day. Increases are filtered as
+// by Increases.
+func Summarize(frames []*inverter.ETDataFrame, loc *time.Location) []Summary {
+	var summaries []Summary
+	index := make(map[time.Time]int)
+	summary := func(start time.Time) *Summary {
+		i, ok := index[start]
+		if !ok {
+			i = len(summaries)
+			index[start] = i
+			summaries = append(summaries, Summary{Period: Day, Start: start})
+		}
+		return &summaries[i]
+	}
+
+	for _, frame := range frames {
+		if frame.ETRuntimeData != nil {
+			summary(Day.Start(frame.Timestamp, loc))
+		}
+	}
+
+	Increases(frames, func(from, to time.Time, delta Summary) {
+		// Split the increase across the days between the readings.
+		for start := Day.Start(from, loc); start.Before(to); start = Day.Next(start) {
+			f := float64(minTime(Day.Next(start), to).Sub(maxTime(start, from))) / float64(to.Sub(from))
+			summary(start).add(delta, f)
+		}
+	})
+
+	// Days within gaps are created after the day ending the gap.
+	slices.SortFunc(summaries, func(a, b Summary) int { return a.Start.Compare(b.Start) })
+	for i := range summaries {
+		summaries[i].derive()
+	}
+
+	return summaries
+}
+
+// Increases calls fn with each increase of a counter of the frames, which
+// must be ordered by timestamp, and the timestamps of the two readings
+// between which it occurred. delta holds the increase of the counter, in
+// kWh, and is zero for the other counters.
+//
+// A decrease means that the counter was reset or misread, and is skipped
+// along with increases faster than MaxPower. Counters omitted from a frame,
+// or in a block of data it does not include, are ignored, and compared
+// across it.
+func Increases(frames []*inverter.ETDataFrame, fn func(from, to time.Time, delta Summary)) {
+	type reading struct {
+		timestamp time.Time
+		value     float64
+	}
+
+	fields := make([]inverter.Field, len(counters))
+	for i, c := range counters {
+		fields[i], _ = inverter.LookupField(c.name)
+	}
+
+	// Each counter is compared with its previous reading, which may be older
+	// than the previous frame if the counter was omitted from frames since.
+	var (
+		last  *inverter.ETRuntimeData
+		prevs = make([]*reading, len(counters))
+	)
+	for _, frame := range frames {
+		cur := frame.ETRuntimeData
+		if cur == nil || (last != nil && !cur.Timestamp.After(last.Timestamp)) {
+			continue
+		}
+		last = cur
+
+		for i, c := range counters {
+			v, ok := fields[i].Value(frame)
+			if !ok {
+				continue
+			}
+			prev := prevs[i]
+			prevs[i] = &reading{timestamp: cur.Timestamp, value: v}
+			if prev == nil {
+				continue
+			}
+
+			elapsed := cur.Timestamp.Sub(prev.timestamp)
+			delta := v - prev.value
+			if delta <= 0 || delta > MaxPower*elapsed.Hours() {
+				continue
+			}
+
+			var s Summary
+			c.add(&s, delta)
+			fn(prev.timestamp, cur.Timestamp, s)
+		}
+	}
+}
+
+// Rollup combines daily summaries, which must be ordered by start, into
+// summaries of a longer period.
+func Rollup(days []Summary, period Period, loc *time.Location) []Summary {
+	var summaries []Summary
+	for _, day := range days {
+		start := period.Start(day.Start, loc)
+		if len(summaries) == 0 || !summaries[len(summaries)-1].Start.Equal(start) {
+			summaries = append(summaries, Summary{Period: period, Start: start})
+		}
+		summaries[len(summaries)-1].add(day, 1)
+	}
+
+	for i := range summaries {
+		summaries[i].derive()
+	}
+
+	return summaries
+}
+
+// add adds the fraction f of the counters of other to the summary.
+func (s *Summary) add(other Summary, f float64) {
+	s.Generation += other.Generation * f
+	s.Export += other.Export * f
+	s.Import += other.Import * f
+	s.Consumption += other.Consumption * f
+	s.BatteryCharge += other.BatteryCharge * f
+	s.BatteryDischarge += other.BatteryDischarge * f
+}
+
+// derive computes the fields derived from the counters.
+func (s *Summary) derive() {
+	s.SelfConsumption = max(s.Generation-s.Export, 0)
+	s.SelfSufficiency = 0
+	if s.Consumption > 0 {
+		s.SelfSufficiency = min(max(1-s.Import/s.Consumption, 0), 1)
+	}
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,341 @@
+package energy_test
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"git.netflux.io/rob/solar-toolkit/gateway/energy"
+	"git.netflux.io/rob/solar-toolkit/inverter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type reading struct {
+	ts                                string
+	generation, export, import_, load float64
+	batteryCharge, batteryDischarge   float64
+	// rawBatteryCharge is the inverter's own battery charge total.
+	rawBatteryCharge int
+}
+
+func frames(t *testing.T, readings ...reading) []*inverter.ETDataFrame {
+	t.Helper()
+
+	var frames []*inverter.ETDataFrame
+	for _, r := range readings {
+		ts, err := time.Parse(time.RFC3339, r.ts)
+		require.NoError(t, err)
+		frames = append(frames, &inverter.ETDataFrame{
+			SerialNumber: "12345",
+			ETRuntimeData: &inverter.ETRuntimeData{
+				Timestamp:             ts,
+				EnergyGenerationTotal: inverter.Energy(r.generation),
+				EnergyExportTotal:     inverter.Energy(r.export),
+				EnergyImportTotal:     inverter.Energy(r.import_),
+				EnergyLoadTotal:       inverter.Energy(r.load),
+				BatteryChargeTotal:    r.rawBatteryCharge,
+			},
+			ETIntegratedData: &inverter.ETIntegratedData{
+				BatteryChargeEnergyTotal:    inverter.Energy(r.batteryCharge),
+				BatteryDischargeEnergyTotal: inverter.Energy(r.batteryDischarge),
+			},
+		})
+	}
+	return frames
+}
+
+func date(y int, m time.Month, d int) time.Time {
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+func TestParsePeriod(t *testing.T) {
+	p, err := energy.ParsePeriod("month")
+	require.NoError(t, err)
+	assert.Equal(t, energy.Month, p)
+
+	_, err = energy.ParsePeriod("week")
+	assert.EqualError(t, err, "unknown period `week`")
+}
+
+func TestSummarize(t *testing.T) {
+	testCases := []struct {
+		name     string
+		readings []reading
+		want     []energy.Summary
+	}{
+		{
+			name: "no frames",
+		},
+		{
+			name:     "single frame",
+			readings: []reading{{ts: "2022-07-14T10:00:00Z", generation: 100}},
+			want:     []energy.Summary{{Period: energy.Day, Start: date(2022, 7, 14)}},
+		},
+		{
+			name: "single day",
+			readings: []reading{
+				{ts: "2022-07-14T10:00:00Z", generation: 100, export: 50, import_: 20, load: 80, batteryCharge: 10, batteryDischarge: 10, rawBatteryCharge: 100},
+				{ts: "2022-07-14T11:00:00Z", generation: 104, export: 51, import_: 20, load: 82, batteryCharge: 11, batteryDischarge: 10, rawBatteryCharge: 150},
+				{ts: "2022-07-14T12:00:00Z", generation: 108, export: 52, import_: 21, load: 84, batteryCharge: 11, batteryDischarge: 10.5, rawBatteryCharge: 200},
+			},
+			want: []energy.Summary{{
+				Period:           energy.Day,
+				Start:            date(2022, 7, 14),
+				Generation:       8,
+				Export:           2,
+				Import:           1,
+				Consumption:      4,
+				BatteryCharge:    1,
+				BatteryDischarge: 0.5,
+				SelfConsumption:  6,
+				SelfSufficiency:  0.75,
+			}},
+		},
+		{
+			name: "gap spanning days",
+			readings: []reading{
+				{ts: "2022-07-14T12:00:00Z", generation: 100},
+				{ts: "2022-07-16T12:00:00Z", generation: 120},
+			},
+			want: []energy.Summary{
+				{Period: energy.Day, Start: date(2022, 7, 14), Generation: 5, SelfConsumption: 5},
+				{Period: energy.Day, Start: date(2022, 7, 15), Generation: 10, SelfConsumption: 10},
+				{Period: energy.Day, Start: date(2022, 7, 16), Generation: 5, SelfConsumption: 5},
+			},
+		},
+		{
+			name: "counter reset",
+			readings: []reading{
+				{ts: "2022-07-14T10:00:00Z", generation: 100},
+				{ts: "2022-07-14T11:00:00Z", generation: 2},
+				{ts: "2022-07-14T12:00:00Z", generation: 5},
+			},
+			want: []energy.Summary{
+				{Period: energy.Day, Start: date(2022, 7, 14), Generation: 3, SelfConsumption: 3},
+			},
+		},
+		{
+			name: "misread counter",
+			readings: []reading{
+				{ts: "2022-07-14T10:00:00Z", generation: 100},
+				{ts: "2022-07-14T10:01:00Z", generation: 0},
+				{ts: "2022-07-14T10:02:00Z", generation: 100.1},
+				{ts: "2022-07-14T10:03:00Z", generation: 100.2},
+			},
+			want: []energy.Summary{
+				{Period: energy.Day, Start: date(2022, 7, 14), Generation: 0.1, SelfConsumption: 0.1},
+			},
+		},
+		{
+			name: "duplicate timestamp",
+			readings: []reading{
+				{ts: "2022-07-14T10:00:00Z", generation: 100},
+				{ts: "2022-07-14T10:00:00Z", generation: 101},
+				{ts: "2022-07-14T11:00:00Z", generation: 102},
+			},
+			want: []energy.Summary{
+				{Period: energy.Day, Start: date(2022, 7, 14), Generation: 2, SelfConsumption: 2},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			summaries := energy.Summarize(frames(t, tc.readings...), time.UTC)
+			require.Len(t, summaries, len(tc.want))
+			for i, want := range tc.want {
+				assertSummary(t, want, summaries[i])
+			}
+		})
+	}
+}
+
+func TestSummarizeOmitted(t *testing.T) {
+	fs := frames(t,
+		reading{ts: "2022-07-14T10:00:00Z", generation: 100, export: 50},
+		reading{ts: "2022-07-14T11:00:00Z", generation: 0, export: 51},
+		reading{ts: "2022-07-14T12:00:00Z", generation: 103, export: 52},
+	)
+	f, _ := inverter.LookupField("energy_generation_total")
+	fs[1].Omit(f)
+
+	// The omitted generation counter is compared across the frame, rather
+	// than as a reset to zero.
+	summaries := energy.Summarize(fs, time.UTC)
+	require.Len(t, summaries, 1)
+	assert.InDelta(t, 3, summaries[0].Generation, 1e-9)
+	assert.InDelta(t, 2, summaries[0].Export, 1e-9)
+}
+
+func TestSummarizeWithoutIntegration(t *testing.T) {
+	fs := frames(t,
+		reading{ts: "2022-07-14T10:00:00Z", generation: 100, rawBatteryCharge: 100},
+		reading{ts: "2022-07-14T11:00:00Z", generation: 101, rawBatteryCharge: 110},
+	)
+	for _, f := range fs {
+		f.ETIntegratedData = nil
+	}
+
+	// The inverter's battery totals are not summed in place of the
+	// integrated ones.
+	summaries := energy.Summarize(fs, time.UTC)
+	require.Len(t, summaries, 1)
+	assertSummary(t, energy.Summary{Period: energy.Day, Start: date(2022, 7, 14), Generation: 1, SelfConsumption: 1}, summaries[0])
+}
+
+func TestSummarizeTimezone(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Madrid")
+	require.NoError(t, err)
+
+	// Midnight in Madrid is 22:00 UTC in summer.
+	summaries := energy.Summarize(frames(t,
+		reading{ts: "2022-07-14T21:00:00Z", generation: 100},
+		reading{ts: "2022-07-14T23:00:00Z", generation: 102},
+	), loc)
+
+	require.Len(t, summaries, 2)
+	assert.True(t, time.Date(2022, 7, 14, 0, 0, 0, 0, loc).Equal(summaries[0].Start))
+	assert.InDelta(t, 1, summaries[0].Generation, 1e-9)
+	assert.True(t, time.Date(2022, 7, 15, 0, 0, 0, 0, loc).Equal(summaries[1].Start))
+	assert.InDelta(t, 1, summaries[1].Generation, 1e-9)
+}
+
+func TestRollup(t *testing.T) {
+	days := []energy.Summary{
+		{Period: energy.Day, Start: date(2022, 6, 30), Generation: 10, Export: 4, Import: 2, Consumption: 8},
+		{Period: energy.Day, Start: date(2022, 7, 1), Generation: 20, Export: 10, Import: 5, Consumption: 10},
+		{Period: energy.Day, Start: date(2022, 7, 2), Generation: 10, Export: 5, Import: 5, Consumption: 10},
+	}
+
+	months := energy.Rollup(days, energy.Month, time.UTC)
+	require.Len(t, months, 2)
+	assertSummary(t, energy.Summary{Period: energy.Month, Start: date(2022, 6, 1), Generation: 10, Export: 4, Import: 2, Consumption: 8, SelfConsumption: 6, SelfSufficiency: 0.75}, months[0])
+	assertSummary(t, energy.Summary{Period: energy.Month, Start: date(2022, 7, 1), Generation: 30, Export: 15, Import: 10, Consumption: 20, SelfConsumption: 15, SelfSufficiency: 0.5}, months[1])
+
+	years := energy.Rollup(days, energy.Year, time.UTC)
+	require.Len(t, years, 1)
+	assertSummary(t, energy.Summary{Period: energy.Year, Start: date(2022, 1, 1), Generation: 40, Export: 19, Import: 12, Consumption: 28, SelfConsumption: 21, SelfSufficiency: 16.0 / 28}, years[0])
+}
+
+func assertSummary(t *testing.T, want, got energy.Summary) {
+	t.Helper()
+
+	assert.Equal(t, want.Period, got.Period)
+	assert.True(t, want.Start.Equal(got.Start), "want start %s, got %s", want.Start, got.Start)
+	assert.InDelta(t, want.Generation, got.Generation, 1e-9, "generation")
+	assert.InDelta(t, want.Export, got.Export, 1e-9, "export")
+	assert.InDelta(t, want.Import, got.Import, 1e-9, "import")
+	assert.InDelta(t, want.Consumption, got.Consumption, 1e-9, "consumption")
+	assert.InDelta(t, want.BatteryCharge, got.BatteryCharge, 1e-9, "battery charge")
+	assert.InDelta(t, want.BatteryDischarge, got.BatteryDischarge, 1e-9, "battery discharge")
+	assert.InDelta(t, want.SelfConsumption, got.SelfConsumption, 1e-9, "self consumption")
+	assert.InDelta(t, want.SelfSufficiency, got.SelfSufficiency, 1e-9, "self sufficiency")
+}
+
+// memoryStore is an in-memory energy.Store.
+type memoryStore struct {
+	frames    []*inverter.ETDataFrame
+	summaries []energy.Summary
+}
+
+func (s *memoryStore) SerialNumbers() ([]string, error) {
+	return []string{"12345"}, nil
+}
+
+func (s *memoryStore) Frames(_ string, from, to time.Time, limit int) ([]*inverter.ETDataFrame, error) {
+	var frames []*inverter.ETDataFrame
+	for _, frame := range s.frames {
+		if !frame.Timestamp.Before(from) && frame.Timestamp.Before(to) && (limit == 0 || len(frames) < limit) {
+			frames = append(frames, frame)
+		}
+	}
+	return frames, nil
+}
+
+func (s *memoryStore) Summaries(_ string, period energy.Period, from, to time.Time) ([]energy.Summary, error) {
+	var summaries []energy.Summary
+	for _, summary := range s.summaries {
+		if summary.Period == period && !summary.Start.Before(from) && summary.Start.Before(to) {
+			summaries = append(summaries, summary)
+		}
+	}
+	return summaries, nil
+}
+
+func (s *memoryStore) LatestSummary(_ string, period energy.Period) (*energy.Summary, error) {
+	var latest *energy.Summary
+	for i, summary := range s.summaries {
+		if summary.Period == period && (latest == nil || summary.Start.After(latest.Start)) {
+			latest = &s.summaries[i]
+		}
+	}
+	return latest, nil
+}
+
+func (s *memoryStore) SaveSummaries(_ string, summaries []energy.Summary) error {
+	for _, summary := range summaries {
+		s.summaries = slices.DeleteFunc(s.summaries, func(other energy.Summary) bool {
+			return other.Period == summary.Period && other.Start.Equal(summary.Start)
+		})
+		s.summaries = append(s.summaries, summary)
+	}
+	slices.SortFunc(s.summaries, func(a, b energy.Summary) int { return a.Start.Compare(b.Start) })
+	return nil
+}
+
+func (s *memoryStore) DeleteSummaries(string) error {
+	s.summaries = nil
+	return nil
+}
+
+func TestUpdate(t *testing.T) {
+	store := memoryStore{}
+	now := time.Date(2022, 8, 1, 0, 0, 0, 0, time.UTC)
+
+	// No frames.
+	require.NoError(t, energy.UpdateAll(&store, time.UTC, now))
+	assert.Empty(t, store.summaries)
+
+	// One reading per hour over two months, generating 1 kWh per hour.
+	start := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+	addFrames := func(from, to time.Time) {
+		for ts := from; ts.Before(to); ts = ts.Add(time.Hour) {
+			store.frames = append(store.frames, frames(t, reading{ts: ts.Format(time.RFC3339), generation: ts.Sub(start).Hours()})...)
+		}
+	}
+	addFrames(start, time.Date(2022, 7, 15, 12, 0, 0, 0, time.UTC))
+
+	require.NoError(t, energy.UpdateAll(&store, time.UTC, now))
+	days, err := store.Summaries("12345", energy.Day, time.Time{}, now)
+	require.NoError(t, err)
+	require.Len(t, days, 45)
+	assert.InDelta(t, 24, days[0].Generation, 1e-9)
+	assert.InDelta(t, 24, days[43].Generation, 1e-9)
+	assert.InDelta(t, 11, days[44].Generation, 1e-9)
+
+	// New frames complete the latest day.
+	addFrames(time.Date(2022, 7, 15, 12, 0, 0, 0, time.UTC), time.Date(2022, 7, 16, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, energy.UpdateAll(&store, time.UTC, now))
+
+	days, err = store.Summaries("12345", energy.Day, time.Time{}, now)
+	require.NoError(t, err)
+	require.Len(t, days, 45)
+	assert.InDelta(t, 23, days[44].Generation, 1e-9)
+
+	months, err := store.Summaries("12345", energy.Month, time.Time{}, now)
+	require.NoError(t, err)
+	require.Len(t, months, 2)
+	assert.InDelta(t, 30*24, months[0].Generation, 1e-9)
+	assert.InDelta(t, 15*24-1, months[1].Generation, 1e-9)
+
+	years, err := store.Summaries("12345", energy.Year, time.Time{}, now)
+	require.NoError(t, err)
+	require.Len(t, years, 1)
+	assert.InDelta(t, 45*24-1, years[0].Generation, 1e-9)
+
+	// Rebuilding gives the same result.
+	before := slices.Clone(store.summaries)
+	require.NoError(t, energy.Rebuild(&store, "12345", time.UTC, now))
+	assert.Equal(t, before, store.summaries)
+}
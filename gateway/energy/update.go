@@ -0,0 +1,116 @@
+package energy
+
+import (
+	"fmt"
+	"time"
+
+	"git.netflux.io/rob/solar-toolkit/inverter"
+)
+
+// Store persists summaries and provides the frames to compute them from.
+type Store interface {
+	// SerialNumbers returns the serial numbers of every device.
+	SerialNumbers() ([]string, error)
+	// Frames returns the frames of the device with timestamps in [from, to),
+	// ordered by timestamp. If limit is greater than zero, at most limit
+	// frames are returned.
+	Frames(serialNumber string, from, to time.Time, limit int) ([]*inverter.ETDataFrame, error)
+	// Summaries returns the summaries of the device for the period with
+	// starts in [from, to), ordered by start.
+	Summaries(serialNumber string, period Period, from, to time.Time) ([]Summary, error)
+	// LatestSummary returns the most recent summary of the device for the
+	// period, or nil if there is none.
+	LatestSummary(serialNumber string, period Period) (*Summary, error)
+	// SaveSummaries creates or replaces the summaries of the device.
+	SaveSummaries(serialNumber string, summaries []Summary) error
+	// DeleteSummaries deletes every summary of the device.
+	DeleteSummaries(serialNumber string) error
+}
+
+// chunkDays is the number of days of frames summarized at a time, bounding
+// memory use when catching up on a long history.
+const chunkDays = 31
+
+// Update summarizes the frames of the device received since the most recent
+// daily summary, which is itself recomputed since the day may not have been
+// complete, and then updates the monthly and yearly summaries.
+func Update(store Store, serialNumber string, loc *time.Location, now time.Time) error {
+	var from time.Time
+	latest, err := store.LatestSummary(serialNumber, Day)
+	if err != nil {
+		return err
+	}
+	if latest != nil {
+		from = latest.Start.In(loc)
+	} else {
+		frames, err := store.Frames(serialNumber, time.Unix(0, 0), now, 1)
+		if err != nil {
+			return err
+		}
+		if len(frames) == 0 || frames[0].ETRuntimeData == nil {
+			return nil
+		}
+		from = Day.Start(frames[0].Timestamp, loc)
+	}
+
+	for start := from; start.Before(now); {
+		end := start.AddDate(0, 0, chunkDays)
+
+		// Include the days either side, so that increases spanning the edges
+		// of the chunk are split correctly.
+		frames, err := store.Frames(serialNumber, start.AddDate(0, 0, -1), end.AddDate(0, 0, 1), 0)
+		if err != nil {
+			return err
+		}
+
+		var days []Summary
+		for _, day := range Summarize(frames, loc) {
+			if !day.Start.Before(start) && day.Start.Before(end) {
+				days = append(days, day)
+			}
+		}
+		if err := store.SaveSummaries(serialNumber, days); err != nil {
+			return err
+		}
+
+		start = end
+	}
+
+	for start := Year.Start(from, loc); start.Before(now); start = Year.Next(start) {
+		days, err := store.Summaries(serialNumber, Day, start, Year.Next(start))
+		if err != nil {
+			return err
+		}
+		summaries := append(Rollup(days, Month, loc), Rollup(days, Year, loc)...)
+		if err := store.SaveSummaries(serialNumber, summaries); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Rebuild deletes the summaries of the device and computes them again from
+// every stored frame, e.g. after changing the timezone.
+func Rebuild(store Store, serialNumber string, loc *time.Location, now time.Time) error {
+	if err := store.DeleteSummaries(serialNumber); err != nil {
+		return err
+	}
+	return Update(store, serialNumber, loc, now)
+}
+
+// UpdateAll updates the summaries of every device.
+func UpdateAll(store Store, loc *time.Location, now time.Time) error {
+	serialNumbers, err := store.SerialNumbers()
+	if err != nil {
+		return err
+	}
+
+	for _, serialNumber := range serialNumbers {
+		if err := Update(store, serialNumber, loc, now); err != nil {
+			return fmt.Errorf("error updating energy summaries of %s: %s", serialNumber, err)
+		}
+	}
+
+	return nil
+}
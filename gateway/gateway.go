@@ -0,0 +1,245 @@
+// Package gateway runs the HTTP server which accepts metrics from the daemon
+// and writes them to a PostgreSQL or SQLite database.
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.netflux.io/rob/solar-toolkit/gateway/energy"
+	"git.netflux.io/rob/solar-toolkit/gateway/handler"
+	"git.netflux.io/rob/solar-toolkit/gateway/rollup"
+	"git.netflux.io/rob/solar-toolkit/gateway/sql/migrations"
+	"git.netflux.io/rob/solar-toolkit/gateway/store"
+	"git.netflux.io/rob/solar-toolkit/gateway/tariff"
+	"git.netflux.io/rob/solar-toolkit/validate"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+// DefaultBindAddr is the default address the gateway listens on.
+const DefaultBindAddr = ":8888"
+
+const shutdownTimeout = time.Second * 5
+
+// maintenanceInterval is the interval at which energy summaries, costs and
+// rollups are updated.
+const maintenanceInterval = time.Minute * 5
+
+// Config holds the configuration of the gateway.
+type Config struct {
+	DatabaseURL string
+	BindAddr    string
+	// AllowUnauthenticated accepts requests without an API token.
+	AllowUnauthenticated bool
+	// MigrateOnStartup applies pending migrations before serving requests.
+	MigrateOnStartup bool
+	// Location is the timezone in which energy summaries and daily rollups
+	// start, normally that of the inverters. Defaults to UTC.
+	Location *time.Location
+	// Retention is the age after which raw frames are deleted, once rolled
+	// up. Zero keeps them forever.
+	Retention time.Duration
+	// Validation holds the plausibility rules which frames are checked
+	// against before they are stored. It must have been validated.
+	Validation validate.Config
+	// Tariffs holds the tariffs from which the daily costs of each device are
+	// computed. It must have been validated.
+	Tariffs tariff.Config
+}
+
+// Connect opens a connection to the database. A sqlite: URL opens a SQLite
+// database file, e.g. sqlite:///var/lib/solar.db or sqlite:solar.db, and any
+// other URL connects to PostgreSQL.
+func Connect(databaseURL string) (*sqlx.DB, error) {
+	driverName, dataSourceName, err := parseDatabaseURL(databaseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sqlx.Connect(driverName, dataSourceName)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to database: %s", err)
+	}
+	if driverName == "sqlite" {
+		// SQLite allows a single writer, so serialize access rather than
+		// fail with "database is locked".
+		db.SetMaxOpenConns(1)
+	}
+
+	return db, nil
+}
+
+// sqlitePragmas are applied to every SQLite connection.
+var sqlitePragmas = []string{"foreign_keys(1)", "journal_mode(WAL)", "busy_timeout(5000)"}
+
+// parseDatabaseURL returns the driver and data source names of the database
+// URL. Anything other than a sqlite: URL is passed to the PostgreSQL driver,
+// which also accepts key=value connection strings.
+func parseDatabaseURL(databaseURL string) (string, string, error) {
+	if !strings.HasPrefix(databaseURL, "sqlite:") {
+		return "postgres", databaseURL, nil
+	}
+
+	u, err := url.Parse(databaseURL)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid database URL: %s", err)
+	}
+	path := u.Opaque
+	if path == "" {
+		path = u.Host + u.Path
+	}
+	if path == "" {
+		return "", "", errors.New("invalid database URL: missing SQLite database path")
+	}
+
+	query := u.Query()
+	for _, pragma := range sqlitePragmas {
+		query.Add("_pragma", pragma)
+	}
+	return "sqlite", "file:" + path + "?" + query.Encode(), nil
+}
+
+// Migrate runs a migration command against the database: "up", "down [n]"
+// or "status". Output is written to w.
+func Migrate(ctx context.Context, db *sqlx.DB, w io.Writer, args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return errors.New("expected up, down or status")
+	}
+
+	steps := 1
+	if len(args) == 2 {
+		var err error
+		if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+			return fmt.Errorf("invalid number of migrations `%s`", args[1])
+		}
+	}
+
+	switch args[0] {
+	case "up":
+		n, err := migrations.Up(ctx, db)
+		fmt.Fprintf(w, "Applied %d migration(s)\n", n)
+		return err
+	case "down":
+		n, err := migrations.Down(ctx, db, steps)
+		fmt.Fprintf(w, "Reverted %d migration(s)\n", n)
+		return err
+	case "status":
+		statuses, dirty, err := migrations.Statuses(ctx, db)
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			state := "pending"
+			if status.Applied {
+				state = "applied"
+			}
+			fmt.Fprintf(w, "%d  %-8s %s\n", status.Version, state, status.Name)
+		}
+		if dirty {
+			fmt.Fprintf(w, "\nWARNING: database is dirty, fix it manually and retry\n")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown migration command `%s`", args[0])
+	}
+}
+
+// maintain updates energy summaries, costs and rollups and prunes old
+// frames, at an interval until the context is cancelled. Errors are logged
+// and retried at the next interval.
+func maintain(ctx context.Context, store store.Store, cfg Config) {
+	ticker := time.NewTicker(maintenanceInterval)
+	defer ticker.Stop()
+
+	for {
+		// Energy summaries and costs are updated first, since pruning depends
+		// on them.
+		now := time.Now()
+		if err := energy.UpdateAll(store, cfg.Location, now); err != nil {
+			log.Print(err)
+		} else if err := tariff.UpdateAll(store, &cfg.Tariffs, cfg.Location, now); err != nil {
+			log.Print(err)
+		} else if err := rollup.UpdateAll(store, cfg.Location, cfg.Retention, now); err != nil {
+			log.Print(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Run serves HTTP requests until the context is cancelled.
+func Run(ctx context.Context, cfg Config) error {
+	if cfg.BindAddr == "" {
+		cfg.BindAddr = DefaultBindAddr
+	}
+	if cfg.Location == nil {
+		cfg.Location = time.UTC
+	}
+
+	db, err := Connect(cfg.DatabaseURL)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if cfg.MigrateOnStartup {
+		n, err := migrations.Up(ctx, db)
+		if err != nil {
+			return err
+		}
+		log.Printf("Applied %d migration(s)", n)
+	}
+	if err := migrations.Check(ctx, db); errors.Is(err, migrations.ErrOutdated) {
+		return fmt.Errorf("%s: run `migrate up` or enable migrate on startup", err)
+	} else if err != nil {
+		return err
+	}
+
+	store := store.New(db)
+	var opts []handler.Option
+	if cfg.AllowUnauthenticated {
+		log.Printf("WARNING: accepting unauthenticated requests")
+		opts = append(opts, handler.AllowUnauthenticated())
+	}
+	validator := validate.New(cfg.Validation.AllRules(), validate.WithHistory(store.LatestFrame))
+	opts = append(opts, handler.WithValidator(validator), handler.WithLocation(cfg.Location))
+	handler := handler.New(store, opts...)
+	// The write timeout allows for series, energy and costs requests over long
+	// ranges.
+	srv := http.Server{
+		ReadTimeout:  time.Second * 3,
+		WriteTimeout: time.Second * 30,
+		Handler:      handler,
+		Addr:         cfg.BindAddr,
+	}
+
+	go maintain(ctx, store, cfg)
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("Listening on %s...", cfg.BindAddr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,411 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.netflux.io/rob/solar-toolkit/format"
+	"git.netflux.io/rob/solar-toolkit/gateway/auth"
+	"git.netflux.io/rob/solar-toolkit/gateway/energy"
+	"git.netflux.io/rob/solar-toolkit/gateway/rollup"
+	"git.netflux.io/rob/solar-toolkit/gateway/series"
+	"git.netflux.io/rob/solar-toolkit/gateway/tariff"
+	"git.netflux.io/rob/solar-toolkit/inverter"
+	"git.netflux.io/rob/solar-toolkit/validate"
+)
+
+const (
+	defaultRange       = 24 * time.Hour
+	defaultEnergyRange = 366 * 24 * time.Hour
+	defaultFrameLimit  = 1000
+	// MaxFrameLimit is the maximum number of frames returned by a single
+	// frames request.
+	MaxFrameLimit = 10000
+	// MaxSeriesFrames is the maximum number of frames read by a single series
+	// request, two weeks of frames at the default poll interval. Rolled-up
+	// ranges are read from the rollups and do not count towards it.
+	MaxSeriesFrames = 20000
+)
+
+// FramesResponse is the response to a latest or frames request. Each frame
+// is an object containing the timestamp and the selected fields.
+type FramesResponse struct {
+	SerialNumber string            `json:"serial_number"`
+	Frames       []json.RawMessage `json:"frames"`
+}
+
+// EnergyResponse is the response to an energy request.
+type EnergyResponse struct {
+	SerialNumber string           `json:"serial_number"`
+	Summaries    []energy.Summary `json:"summaries"`
+}
+
+// CostsResponse is the response to a costs request.
+type CostsResponse struct {
+	SerialNumber string        `json:"serial_number"`
+	Costs        []tariff.Cost `json:"costs"`
+}
+
+// SeriesResponse is the response to a series request.
+type SeriesResponse struct {
+	SerialNumber string             `json:"serial_number"`
+	Bucket       string             `json:"bucket"`
+	Aggregation  series.Aggregation `json:"aggregation"`
+	Timezone     string             `json:"timezone"`
+	Points       []series.Point     `json:"points"`
+}
+
+// RejectedResponse is the response to a rejected request.
+type RejectedResponse struct {
+	SerialNumber string          `json:"serial_number"`
+	Rejected     []RejectedCount `json:"rejected"`
+}
+
+// RejectedCount is the number of values of a field rejected with a policy
+// since the gateway started.
+type RejectedCount struct {
+	Field  string          `json:"field"`
+	Policy validate.Policy `json:"policy"`
+	Count  uint64          `json:"count"`
+}
+
+func (h *Handler) handleLatest(w http.ResponseWriter, r *http.Request, token *auth.Token) {
+	query := r.URL.Query()
+	serialNumber, ok := querySerialNumber(w, query, token)
+	if !ok {
+		return
+	}
+	fields, err := queryFields(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	frame, err := h.store.LatestFrame(serialNumber)
+	if err != nil {
+		log.Printf("error fetching latest frame: %v", err)
+		http.Error(w, "unexpected error", http.StatusInternalServerError)
+		return
+	}
+	if frame == nil {
+		http.Error(w, fmt.Sprintf("no data for device `%s`", serialNumber), http.StatusNotFound)
+		return
+	}
+
+	writeFrames(w, serialNumber, []*inverter.ETDataFrame{frame}, fields)
+}
+
+func (h *Handler) handleFrames(w http.ResponseWriter, r *http.Request, token *auth.Token) {
+	query := r.URL.Query()
+	serialNumber, ok := querySerialNumber(w, query, token)
+	if !ok {
+		return
+	}
+	fields, err := queryFields(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	from, to, err := queryRange(query, defaultRange)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultFrameLimit
+	if s := query.Get("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > MaxFrameLimit {
+			http.Error(w, fmt.Sprintf("invalid limit, must be between 1 and %d", MaxFrameLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	frames, err := h.store.Frames(serialNumber, from, to, limit)
+	if err != nil {
+		log.Printf("error fetching frames: %v", err)
+		http.Error(w, "unexpected error", http.StatusInternalServerError)
+		return
+	}
+
+	writeFrames(w, serialNumber, frames, fields)
+}
+
+func (h *Handler) handleSeries(w http.ResponseWriter, r *http.Request, token *auth.Token) {
+	query := r.URL.Query()
+	serialNumber, ok := querySerialNumber(w, query, token)
+	if !ok {
+		return
+	}
+	fields, err := queryFields(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	from, to, err := queryRange(query, defaultRange)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	bucket, err := series.ParseBucket(queryDefault(query, "bucket", "1h"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	agg, err := series.ParseAggregation(queryDefault(query, "agg", string(series.Avg)))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	loc, err := time.LoadLocation(queryDefault(query, "tz", "UTC"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("unknown timezone `%s`", query.Get("tz")), http.StatusBadRequest)
+		return
+	}
+
+	points, err := h.series(serialNumber, fields, bucket, agg, loc, from, to)
+	if errors.Is(err, errTooManyFrames) {
+		http.Error(w, fmt.Sprintf("too many frames in range, maximum is %d: use a shorter range, or a bucket of 5m or more", MaxSeriesFrames), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf("error fetching series: %v", err)
+		http.Error(w, "unexpected error", http.StatusInternalServerError)
+		return
+	}
+	if points == nil {
+		points = []series.Point{}
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(SeriesResponse{
+		SerialNumber: serialNumber,
+		Bucket:       bucket.String(),
+		Aggregation:  agg,
+		Timezone:     loc.String(),
+		Points:       points,
+	})
+}
+
+var errTooManyFrames = errors.New("too many frames")
+
+// series aggregates the fields of the device over [from, to). The part of the
+// range which has been rolled up is read from the rollups, since its frames
+// may have been pruned, and the rest from the frames. The Last aggregation
+// and buckets which are not made up of whole rollups are only read from the
+// frames.
+func (h *Handler) series(serialNumber string, fields []inverter.Field, bucket series.Bucket, agg series.Aggregation, loc *time.Location, from, to time.Time) ([]series.Point, error) {
+	var rollups []rollup.Rollup
+	res, ok := rollup.Resolution(bucket, loc, h.location, from, to)
+	if ok && agg != series.Last {
+		rolledUp, found, err := h.store.LatestRollup(serialNumber, rollup.Daily.String())
+		if err != nil {
+			return nil, err
+		}
+		if found && rolledUp.After(from) {
+			until := rolledUp
+			if to.Before(until) {
+				until = to
+			}
+			if rollups, err = h.store.Rollups(serialNumber, res.String(), from, until); err != nil {
+				return nil, err
+			}
+			from = until
+		}
+	}
+
+	var frames []*inverter.ETDataFrame
+	if from.Before(to) {
+		var err error
+		if frames, err = h.store.Frames(serialNumber, from, to, MaxSeriesFrames+1); err != nil {
+			return nil, err
+		}
+		if len(frames) > MaxSeriesFrames {
+			return nil, errTooManyFrames
+		}
+	}
+
+	if len(rollups) == 0 {
+		return series.Aggregate(frames, fields, bucket, agg, loc), nil
+	}
+	rollups = append(rollups, rollup.Compute(frames, fields, res, h.location)...)
+	return rollup.Series(rollups, fields, bucket, agg, loc), nil
+}
+
+func (h *Handler) handleEnergy(w http.ResponseWriter, r *http.Request, token *auth.Token) {
+	query := r.URL.Query()
+	serialNumber, ok := querySerialNumber(w, query, token)
+	if !ok {
+		return
+	}
+	from, to, err := queryRange(query, defaultEnergyRange)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	period, err := energy.ParsePeriod(queryDefault(query, "period", string(energy.Day)))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	summaries, err := h.store.Summaries(serialNumber, period, from, to)
+	if err != nil {
+		log.Printf("error fetching energy summaries: %v", err)
+		http.Error(w, "unexpected error", http.StatusInternalServerError)
+		return
+	}
+	if summaries == nil {
+		summaries = []energy.Summary{}
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(EnergyResponse{SerialNumber: serialNumber, Summaries: summaries})
+}
+
+func (h *Handler) handleCosts(w http.ResponseWriter, r *http.Request, token *auth.Token) {
+	query := r.URL.Query()
+	serialNumber, ok := querySerialNumber(w, query, token)
+	if !ok {
+		return
+	}
+	from, to, err := queryRange(query, defaultEnergyRange)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	period, err := energy.ParsePeriod(queryDefault(query, "period", string(energy.Day)))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Fetch every day of the last period starting before to, so that it is
+	// complete.
+	days, err := h.store.Costs(serialNumber, from, period.Next(period.Start(to.Add(-1), h.location)))
+	if err != nil {
+		log.Printf("error fetching costs: %v", err)
+		http.Error(w, "unexpected error", http.StatusInternalServerError)
+		return
+	}
+
+	costs := []tariff.Cost{}
+	for _, c := range tariff.Rollup(days, period, h.location) {
+		if !c.Start.Before(from) && c.Start.Before(to) {
+			costs = append(costs, c)
+		}
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(CostsResponse{SerialNumber: serialNumber, Costs: costs})
+}
+
+func (h *Handler) handleRejected(w http.ResponseWriter, r *http.Request, token *auth.Token) {
+	serialNumber, ok := querySerialNumber(w, r.URL.Query(), token)
+	if !ok {
+		return
+	}
+
+	resp := RejectedResponse{SerialNumber: serialNumber, Rejected: []RejectedCount{}}
+	if h.validator != nil {
+		for _, c := range h.validator.Rejected() {
+			if c.SerialNumber == serialNumber {
+				resp.Rejected = append(resp.Rejected, RejectedCount{Field: c.Field, Policy: c.Policy, Count: c.N})
+			}
+		}
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// querySerialNumber returns the device requested, which defaults to the
+// device of the token. It writes an error response and returns false if the
+// device is missing or the token is not valid for it.
+func querySerialNumber(w http.ResponseWriter, query url.Values, token *auth.Token) (string, bool) {
+	serialNumber := query.Get("device")
+	if !authorize(w, token, &serialNumber) {
+		return "", false
+	}
+	if serialNumber == "" {
+		http.Error(w, "missing device", http.StatusBadRequest)
+		return "", false
+	}
+	return serialNumber, true
+}
+
+// queryFields returns the fields matching the comma-separated patterns of
+// the fields parameter, or every field if it is absent.
+func queryFields(query url.Values) ([]inverter.Field, error) {
+	s := query.Get("fields")
+	if s == "" {
+		return inverter.Fields(), nil
+	}
+
+	return inverter.MatchFields(strings.Split(s, ","))
+}
+
+// queryRange returns the time range of the from and to parameters, which
+// defaults to the period of length d ending now. Errors are safe to send to
+// the client.
+func queryRange(query url.Values, d time.Duration) (time.Time, time.Time, error) {
+	to := time.Now()
+	if s := query.Get("to"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid to `%s`, expected RFC 3339", s)
+		}
+		to = t
+	}
+
+	from := to.Add(-d)
+	if s := query.Get("from"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid from `%s`, expected RFC 3339", s)
+		}
+		from = t
+	}
+
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, errors.New("from must be before to")
+	}
+
+	return from, to, nil
+}
+
+func queryDefault(query url.Values, key, fallback string) string {
+	if s := query.Get(key); s != "" {
+		return s
+	}
+	return fallback
+}
+
+func writeFrames(w http.ResponseWriter, serialNumber string, frames []*inverter.ETDataFrame, fields []inverter.Field) {
+	resp := FramesResponse{SerialNumber: serialNumber, Frames: make([]json.RawMessage, 0, len(frames))}
+	for _, frame := range frames {
+		var buf bytes.Buffer
+		if err := format.Write(&buf, format.JSON, frame, fields); err != nil {
+			log.Printf("error encoding frame: %v", err)
+			http.Error(w, "unexpected error", http.StatusInternalServerError)
+			return
+		}
+		resp.Frames = append(resp.Frames, buf.Bytes())
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,332 @@
+package handler_test
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"git.netflux.io/rob/solar-toolkit/gateway/energy"
+	"git.netflux.io/rob/solar-toolkit/gateway/handler"
+	"git.netflux.io/rob/solar-toolkit/gateway/rollup"
+	"git.netflux.io/rob/solar-toolkit/gateway/tariff"
+	"git.netflux.io/rob/solar-toolkit/inverter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandlerAPI(t *testing.T) {
+	frame := func(ts string, pvPower, batteryVoltage float64) *inverter.ETDataFrame {
+		timestamp, err := time.Parse(time.RFC3339, ts)
+		require.NoError(t, err)
+		return &inverter.ETDataFrame{
+			SerialNumber: "12345",
+			ETRuntimeData: &inverter.ETRuntimeData{
+				Timestamp:      timestamp,
+				PVPower:        inverter.Power(pvPower),
+				BatteryVoltage: inverter.Voltage(batteryVoltage),
+			},
+		}
+	}
+
+	frames := []*inverter.ETDataFrame{
+		frame("2022-07-14T10:00:00Z", 100, 52),
+		frame("2022-07-14T10:30:00Z", 300, 53),
+		frame("2022-07-14T11:15:00Z", 50, 51),
+	}
+
+	summaries := []energy.Summary{
+		{Period: energy.Day, Start: time.Date(2022, 7, 14, 0, 0, 0, 0, time.UTC), Generation: 20, Export: 5, Import: 2, Consumption: 17, SelfConsumption: 15, SelfSufficiency: 15.0 / 17},
+		{Period: energy.Month, Start: time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC), Generation: 400, Export: 100, Import: 50, Consumption: 350, SelfConsumption: 300, SelfSufficiency: 300.0 / 350},
+	}
+
+	costs := []tariff.Cost{
+		{Period: energy.Day, Start: time.Date(2022, 7, 14, 0, 0, 0, 0, time.UTC), Currency: "EUR", Import: []tariff.Charge{{Rate: "peak", Price: 0.3, Energy: 5, Amount: 1.5}}, Export: []tariff.Charge{}, Days: 1, StandingCharge: 0.25, Savings: 1},
+		{Period: energy.Day, Start: time.Date(2022, 7, 15, 0, 0, 0, 0, time.UTC), Currency: "EUR", Import: []tariff.Charge{}, Export: []tariff.Charge{{Rate: "export", Price: 0.05, Energy: 10, Amount: 0.5}}, Days: 1, StandingCharge: 0.25, Savings: 2},
+		{Period: energy.Day, Start: time.Date(2022, 8, 1, 0, 0, 0, 0, time.UTC), Currency: "EUR", Import: []tariff.Charge{}, Export: []tariff.Charge{}, Days: 1, StandingCharge: 0.25},
+	}
+	for i := range costs {
+		costs[i].Derive()
+	}
+
+	testCases := []struct {
+		name           string
+		httpMethod     string
+		path           string
+		token          string
+		noAuth         bool
+		storeErr       error
+		wantStatusCode int
+		wantBody       string
+	}{
+		{
+			name:           "latest",
+			path:           "/api/latest?fields=pv_power",
+			wantStatusCode: http.StatusOK,
+			wantBody:       `{"serial_number":"12345","frames":[{"timestamp":"2022-07-14T11:15:00Z","pv_power":50}]}` + "\n",
+		},
+		{
+			name:           "latest, explicit device",
+			path:           "/api/latest?device=12345&fields=pv_power",
+			wantStatusCode: http.StatusOK,
+			wantBody:       `{"serial_number":"12345","frames":[{"timestamp":"2022-07-14T11:15:00Z","pv_power":50}]}` + "\n",
+		},
+		{
+			name:           "latest, other device",
+			path:           "/api/latest?device=67890",
+			wantStatusCode: http.StatusForbidden,
+			wantBody:       "token is not valid for device `67890`\n",
+		},
+		{
+			name:           "latest, unauthenticated",
+			path:           "/api/latest",
+			token:          "-",
+			wantStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:           "latest, authentication disabled, missing device",
+			path:           "/api/latest",
+			token:          "-",
+			noAuth:         true,
+			wantStatusCode: http.StatusBadRequest,
+			wantBody:       "missing device\n",
+		},
+		{
+			name:           "latest, store error",
+			path:           "/api/latest",
+			storeErr:       errors.New("boom"),
+			wantStatusCode: http.StatusInternalServerError,
+			wantBody:       "unexpected error\n",
+		},
+		{
+			name:           "latest, method not allowed",
+			httpMethod:     http.MethodPost,
+			path:           "/api/latest",
+			wantStatusCode: http.StatusMethodNotAllowed,
+		},
+		{
+			name:           "frames",
+			path:           "/api/frames?from=2022-07-14T10:00:00Z&to=2022-07-14T11:00:00Z&fields=pv_power,battery_v*",
+			wantStatusCode: http.StatusOK,
+			wantBody:       `{"serial_number":"12345","frames":[{"timestamp":"2022-07-14T10:00:00Z","pv_power":100,"battery_voltage":52},{"timestamp":"2022-07-14T10:30:00Z","pv_power":300,"battery_voltage":53}]}` + "\n",
+		},
+		{
+			name:           "frames, limit",
+			path:           "/api/frames?from=2022-07-14T10:00:00Z&to=2022-07-14T12:00:00Z&fields=pv_power&limit=1",
+			wantStatusCode: http.StatusOK,
+			wantBody:       `{"serial_number":"12345","frames":[{"timestamp":"2022-07-14T10:00:00Z","pv_power":100}]}` + "\n",
+		},
+		{
+			name:           "frames, empty",
+			path:           "/api/frames?from=2023-01-01T00:00:00Z&to=2023-01-02T00:00:00Z",
+			wantStatusCode: http.StatusOK,
+			wantBody:       `{"serial_number":"12345","frames":[]}` + "\n",
+		},
+		{
+			name:           "frames, invalid limit",
+			path:           "/api/frames?limit=0",
+			wantStatusCode: http.StatusBadRequest,
+			wantBody:       "invalid limit, must be between 1 and 10000\n",
+		},
+		{
+			name:           "frames, invalid from",
+			path:           "/api/frames?from=yesterday",
+			wantStatusCode: http.StatusBadRequest,
+			wantBody:       "invalid from `yesterday`, expected RFC 3339\n",
+		},
+		{
+			name:           "frames, from after to",
+			path:           "/api/frames?from=2022-07-14T12:00:00Z&to=2022-07-14T10:00:00Z",
+			wantStatusCode: http.StatusBadRequest,
+			wantBody:       "from must be before to\n",
+		},
+		{
+			name:           "frames, unknown field",
+			path:           "/api/frames?fields=foo",
+			wantStatusCode: http.StatusBadRequest,
+			wantBody:       "unknown field `foo`\n",
+		},
+		{
+			name:           "series",
+			path:           "/api/series?from=2022-07-14T10:00:00Z&to=2022-07-14T12:00:00Z&fields=pv_power&bucket=1h&agg=max",
+			wantStatusCode: http.StatusOK,
+			wantBody:       `{"serial_number":"12345","bucket":"1h","aggregation":"max","timezone":"UTC","points":[{"start":"2022-07-14T10:00:00Z","values":{"pv_power":300}},{"start":"2022-07-14T11:00:00Z","values":{"pv_power":50}}]}` + "\n",
+		},
+		{
+			name:           "series, defaults",
+			path:           "/api/series?from=2022-07-14T10:00:00Z&to=2022-07-14T12:00:00Z&fields=pv_power",
+			wantStatusCode: http.StatusOK,
+			wantBody:       `{"serial_number":"12345","bucket":"1h","aggregation":"avg","timezone":"UTC","points":[{"start":"2022-07-14T10:00:00Z","values":{"pv_power":200}},{"start":"2022-07-14T11:00:00Z","values":{"pv_power":50}}]}` + "\n",
+		},
+		{
+			name:           "series, timezone",
+			path:           "/api/series?from=2022-07-14T10:00:00Z&to=2022-07-14T12:00:00Z&fields=pv_power&bucket=1d&agg=last&tz=Europe/Madrid",
+			wantStatusCode: http.StatusOK,
+			wantBody:       `{"serial_number":"12345","bucket":"1d","aggregation":"last","timezone":"Europe/Madrid","points":[{"start":"2022-07-14T00:00:00+02:00","values":{"pv_power":50}}]}` + "\n",
+		},
+		{
+			name:           "series, empty",
+			path:           "/api/series?from=2023-01-01T00:00:00Z&to=2023-01-02T00:00:00Z",
+			wantStatusCode: http.StatusOK,
+			wantBody:       `{"serial_number":"12345","bucket":"1h","aggregation":"avg","timezone":"UTC","points":[]}` + "\n",
+		},
+		{
+			name:           "series, invalid bucket",
+			path:           "/api/series?bucket=7m",
+			wantStatusCode: http.StatusBadRequest,
+			wantBody:       "invalid bucket `7m`: minutes must divide an hour\n",
+		},
+		{
+			name:           "series, invalid aggregation",
+			path:           "/api/series?agg=median",
+			wantStatusCode: http.StatusBadRequest,
+			wantBody:       "unknown aggregation `median`\n",
+		},
+		{
+			name:           "energy",
+			path:           "/api/energy?period=month&from=2022-01-01T00:00:00Z&to=2023-01-01T00:00:00Z",
+			wantStatusCode: http.StatusOK,
+			wantBody:       `{"serial_number":"12345","summaries":[{"period":"month","start":"2022-07-01T00:00:00Z","generation":400,"export":100,"import":50,"consumption":350,"battery_charge":0,"battery_discharge":0,"self_consumption":300,"self_sufficiency":0.8571428571428571}]}` + "\n",
+		},
+		{
+			name:           "energy, empty",
+			path:           "/api/energy?period=year&from=2022-01-01T00:00:00Z&to=2023-01-01T00:00:00Z",
+			wantStatusCode: http.StatusOK,
+			wantBody:       `{"serial_number":"12345","summaries":[]}` + "\n",
+		},
+		{
+			name:           "energy, invalid period",
+			path:           "/api/energy?period=week",
+			wantStatusCode: http.StatusBadRequest,
+			wantBody:       "unknown period `week`\n",
+		},
+		{
+			name:           "costs",
+			path:           "/api/costs?period=month&from=2022-07-01T00:00:00Z&to=2022-08-01T00:00:00Z",
+			wantStatusCode: http.StatusOK,
+			wantBody:       `{"serial_number":"12345","costs":[{"period":"month","start":"2022-07-01T00:00:00Z","currency":"EUR","import":[{"rate":"peak","price":0.3,"energy":5,"amount":1.5}],"export":[{"rate":"export","price":0.05,"energy":10,"amount":0.5}],"days":2,"standing_charge":0.5,"import_cost":1.5,"export_revenue":0.5,"total":1.5,"savings":3}]}` + "\n",
+		},
+		{
+			name:           "costs, days",
+			path:           "/api/costs?from=2022-07-15T00:00:00Z&to=2022-07-16T00:00:00Z",
+			wantStatusCode: http.StatusOK,
+			wantBody:       `{"serial_number":"12345","costs":[{"period":"day","start":"2022-07-15T00:00:00Z","currency":"EUR","import":[],"export":[{"rate":"export","price":0.05,"energy":10,"amount":0.5}],"days":1,"standing_charge":0.25,"import_cost":0,"export_revenue":0.5,"total":-0.25,"savings":2}]}` + "\n",
+		},
+		{
+			name:           "costs, partial period",
+			path:           "/api/costs?period=month&from=2022-07-15T00:00:00Z&to=2022-08-02T00:00:00Z",
+			wantStatusCode: http.StatusOK,
+			wantBody:       `{"serial_number":"12345","costs":[{"period":"month","start":"2022-08-01T00:00:00Z","currency":"EUR","import":[],"export":[],"days":1,"standing_charge":0.25,"import_cost":0,"export_revenue":0,"total":0.25,"savings":0}]}` + "\n",
+		},
+		{
+			name:           "costs, store error",
+			path:           "/api/costs",
+			storeErr:       errors.New("boom"),
+			wantStatusCode: http.StatusInternalServerError,
+			wantBody:       "unexpected error\n",
+		},
+		{
+			name:           "series, invalid timezone",
+			path:           "/api/series?tz=Mars/Olympus",
+			wantStatusCode: http.StatusBadRequest,
+			wantBody:       "unknown timezone `Mars/Olympus`\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := mockStore{err: tc.storeErr, frames: frames, summaries: summaries, costs: costs}
+			var opts []handler.Option
+			if tc.noAuth {
+				opts = append(opts, handler.AllowUnauthenticated())
+			}
+			h := handler.New(&store, opts...)
+
+			httpMethod := tc.httpMethod
+			if httpMethod == "" {
+				httpMethod = http.MethodGet
+			}
+			req := httptest.NewRequest(httpMethod, tc.path, nil)
+			if tc.token != "-" {
+				req.Header.Set("authorization", "Bearer "+validToken)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			resp := rec.Result()
+			defer resp.Body.Close()
+
+			assert.Equal(t, tc.wantStatusCode, resp.StatusCode)
+
+			if tc.wantBody != "" {
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				assert.Equal(t, tc.wantBody, string(body))
+			}
+		})
+	}
+}
+
+func TestHandlerSeriesBudget(t *testing.T) {
+	// One frame per second, more than a series request may read.
+	start := time.Date(2022, 7, 14, 0, 0, 0, 0, time.UTC)
+	var frames []*inverter.ETDataFrame
+	for i := 0; i <= handler.MaxSeriesFrames; i++ {
+		frames = append(frames, &inverter.ETDataFrame{
+			SerialNumber:  "12345",
+			ETRuntimeData: &inverter.ETRuntimeData{Timestamp: start.Add(time.Duration(i) * time.Second), PVPower: 100},
+		})
+	}
+
+	// The range has been rolled up, since the latest daily rollup starts the
+	// next day.
+	rollups := []rollup.Rollup{{Resolution: "1d", Start: start.AddDate(0, 0, 1)}}
+	for i := 0; i < 6; i++ {
+		rollups = append(rollups, rollup.Rollup{Resolution: "1h", Start: start.Add(time.Duration(i) * time.Hour), Avg: map[string]float64{"pv_power": 100}})
+	}
+
+	testCases := []struct {
+		name           string
+		path           string
+		rollups        []rollup.Rollup
+		wantStatusCode int
+		wantBody       string
+	}{
+		{
+			name:           "frames",
+			path:           "/api/series?from=2022-07-14T00:00:00Z&to=2022-07-14T06:00:00Z&fields=pv_power&bucket=1h",
+			wantStatusCode: http.StatusBadRequest,
+			wantBody:       "too many frames in range, maximum is 20000: use a shorter range, or a bucket of 5m or more\n",
+		},
+		{
+			name:           "rollups",
+			path:           "/api/series?from=2022-07-14T00:00:00Z&to=2022-07-14T06:00:00Z&fields=pv_power&bucket=1h",
+			rollups:        rollups,
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:           "bucket finer than rollups",
+			path:           "/api/series?from=2022-07-14T00:00:00Z&to=2022-07-14T06:00:00Z&fields=pv_power&bucket=1m",
+			rollups:        rollups,
+			wantStatusCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := mockStore{frames: frames, rollups: tc.rollups}
+			h := handler.New(&store)
+
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			req.Header.Set("authorization", "Bearer "+validToken)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.wantStatusCode, rec.Code)
+			if tc.wantBody != "" {
+				assert.Equal(t, tc.wantBody, rec.Body.String())
+			}
+		})
+	}
+}
@@ -1,25 +1,122 @@
 package handler
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net/http"
+	"strconv"
+	"time"
 
+	"git.netflux.io/rob/solar-toolkit/gateway/api"
+	"git.netflux.io/rob/solar-toolkit/gateway/auth"
+	"git.netflux.io/rob/solar-toolkit/gateway/energy"
+	"git.netflux.io/rob/solar-toolkit/gateway/rollup"
+	"git.netflux.io/rob/solar-toolkit/gateway/tariff"
 	"git.netflux.io/rob/solar-toolkit/inverter"
+	"git.netflux.io/rob/solar-toolkit/validate"
 )
 
-const timestampMinimumYear = 2022
+const (
+	timestampMinimumYear = 2022
+
+	maxFrameBody         = 1 << 20
+	maxBatchBody         = 16 << 20
+	maxIdempotencyKeyLen = 255
+)
+
+// ErrDuplicate is returned by a Store when a frame from the same inverter
+// with the same timestamp has already been stored.
+var ErrDuplicate = errors.New("duplicate frame")
 
 type Store interface {
+	// InsertDataFrame inserts the frame, returning ErrDuplicate if it was
+	// already stored.
 	InsertDataFrame(*inverter.ETDataFrame) error
+	// InsertDataFrames inserts the frames in a single transaction. Frames
+	// which could not be inserted are reported in the returned slice of
+	// errors, which is indexed like frames, with ErrDuplicate for frames
+	// which were already stored. The second return value is non-nil if the
+	// batch failed as a whole.
+	InsertDataFrames([]*inverter.ETDataFrame) ([]error, error)
+	// RegisterDevice creates or updates a device, keyed by serial number.
+	RegisterDevice(*inverter.DeviceInfo) error
+	// LookupToken returns the unrevoked API token with the given hash, or nil
+	// if none exists.
+	LookupToken(tokenHash string) (*auth.Token, error)
+	// IdempotentResponse returns the stored response for an idempotency key.
+	IdempotentResponse(key string) ([]byte, bool, error)
+	// SaveIdempotentResponse stores the response for an idempotency key.
+	SaveIdempotentResponse(key string, response []byte) error
+	// LatestFrame returns the most recent frame of the device, or nil if it
+	// has none.
+	LatestFrame(serialNumber string) (*inverter.ETDataFrame, error)
+	// Frames returns the frames of the device with timestamps in [from, to),
+	// ordered by timestamp. If limit is greater than zero, at most limit
+	// frames are returned.
+	Frames(serialNumber string, from, to time.Time, limit int) ([]*inverter.ETDataFrame, error)
+	// Summaries returns the energy summaries of the device for the period
+	// with starts in [from, to), ordered by start.
+	Summaries(serialNumber string, period energy.Period, from, to time.Time) ([]energy.Summary, error)
+	// Costs returns the daily costs of the device with starts in [from, to),
+	// ordered by start.
+	Costs(serialNumber string, from, to time.Time) ([]tariff.Cost, error)
+	// LatestRollup returns the start of the most recent rollup of the device
+	// at the resolution, or false if there is none.
+	LatestRollup(serialNumber string, resolution string) (time.Time, bool, error)
+	// Rollups returns the rollups of the device at the resolution with starts
+	// in [from, to), ordered by start.
+	Rollups(serialNumber string, resolution string, from, to time.Time) ([]rollup.Rollup, error)
 }
 
 type Handler struct {
-	store Store
+	store                Store
+	allowUnauthenticated bool
+	validator            *validate.Validator
+	location             *time.Location
 }
 
-func New(store Store) *Handler { return &Handler{store: store} }
+// Option configures a Handler.
+type Option func(*Handler)
+
+// AllowUnauthenticated disables authentication, e.g. while tokens are being
+// rolled out to existing daemons. Requests which do send a token are still
+// checked.
+func AllowUnauthenticated() Option {
+	return func(h *Handler) { h.allowUnauthenticated = true }
+}
+
+// WithValidator checks frames with the validator before they are stored.
+// Frames which must be dropped are rejected as invalid.
+func WithValidator(validator *validate.Validator) Option {
+	return func(h *Handler) { h.validator = validator }
+}
+
+// WithLocation sets the timezone in which the monthly and yearly costs
+// start and the rollups were computed, which should be that of the daily
+// costs and rollups. Defaults to UTC.
+func WithLocation(loc *time.Location) Option {
+	return func(h *Handler) { h.location = loc }
+}
+
+func New(store Store, opts ...Option) *Handler {
+	h := Handler{store: store, location: time.UTC}
+	for _, opt := range opts {
+		opt(&h)
+	}
+	return &h
+}
+
+// handlerFunc handles an authenticated request. The token is nil if the
+// request was not authenticated and authentication is disabled.
+type handlerFunc func(http.ResponseWriter, *http.Request, *auth.Token)
+
+var errInvalidTimestamp = errors.New("invalid timestamp")
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet && r.URL.Path == "/healthz" {
@@ -28,48 +125,335 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if r.Method != http.MethodPost {
+	var handle handlerFunc
+	method := http.MethodPost
+	switch r.URL.Path {
+	case "/gateway/et_runtime_data":
+		handle = h.handleFrame
+	case "/gateway/et_runtime_data/batch":
+		handle = h.handleBatch
+	case "/gateway/devices":
+		handle = h.handleDevice
+	case "/api/latest":
+		handle, method = h.handleLatest, http.MethodGet
+	case "/api/frames":
+		handle, method = h.handleFrames, http.MethodGet
+	case "/api/series":
+		handle, method = h.handleSeries, http.MethodGet
+	case "/api/energy":
+		handle, method = h.handleEnergy, http.MethodGet
+	case "/api/costs":
+		handle, method = h.handleCosts, http.MethodGet
+	case "/api/rejected":
+		handle, method = h.handleRejected, http.MethodGet
+	default:
+		http.Error(w, "endpoint not found", http.StatusNotFound)
+		return
+	}
+
+	if r.Method != method {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	if r.URL.Path != "/gateway/et_runtime_data" {
-		http.Error(w, "endpoint not found", http.StatusNotFound)
+	token, ok := h.authenticate(w, r)
+	if !ok {
 		return
 	}
 
-	body, err := io.ReadAll(r.Body)
+	// Reads are naturally idempotent.
+	key := r.Header.Get(api.IdempotencyKeyHeader)
+	if key == "" || method != http.MethodPost {
+		handle(w, r, token)
+		return
+	}
+	if len(key) > maxIdempotencyKeyLen {
+		http.Error(w, "invalid idempotency key", http.StatusBadRequest)
+		return
+	}
+
+	// Scope keys to the token, so that one client can't replay the responses
+	// of another.
+	scope := "-"
+	if token != nil {
+		scope = strconv.FormatInt(token.ID, 10)
+	}
+	h.handleIdempotent(w, r, scope+" "+r.URL.Path+" "+key, token, handle)
+}
+
+// authenticate returns the token of the request, writing a 401 response and
+// returning false if it is missing or invalid.
+func (h *Handler) authenticate(w http.ResponseWriter, r *http.Request) (*auth.Token, bool) {
+	tokenString, ok := auth.RequestToken(r)
+	if !ok {
+		if h.allowUnauthenticated {
+			return nil, true
+		}
+		unauthorized(w)
+		return nil, false
+	}
+
+	token, err := h.store.LookupToken(auth.HashToken(tokenString))
 	if err != nil {
-		log.Printf("could not read body: %v", err)
+		log.Printf("error fetching token: %v", err)
 		http.Error(w, "unexpected error", http.StatusInternalServerError)
-		return
+		return nil, false
+	}
+	if token == nil {
+		unauthorized(w)
+		return nil, false
 	}
 
-	var runtimeData inverter.ETRuntimeData
-	err = json.Unmarshal(body, &runtimeData)
+	return token, true
+}
+
+func unauthorized(w http.ResponseWriter) {
+	w.Header().Set("www-authenticate", `Bearer realm="solar-toolkit"`)
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+}
+
+// authorize checks that the token is bound to the serial number, writing a
+// 403 response and returning false if not. An empty serial number, sent by
+// older daemons, is replaced with the token's serial number.
+func authorize(w http.ResponseWriter, token *auth.Token, serialNumber *string) bool {
+	if err := authorized(token, serialNumber); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// authorized is like authorize, but returns an error safe to send to the
+// client rather than writing a response.
+func authorized(token *auth.Token, serialNumber *string) error {
+	if token == nil {
+		return nil
+	}
+	if *serialNumber == "" {
+		*serialNumber = token.SerialNumber
+	}
+	if *serialNumber != token.SerialNumber {
+		return fmt.Errorf("token is not valid for device `%s`", *serialNumber)
+	}
+	return nil
+}
+
+// handleIdempotent replays the stored response if the key has been seen
+// before, and otherwise handles the request and stores a successful
+// response. Since inserting a frame is itself idempotent, it does not matter
+// if concurrent requests with the same key are both handled.
+func (h *Handler) handleIdempotent(w http.ResponseWriter, r *http.Request, key string, token *auth.Token, handle handlerFunc) {
+	response, ok, err := h.store.IdempotentResponse(key)
 	if err != nil {
-		log.Printf("could not unmarshal runtime data body: %v", err)
+		log.Printf("error fetching idempotency key: %v", err)
 		http.Error(w, "unexpected error", http.StatusInternalServerError)
 		return
 	}
+	if ok {
+		w.Header().Set(api.IdempotentReplayedHeader, "true")
+		if json.Valid(response) {
+			w.Header().Set("content-type", "application/json")
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(response)
+		return
+	}
+
+	buf := bufferedResponse{header: w.Header()}
+	handle(&buf, r, token)
+	buf.WriteHeader(http.StatusOK)
+
+	if buf.code == http.StatusOK {
+		if err := h.store.SaveIdempotentResponse(key, buf.body.Bytes()); err != nil {
+			log.Printf("error saving idempotency key: %v", err)
+		}
+	}
+
+	w.WriteHeader(buf.code)
+	buf.body.WriteTo(w)
+}
+
+// bufferedResponse is a http.ResponseWriter which buffers the response body,
+// so that it can be stored before being written.
+type bufferedResponse struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header { return b.header }
+
+func (b *bufferedResponse) WriteHeader(code int) {
+	if b.code == 0 {
+		b.code = code
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	return b.body.Write(p)
+}
+
+func (h *Handler) handleFrame(w http.ResponseWriter, r *http.Request, token *auth.Token) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxFrameBody))
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		log.Printf("could not read body: %v", err)
+		http.Error(w, "unexpected error", http.StatusInternalServerError)
+		return
+	}
+
+	dataFrame, err := decodeFrame(body)
+	if errors.Is(err, errInvalidTimestamp) {
+		log.Printf("invalid timestamp: %v", dataFrame.Timestamp)
+		http.Error(w, "invalid data", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf("could not unmarshal body: %v", err)
+		http.Error(w, "invalid data", http.StatusBadRequest)
+		return
+	}
 
-	if runtimeData.Timestamp.Year() < timestampMinimumYear {
-		log.Printf("invalid timestamp: %v", runtimeData.Timestamp)
+	if !authorize(w, token, &dataFrame.SerialNumber) {
+		return
+	}
+
+	if !h.validate(dataFrame) {
 		http.Error(w, "invalid data", http.StatusBadRequest)
 		return
 	}
 
-	var meterData inverter.ETMeterData
-	err = json.Unmarshal(body, &meterData)
-	if err != nil {
-		log.Printf("could not unmarshal meterData body: %v", err)
+	err = h.store.InsertDataFrame(dataFrame)
+	if errors.Is(err, ErrDuplicate) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("duplicate\n"))
+		return
+	} else if err != nil {
+		log.Printf("error storing data: %v", err)
 		http.Error(w, "unexpected error", http.StatusInternalServerError)
 		return
 	}
 
-	dataFrame := inverter.ETDataFrame{ETRuntimeData: &runtimeData, ETMeterData: &meterData}
-	if err = h.store.InsertDataFrame(&dataFrame); err != nil {
-		log.Printf("error storing data: %v", err)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK\n"))
+}
+
+// handleBatch accepts either a JSON array of frames, or a stream of
+// newline-delimited JSON frames if the content type is
+// application/x-ndjson.
+func (h *Handler) handleBatch(w http.ResponseWriter, r *http.Request, token *auth.Token) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBatchBody))
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		log.Printf("could not read body: %v", err)
+		http.Error(w, "unexpected error", http.StatusInternalServerError)
+		return
+	}
+
+	var items []json.RawMessage
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("content-type"))
+	if mediaType == "application/x-ndjson" {
+		items, err = splitNDJSON(body)
+	} else {
+		err = json.Unmarshal(body, &items)
+	}
+	if err != nil {
+		http.Error(w, "invalid batch", http.StatusBadRequest)
+		return
+	}
+
+	if len(items) > api.MaxBatchSize {
+		http.Error(w, fmt.Sprintf("too many frames, maximum is %d", api.MaxBatchSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	results := make([]api.BatchResult, len(items))
+	frames := make([]*inverter.ETDataFrame, 0, len(items))
+	indexes := make([]int, 0, len(items))
+	for i, item := range items {
+		frame, err := decodeFrame(item)
+		if errors.Is(err, errInvalidTimestamp) {
+			results[i] = api.BatchResult{Status: api.StatusRejected, Error: "invalid timestamp"}
+			continue
+		} else if err != nil {
+			results[i] = api.BatchResult{Status: api.StatusRejected, Error: "invalid frame"}
+			continue
+		}
+		// Frames of other devices are rejected individually, so that the rest
+		// of the batch is stored.
+		if err := authorized(token, &frame.SerialNumber); err != nil {
+			results[i] = api.BatchResult{Status: api.StatusRejected, Error: err.Error()}
+			continue
+		}
+		if !h.validate(frame) {
+			results[i] = api.BatchResult{Status: api.StatusRejected, Error: "implausible frame"}
+			continue
+		}
+		frames = append(frames, frame)
+		indexes = append(indexes, i)
+	}
+
+	if len(frames) > 0 {
+		errs, err := h.store.InsertDataFrames(frames)
+		if err != nil {
+			log.Printf("error storing batch: %v", err)
+			http.Error(w, "unexpected error", http.StatusInternalServerError)
+			return
+		}
+		for j, i := range indexes {
+			if errors.Is(errs[j], ErrDuplicate) {
+				results[i] = api.BatchResult{Status: api.StatusDuplicate}
+				continue
+			}
+			if errs[j] != nil {
+				log.Printf("error storing data: %v", errs[j])
+				results[i] = api.BatchResult{Status: api.StatusRejected, Error: "could not store frame"}
+				continue
+			}
+			results[i] = api.BatchResult{Status: api.StatusAccepted}
+		}
+	}
+
+	resp := api.BatchResponse{Results: results}
+	for _, result := range results {
+		switch result.Status {
+		case api.StatusAccepted:
+			resp.Accepted++
+		case api.StatusDuplicate:
+			resp.Duplicates++
+		default:
+			resp.Rejected++
+		}
+	}
+
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (h *Handler) handleDevice(w http.ResponseWriter, r *http.Request, token *auth.Token) {
+	var deviceInfo inverter.DeviceInfo
+	if err := json.NewDecoder(r.Body).Decode(&deviceInfo); err != nil {
+		http.Error(w, "invalid data", http.StatusBadRequest)
+		return
+	}
+
+	if deviceInfo.SerialNumber == "" {
+		http.Error(w, "missing serial number", http.StatusBadRequest)
+		return
+	}
+	if !authorize(w, token, &deviceInfo.SerialNumber) {
+		return
+	}
+
+	if err := h.store.RegisterDevice(&deviceInfo); err != nil {
+		log.Printf("error registering device: %v", err)
 		http.Error(w, "unexpected error", http.StatusInternalServerError)
 		return
 	}
@@ -77,3 +461,57 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("OK\n"))
 }
+
+// validate checks the frame with the validator, if any, logging implausible
+// values. It returns false if the frame must be dropped.
+func (h *Handler) validate(frame *inverter.ETDataFrame) bool {
+	if h.validator == nil {
+		return true
+	}
+
+	result := h.validator.Check(frame)
+	if result.Drop {
+		log.Printf("%s: dropping implausible frame: %s", frame.SerialNumber, result)
+		return false
+	}
+	if len(result.Violations) > 0 {
+		log.Printf("%s: implausible values: %s", frame.SerialNumber, result)
+	}
+	return true
+}
+
+func decodeFrame(p []byte) (*inverter.ETDataFrame, error) {
+	frame := inverter.ETDataFrame{
+		ETRuntimeData: &inverter.ETRuntimeData{},
+		ETMeterData:   &inverter.ETMeterData{},
+	}
+	if err := json.Unmarshal(p, &frame); err != nil {
+		return nil, err
+	}
+
+	// Frames from older daemons lack the power flows, and carry a house
+	// consumption computed from the raw battery registers.
+	if !frame.HasFlows() {
+		frame.DeriveFlows()
+	}
+
+	if frame.Timestamp.Year() < timestampMinimumYear {
+		return &frame, errInvalidTimestamp
+	}
+
+	return &frame, nil
+}
+
+func splitNDJSON(p []byte) ([]json.RawMessage, error) {
+	var items []json.RawMessage
+	scanner := bufio.NewScanner(bytes.NewReader(p))
+	scanner.Buffer(nil, maxBatchBody)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		items = append(items, json.RawMessage(bytes.Clone(line)))
+	}
+	return items, scanner.Err()
+}
@@ -7,28 +7,170 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
+	"git.netflux.io/rob/solar-toolkit/gateway/api"
+	"git.netflux.io/rob/solar-toolkit/gateway/auth"
+	"git.netflux.io/rob/solar-toolkit/gateway/energy"
 	"git.netflux.io/rob/solar-toolkit/gateway/handler"
+	"git.netflux.io/rob/solar-toolkit/gateway/rollup"
+	"git.netflux.io/rob/solar-toolkit/gateway/tariff"
 	"git.netflux.io/rob/solar-toolkit/inverter"
+	"git.netflux.io/rob/solar-toolkit/validate"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
+const validToken = "stk_valid"
+
 type mockStore struct {
-	err error
+	err       error
+	itemErr   func(*inverter.ETDataFrame) error
+	inserted  []*inverter.ETDataFrame
+	responses map[string][]byte
+	frames    []*inverter.ETDataFrame
+	summaries []energy.Summary
+	costs     []tariff.Cost
+	rollups   []rollup.Rollup
+}
+
+func (s *mockStore) InsertDataFrame(frame *inverter.ETDataFrame) error {
+	if s.err == nil && s.itemErr != nil {
+		return s.itemErr(frame)
+	}
+	if s.err == nil {
+		s.inserted = append(s.inserted, frame)
+	}
+	return s.err
 }
 
-func (s *mockStore) InsertDataFrame(*inverter.ETDataFrame) error {
+func (s *mockStore) LookupToken(tokenHash string) (*auth.Token, error) {
+	if tokenHash == auth.HashToken(validToken) {
+		return &auth.Token{ID: 1, SerialNumber: "12345"}, nil
+	}
+	return nil, nil
+}
+
+func (s *mockStore) RegisterDevice(*inverter.DeviceInfo) error {
 	return s.err
 }
 
+func (s *mockStore) IdempotentResponse(key string) ([]byte, bool, error) {
+	response, ok := s.responses[key]
+	return response, ok, nil
+}
+
+func (s *mockStore) SaveIdempotentResponse(key string, response []byte) error {
+	if s.responses == nil {
+		s.responses = make(map[string][]byte)
+	}
+	s.responses[key] = response
+	return nil
+}
+
+func (s *mockStore) InsertDataFrames(frames []*inverter.ETDataFrame) ([]error, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	errs := make([]error, len(frames))
+	if s.itemErr != nil {
+		for i, frame := range frames {
+			errs[i] = s.itemErr(frame)
+		}
+	}
+	return errs, nil
+}
+
+func (s *mockStore) LatestFrame(string) (*inverter.ETDataFrame, error) {
+	if s.err != nil || len(s.frames) == 0 {
+		return nil, s.err
+	}
+	return s.frames[len(s.frames)-1], nil
+}
+
+func (s *mockStore) Frames(_ string, from, to time.Time, limit int) ([]*inverter.ETDataFrame, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	var frames []*inverter.ETDataFrame
+	for _, frame := range s.frames {
+		if !frame.Timestamp.Before(from) && frame.Timestamp.Before(to) && (limit == 0 || len(frames) < limit) {
+			frames = append(frames, frame)
+		}
+	}
+	return frames, nil
+}
+
+func (s *mockStore) Summaries(_ string, period energy.Period, from, to time.Time) ([]energy.Summary, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	var summaries []energy.Summary
+	for _, summary := range s.summaries {
+		if summary.Period == period && !summary.Start.Before(from) && summary.Start.Before(to) {
+			summaries = append(summaries, summary)
+		}
+	}
+	return summaries, nil
+}
+
+func (s *mockStore) Costs(_ string, from, to time.Time) ([]tariff.Cost, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	var costs []tariff.Cost
+	for _, c := range s.costs {
+		if !c.Start.Before(from) && c.Start.Before(to) {
+			costs = append(costs, c)
+		}
+	}
+	return costs, nil
+}
+
+func (s *mockStore) LatestRollup(_ string, resolution string) (time.Time, bool, error) {
+	if s.err != nil {
+		return time.Time{}, false, s.err
+	}
+
+	var latest time.Time
+	var ok bool
+	for _, r := range s.rollups {
+		if r.Resolution == resolution && (!ok || r.Start.After(latest)) {
+			latest, ok = r.Start, true
+		}
+	}
+	return latest, ok, nil
+}
+
+func (s *mockStore) Rollups(_ string, resolution string, from, to time.Time) ([]rollup.Rollup, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	var rollups []rollup.Rollup
+	for _, r := range s.rollups {
+		if r.Resolution == resolution && !r.Start.Before(from) && r.Start.Before(to) {
+			rollups = append(rollups, r)
+		}
+	}
+	return rollups, nil
+}
+
 func TestHandler(t *testing.T) {
 	testCases := []struct {
 		name           string
 		httpMethod     string
 		path           string
 		body           string
+		contentType    string
+		token          string
+		noAuth         bool
 		storeErr       error
+		storeItemErr   func(*inverter.ETDataFrame) error
 		wantStatusCode int
 		wantBody       string
 	}{
@@ -58,8 +200,16 @@ func TestHandler(t *testing.T) {
 			httpMethod:     http.MethodPost,
 			path:           "/gateway/et_runtime_data",
 			body:           `{`,
-			wantStatusCode: http.StatusInternalServerError,
-			wantBody:       "unexpected error\n",
+			wantStatusCode: http.StatusBadRequest,
+			wantBody:       "invalid data\n",
+		},
+		{
+			name:           "payload too large",
+			httpMethod:     http.MethodPost,
+			path:           "/gateway/et_runtime_data",
+			body:           `{"model_name": "` + strings.Repeat("x", 1<<20) + `"}`,
+			wantStatusCode: http.StatusRequestEntityTooLarge,
+			wantBody:       "request too large\n",
 		},
 		{
 			name:           "invalid timestamp",
@@ -86,13 +236,201 @@ func TestHandler(t *testing.T) {
 			wantStatusCode: http.StatusOK,
 			wantBody:       "OK\n",
 		},
+		{
+			name:           "missing token",
+			httpMethod:     http.MethodPost,
+			path:           "/gateway/et_runtime_data",
+			body:           `{"timestamp": "2022-01-01T00:00:00Z"}`,
+			token:          "-",
+			wantStatusCode: http.StatusUnauthorized,
+			wantBody:       "unauthorized\n",
+		},
+		{
+			name:           "invalid token",
+			httpMethod:     http.MethodPost,
+			path:           "/gateway/et_runtime_data",
+			body:           `{"timestamp": "2022-01-01T00:00:00Z"}`,
+			token:          "stk_invalid",
+			wantStatusCode: http.StatusUnauthorized,
+			wantBody:       "unauthorized\n",
+		},
+		{
+			name:           "authentication disabled",
+			httpMethod:     http.MethodPost,
+			path:           "/gateway/et_runtime_data",
+			body:           `{"serial_number": "67890", "timestamp": "2022-01-01T00:00:00Z"}`,
+			token:          "-",
+			noAuth:         true,
+			wantStatusCode: http.StatusOK,
+			wantBody:       "OK\n",
+		},
+		{
+			name:           "authentication disabled, invalid token",
+			httpMethod:     http.MethodPost,
+			path:           "/gateway/et_runtime_data",
+			body:           `{"timestamp": "2022-01-01T00:00:00Z"}`,
+			token:          "stk_invalid",
+			noAuth:         true,
+			wantStatusCode: http.StatusUnauthorized,
+			wantBody:       "unauthorized\n",
+		},
+		{
+			name:           "token for other device",
+			httpMethod:     http.MethodPost,
+			path:           "/gateway/et_runtime_data",
+			body:           `{"serial_number": "67890", "timestamp": "2022-01-01T00:00:00Z"}`,
+			wantStatusCode: http.StatusForbidden,
+			wantBody:       "token is not valid for device `67890`\n",
+		},
+		{
+			name:           "batch, token for other device",
+			httpMethod:     http.MethodPost,
+			path:           "/gateway/et_runtime_data/batch",
+			body:           `[{"serial_number": "12345", "timestamp": "2022-01-01T00:00:00Z"}, {"serial_number": "67890", "timestamp": "2022-01-01T00:00:00Z"}]`,
+			wantStatusCode: http.StatusOK,
+			wantBody:       `{"accepted":1,"duplicates":0,"rejected":1,"results":[{"status":"accepted"},{"status":"rejected","error":"token is not valid for device ` + "`67890`" + `"}]}` + "\n",
+		},
+		{
+			name:           "device, token for other device",
+			httpMethod:     http.MethodPost,
+			path:           "/gateway/devices",
+			body:           `{"serial_number": "67890"}`,
+			wantStatusCode: http.StatusForbidden,
+			wantBody:       "token is not valid for device `67890`\n",
+		},
+		{
+			name:           "duplicate",
+			httpMethod:     http.MethodPost,
+			path:           "/gateway/et_runtime_data",
+			body:           `{"timestamp": "2022-01-01T00:00:00Z"}`,
+			storeItemErr:   func(*inverter.ETDataFrame) error { return handler.ErrDuplicate },
+			wantStatusCode: http.StatusOK,
+			wantBody:       "duplicate\n",
+		},
+		{
+			name:           "device, invalid payload",
+			httpMethod:     http.MethodPost,
+			path:           "/gateway/devices",
+			body:           `{`,
+			wantStatusCode: http.StatusBadRequest,
+			wantBody:       "invalid data\n",
+		},
+		{
+			name:           "device, missing serial number",
+			httpMethod:     http.MethodPost,
+			path:           "/gateway/devices",
+			body:           `{"model_name": "GW5000-EH"}`,
+			wantStatusCode: http.StatusBadRequest,
+			wantBody:       "missing serial number\n",
+		},
+		{
+			name:           "device, store error",
+			httpMethod:     http.MethodPost,
+			path:           "/gateway/devices",
+			body:           `{"serial_number": "12345", "model_name": "GW5000-EH"}`,
+			storeErr:       errors.New("boom"),
+			wantStatusCode: http.StatusInternalServerError,
+			wantBody:       "unexpected error\n",
+		},
+		{
+			name:           "device, OK",
+			httpMethod:     http.MethodPost,
+			path:           "/gateway/devices",
+			body:           `{"serial_number": "12345", "model_name": "GW5000-EH"}`,
+			wantStatusCode: http.StatusOK,
+			wantBody:       "OK\n",
+		},
+		{
+			name:           "batch, invalid payload",
+			httpMethod:     http.MethodPost,
+			path:           "/gateway/et_runtime_data/batch",
+			body:           `{"timestamp": "2022-01-01T00:00:00Z"}`,
+			wantStatusCode: http.StatusBadRequest,
+			wantBody:       "invalid batch\n",
+		},
+		{
+			name:           "batch, too many frames",
+			httpMethod:     http.MethodPost,
+			path:           "/gateway/et_runtime_data/batch",
+			body:           "[" + strings.Repeat(`{},`, api.MaxBatchSize) + "{}]",
+			wantStatusCode: http.StatusRequestEntityTooLarge,
+			wantBody:       "too many frames, maximum is 1000\n",
+		},
+		{
+			name:           "batch, store error",
+			httpMethod:     http.MethodPost,
+			path:           "/gateway/et_runtime_data/batch",
+			body:           `[{"timestamp": "2022-01-01T00:00:00Z"}]`,
+			storeErr:       errors.New("boom"),
+			wantStatusCode: http.StatusInternalServerError,
+			wantBody:       "unexpected error\n",
+		},
+		{
+			name:           "batch, empty",
+			httpMethod:     http.MethodPost,
+			path:           "/gateway/et_runtime_data/batch",
+			body:           `[]`,
+			wantStatusCode: http.StatusOK,
+			wantBody:       `{"accepted":0,"duplicates":0,"rejected":0,"results":[]}` + "\n",
+		},
+		{
+			name:       "batch, JSON array",
+			httpMethod: http.MethodPost,
+			path:       "/gateway/et_runtime_data/batch",
+			body:       `[{"timestamp": "2022-01-01T00:00:00Z"}, {"timestamp": "1970-01-01T00:00:00Z"}, 1, {"timestamp": "2022-01-01T00:01:00Z", "pv_power": 9}]`,
+			storeItemErr: func(frame *inverter.ETDataFrame) error {
+				if frame.PVPower == 9 {
+					return errors.New("boom")
+				}
+				return nil
+			},
+			wantStatusCode: http.StatusOK,
+			wantBody:       `{"accepted":1,"duplicates":0,"rejected":3,"results":[{"status":"accepted"},{"status":"rejected","error":"invalid timestamp"},{"status":"rejected","error":"invalid frame"},{"status":"rejected","error":"could not store frame"}]}` + "\n",
+		},
+		{
+			name:       "batch, duplicates",
+			httpMethod: http.MethodPost,
+			path:       "/gateway/et_runtime_data/batch",
+			body:       `[{"timestamp": "2022-01-01T00:00:00Z"}, {"timestamp": "2022-01-01T00:01:00Z", "pv_power": 9}]`,
+			storeItemErr: func(frame *inverter.ETDataFrame) error {
+				if frame.PVPower == 9 {
+					return handler.ErrDuplicate
+				}
+				return nil
+			},
+			wantStatusCode: http.StatusOK,
+			wantBody:       `{"accepted":1,"duplicates":1,"rejected":0,"results":[{"status":"accepted"},{"status":"duplicate"}]}` + "\n",
+		},
+		{
+			name:           "batch, NDJSON",
+			httpMethod:     http.MethodPost,
+			path:           "/gateway/et_runtime_data/batch",
+			contentType:    "application/x-ndjson",
+			body:           "{\"timestamp\": \"2022-01-01T00:00:00Z\"}\n\n{\"timestamp\": \"2022-01-01T00:01:00Z\"}\n{\n",
+			wantStatusCode: http.StatusOK,
+			wantBody:       `{"accepted":2,"duplicates":0,"rejected":1,"results":[{"status":"accepted"},{"status":"accepted"},{"status":"rejected","error":"invalid frame"}]}` + "\n",
+		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			mockStore := mockStore{err: tc.storeErr}
-			handler := handler.New(&mockStore)
+			mockStore := mockStore{err: tc.storeErr, itemErr: tc.storeItemErr}
+			var opts []handler.Option
+			if tc.noAuth {
+				opts = append(opts, handler.AllowUnauthenticated())
+			}
+			handler := handler.New(&mockStore, opts...)
 			req := httptest.NewRequest(tc.httpMethod, tc.path, strings.NewReader(tc.body))
+			switch tc.token {
+			case "":
+				req.Header.Set("authorization", "Bearer "+validToken)
+			case "-":
+			default:
+				req.Header.Set("authorization", "Bearer "+tc.token)
+			}
+			if tc.contentType != "" {
+				req.Header.Set("content-type", tc.contentType)
+			}
 			rec := httptest.NewRecorder()
 			handler.ServeHTTP(rec, req)
 			resp := rec.Result()
@@ -108,3 +446,144 @@ func TestHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestHandlerIdempotencyKey(t *testing.T) {
+	var store mockStore
+	h := handler.New(&store)
+
+	post := func(key, body string) *http.Response {
+		req := httptest.NewRequest(http.MethodPost, "/gateway/et_runtime_data", strings.NewReader(body))
+		req.SetBasicAuth("solar", validToken)
+		if key != "" {
+			req.Header.Set(api.IdempotencyKeyHeader, key)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Result()
+	}
+
+	resp := post("abc", `{"timestamp": "1970-01-01T00:00:00Z"}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Empty(t, store.responses, "failed responses must not be stored")
+
+	resp = post("abc", `{"timestamp": "2022-01-01T00:00:00Z"}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get(api.IdempotentReplayedHeader))
+	assert.Len(t, store.inserted, 1)
+
+	resp = post("abc", `{"timestamp": "2022-01-01T00:00:00Z"}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "true", resp.Header.Get(api.IdempotentReplayedHeader))
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "OK\n", string(body))
+	assert.Len(t, store.inserted, 1)
+
+	resp = post(strings.Repeat("x", 256), `{"timestamp": "2022-01-01T00:00:00Z"}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestHandlerSerialNumberFromToken(t *testing.T) {
+	var store mockStore
+	h := handler.New(&store)
+
+	req := httptest.NewRequest(http.MethodPost, "/gateway/et_runtime_data", strings.NewReader(`{"timestamp": "2022-01-01T00:00:00Z"}`))
+	req.Header.Set("authorization", "Bearer "+validToken)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	require.Len(t, store.inserted, 1)
+	assert.Equal(t, "12345", store.inserted[0].SerialNumber)
+}
+
+func TestHandlerPartialFrame(t *testing.T) {
+	var store mockStore
+	h := handler.New(&store)
+
+	req := httptest.NewRequest(http.MethodPost, "/gateway/et_runtime_data", strings.NewReader(`{"timestamp": "2022-01-01T00:00:00Z", "pv_power": 2500, "pv2_voltage": null}`))
+	req.Header.Set("authorization", "Bearer "+validToken)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	require.Len(t, store.inserted, 1)
+
+	// Fields absent from the request are stored as null rather than zero.
+	frame := store.inserted[0]
+	assert.False(t, frame.Omitted("pv_power"))
+	assert.True(t, frame.Omitted("pv2_voltage"))
+	assert.True(t, frame.Omitted("pv1_voltage"))
+	assert.True(t, frame.Omitted("meter_frequency"))
+}
+
+func TestHandlerValidation(t *testing.T) {
+	ptr := func(v float64) *float64 { return &v }
+	cfg := validate.Config{
+		DisableDefaults: true,
+		Rules: []validate.Rule{
+			{Fields: []string{"battery_voltage"}, Max: ptr(1000)},
+			{Fields: []string{"temperature"}, Max: ptr(150), Policy: validate.Flag},
+			{Fields: []string{"energy_generation_total"}, Monotonic: true, Policy: validate.DropFrame},
+		},
+	}
+	require.NoError(t, cfg.Validate())
+
+	store := mockStore{frames: []*inverter.ETDataFrame{{
+		SerialNumber:  "12345",
+		ETRuntimeData: &inverter.ETRuntimeData{Timestamp: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC), EnergyGenerationTotal: 1000},
+	}}}
+	h := handler.New(&store, handler.WithValidator(validate.New(cfg.AllRules(), validate.WithHistory(store.LatestFrame))))
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("authorization", "Bearer "+validToken)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(http.MethodPost, "/gateway/et_runtime_data", `{"timestamp": "2022-01-01T00:01:00Z", "battery_voltage": 6553.5, "temperature": 200, "energy_generation_total": 1000.5}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	require.Len(t, store.inserted, 1)
+	assert.True(t, store.inserted[0].Omitted("battery_voltage"))
+	assert.Equal(t, []string{"temperature"}, store.inserted[0].Flagged)
+
+	// The lifetime counter went backwards.
+	rec = do(http.MethodPost, "/gateway/et_runtime_data", `{"timestamp": "2022-01-01T00:02:00Z", "energy_generation_total": 5}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, "invalid data\n", rec.Body.String())
+	assert.Len(t, store.inserted, 1)
+
+	rec = do(http.MethodPost, "/gateway/et_runtime_data/batch", `[{"timestamp": "2022-01-01T00:03:00Z", "energy_generation_total": 1000.6}, {"timestamp": "2022-01-01T00:04:00Z", "energy_generation_total": 6}]`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"accepted":1,"duplicates":0,"rejected":1,"results":[{"status":"accepted"},{"status":"rejected","error":"implausible frame"}]}`, rec.Body.String())
+
+	rec = do(http.MethodGet, "/api/rejected", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"serial_number":"12345","rejected":[
+		{"field":"battery_voltage","policy":"drop_field","count":1},
+		{"field":"energy_generation_total","policy":"drop_frame","count":2},
+		{"field":"temperature","policy":"flag","count":1}
+	]}`, rec.Body.String())
+}
+
+func TestHandlerDerivesFlows(t *testing.T) {
+	var store mockStore
+	h := handler.New(&store)
+
+	// Frames from older daemons lack the power flows.
+	req := httptest.NewRequest(http.MethodPost, "/gateway/et_runtime_data", strings.NewReader(`{"timestamp": "2022-01-01T00:00:00Z", "pv_power": 2500, "battery_voltage": 50, "battery_current": -10, "active_power": 1000, "house_consumption": 1}`))
+	req.Header.Set("authorization", "Bearer "+validToken)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	require.Len(t, store.inserted, 1)
+	frame := store.inserted[0]
+	assert.Equal(t, inverter.Power(1000), frame.HouseConsumption)
+	assert.Equal(t, inverter.Power(1000), frame.PVToLoad)
+	assert.Equal(t, inverter.Power(500), frame.PVToBattery)
+	assert.Equal(t, inverter.Power(1000), frame.PVToGrid)
+	assert.Equal(t, 0.6, frame.SelfConsumption)
+}
@@ -0,0 +1,309 @@
+// Package rollup maintains downsampled copies of the stored frames, and
+// prunes raw frames once they are older than the retention period.
+//
+// Each rollup holds the average, minimum and maximum of every field over a
+// bucket of 5 minutes, 1 hour or 1 day, computed with the series package so
+// that they match the series API. The series API in turn reads rollups for
+// ranges which have been rolled up, so that it still returns data once the
+// raw frames have been pruned.
+package rollup
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"git.netflux.io/rob/solar-toolkit/gateway/energy"
+	"git.netflux.io/rob/solar-toolkit/gateway/series"
+	"git.netflux.io/rob/solar-toolkit/inverter"
+)
+
+// Resolutions are the bucket sizes of the maintained rollups.
+var Resolutions = []series.Bucket{
+	{N: 5, Unit: series.Minute},
+	{N: 1, Unit: series.Hour},
+	{N: 1, Unit: series.Day},
+}
+
+// Daily is the resolution of the daily rollups. Rollups before the start of
+// the most recent daily rollup are complete; later ones are recomputed as
+// frames arrive.
+var Daily = series.Bucket{N: 1, Unit: series.Day}
+
+// Rollup holds the aggregated fields of a device over one bucket.
+type Rollup struct {
+	Resolution string
+	Start      time.Time
+	Avg        map[string]float64
+	Min        map[string]float64
+	Max        map[string]float64
+}
+
+// Store persists rollups and provides the frames to compute them from.
+type Store interface {
+	// SerialNumbers returns the serial numbers of every device.
+	SerialNumbers() ([]string, error)
+	// Frames returns the frames of the device with timestamps in [from, to),
+	// ordered by timestamp. If limit is greater than zero, at most limit
+	// frames are returned.
+	Frames(serialNumber string, from, to time.Time, limit int) ([]*inverter.ETDataFrame, error)
+	// LatestRollup returns the start of the most recent rollup of the device
+	// at the resolution, or false if there is none.
+	LatestRollup(serialNumber string, resolution string) (time.Time, bool, error)
+	// SaveRollups creates or replaces the rollups of the device.
+	SaveRollups(serialNumber string, rollups []Rollup) error
+	// LatestSummary returns the most recent energy summary of the device for
+	// the period, or nil if there is none.
+	LatestSummary(serialNumber string, period energy.Period) (*energy.Summary, error)
+	// DeleteFrames deletes the frames of the device older than before,
+	// returning the number deleted.
+	DeleteFrames(serialNumber string, before time.Time) (int64, error)
+}
+
+// chunkDays is the number of days of frames rolled up at a time, bounding
+// memory use when catching up on a long history.
+const chunkDays = 7
+
+// Update computes the rollups of the frames of the device received since the
+// most recent daily rollup, which is itself recomputed since the day may not
+// have been complete. Days start at midnight in loc.
+func Update(store Store, serialNumber string, loc *time.Location, now time.Time) error {
+	from, ok, err := store.LatestRollup(serialNumber, Daily.String())
+	if err != nil {
+		return err
+	}
+	if ok {
+		from = from.In(loc)
+	} else {
+		frames, err := store.Frames(serialNumber, time.Unix(0, 0), now, 1)
+		if err != nil {
+			return err
+		}
+		if len(frames) == 0 || frames[0].ETRuntimeData == nil {
+			return nil
+		}
+		from = Daily.Start(frames[0].Timestamp, loc)
+	}
+
+	fields := inverter.Fields()
+	for start := from; start.Before(now); {
+		end := start.AddDate(0, 0, chunkDays)
+
+		frames, err := store.Frames(serialNumber, start, end, 0)
+		if err != nil {
+			return err
+		}
+
+		var rollups []Rollup
+		for _, resolution := range Resolutions {
+			rollups = append(rollups, Compute(frames, fields, resolution, loc)...)
+		}
+		if err := store.SaveRollups(serialNumber, rollups); err != nil {
+			return err
+		}
+
+		start = end
+	}
+
+	return nil
+}
+
+// Compute returns the rollups of the frames, which must be ordered by
+// timestamp, at the resolution.
+func Compute(frames []*inverter.ETDataFrame, fields []inverter.Field, resolution series.Bucket, loc *time.Location) []Rollup {
+	avg := series.Aggregate(frames, fields, resolution, series.Avg, loc)
+	mins := series.Aggregate(frames, fields, resolution, series.Min, loc)
+	maxs := series.Aggregate(frames, fields, resolution, series.Max, loc)
+
+	rollups := make([]Rollup, 0, len(avg))
+	for i, p := range avg {
+		rollups = append(rollups, Rollup{
+			Resolution: resolution.String(),
+			Start:      p.Start,
+			Avg:        p.Values,
+			Min:        mins[i].Values,
+			Max:        maxs[i].Values,
+		})
+	}
+
+	return rollups
+}
+
+// Resolution returns the coarsest resolution of the rollups, computed in
+// rollupLoc, from which series of the bucket in loc can be aggregated over
+// [from, to), or false if there is none. The rollups must fit exactly within
+// the buckets, so daily rollups are only used in the same timezone, and
+// finer ones only if both timezones are offset from UTC by a multiple of the
+// resolution.
+func Resolution(bucket series.Bucket, loc, rollupLoc *time.Location, from, to time.Time) (series.Bucket, bool) {
+	for i := len(Resolutions) - 1; i >= 0; i-- {
+		res := Resolutions[i]
+		if divides(res, bucket) && aligned(res, loc, rollupLoc, from, to) {
+			return res, true
+		}
+	}
+	return series.Bucket{}, false
+}
+
+// divides returns whether every bucket is made up of whole rollups of the
+// resolution.
+func divides(res, bucket series.Bucket) bool {
+	switch res.Unit {
+	case series.Minute:
+		return bucket.Unit != series.Minute || bucket.N%res.N == 0
+	case series.Hour:
+		return bucket.Unit != series.Minute && (bucket.Unit != series.Hour || bucket.N%res.N == 0)
+	default:
+		return bucket.Unit != series.Minute && bucket.Unit != series.Hour
+	}
+}
+
+func aligned(res series.Bucket, loc, rollupLoc *time.Location, from, to time.Time) bool {
+	if res.Unit == series.Day {
+		return loc.String() == rollupLoc.String()
+	}
+
+	d := 60
+	if res.Unit == series.Hour {
+		d = 3600
+	}
+	d *= res.N
+	for _, t := range []time.Time{from, to} {
+		for _, l := range []*time.Location{loc, rollupLoc} {
+			if _, offset := t.In(l).Zone(); offset%d != 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Series aggregates the rollups, which must be ordered by start and be of a
+// resolution returned by Resolution for the bucket, into buckets. Averages
+// are the averages of the rollup averages, weighting each rollup equally.
+// Rollups do not keep the last value of each field, so the Last aggregation
+// is not supported and returns no points.
+func Series(rollups []Rollup, fields []inverter.Field, bucket series.Bucket, agg series.Aggregation, loc *time.Location) []series.Point {
+	if agg == series.Last {
+		return nil
+	}
+
+	type acc struct {
+		v float64
+		n int
+	}
+	var points []series.Point
+	var accs []acc
+
+	flush := func() {
+		if len(points) == 0 {
+			return
+		}
+		p := &points[len(points)-1]
+		for i, f := range fields {
+			a := accs[i]
+			if a.n == 0 {
+				continue
+			}
+			if agg == series.Avg {
+				p.Values[f.Name] = a.v / float64(a.n)
+			} else {
+				p.Values[f.Name] = a.v
+			}
+		}
+	}
+
+	for _, r := range rollups {
+		start := bucket.Start(r.Start, loc)
+		if len(points) == 0 || !points[len(points)-1].Start.Equal(start) {
+			flush()
+			points = append(points, series.Point{Start: start, Values: make(map[string]float64)})
+			accs = make([]acc, len(fields))
+		}
+
+		values := r.Avg
+		switch agg {
+		case series.Min:
+			values = r.Min
+		case series.Max:
+			values = r.Max
+		}
+		for i, f := range fields {
+			v, ok := values[f.Name]
+			if !ok {
+				continue
+			}
+			a := &accs[i]
+			switch {
+			case a.n == 0:
+				a.v = v
+			case agg == series.Avg:
+				a.v += v
+			case agg == series.Min:
+				a.v = min(a.v, v)
+			default:
+				a.v = max(a.v, v)
+			}
+			a.n++
+		}
+	}
+	flush()
+
+	return points
+}
+
+// Prune deletes the frames of the device older than the retention period.
+// Frames which have not yet been rolled up or included in an energy summary
+// are kept.
+func Prune(store Store, serialNumber string, retention time.Duration, now time.Time) (int64, error) {
+	before := now.Add(-retention)
+
+	// The latest daily rollup and energy summary are recomputed on each
+	// update, so their frames must be kept, along with the preceding day's
+	// which the energy summary is computed relative to.
+	rolledUp, ok, err := store.LatestRollup(serialNumber, Daily.String())
+	if err != nil || !ok {
+		return 0, err
+	}
+	if rolledUp.Before(before) {
+		before = rolledUp
+	}
+
+	summary, err := store.LatestSummary(serialNumber, energy.Day)
+	if err != nil || summary == nil {
+		return 0, err
+	}
+	if start := summary.Start.AddDate(0, 0, -1); start.Before(before) {
+		before = start
+	}
+
+	return store.DeleteFrames(serialNumber, before)
+}
+
+// UpdateAll updates the rollups of every device and then, if retention is
+// greater than zero, prunes their frames.
+func UpdateAll(store Store, loc *time.Location, retention time.Duration, now time.Time) error {
+	serialNumbers, err := store.SerialNumbers()
+	if err != nil {
+		return err
+	}
+
+	for _, serialNumber := range serialNumbers {
+		if err := Update(store, serialNumber, loc, now); err != nil {
+			return fmt.Errorf("error updating rollups of %s: %s", serialNumber, err)
+		}
+		if retention <= 0 {
+			continue
+		}
+
+		n, err := Prune(store, serialNumber, retention, now)
+		if err != nil {
+			return fmt.Errorf("error pruning frames of %s: %s", serialNumber, err)
+		}
+		if n > 0 {
+			log.Printf("Pruned %d frame(s) of %s", n, serialNumber)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,264 @@
+package rollup_test
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"git.netflux.io/rob/solar-toolkit/gateway/energy"
+	"git.netflux.io/rob/solar-toolkit/gateway/rollup"
+	"git.netflux.io/rob/solar-toolkit/gateway/series"
+	"git.netflux.io/rob/solar-toolkit/inverter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func frame(ts time.Time, pvPower float64) *inverter.ETDataFrame {
+	return &inverter.ETDataFrame{
+		SerialNumber:  "12345",
+		ETRuntimeData: &inverter.ETRuntimeData{Timestamp: ts, PVPower: inverter.Power(pvPower)},
+	}
+}
+
+func TestCompute(t *testing.T) {
+	start := time.Date(2022, 7, 14, 10, 0, 0, 0, time.UTC)
+	frames := []*inverter.ETDataFrame{
+		frame(start, 100),
+		frame(start.Add(2*time.Minute), 300),
+		frame(start.Add(7*time.Minute), 50),
+	}
+	fields, err := inverter.MatchFields([]string{"pv_power"})
+	require.NoError(t, err)
+
+	rollups := rollup.Compute(frames, fields, series.Bucket{N: 5, Unit: series.Minute}, time.UTC)
+	assert.Equal(t, []rollup.Rollup{
+		{
+			Resolution: "5m",
+			Start:      start,
+			Avg:        map[string]float64{"pv_power": 200},
+			Min:        map[string]float64{"pv_power": 100},
+			Max:        map[string]float64{"pv_power": 300},
+		},
+		{
+			Resolution: "5m",
+			Start:      start.Add(5 * time.Minute),
+			Avg:        map[string]float64{"pv_power": 50},
+			Min:        map[string]float64{"pv_power": 50},
+			Max:        map[string]float64{"pv_power": 50},
+		},
+	}, rollups)
+}
+
+// memoryStore is an in-memory rollup.Store.
+type memoryStore struct {
+	frames  []*inverter.ETDataFrame
+	rollups []rollup.Rollup
+	summary *energy.Summary
+}
+
+func (s *memoryStore) SerialNumbers() ([]string, error) {
+	return []string{"12345"}, nil
+}
+
+func (s *memoryStore) Frames(_ string, from, to time.Time, limit int) ([]*inverter.ETDataFrame, error) {
+	var frames []*inverter.ETDataFrame
+	for _, frame := range s.frames {
+		if !frame.Timestamp.Before(from) && frame.Timestamp.Before(to) && (limit == 0 || len(frames) < limit) {
+			frames = append(frames, frame)
+		}
+	}
+	return frames, nil
+}
+
+func (s *memoryStore) LatestRollup(_ string, resolution string) (time.Time, bool, error) {
+	var latest time.Time
+	var ok bool
+	for _, r := range s.rollups {
+		if r.Resolution == resolution && (!ok || r.Start.After(latest)) {
+			latest, ok = r.Start, true
+		}
+	}
+	return latest, ok, nil
+}
+
+func (s *memoryStore) SaveRollups(_ string, rollups []rollup.Rollup) error {
+	for _, r := range rollups {
+		s.rollups = slices.DeleteFunc(s.rollups, func(other rollup.Rollup) bool {
+			return other.Resolution == r.Resolution && other.Start.Equal(r.Start)
+		})
+		s.rollups = append(s.rollups, r)
+	}
+	return nil
+}
+
+func (s *memoryStore) LatestSummary(string, energy.Period) (*energy.Summary, error) {
+	return s.summary, nil
+}
+
+func (s *memoryStore) DeleteFrames(_ string, before time.Time) (int64, error) {
+	n := len(s.frames)
+	s.frames = slices.DeleteFunc(s.frames, func(frame *inverter.ETDataFrame) bool { return frame.Timestamp.Before(before) })
+	return int64(n - len(s.frames)), nil
+}
+
+func (s *memoryStore) count(resolution string) int {
+	var n int
+	for _, r := range s.rollups {
+		if r.Resolution == resolution {
+			n++
+		}
+	}
+	return n
+}
+
+func TestUpdateAll(t *testing.T) {
+	// One frame per minute over ten days.
+	start := time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 0, 10)
+	var store memoryStore
+	for ts := start; ts.Before(end); ts = ts.Add(time.Minute) {
+		store.frames = append(store.frames, frame(ts, float64(ts.Hour())))
+	}
+	store.summary = &energy.Summary{Period: energy.Day, Start: end.AddDate(0, 0, -1)}
+	now := end.Add(time.Hour)
+
+	require.NoError(t, rollup.UpdateAll(&store, time.UTC, 0, now))
+	assert.Equal(t, 10*288, store.count("5m"))
+	assert.Equal(t, 10*24, store.count("1h"))
+	assert.Equal(t, 10, store.count("1d"))
+	assert.Len(t, store.frames, 10*24*60, "frames must be kept without retention")
+
+	// Rollups are kept, and frames pruned, after the retention period.
+	require.NoError(t, rollup.UpdateAll(&store, time.UTC, 3*24*time.Hour, now))
+	assert.Equal(t, 10, store.count("1d"))
+	require.NotEmpty(t, store.frames)
+	assert.Equal(t, time.Date(2022, 7, 8, 1, 0, 0, 0, time.UTC), store.frames[0].Timestamp)
+
+	i := slices.IndexFunc(store.rollups, func(r rollup.Rollup) bool {
+		return r.Resolution == "1d" && r.Start.Equal(start)
+	})
+	require.GreaterOrEqual(t, i, 0)
+	assert.Equal(t, 11.5, store.rollups[i].Avg["pv_power"])
+	assert.Equal(t, 0.0, store.rollups[i].Min["pv_power"])
+	assert.Equal(t, 23.0, store.rollups[i].Max["pv_power"])
+}
+
+func TestPrune(t *testing.T) {
+	start := time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC)
+	now := start.AddDate(0, 0, 10)
+
+	testCases := []struct {
+		name      string
+		rollups   []rollup.Rollup
+		summary   *energy.Summary
+		wantFirst time.Time
+	}{
+		{
+			name:      "not rolled up",
+			summary:   &energy.Summary{Start: now},
+			wantFirst: start,
+		},
+		{
+			name:      "not summarized",
+			rollups:   []rollup.Rollup{{Resolution: "1d", Start: now}},
+			wantFirst: start,
+		},
+		{
+			name:      "rolled up and summarized",
+			rollups:   []rollup.Rollup{{Resolution: "1d", Start: now}},
+			summary:   &energy.Summary{Start: now},
+			wantFirst: start.AddDate(0, 0, 7),
+		},
+		{
+			name:      "rollups behind",
+			rollups:   []rollup.Rollup{{Resolution: "1d", Start: start.AddDate(0, 0, 2)}},
+			summary:   &energy.Summary{Start: now},
+			wantFirst: start.AddDate(0, 0, 2),
+		},
+		{
+			name:      "energy summaries behind",
+			rollups:   []rollup.Rollup{{Resolution: "1d", Start: now}},
+			summary:   &energy.Summary{Start: start.AddDate(0, 0, 2)},
+			wantFirst: start.AddDate(0, 0, 1),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := memoryStore{rollups: tc.rollups, summary: tc.summary}
+			for ts := start; ts.Before(now); ts = ts.Add(time.Hour) {
+				store.frames = append(store.frames, frame(ts, 0))
+			}
+
+			_, err := rollup.Prune(&store, "12345", 3*24*time.Hour, now)
+			require.NoError(t, err)
+			require.NotEmpty(t, store.frames)
+			assert.Equal(t, tc.wantFirst, store.frames[0].Timestamp)
+		})
+	}
+}
+
+func TestResolution(t *testing.T) {
+	madrid, err := time.LoadLocation("Europe/Madrid")
+	require.NoError(t, err)
+	kolkata, err := time.LoadLocation("Asia/Kolkata")
+	require.NoError(t, err)
+	from := time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, 0)
+
+	testCases := []struct {
+		bucket    string
+		loc       *time.Location
+		wantRes   string
+		wantFound bool
+	}{
+		{bucket: "1m", loc: time.UTC},
+		{bucket: "15m", loc: time.UTC, wantRes: "5m", wantFound: true},
+		{bucket: "6h", loc: time.UTC, wantRes: "1h", wantFound: true},
+		{bucket: "1M", loc: time.UTC, wantRes: "1d", wantFound: true},
+		{bucket: "1d", loc: madrid, wantRes: "1h", wantFound: true},
+		{bucket: "1h", loc: kolkata, wantRes: "5m", wantFound: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.bucket+" "+tc.loc.String(), func(t *testing.T) {
+			bucket, err := series.ParseBucket(tc.bucket)
+			require.NoError(t, err)
+
+			res, ok := rollup.Resolution(bucket, tc.loc, time.UTC, from, to)
+			assert.Equal(t, tc.wantFound, ok)
+			if tc.wantFound {
+				assert.Equal(t, tc.wantRes, res.String())
+			}
+		})
+	}
+}
+
+func TestSeries(t *testing.T) {
+	start := time.Date(2022, 7, 14, 10, 0, 0, 0, time.UTC)
+	rollups := []rollup.Rollup{
+		{Resolution: "5m", Start: start, Avg: map[string]float64{"pv_power": 200}, Min: map[string]float64{"pv_power": 100}, Max: map[string]float64{"pv_power": 300}},
+		{Resolution: "5m", Start: start.Add(5 * time.Minute), Avg: map[string]float64{"pv_power": 50}, Min: map[string]float64{"pv_power": 50}, Max: map[string]float64{"pv_power": 50}},
+		{Resolution: "5m", Start: start.Add(15 * time.Minute), Avg: map[string]float64{"pv_power": 10}, Min: map[string]float64{"pv_power": 0}, Max: map[string]float64{"pv_power": 20}},
+	}
+	fields, err := inverter.MatchFields([]string{"pv_power", "battery_voltage"})
+	require.NoError(t, err)
+	bucket := series.Bucket{N: 15, Unit: series.Minute}
+
+	for _, tc := range []struct {
+		agg  series.Aggregation
+		want []float64
+	}{
+		{agg: series.Avg, want: []float64{125, 10}},
+		{agg: series.Min, want: []float64{50, 0}},
+		{agg: series.Max, want: []float64{300, 20}},
+	} {
+		points := rollup.Series(rollups, fields, bucket, tc.agg, time.UTC)
+		assert.Equal(t, []series.Point{
+			{Start: start, Values: map[string]float64{"pv_power": tc.want[0]}},
+			{Start: start.Add(15 * time.Minute), Values: map[string]float64{"pv_power": tc.want[1]}},
+		}, points, tc.agg)
+	}
+
+	assert.Empty(t, rollup.Series(rollups, fields, bucket, series.Last, time.UTC))
+}
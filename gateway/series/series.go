@@ -0,0 +1,181 @@
+// Package series aggregates data frames into time buckets.
+//
+// Aggregation is done in Go rather than SQL so that every store backend
+// returns identical results.
+package series
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"git.netflux.io/rob/solar-toolkit/inverter"
+)
+
+// Unit is the unit of a bucket size.
+type Unit byte
+
+const (
+	Minute Unit = 'm'
+	Hour   Unit = 'h'
+	Day    Unit = 'd'
+	Week   Unit = 'w'
+	Month  Unit = 'M'
+)
+
+// Bucket is a bucket size, e.g. 15 minutes or 1 day. Minute and hour buckets
+// may span several units; day, week and month buckets span exactly one.
+type Bucket struct {
+	N    int
+	Unit Unit
+}
+
+func (b Bucket) String() string { return strconv.Itoa(b.N) + string(b.Unit) }
+
+// ParseBucket parses a bucket size such as "5m", "1h", "1d", "1w" or "1M".
+func ParseBucket(s string) (Bucket, error) {
+	if len(s) < 2 {
+		return Bucket{}, fmt.Errorf("invalid bucket `%s`", s)
+	}
+
+	n, err := strconv.Atoi(s[:len(s)-1])
+	if err != nil || n < 1 {
+		return Bucket{}, fmt.Errorf("invalid bucket `%s`", s)
+	}
+
+	b := Bucket{N: n, Unit: Unit(s[len(s)-1])}
+	switch b.Unit {
+	case Minute:
+		if n >= 60 || 60%n != 0 {
+			return Bucket{}, fmt.Errorf("invalid bucket `%s`: minutes must divide an hour", s)
+		}
+	case Hour:
+		if n >= 24 || 24%n != 0 {
+			return Bucket{}, fmt.Errorf("invalid bucket `%s`: hours must divide a day", s)
+		}
+	case Day, Week, Month:
+		if n != 1 {
+			return Bucket{}, fmt.Errorf("invalid bucket `%s`: only 1%c is supported", s, b.Unit)
+		}
+	default:
+		return Bucket{}, fmt.Errorf("invalid bucket `%s`: unknown unit", s)
+	}
+
+	return b, nil
+}
+
+// Start returns the start of the bucket containing t. Buckets are aligned to
+// the wall clock of loc, e.g. days start at local midnight and weeks on
+// Monday.
+func (b Bucket) Start(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	y, mo, d := t.Date()
+
+	switch b.Unit {
+	case Minute:
+		return time.Date(y, mo, d, t.Hour(), t.Minute()-t.Minute()%b.N, 0, 0, loc)
+	case Hour:
+		return time.Date(y, mo, d, t.Hour()-t.Hour()%b.N, 0, 0, 0, loc)
+	case Day:
+		return time.Date(y, mo, d, 0, 0, 0, 0, loc)
+	case Week:
+		return time.Date(y, mo, d-(int(t.Weekday())+6)%7, 0, 0, 0, 0, loc)
+	default:
+		return time.Date(y, mo, 1, 0, 0, 0, 0, loc)
+	}
+}
+
+// Aggregation is a function aggregating the values within a bucket.
+type Aggregation string
+
+const (
+	Avg  Aggregation = "avg"
+	Min  Aggregation = "min"
+	Max  Aggregation = "max"
+	Last Aggregation = "last"
+)
+
+// ParseAggregation parses an aggregation name.
+func ParseAggregation(s string) (Aggregation, error) {
+	switch a := Aggregation(s); a {
+	case Avg, Min, Max, Last:
+		return a, nil
+	default:
+		return "", fmt.Errorf("unknown aggregation `%s`", s)
+	}
+}
+
+// Point is a single aggregated bucket. Fields without any values in the
+// bucket are omitted from Values.
+type Point struct {
+	Start  time.Time          `json:"start"`
+	Values map[string]float64 `json:"values"`
+}
+
+type acc struct {
+	sum, min, max, last float64
+	n                   int
+}
+
+// Aggregate aggregates the fields of the frames, which must be ordered by
+// timestamp, into buckets. Empty buckets are omitted.
+func Aggregate(frames []*inverter.ETDataFrame, fields []inverter.Field, bucket Bucket, agg Aggregation, loc *time.Location) []Point {
+	var points []Point
+	var accs []acc
+
+	flush := func() {
+		if len(points) == 0 {
+			return
+		}
+		p := &points[len(points)-1]
+		for i, f := range fields {
+			a := accs[i]
+			if a.n == 0 {
+				continue
+			}
+			switch agg {
+			case Avg:
+				p.Values[f.Name] = a.sum / float64(a.n)
+			case Min:
+				p.Values[f.Name] = a.min
+			case Max:
+				p.Values[f.Name] = a.max
+			case Last:
+				p.Values[f.Name] = a.last
+			}
+		}
+	}
+
+	for _, frame := range frames {
+		if frame.ETRuntimeData == nil {
+			continue
+		}
+
+		start := bucket.Start(frame.Timestamp, loc)
+		if len(points) == 0 || !points[len(points)-1].Start.Equal(start) {
+			flush()
+			points = append(points, Point{Start: start, Values: make(map[string]float64)})
+			accs = make([]acc, len(fields))
+		}
+
+		for i, f := range fields {
+			v, ok := f.Value(frame)
+			if !ok || math.IsNaN(v) {
+				continue
+			}
+			a := &accs[i]
+			if a.n == 0 {
+				a.min, a.max = v, v
+			}
+			a.sum += v
+			a.min = min(a.min, v)
+			a.max = max(a.max, v)
+			a.last = v
+			a.n++
+		}
+	}
+	flush()
+
+	return points
+}
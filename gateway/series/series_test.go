@@ -0,0 +1,129 @@
+package series_test
+
+import (
+	"testing"
+	"time"
+
+	"git.netflux.io/rob/solar-toolkit/gateway/series"
+	"git.netflux.io/rob/solar-toolkit/inverter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBucket(t *testing.T) {
+	testCases := []struct {
+		in      string
+		want    series.Bucket
+		wantErr string
+	}{
+		{in: "1m", want: series.Bucket{N: 1, Unit: series.Minute}},
+		{in: "15m", want: series.Bucket{N: 15, Unit: series.Minute}},
+		{in: "6h", want: series.Bucket{N: 6, Unit: series.Hour}},
+		{in: "1d", want: series.Bucket{N: 1, Unit: series.Day}},
+		{in: "1w", want: series.Bucket{N: 1, Unit: series.Week}},
+		{in: "1M", want: series.Bucket{N: 1, Unit: series.Month}},
+		{in: "", wantErr: "invalid bucket ``"},
+		{in: "m", wantErr: "invalid bucket `m`"},
+		{in: "0m", wantErr: "invalid bucket `0m`"},
+		{in: "7m", wantErr: "invalid bucket `7m`: minutes must divide an hour"},
+		{in: "60m", wantErr: "invalid bucket `60m`: minutes must divide an hour"},
+		{in: "5h", wantErr: "invalid bucket `5h`: hours must divide a day"},
+		{in: "2d", wantErr: "invalid bucket `2d`: only 1d is supported"},
+		{in: "1y", wantErr: "invalid bucket `1y`: unknown unit"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.in, func(t *testing.T) {
+			b, err := series.ParseBucket(tc.in)
+			if tc.wantErr != "" {
+				assert.EqualError(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, b)
+			assert.Equal(t, tc.in, b.String())
+		})
+	}
+}
+
+func TestBucketStart(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Madrid")
+	require.NoError(t, err)
+
+	// Thursday 2022-07-14 00:37:12 in Madrid.
+	ts := time.Date(2022, 7, 13, 22, 37, 12, 0, time.UTC)
+
+	testCases := []struct {
+		bucket string
+		want   time.Time
+	}{
+		{bucket: "1m", want: time.Date(2022, 7, 14, 0, 37, 0, 0, loc)},
+		{bucket: "15m", want: time.Date(2022, 7, 14, 0, 30, 0, 0, loc)},
+		{bucket: "1h", want: time.Date(2022, 7, 14, 0, 0, 0, 0, loc)},
+		{bucket: "1d", want: time.Date(2022, 7, 14, 0, 0, 0, 0, loc)},
+		{bucket: "1w", want: time.Date(2022, 7, 11, 0, 0, 0, 0, loc)},
+		{bucket: "1M", want: time.Date(2022, 7, 1, 0, 0, 0, 0, loc)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.bucket, func(t *testing.T) {
+			b, err := series.ParseBucket(tc.bucket)
+			require.NoError(t, err)
+			assert.True(t, tc.want.Equal(b.Start(ts, loc)), "got %s", b.Start(ts, loc))
+		})
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	frame := func(ts string, pvPower float64) *inverter.ETDataFrame {
+		timestamp, err := time.Parse(time.RFC3339, ts)
+		require.NoError(t, err)
+		return &inverter.ETDataFrame{ETRuntimeData: &inverter.ETRuntimeData{Timestamp: timestamp, PVPower: inverter.Power(pvPower)}}
+	}
+
+	frames := []*inverter.ETDataFrame{
+		frame("2022-07-14T10:00:00Z", 100),
+		frame("2022-07-14T10:20:00Z", 300),
+		frame("2022-07-14T10:40:00Z", 200),
+		frame("2022-07-14T12:10:00Z", 50),
+	}
+	fields, err := inverter.MatchFields([]string{"pv_power", "meter_frequency"})
+	require.NoError(t, err)
+	bucket, err := series.ParseBucket("1h")
+	require.NoError(t, err)
+
+	testCases := []struct {
+		agg  series.Aggregation
+		want []float64
+	}{
+		{agg: series.Avg, want: []float64{200, 50}},
+		{agg: series.Min, want: []float64{100, 50}},
+		{agg: series.Max, want: []float64{300, 50}},
+		{agg: series.Last, want: []float64{200, 50}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(string(tc.agg), func(t *testing.T) {
+			points := series.Aggregate(frames, fields, bucket, tc.agg, time.UTC)
+			require.Len(t, points, 2)
+
+			assert.Equal(t, time.Date(2022, 7, 14, 10, 0, 0, 0, time.UTC), points[0].Start)
+			assert.Equal(t, map[string]float64{"pv_power": tc.want[0]}, points[0].Values)
+			assert.Equal(t, time.Date(2022, 7, 14, 12, 0, 0, 0, time.UTC), points[1].Start)
+			assert.Equal(t, map[string]float64{"pv_power": tc.want[1]}, points[1].Values)
+		})
+	}
+
+	t.Run("no frames", func(t *testing.T) {
+		assert.Empty(t, series.Aggregate(nil, fields, bucket, series.Avg, time.UTC))
+	})
+}
+
+func TestParseAggregation(t *testing.T) {
+	agg, err := series.ParseAggregation("max")
+	require.NoError(t, err)
+	assert.Equal(t, series.Max, agg)
+
+	_, err = series.ParseAggregation("median")
+	assert.EqualError(t, err, "unknown aggregation `median`")
+}
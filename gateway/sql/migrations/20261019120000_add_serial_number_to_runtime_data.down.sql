@@ -0,0 +1,5 @@
+DROP INDEX index_et_runtime_data_on_timestamp;
+DROP INDEX index_et_runtime_data_on_serial_number_and_timestamp;
+CREATE UNIQUE INDEX index_et_runtime_data_on_timestamp ON et_runtime_data (timestamp);
+
+ALTER TABLE et_runtime_data DROP COLUMN serial_number;
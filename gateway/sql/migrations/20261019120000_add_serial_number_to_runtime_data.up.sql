@@ -0,0 +1,5 @@
+ALTER TABLE et_runtime_data ADD COLUMN serial_number TEXT NOT NULL DEFAULT '';
+
+DROP INDEX index_et_runtime_data_on_timestamp;
+CREATE UNIQUE INDEX index_et_runtime_data_on_serial_number_and_timestamp ON et_runtime_data (serial_number, timestamp);
+CREATE INDEX index_et_runtime_data_on_timestamp ON et_runtime_data (timestamp);
@@ -0,0 +1,7 @@
+CREATE TABLE idempotency_keys (
+  key TEXT PRIMARY KEY,
+  response TEXT NOT NULL,
+  created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX index_idempotency_keys_on_created_at ON idempotency_keys (created_at);
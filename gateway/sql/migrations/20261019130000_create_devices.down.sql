@@ -0,0 +1,3 @@
+ALTER TABLE et_runtime_data DROP COLUMN device_id;
+
+DROP TABLE devices;
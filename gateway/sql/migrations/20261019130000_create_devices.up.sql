@@ -0,0 +1,30 @@
+CREATE TABLE devices (
+  id SERIAL PRIMARY KEY,
+  serial_number TEXT NOT NULL,
+  model_name TEXT NOT NULL DEFAULT '',
+  rated_power INT NOT NULL DEFAULT 0,
+  modbus_version INT NOT NULL DEFAULT 0,
+  ac_output_type INT NOT NULL DEFAULT 0,
+  dsp1_sw_version INT NOT NULL DEFAULT 0,
+  dsp2_sw_version INT NOT NULL DEFAULT 0,
+  dsp_svn_version INT NOT NULL DEFAULT 0,
+  arm_sw_version INT NOT NULL DEFAULT 0,
+  arm_svn_version INT NOT NULL DEFAULT 0,
+  software_version TEXT NOT NULL DEFAULT '',
+  arm_version TEXT NOT NULL DEFAULT '',
+  single_phase BOOLEAN NOT NULL DEFAULT FALSE,
+  created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX index_devices_on_serial_number ON devices (serial_number);
+
+-- Register a device for each serial number already present, including the
+-- empty serial number of frames sent by daemons which did not report one.
+INSERT INTO devices (serial_number) SELECT DISTINCT serial_number FROM et_runtime_data;
+
+ALTER TABLE et_runtime_data ADD COLUMN device_id INT REFERENCES devices (id);
+UPDATE et_runtime_data SET device_id = devices.id FROM devices WHERE devices.serial_number = et_runtime_data.serial_number;
+ALTER TABLE et_runtime_data ALTER COLUMN device_id SET NOT NULL;
+
+CREATE INDEX index_et_runtime_data_on_device_id ON et_runtime_data (device_id);
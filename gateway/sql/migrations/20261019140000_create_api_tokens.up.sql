@@ -0,0 +1,10 @@
+CREATE TABLE api_tokens (
+  id SERIAL PRIMARY KEY,
+  device_id INT NOT NULL REFERENCES devices (id),
+  name TEXT NOT NULL DEFAULT '',
+  token_hash TEXT NOT NULL,
+  created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  revoked_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE UNIQUE INDEX index_api_tokens_on_token_hash ON api_tokens (token_hash);
@@ -0,0 +1,119 @@
+CREATE TABLE et_runtime_data_restored (
+  timestamp TIMESTAMP WITH TIME ZONE NOT NULL,
+  pv1_voltage DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  pv1_current DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  pv1_power DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  pv2_voltage DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  pv2_current DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  pv2_power DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  pv_power DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  pv2_mode INT NOT NULL DEFAULT 0,
+  pv1_mode INT NOT NULL DEFAULT 0,
+  on_grid_l1_voltage DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  on_grid_l1_current DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  on_grid_l1_frequency DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  on_grid_l1_power DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  on_grid_l2_voltage DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  on_grid_l2_current DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  on_grid_l2_frequency DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  on_grid_l2_power DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  on_grid_l3_voltage DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  on_grid_l3_current DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  on_grid_l3_frequency DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  on_grid_l3_power DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  grid_mode INT NOT NULL DEFAULT 0,
+  total_inverter_power DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  active_power DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  reactive_power DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  apparent_power DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  backup_l1_voltage DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  backup_l1_current DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  backup_l1_frequency DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  load_mode_l1 INT NOT NULL DEFAULT 0,
+  backup_l1_power DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  backup_l2_voltage DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  backup_l2_current DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  backup_l2_frequency DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  load_mode_l2 INT NOT NULL DEFAULT 0,
+  backup_l2_power DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  backup_l3_voltage DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  backup_l3_current DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  backup_l3_frequency DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  load_mode_l3 INT NOT NULL DEFAULT 0,
+  backup_l3_power DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  load_l1 DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  load_l2 DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  load_l3 DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  backup_load DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  load DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  ups_load DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  temperature_air DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  temperature_module DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  temperature DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  bus_voltage DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  nbus_voltage DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  battery_voltage DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  battery_current DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  battery_mode INT NOT NULL DEFAULT 0,
+  warning_code INT NOT NULL DEFAULT 0,
+  safety_country_code INT NOT NULL DEFAULT 0,
+  work_mode INT NOT NULL DEFAULT 0,
+  operation_code INT NOT NULL DEFAULT 0,
+  energy_generation_total DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  energy_generation_today DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  energy_export_total DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  energy_export_total_hours DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  energy_export_today DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  energy_import_total DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  energy_import_today DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  energy_load_total DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  energy_load_day DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  battery_charge_total DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  battery_charge_today DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  battery_discharge_total DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  battery_discharge_today DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  house_consumption DOUBLE PRECISION NOT NULL DEFAULT 0.0,
+  created_at TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+  meter_test_status INT NOT NULL DEFAULT 0,
+  meter_comm_status INT NOT NULL DEFAULT 0,
+  active_power_l1 DOUBLE PRECISION NOT NULL DEFAULT 0,
+  active_power_l2 DOUBLE PRECISION NOT NULL DEFAULT 0,
+  active_power_l3 DOUBLE PRECISION NOT NULL DEFAULT 0,
+  active_power_total DOUBLE PRECISION NOT NULL DEFAULT 0,
+  reactive_power_total DOUBLE PRECISION NOT NULL DEFAULT 0,
+  meter_power_factor1 DOUBLE PRECISION NOT NULL DEFAULT 0,
+  meter_power_factor2 DOUBLE PRECISION NOT NULL DEFAULT 0,
+  meter_power_factor3 DOUBLE PRECISION NOT NULL DEFAULT 0,
+  meter_power_factor DOUBLE PRECISION NOT NULL DEFAULT 0,
+  meter_frequency DOUBLE PRECISION NOT NULL DEFAULT 0,
+  meter_energy_export_total DOUBLE PRECISION NOT NULL DEFAULT 0,
+  meter_energy_import_total DOUBLE PRECISION NOT NULL DEFAULT 0,
+  meter_active_power1 DOUBLE PRECISION NOT NULL DEFAULT 0,
+  meter_active_power2 DOUBLE PRECISION NOT NULL DEFAULT 0,
+  meter_active_power3 DOUBLE PRECISION NOT NULL DEFAULT 0,
+  meter_active_power_total DOUBLE PRECISION NOT NULL DEFAULT 0,
+  meter_reactive_power1 DOUBLE PRECISION NOT NULL DEFAULT 0,
+  meter_reactive_power2 DOUBLE PRECISION NOT NULL DEFAULT 0,
+  meter_reactive_power3 DOUBLE PRECISION NOT NULL DEFAULT 0,
+  meter_reactive_power_total DOUBLE PRECISION NOT NULL DEFAULT 0,
+  meter_apparent_power1 DOUBLE PRECISION NOT NULL DEFAULT 0,
+  meter_apparent_power2 DOUBLE PRECISION NOT NULL DEFAULT 0,
+  meter_apparent_power3 DOUBLE PRECISION NOT NULL DEFAULT 0,
+  meter_apparent_power_total DOUBLE PRECISION NOT NULL DEFAULT 0,
+  meter_software_version INT NOT NULL DEFAULT 0,
+  serial_number TEXT NOT NULL DEFAULT '',
+  device_id INT NOT NULL REFERENCES devices (id)
+);
+
+INSERT INTO et_runtime_data_restored (timestamp, pv1_voltage, pv1_current, pv1_power, pv2_voltage, pv2_current, pv2_power, pv_power, pv2_mode, pv1_mode, on_grid_l1_voltage, on_grid_l1_current, on_grid_l1_frequency, on_grid_l1_power, on_grid_l2_voltage, on_grid_l2_current, on_grid_l2_frequency, on_grid_l2_power, on_grid_l3_voltage, on_grid_l3_current, on_grid_l3_frequency, on_grid_l3_power, grid_mode, total_inverter_power, active_power, reactive_power, apparent_power, backup_l1_voltage, backup_l1_current, backup_l1_frequency, load_mode_l1, backup_l1_power, backup_l2_voltage, backup_l2_current, backup_l2_frequency, load_mode_l2, backup_l2_power, backup_l3_voltage, backup_l3_current, backup_l3_frequency, load_mode_l3, backup_l3_power, load_l1, load_l2, load_l3, backup_load, load, ups_load, temperature_air, temperature_module, temperature, bus_voltage, nbus_voltage, battery_voltage, battery_current, battery_mode, warning_code, safety_country_code, work_mode, operation_code, energy_generation_total, energy_generation_today, energy_export_total, energy_export_total_hours, energy_export_today, energy_import_total, energy_import_today, energy_load_total, energy_load_day, battery_charge_total, battery_charge_today, battery_discharge_total, battery_discharge_today, house_consumption, created_at, meter_test_status, meter_comm_status, active_power_l1, active_power_l2, active_power_l3, active_power_total, reactive_power_total, meter_power_factor1, meter_power_factor2, meter_power_factor3, meter_power_factor, meter_frequency, meter_energy_export_total, meter_energy_import_total, meter_active_power1, meter_active_power2, meter_active_power3, meter_active_power_total, meter_reactive_power1, meter_reactive_power2, meter_reactive_power3, meter_reactive_power_total, meter_apparent_power1, meter_apparent_power2, meter_apparent_power3, meter_apparent_power_total, meter_software_version, serial_number, device_id)
+SELECT timestamp, pv1_voltage, pv1_current, pv1_power, pv2_voltage, pv2_current, pv2_power, pv_power, pv2_mode, pv1_mode, on_grid_l1_voltage, on_grid_l1_current, on_grid_l1_frequency, on_grid_l1_power, on_grid_l2_voltage, on_grid_l2_current, on_grid_l2_frequency, on_grid_l2_power, on_grid_l3_voltage, on_grid_l3_current, on_grid_l3_frequency, on_grid_l3_power, grid_mode, total_inverter_power, active_power, reactive_power, apparent_power, backup_l1_voltage, backup_l1_current, backup_l1_frequency, load_mode_l1, backup_l1_power, backup_l2_voltage, backup_l2_current, backup_l2_frequency, load_mode_l2, backup_l2_power, backup_l3_voltage, backup_l3_current, backup_l3_frequency, load_mode_l3, backup_l3_power, load_l1, load_l2, load_l3, backup_load, load, ups_load, temperature_air, temperature_module, temperature, bus_voltage, nbus_voltage, battery_voltage, battery_current, battery_mode, warning_code, safety_country_code, work_mode, operation_code, energy_generation_total, energy_generation_today, energy_export_total, energy_export_total_hours, energy_export_today, energy_import_total, energy_import_today, energy_load_total, energy_load_day, battery_charge_total, battery_charge_today, battery_discharge_total, battery_discharge_today, house_consumption, created_at, meter_test_status, meter_comm_status, active_power_l1, active_power_l2, active_power_l3, active_power_total, reactive_power_total, meter_power_factor1, meter_power_factor2, meter_power_factor3, meter_power_factor, meter_frequency, meter_energy_export_total, meter_energy_import_total, meter_active_power1, meter_active_power2, meter_active_power3, meter_active_power_total, meter_reactive_power1, meter_reactive_power2, meter_reactive_power3, meter_reactive_power_total, meter_apparent_power1, meter_apparent_power2, meter_apparent_power3, meter_apparent_power_total, meter_software_version, serial_number, device_id
+FROM et_runtime_data;
+
+DROP VIEW et_runtime_data;
+DROP TABLE frames;
+
+ALTER TABLE et_runtime_data_restored RENAME TO et_runtime_data;
+
+CREATE UNIQUE INDEX index_et_runtime_data_on_serial_number_and_timestamp ON et_runtime_data (serial_number, timestamp);
+CREATE INDEX index_et_runtime_data_on_timestamp ON et_runtime_data (timestamp);
+CREATE INDEX index_et_runtime_data_on_device_id ON et_runtime_data (device_id);
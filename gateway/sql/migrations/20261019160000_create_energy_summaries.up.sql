@@ -0,0 +1,15 @@
+CREATE TABLE energy_summaries (
+  device_id INT NOT NULL REFERENCES devices (id),
+  period TEXT NOT NULL,
+  start TIMESTAMP WITH TIME ZONE NOT NULL,
+  generation DOUBLE PRECISION NOT NULL,
+  export DOUBLE PRECISION NOT NULL,
+  import DOUBLE PRECISION NOT NULL,
+  consumption DOUBLE PRECISION NOT NULL,
+  battery_charge DOUBLE PRECISION NOT NULL,
+  battery_discharge DOUBLE PRECISION NOT NULL,
+  self_consumption DOUBLE PRECISION NOT NULL,
+  self_sufficiency DOUBLE PRECISION NOT NULL,
+  updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (device_id, period, start)
+);
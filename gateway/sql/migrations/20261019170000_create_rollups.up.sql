@@ -0,0 +1,10 @@
+CREATE TABLE rollups (
+  device_id INT NOT NULL REFERENCES devices (id),
+  resolution TEXT NOT NULL,
+  start TIMESTAMP WITH TIME ZONE NOT NULL,
+  avg JSONB NOT NULL,
+  min JSONB NOT NULL,
+  max JSONB NOT NULL,
+  updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (device_id, resolution, start)
+);
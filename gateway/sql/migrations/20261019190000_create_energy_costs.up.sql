@@ -0,0 +1,11 @@
+CREATE TABLE energy_costs (
+  device_id INT NOT NULL REFERENCES devices (id),
+  start TIMESTAMP WITH TIME ZONE NOT NULL,
+  currency TEXT NOT NULL,
+  import JSONB NOT NULL,
+  export JSONB NOT NULL,
+  standing_charge DOUBLE PRECISION NOT NULL,
+  savings DOUBLE PRECISION NOT NULL,
+  updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (device_id, start)
+);
@@ -0,0 +1,108 @@
+CREATE OR REPLACE VIEW et_runtime_data AS
+SELECT
+  frames.timestamp,
+  COALESCE((frames.data->>'pv1_voltage')::DOUBLE PRECISION, 0) AS pv1_voltage,
+  COALESCE((frames.data->>'pv1_current')::DOUBLE PRECISION, 0) AS pv1_current,
+  COALESCE((frames.data->>'pv1_power')::DOUBLE PRECISION, 0) AS pv1_power,
+  COALESCE((frames.data->>'pv2_voltage')::DOUBLE PRECISION, 0) AS pv2_voltage,
+  COALESCE((frames.data->>'pv2_current')::DOUBLE PRECISION, 0) AS pv2_current,
+  COALESCE((frames.data->>'pv2_power')::DOUBLE PRECISION, 0) AS pv2_power,
+  COALESCE((frames.data->>'pv_power')::DOUBLE PRECISION, 0) AS pv_power,
+  COALESCE((frames.data->>'pv2_mode')::INT, 0) AS pv2_mode,
+  COALESCE((frames.data->>'pv1_mode')::INT, 0) AS pv1_mode,
+  COALESCE((frames.data->>'on_grid_l1_voltage')::DOUBLE PRECISION, 0) AS on_grid_l1_voltage,
+  COALESCE((frames.data->>'on_grid_l1_current')::DOUBLE PRECISION, 0) AS on_grid_l1_current,
+  COALESCE((frames.data->>'on_grid_l1_frequency')::DOUBLE PRECISION, 0) AS on_grid_l1_frequency,
+  COALESCE((frames.data->>'on_grid_l1_power')::DOUBLE PRECISION, 0) AS on_grid_l1_power,
+  COALESCE((frames.data->>'on_grid_l2_voltage')::DOUBLE PRECISION, 0) AS on_grid_l2_voltage,
+  COALESCE((frames.data->>'on_grid_l2_current')::DOUBLE PRECISION, 0) AS on_grid_l2_current,
+  COALESCE((frames.data->>'on_grid_l2_frequency')::DOUBLE PRECISION, 0) AS on_grid_l2_frequency,
+  COALESCE((frames.data->>'on_grid_l2_power')::DOUBLE PRECISION, 0) AS on_grid_l2_power,
+  COALESCE((frames.data->>'on_grid_l3_voltage')::DOUBLE PRECISION, 0) AS on_grid_l3_voltage,
+  COALESCE((frames.data->>'on_grid_l3_current')::DOUBLE PRECISION, 0) AS on_grid_l3_current,
+  COALESCE((frames.data->>'on_grid_l3_frequency')::DOUBLE PRECISION, 0) AS on_grid_l3_frequency,
+  COALESCE((frames.data->>'on_grid_l3_power')::DOUBLE PRECISION, 0) AS on_grid_l3_power,
+  COALESCE((frames.data->>'grid_mode')::INT, 0) AS grid_mode,
+  COALESCE((frames.data->>'total_inverter_power')::DOUBLE PRECISION, 0) AS total_inverter_power,
+  COALESCE((frames.data->>'active_power')::DOUBLE PRECISION, 0) AS active_power,
+  COALESCE((frames.data->>'reactive_power')::DOUBLE PRECISION, 0) AS reactive_power,
+  COALESCE((frames.data->>'apparent_power')::DOUBLE PRECISION, 0) AS apparent_power,
+  COALESCE((frames.data->>'backup_l1_voltage')::DOUBLE PRECISION, 0) AS backup_l1_voltage,
+  COALESCE((frames.data->>'backup_l1_current')::DOUBLE PRECISION, 0) AS backup_l1_current,
+  COALESCE((frames.data->>'backup_l1_frequency')::DOUBLE PRECISION, 0) AS backup_l1_frequency,
+  COALESCE((frames.data->>'load_mode_l1')::INT, 0) AS load_mode_l1,
+  COALESCE((frames.data->>'backup_l1_power')::DOUBLE PRECISION, 0) AS backup_l1_power,
+  COALESCE((frames.data->>'backup_l2_voltage')::DOUBLE PRECISION, 0) AS backup_l2_voltage,
+  COALESCE((frames.data->>'backup_l2_current')::DOUBLE PRECISION, 0) AS backup_l2_current,
+  COALESCE((frames.data->>'backup_l2_frequency')::DOUBLE PRECISION, 0) AS backup_l2_frequency,
+  COALESCE((frames.data->>'load_mode_l2')::INT, 0) AS load_mode_l2,
+  COALESCE((frames.data->>'backup_l2_power')::DOUBLE PRECISION, 0) AS backup_l2_power,
+  COALESCE((frames.data->>'backup_l3_voltage')::DOUBLE PRECISION, 0) AS backup_l3_voltage,
+  COALESCE((frames.data->>'backup_l3_current')::DOUBLE PRECISION, 0) AS backup_l3_current,
+  COALESCE((frames.data->>'backup_l3_frequency')::DOUBLE PRECISION, 0) AS backup_l3_frequency,
+  COALESCE((frames.data->>'load_mode_l3')::INT, 0) AS load_mode_l3,
+  COALESCE((frames.data->>'backup_l3_power')::DOUBLE PRECISION, 0) AS backup_l3_power,
+  COALESCE((frames.data->>'load_l1')::DOUBLE PRECISION, 0) AS load_l1,
+  COALESCE((frames.data->>'load_l2')::DOUBLE PRECISION, 0) AS load_l2,
+  COALESCE((frames.data->>'load_l3')::DOUBLE PRECISION, 0) AS load_l3,
+  COALESCE((frames.data->>'backup_load')::DOUBLE PRECISION, 0) AS backup_load,
+  COALESCE((frames.data->>'load')::DOUBLE PRECISION, 0) AS load,
+  COALESCE((frames.data->>'ups_load')::DOUBLE PRECISION, 0) AS ups_load,
+  COALESCE((frames.data->>'temperature_air')::DOUBLE PRECISION, 0) AS temperature_air,
+  COALESCE((frames.data->>'temperature_module')::DOUBLE PRECISION, 0) AS temperature_module,
+  COALESCE((frames.data->>'temperature')::DOUBLE PRECISION, 0) AS temperature,
+  COALESCE((frames.data->>'bus_voltage')::DOUBLE PRECISION, 0) AS bus_voltage,
+  COALESCE((frames.data->>'nbus_voltage')::DOUBLE PRECISION, 0) AS nbus_voltage,
+  COALESCE((frames.data->>'battery_voltage')::DOUBLE PRECISION, 0) AS battery_voltage,
+  COALESCE((frames.data->>'battery_current')::DOUBLE PRECISION, 0) AS battery_current,
+  COALESCE((frames.data->>'battery_mode')::INT, 0) AS battery_mode,
+  COALESCE((frames.data->>'warning_code')::INT, 0) AS warning_code,
+  COALESCE((frames.data->>'safety_country_code')::INT, 0) AS safety_country_code,
+  COALESCE((frames.data->>'work_mode')::INT, 0) AS work_mode,
+  COALESCE((frames.data->>'operation_code')::INT, 0) AS operation_code,
+  COALESCE((frames.data->>'energy_generation_total')::DOUBLE PRECISION, 0) AS energy_generation_total,
+  COALESCE((frames.data->>'energy_generation_today')::DOUBLE PRECISION, 0) AS energy_generation_today,
+  COALESCE((frames.data->>'energy_export_total')::DOUBLE PRECISION, 0) AS energy_export_total,
+  COALESCE((frames.data->>'energy_export_total_hours')::DOUBLE PRECISION, 0) AS energy_export_total_hours,
+  COALESCE((frames.data->>'energy_export_today')::DOUBLE PRECISION, 0) AS energy_export_today,
+  COALESCE((frames.data->>'energy_import_total')::DOUBLE PRECISION, 0) AS energy_import_total,
+  COALESCE((frames.data->>'energy_import_today')::DOUBLE PRECISION, 0) AS energy_import_today,
+  COALESCE((frames.data->>'energy_load_total')::DOUBLE PRECISION, 0) AS energy_load_total,
+  COALESCE((frames.data->>'energy_load_day')::DOUBLE PRECISION, 0) AS energy_load_day,
+  COALESCE((frames.data->>'battery_charge_total')::DOUBLE PRECISION, 0) AS battery_charge_total,
+  COALESCE((frames.data->>'battery_charge_today')::DOUBLE PRECISION, 0) AS battery_charge_today,
+  COALESCE((frames.data->>'battery_discharge_total')::DOUBLE PRECISION, 0) AS battery_discharge_total,
+  COALESCE((frames.data->>'battery_discharge_today')::DOUBLE PRECISION, 0) AS battery_discharge_today,
+  COALESCE((frames.data->>'house_consumption')::DOUBLE PRECISION, 0) AS house_consumption,
+  frames.created_at,
+  COALESCE((frames.data->>'meter_test_status')::INT, 0) AS meter_test_status,
+  COALESCE((frames.data->>'meter_comm_status')::INT, 0) AS meter_comm_status,
+  COALESCE((frames.data->>'active_power_l1')::DOUBLE PRECISION, 0) AS active_power_l1,
+  COALESCE((frames.data->>'active_power_l2')::DOUBLE PRECISION, 0) AS active_power_l2,
+  COALESCE((frames.data->>'active_power_l3')::DOUBLE PRECISION, 0) AS active_power_l3,
+  COALESCE((frames.data->>'active_power_total')::DOUBLE PRECISION, 0) AS active_power_total,
+  COALESCE((frames.data->>'reactive_power_total')::DOUBLE PRECISION, 0) AS reactive_power_total,
+  COALESCE((frames.data->>'meter_power_factor1')::DOUBLE PRECISION, 0) AS meter_power_factor1,
+  COALESCE((frames.data->>'meter_power_factor2')::DOUBLE PRECISION, 0) AS meter_power_factor2,
+  COALESCE((frames.data->>'meter_power_factor3')::DOUBLE PRECISION, 0) AS meter_power_factor3,
+  COALESCE((frames.data->>'meter_power_factor')::DOUBLE PRECISION, 0) AS meter_power_factor,
+  COALESCE((frames.data->>'meter_frequency')::DOUBLE PRECISION, 0) AS meter_frequency,
+  COALESCE((frames.data->>'meter_energy_export_total')::DOUBLE PRECISION, 0) AS meter_energy_export_total,
+  COALESCE((frames.data->>'meter_energy_import_total')::DOUBLE PRECISION, 0) AS meter_energy_import_total,
+  COALESCE((frames.data->>'meter_active_power1')::DOUBLE PRECISION, 0) AS meter_active_power1,
+  COALESCE((frames.data->>'meter_active_power2')::DOUBLE PRECISION, 0) AS meter_active_power2,
+  COALESCE((frames.data->>'meter_active_power3')::DOUBLE PRECISION, 0) AS meter_active_power3,
+  COALESCE((frames.data->>'meter_active_power_total')::DOUBLE PRECISION, 0) AS meter_active_power_total,
+  COALESCE((frames.data->>'meter_reactive_power1')::DOUBLE PRECISION, 0) AS meter_reactive_power1,
+  COALESCE((frames.data->>'meter_reactive_power2')::DOUBLE PRECISION, 0) AS meter_reactive_power2,
+  COALESCE((frames.data->>'meter_reactive_power3')::DOUBLE PRECISION, 0) AS meter_reactive_power3,
+  COALESCE((frames.data->>'meter_reactive_power_total')::DOUBLE PRECISION, 0) AS meter_reactive_power_total,
+  COALESCE((frames.data->>'meter_apparent_power1')::DOUBLE PRECISION, 0) AS meter_apparent_power1,
+  COALESCE((frames.data->>'meter_apparent_power2')::DOUBLE PRECISION, 0) AS meter_apparent_power2,
+  COALESCE((frames.data->>'meter_apparent_power3')::DOUBLE PRECISION, 0) AS meter_apparent_power3,
+  COALESCE((frames.data->>'meter_apparent_power_total')::DOUBLE PRECISION, 0) AS meter_apparent_power_total,
+  COALESCE((frames.data->>'meter_software_version')::INT, 0) AS meter_software_version,
+  devices.serial_number,
+  frames.device_id
+FROM frames
+JOIN devices ON devices.id = frames.device_id;
@@ -0,0 +1,110 @@
+-- Absent and unavailable readings are NULL rather than zero, so that charts
+-- show gaps instead of fake zeros.
+CREATE OR REPLACE VIEW et_runtime_data AS
+SELECT
+  frames.timestamp,
+  (frames.data->>'pv1_voltage')::DOUBLE PRECISION AS pv1_voltage,
+  (frames.data->>'pv1_current')::DOUBLE PRECISION AS pv1_current,
+  (frames.data->>'pv1_power')::DOUBLE PRECISION AS pv1_power,
+  (frames.data->>'pv2_voltage')::DOUBLE PRECISION AS pv2_voltage,
+  (frames.data->>'pv2_current')::DOUBLE PRECISION AS pv2_current,
+  (frames.data->>'pv2_power')::DOUBLE PRECISION AS pv2_power,
+  (frames.data->>'pv_power')::DOUBLE PRECISION AS pv_power,
+  (frames.data->>'pv2_mode')::INT AS pv2_mode,
+  (frames.data->>'pv1_mode')::INT AS pv1_mode,
+  (frames.data->>'on_grid_l1_voltage')::DOUBLE PRECISION AS on_grid_l1_voltage,
+  (frames.data->>'on_grid_l1_current')::DOUBLE PRECISION AS on_grid_l1_current,
+  (frames.data->>'on_grid_l1_frequency')::DOUBLE PRECISION AS on_grid_l1_frequency,
+  (frames.data->>'on_grid_l1_power')::DOUBLE PRECISION AS on_grid_l1_power,
+  (frames.data->>'on_grid_l2_voltage')::DOUBLE PRECISION AS on_grid_l2_voltage,
+  (frames.data->>'on_grid_l2_current')::DOUBLE PRECISION AS on_grid_l2_current,
+  (frames.data->>'on_grid_l2_frequency')::DOUBLE PRECISION AS on_grid_l2_frequency,
+  (frames.data->>'on_grid_l2_power')::DOUBLE PRECISION AS on_grid_l2_power,
+  (frames.data->>'on_grid_l3_voltage')::DOUBLE PRECISION AS on_grid_l3_voltage,
+  (frames.data->>'on_grid_l3_current')::DOUBLE PRECISION AS on_grid_l3_current,
+  (frames.data->>'on_grid_l3_frequency')::DOUBLE PRECISION AS on_grid_l3_frequency,
+  (frames.data->>'on_grid_l3_power')::DOUBLE PRECISION AS on_grid_l3_power,
+  (frames.data->>'grid_mode')::INT AS grid_mode,
+  (frames.data->>'total_inverter_power')::DOUBLE PRECISION AS total_inverter_power,
+  (frames.data->>'active_power')::DOUBLE PRECISION AS active_power,
+  (frames.data->>'reactive_power')::DOUBLE PRECISION AS reactive_power,
+  (frames.data->>'apparent_power')::DOUBLE PRECISION AS apparent_power,
+  (frames.data->>'backup_l1_voltage')::DOUBLE PRECISION AS backup_l1_voltage,
+  (frames.data->>'backup_l1_current')::DOUBLE PRECISION AS backup_l1_current,
+  (frames.data->>'backup_l1_frequency')::DOUBLE PRECISION AS backup_l1_frequency,
+  (frames.data->>'load_mode_l1')::INT AS load_mode_l1,
+  (frames.data->>'backup_l1_power')::DOUBLE PRECISION AS backup_l1_power,
+  (frames.data->>'backup_l2_voltage')::DOUBLE PRECISION AS backup_l2_voltage,
+  (frames.data->>'backup_l2_current')::DOUBLE PRECISION AS backup_l2_current,
+  (frames.data->>'backup_l2_frequency')::DOUBLE PRECISION AS backup_l2_frequency,
+  (frames.data->>'load_mode_l2')::INT AS load_mode_l2,
+  (frames.data->>'backup_l2_power')::DOUBLE PRECISION AS backup_l2_power,
+  (frames.data->>'backup_l3_voltage')::DOUBLE PRECISION AS backup_l3_voltage,
+  (frames.data->>'backup_l3_current')::DOUBLE PRECISION AS backup_l3_current,
+  (frames.data->>'backup_l3_frequency')::DOUBLE PRECISION AS backup_l3_frequency,
+  (frames.data->>'load_mode_l3')::INT AS load_mode_l3,
+  (frames.data->>'backup_l3_power')::DOUBLE PRECISION AS backup_l3_power,
+  (frames.data->>'load_l1')::DOUBLE PRECISION AS load_l1,
+  (frames.data->>'load_l2')::DOUBLE PRECISION AS load_l2,
+  (frames.data->>'load_l3')::DOUBLE PRECISION AS load_l3,
+  (frames.data->>'backup_load')::DOUBLE PRECISION AS backup_load,
+  (frames.data->>'load')::DOUBLE PRECISION AS load,
+  (frames.data->>'ups_load')::DOUBLE PRECISION AS ups_load,
+  (frames.data->>'temperature_air')::DOUBLE PRECISION AS temperature_air,
+  (frames.data->>'temperature_module')::DOUBLE PRECISION AS temperature_module,
+  (frames.data->>'temperature')::DOUBLE PRECISION AS temperature,
+  (frames.data->>'bus_voltage')::DOUBLE PRECISION AS bus_voltage,
+  (frames.data->>'nbus_voltage')::DOUBLE PRECISION AS nbus_voltage,
+  (frames.data->>'battery_voltage')::DOUBLE PRECISION AS battery_voltage,
+  (frames.data->>'battery_current')::DOUBLE PRECISION AS battery_current,
+  (frames.data->>'battery_mode')::INT AS battery_mode,
+  (frames.data->>'warning_code')::INT AS warning_code,
+  (frames.data->>'safety_country_code')::INT AS safety_country_code,
+  (frames.data->>'work_mode')::INT AS work_mode,
+  (frames.data->>'operation_code')::INT AS operation_code,
+  (frames.data->>'energy_generation_total')::DOUBLE PRECISION AS energy_generation_total,
+  (frames.data->>'energy_generation_today')::DOUBLE PRECISION AS energy_generation_today,
+  (frames.data->>'energy_export_total')::DOUBLE PRECISION AS energy_export_total,
+  (frames.data->>'energy_export_total_hours')::DOUBLE PRECISION AS energy_export_total_hours,
+  (frames.data->>'energy_export_today')::DOUBLE PRECISION AS energy_export_today,
+  (frames.data->>'energy_import_total')::DOUBLE PRECISION AS energy_import_total,
+  (frames.data->>'energy_import_today')::DOUBLE PRECISION AS energy_import_today,
+  (frames.data->>'energy_load_total')::DOUBLE PRECISION AS energy_load_total,
+  (frames.data->>'energy_load_day')::DOUBLE PRECISION AS energy_load_day,
+  (frames.data->>'battery_charge_total')::DOUBLE PRECISION AS battery_charge_total,
+  (frames.data->>'battery_charge_today')::DOUBLE PRECISION AS battery_charge_today,
+  (frames.data->>'battery_discharge_total')::DOUBLE PRECISION AS battery_discharge_total,
+  (frames.data->>'battery_discharge_today')::DOUBLE PRECISION AS battery_discharge_today,
+  (frames.data->>'house_consumption')::DOUBLE PRECISION AS house_consumption,
+  frames.created_at,
+  (frames.data->>'meter_test_status')::INT AS meter_test_status,
+  (frames.data->>'meter_comm_status')::INT AS meter_comm_status,
+  (frames.data->>'active_power_l1')::DOUBLE PRECISION AS active_power_l1,
+  (frames.data->>'active_power_l2')::DOUBLE PRECISION AS active_power_l2,
+  (frames.data->>'active_power_l3')::DOUBLE PRECISION AS active_power_l3,
+  (frames.data->>'active_power_total')::DOUBLE PRECISION AS active_power_total,
+  (frames.data->>'reactive_power_total')::DOUBLE PRECISION AS reactive_power_total,
+  (frames.data->>'meter_power_factor1')::DOUBLE PRECISION AS meter_power_factor1,
+  (frames.data->>'meter_power_factor2')::DOUBLE PRECISION AS meter_power_factor2,
+  (frames.data->>'meter_power_factor3')::DOUBLE PRECISION AS meter_power_factor3,
+  (frames.data->>'meter_power_factor')::DOUBLE PRECISION AS meter_power_factor,
+  (frames.data->>'meter_frequency')::DOUBLE PRECISION AS meter_frequency,
+  (frames.data->>'meter_energy_export_total')::DOUBLE PRECISION AS meter_energy_export_total,
+  (frames.data->>'meter_energy_import_total')::DOUBLE PRECISION AS meter_energy_import_total,
+  (frames.data->>'meter_active_power1')::DOUBLE PRECISION AS meter_active_power1,
+  (frames.data->>'meter_active_power2')::DOUBLE PRECISION AS meter_active_power2,
+  (frames.data->>'meter_active_power3')::DOUBLE PRECISION AS meter_active_power3,
+  (frames.data->>'meter_active_power_total')::DOUBLE PRECISION AS meter_active_power_total,
+  (frames.data->>'meter_reactive_power1')::DOUBLE PRECISION AS meter_reactive_power1,
+  (frames.data->>'meter_reactive_power2')::DOUBLE PRECISION AS meter_reactive_power2,
+  (frames.data->>'meter_reactive_power3')::DOUBLE PRECISION AS meter_reactive_power3,
+  (frames.data->>'meter_reactive_power_total')::DOUBLE PRECISION AS meter_reactive_power_total,
+  (frames.data->>'meter_apparent_power1')::DOUBLE PRECISION AS meter_apparent_power1,
+  (frames.data->>'meter_apparent_power2')::DOUBLE PRECISION AS meter_apparent_power2,
+  (frames.data->>'meter_apparent_power3')::DOUBLE PRECISION AS meter_apparent_power3,
+  (frames.data->>'meter_apparent_power_total')::DOUBLE PRECISION AS meter_apparent_power_total,
+  (frames.data->>'meter_software_version')::INT AS meter_software_version,
+  devices.serial_number,
+  frames.device_id
+FROM frames
+JOIN devices ON devices.id = frames.device_id;
@@ -0,0 +1,324 @@
+// Package migrations embeds the SQL schema migrations of the gateway, and
+// applies them to a database.
+//
+// PostgreSQL and SQLite each have their own set of migrations, selected by
+// the driver name of the database. Applied versions are tracked in a
+// schema_migrations table which is compatible with golang-migrate, so
+// databases previously migrated with that tool can be migrated further by
+// this package and vice versa.
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+//go:embed *.sql
+var postgresFiles embed.FS
+
+//go:embed sqlite/*.sql
+var sqliteFiles embed.FS
+
+// Migration is a single schema migration.
+type Migration struct {
+	Version uint64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// List returns the embedded migrations for the database driver, "postgres"
+// or "sqlite", ordered by version.
+func List(driverName string) ([]Migration, error) {
+	switch driverName {
+	case "postgres":
+		return parse(postgresFiles)
+	case "sqlite":
+		fsys, err := fs.Sub(sqliteFiles, "sqlite")
+		if err != nil {
+			return nil, fmt.Errorf("error reading migrations: %s", err)
+		}
+		return parse(fsys)
+	default:
+		return nil, fmt.Errorf("unsupported database driver `%s`", driverName)
+	}
+}
+
+func parse(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, fmt.Errorf("error reading migrations: %s", err)
+	}
+
+	byVersion := make(map[uint64]*Migration)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		name := entry.Name()
+		base, direction, ok := strings.Cut(strings.TrimSuffix(name, ".sql"), ".")
+		if !ok || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("invalid migration filename `%s`", name)
+		}
+		versionStr, desc, _ := strings.Cut(base, "_")
+		version, err := strconv.ParseUint(versionStr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version in `%s`", name)
+		}
+
+		content, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, fmt.Errorf("error reading migration: %s", err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: desc}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	result := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d is missing an up or down file", m.Version)
+		}
+		result = append(result, *m)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Version < result[j].Version })
+
+	return result, nil
+}
+
+const createMigrationsTableSQL = `CREATE TABLE IF NOT EXISTS schema_migrations (version BIGINT NOT NULL PRIMARY KEY, dirty BOOLEAN NOT NULL)`
+
+// Version returns the currently applied schema version, or zero if no
+// migrations have been applied.
+func Version(ctx context.Context, db *sqlx.DB) (version uint64, dirty bool, err error) {
+	if _, err = db.ExecContext(ctx, createMigrationsTableSQL); err != nil {
+		return 0, false, fmt.Errorf("error creating migrations table: %s", err)
+	}
+
+	err = db.QueryRowxContext(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&version, &dirty)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("error reading schema version: %s", err)
+	}
+
+	return version, dirty, nil
+}
+
+// lockID identifies the advisory lock held while migrating, so that
+// concurrently starting gateways don't race to apply migrations.
+const lockID = 0x736f6c6172 // "solar"
+
+// lock takes the migration advisory lock on PostgreSQL, blocking until it is
+// available, and returns a function which releases it. On other databases it
+// does nothing.
+func lock(ctx context.Context, db *sqlx.DB) (func(), error) {
+	if db.DriverName() != "postgres" {
+		return func() {}, nil
+	}
+
+	// Advisory locks belong to a session, so the same connection must be used
+	// to take and release the lock.
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error acquiring connection: %s", err)
+	}
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, lockID); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error acquiring migration lock: %s", err)
+	}
+
+	return func() {
+		conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, lockID)
+		conn.Close()
+	}, nil
+}
+
+// Up applies all pending migrations, and returns the number applied.
+func Up(ctx context.Context, db *sqlx.DB) (int, error) {
+	unlock, err := lock(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	migrations, current, err := prepare(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+		if err := apply(ctx, db, m.Up, m.Version); err != nil {
+			return n, fmt.Errorf("error applying migration %d: %s", m.Version, err)
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+// Down reverts up to steps applied migrations, and returns the number
+// reverted.
+func Down(ctx context.Context, db *sqlx.DB, steps int) (int, error) {
+	unlock, err := lock(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	migrations, current, err := prepare(ctx, db)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for i := len(migrations) - 1; i >= 0 && n < steps; i-- {
+		m := migrations[i]
+		if m.Version > current {
+			continue
+		}
+
+		var prev uint64
+		if i > 0 {
+			prev = migrations[i-1].Version
+		}
+		if err := apply(ctx, db, m.Down, prev); err != nil {
+			return n, fmt.Errorf("error reverting migration %d: %s", m.Version, err)
+		}
+		current = prev
+		n++
+	}
+
+	return n, nil
+}
+
+// Status is the status of a single migration.
+type Status struct {
+	Migration
+	Applied bool
+}
+
+// Statuses returns the status of every embedded migration, and whether the
+// database is dirty.
+func Statuses(ctx context.Context, db *sqlx.DB) ([]Status, bool, error) {
+	migrations, err := List(db.DriverName())
+	if err != nil {
+		return nil, false, err
+	}
+
+	current, dirty, err := Version(ctx, db)
+	if err != nil {
+		return nil, false, err
+	}
+
+	result := make([]Status, len(migrations))
+	for i, m := range migrations {
+		result[i] = Status{Migration: m, Applied: m.Version <= current}
+	}
+
+	return result, dirty, nil
+}
+
+// Latest returns the version of the newest embedded migration for the
+// database driver.
+func Latest(driverName string) (uint64, error) {
+	migrations, err := List(driverName)
+	if err != nil {
+		return 0, err
+	}
+	if len(migrations) == 0 {
+		return 0, nil
+	}
+	return migrations[len(migrations)-1].Version, nil
+}
+
+// ErrOutdated is returned by Check when migrations are pending.
+var ErrOutdated = errors.New("database schema is outdated")
+
+// Check returns an error if the database is dirty, or if any embedded
+// migrations have not been applied. A database migrated beyond the newest
+// embedded migration, e.g. by a newer gateway during a rolling deployment, is
+// accepted.
+func Check(ctx context.Context, db *sqlx.DB) error {
+	latest, err := Latest(db.DriverName())
+	if err != nil {
+		return err
+	}
+
+	current, dirty, err := Version(ctx, db)
+	if err != nil {
+		return err
+	}
+	if dirty {
+		return fmt.Errorf("database is dirty at version %d, fix it manually and retry", current)
+	}
+	if current < latest {
+		return fmt.Errorf("%w: at version %d, expected %d", ErrOutdated, current, latest)
+	}
+
+	return nil
+}
+
+func prepare(ctx context.Context, db *sqlx.DB) ([]Migration, uint64, error) {
+	migrations, err := List(db.DriverName())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	current, dirty, err := Version(ctx, db)
+	if err != nil {
+		return nil, 0, err
+	}
+	if dirty {
+		return nil, 0, fmt.Errorf("database is dirty at version %d, fix it manually and retry", current)
+	}
+
+	return migrations, current, nil
+}
+
+// apply runs the SQL and records the resulting version in a single
+// transaction.
+func apply(ctx context.Context, db *sqlx.DB, stmts string, version uint64) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error beginning transaction: %s", err)
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, stmts); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, `DELETE FROM schema_migrations`); err != nil {
+		return fmt.Errorf("error updating schema version: %s", err)
+	}
+	if version > 0 {
+		if _, err = tx.ExecContext(ctx, tx.Rebind(`INSERT INTO schema_migrations (version, dirty) VALUES (?, false)`), version); err != nil {
+			return fmt.Errorf("error updating schema version: %s", err)
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,65 @@
+package migrations_test
+
+import (
+	"testing"
+
+	"git.netflux.io/rob/solar-toolkit/gateway/sql/migrations"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestList(t *testing.T) {
+	testCases := []struct {
+		driverName  string
+		wantVersion uint64
+		wantName    string
+		wantUp      string
+		wantDown    string
+	}{
+		{
+			driverName:  "postgres",
+			wantVersion: 20220713135223,
+			wantName:    "create_runtime_data_table",
+			wantUp:      "CREATE TABLE et_runtime_data",
+			wantDown:    "DROP TABLE et_runtime_data",
+		},
+		{
+			driverName:  "sqlite",
+			wantVersion: 20261019180000,
+			wantName:    "create_schema",
+			wantUp:      "CREATE TABLE frames",
+			wantDown:    "DROP TABLE frames",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.driverName, func(t *testing.T) {
+			list, err := migrations.List(tc.driverName)
+			require.NoError(t, err)
+			require.NotEmpty(t, list)
+
+			assert.Equal(t, tc.wantVersion, list[0].Version)
+			assert.Equal(t, tc.wantName, list[0].Name)
+			assert.Contains(t, list[0].Up, tc.wantUp)
+			assert.Contains(t, list[0].Down, tc.wantDown)
+
+			for i := 1; i < len(list); i++ {
+				assert.Greater(t, list[i].Version, list[i-1].Version)
+			}
+		})
+	}
+
+	_, err := migrations.List("mysql")
+	assert.EqualError(t, err, "unsupported database driver `mysql`")
+}
+
+func TestLatest(t *testing.T) {
+	for _, driverName := range []string{"postgres", "sqlite"} {
+		list, err := migrations.List(driverName)
+		require.NoError(t, err)
+
+		latest, err := migrations.Latest(driverName)
+		require.NoError(t, err)
+		assert.Equal(t, list[len(list)-1].Version, latest)
+	}
+}
@@ -0,0 +1,6 @@
+DROP TABLE rollups;
+DROP TABLE energy_summaries;
+DROP TABLE api_tokens;
+DROP TABLE idempotency_keys;
+DROP TABLE frames;
+DROP TABLE devices;
@@ -0,0 +1,73 @@
+-- Timestamps are stored as UTC text in the fixed-width format
+-- 2006-01-02T15:04:05.000Z, so that they sort and compare correctly.
+
+CREATE TABLE devices (
+  id INTEGER PRIMARY KEY,
+  serial_number TEXT NOT NULL UNIQUE,
+  model_name TEXT NOT NULL DEFAULT '',
+  rated_power INT NOT NULL DEFAULT 0,
+  modbus_version INT NOT NULL DEFAULT 0,
+  ac_output_type INT NOT NULL DEFAULT 0,
+  dsp1_sw_version INT NOT NULL DEFAULT 0,
+  dsp2_sw_version INT NOT NULL DEFAULT 0,
+  dsp_svn_version INT NOT NULL DEFAULT 0,
+  arm_sw_version INT NOT NULL DEFAULT 0,
+  arm_svn_version INT NOT NULL DEFAULT 0,
+  software_version TEXT NOT NULL DEFAULT '',
+  arm_version TEXT NOT NULL DEFAULT '',
+  single_phase BOOLEAN NOT NULL DEFAULT FALSE,
+  created_at TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+  updated_at TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now'))
+);
+
+CREATE TABLE frames (
+  device_id INTEGER NOT NULL REFERENCES devices (id),
+  timestamp TIMESTAMP NOT NULL,
+  data TEXT NOT NULL,
+  created_at TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+  PRIMARY KEY (device_id, timestamp)
+) WITHOUT ROWID;
+
+CREATE TABLE idempotency_keys (
+  key TEXT PRIMARY KEY,
+  response TEXT NOT NULL,
+  created_at TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now'))
+);
+
+CREATE INDEX index_idempotency_keys_on_created_at ON idempotency_keys (created_at);
+
+CREATE TABLE api_tokens (
+  id INTEGER PRIMARY KEY,
+  device_id INTEGER NOT NULL REFERENCES devices (id),
+  name TEXT NOT NULL DEFAULT '',
+  token_hash TEXT NOT NULL UNIQUE,
+  created_at TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+  revoked_at TIMESTAMP
+);
+
+CREATE TABLE energy_summaries (
+  device_id INTEGER NOT NULL REFERENCES devices (id),
+  period TEXT NOT NULL,
+  start TIMESTAMP NOT NULL,
+  generation REAL NOT NULL,
+  export REAL NOT NULL,
+  import REAL NOT NULL,
+  consumption REAL NOT NULL,
+  battery_charge REAL NOT NULL,
+  battery_discharge REAL NOT NULL,
+  self_consumption REAL NOT NULL,
+  self_sufficiency REAL NOT NULL,
+  updated_at TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+  PRIMARY KEY (device_id, period, start)
+);
+
+CREATE TABLE rollups (
+  device_id INTEGER NOT NULL REFERENCES devices (id),
+  resolution TEXT NOT NULL,
+  start TIMESTAMP NOT NULL,
+  avg TEXT NOT NULL,
+  min TEXT NOT NULL,
+  max TEXT NOT NULL,
+  updated_at TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+  PRIMARY KEY (device_id, resolution, start)
+);
@@ -0,0 +1 @@
+DROP TABLE energy_costs;
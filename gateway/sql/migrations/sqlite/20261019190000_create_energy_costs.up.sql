@@ -0,0 +1,11 @@
+CREATE TABLE energy_costs (
+  device_id INTEGER NOT NULL REFERENCES devices (id),
+  start TIMESTAMP NOT NULL,
+  currency TEXT NOT NULL,
+  import TEXT NOT NULL,
+  export TEXT NOT NULL,
+  standing_charge REAL NOT NULL,
+  savings REAL NOT NULL,
+  updated_at TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+  PRIMARY KEY (device_id, start)
+);
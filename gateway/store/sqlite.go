@@ -0,0 +1,481 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"git.netflux.io/rob/solar-toolkit/gateway/auth"
+	"git.netflux.io/rob/solar-toolkit/gateway/energy"
+	"git.netflux.io/rob/solar-toolkit/gateway/handler"
+	"git.netflux.io/rob/solar-toolkit/gateway/rollup"
+	"git.netflux.io/rob/solar-toolkit/gateway/tariff"
+	"git.netflux.io/rob/solar-toolkit/inverter"
+	"github.com/jmoiron/sqlx"
+)
+
+// SQLiteStore stores frames in a SQLite database, for running the gateway
+// with a local file rather than a database server.
+//
+// SQLite has no timestamp type, so timestamps are stored as UTC text in a
+// fixed-width layout which sorts chronologically.
+type SQLiteStore struct {
+	db *sqlx.DB
+}
+
+func NewSQLite(db *sqlx.DB) *SQLiteStore {
+	return &SQLiteStore{db: db}
+}
+
+// sqliteTimeLayout matches strftime('%Y-%m-%dT%H:%M:%fZ'), used for the
+// column defaults.
+const sqliteTimeLayout = "2006-01-02T15:04:05.000Z"
+
+const sqliteNow = "strftime('%Y-%m-%dT%H:%M:%fZ', 'now')"
+
+func sqliteTime(t time.Time) string {
+	return t.UTC().Format(sqliteTimeLayout)
+}
+
+// InsertDataFrame inserts the frame, returning handler.ErrDuplicate if a
+// frame from the same inverter with the same timestamp already exists.
+func (s *SQLiteStore) InsertDataFrame(frame *inverter.ETDataFrame) error {
+	return insertSQLiteDataFrame(s.db, frame)
+}
+
+func insertSQLiteDataFrame(db sqlx.Ext, frame *inverter.ETDataFrame) error {
+	if _, err := db.Exec("INSERT INTO devices (serial_number) VALUES ($1) ON CONFLICT (serial_number) DO NOTHING", frame.SerialNumber); err != nil {
+		return fmt.Errorf("error registering device: %s", err)
+	}
+
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return fmt.Errorf("error encoding frame: %s", err)
+	}
+
+	res, err := db.Exec(insertSql, frame.SerialNumber, sqliteTime(frame.Timestamp), string(data))
+	if err != nil {
+		return fmt.Errorf("error inserting data: %s", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error inserting data: %s", err)
+	}
+	if n == 0 {
+		return handler.ErrDuplicate
+	}
+
+	return nil
+}
+
+// InsertDataFrames inserts the frames in a single transaction. Each frame is
+// inserted within its own savepoint, so that a failing frame does not abort
+// the others.
+func (s *SQLiteStore) InsertDataFrames(frames []*inverter.ETDataFrame) ([]error, error) {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("error beginning transaction: %s", err)
+	}
+	defer tx.Rollback()
+
+	errs := make([]error, len(frames))
+	for i, frame := range frames {
+		if _, err := tx.Exec("SAVEPOINT insert_frame"); err != nil {
+			return nil, fmt.Errorf("error creating savepoint: %s", err)
+		}
+
+		if err := insertSQLiteDataFrame(tx, frame); err != nil {
+			errs[i] = err
+			if _, err := tx.Exec("ROLLBACK TO SAVEPOINT insert_frame"); err != nil {
+				return nil, fmt.Errorf("error rolling back savepoint: %s", err)
+			}
+			continue
+		}
+
+		if _, err := tx.Exec("RELEASE SAVEPOINT insert_frame"); err != nil {
+			return nil, fmt.Errorf("error releasing savepoint: %s", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error committing transaction: %s", err)
+	}
+
+	return errs, nil
+}
+
+// sqliteRegisterDeviceSql is a named query, so the colons of sqliteNow are
+// escaped.
+const sqliteRegisterDeviceSql = `INSERT INTO devices (serial_number, model_name, rated_power, modbus_version, ac_output_type, dsp1_sw_version, dsp2_sw_version, dsp_svn_version, arm_sw_version, arm_svn_version, software_version, arm_version, single_phase) VALUES (:serial_number, :model_name, :rated_power, :modbus_version, :ac_output_type, :dsp1_sw_version, :dsp2_sw_version, :dsp_svn_version, :arm_sw_version, :arm_svn_version, :software_version, :arm_version, :single_phase) ON CONFLICT (serial_number) DO UPDATE SET model_name = EXCLUDED.model_name, rated_power = EXCLUDED.rated_power, modbus_version = EXCLUDED.modbus_version, ac_output_type = EXCLUDED.ac_output_type, dsp1_sw_version = EXCLUDED.dsp1_sw_version, dsp2_sw_version = EXCLUDED.dsp2_sw_version, dsp_svn_version = EXCLUDED.dsp_svn_version, arm_sw_version = EXCLUDED.arm_sw_version, arm_svn_version = EXCLUDED.arm_svn_version, software_version = EXCLUDED.software_version, arm_version = EXCLUDED.arm_version, single_phase = EXCLUDED.single_phase, updated_at = strftime('%Y-%m-%dT%H::%M::%fZ', 'now')`
+
+// RegisterDevice creates or updates the device with the serial number of
+// info.
+func (s *SQLiteStore) RegisterDevice(info *inverter.DeviceInfo) error {
+	if _, err := s.db.NamedExec(sqliteRegisterDeviceSql, info); err != nil {
+		return fmt.Errorf("error registering device: %s", err)
+	}
+
+	return nil
+}
+
+// sqliteExpiry is the creation time before which idempotency keys have
+// expired.
+const sqliteExpiry = "strftime('%Y-%m-%dT%H:%M:%fZ', 'now', '-" + idempotencyKeyTTL + "')"
+
+// IdempotentResponse returns the response previously stored for the
+// idempotency key, if any.
+func (s *SQLiteStore) IdempotentResponse(key string) ([]byte, bool, error) {
+	var response string
+	err := s.db.Get(&response, "SELECT response FROM idempotency_keys WHERE key = $1 AND created_at > "+sqliteExpiry, key)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, fmt.Errorf("error fetching idempotency key: %s", err)
+	}
+
+	return []byte(response), true, nil
+}
+
+// SaveIdempotentResponse stores the response for the idempotency key, and
+// expires old keys.
+func (s *SQLiteStore) SaveIdempotentResponse(key string, response []byte) error {
+	if _, err := s.db.Exec("DELETE FROM idempotency_keys WHERE created_at < " + sqliteExpiry); err != nil {
+		return fmt.Errorf("error expiring idempotency keys: %s", err)
+	}
+
+	if _, err := s.db.Exec("INSERT INTO idempotency_keys (key, response) VALUES ($1, $2) ON CONFLICT (key) DO NOTHING", key, string(response)); err != nil {
+		return fmt.Errorf("error saving idempotency key: %s", err)
+	}
+
+	return nil
+}
+
+// CreateToken stores the hash of a new API token bound to the device with
+// the given serial number, registering the device if needed.
+func (s *SQLiteStore) CreateToken(serialNumber, name, tokenHash string) (*auth.Token, error) {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("error beginning transaction: %s", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("INSERT INTO devices (serial_number) VALUES ($1) ON CONFLICT (serial_number) DO NOTHING", serialNumber); err != nil {
+		return nil, fmt.Errorf("error registering device: %s", err)
+	}
+
+	res, err := tx.Exec("INSERT INTO api_tokens (device_id, name, token_hash) SELECT id, $2, $3 FROM devices WHERE serial_number = $1", serialNumber, name, tokenHash)
+	if err != nil {
+		return nil, fmt.Errorf("error creating token: %s", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("error creating token: %s", err)
+	}
+
+	var token auth.Token
+	if err := tx.Get(&token, selectTokensSql+" WHERE api_tokens.id = $1", id); err != nil {
+		return nil, fmt.Errorf("error fetching token: %s", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error committing transaction: %s", err)
+	}
+
+	return &token, nil
+}
+
+// LookupToken returns the unrevoked token with the given hash, or nil if it
+// does not exist.
+func (s *SQLiteStore) LookupToken(tokenHash string) (*auth.Token, error) {
+	var token auth.Token
+	err := s.db.Get(&token, selectTokensSql+" WHERE api_tokens.token_hash = $1 AND api_tokens.revoked_at IS NULL", tokenHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error fetching token: %s", err)
+	}
+
+	return &token, nil
+}
+
+// ListTokens returns every token, including revoked tokens.
+func (s *SQLiteStore) ListTokens() ([]auth.Token, error) {
+	var tokens []auth.Token
+	if err := s.db.Select(&tokens, selectTokensSql+" ORDER BY api_tokens.id"); err != nil {
+		return nil, fmt.Errorf("error listing tokens: %s", err)
+	}
+
+	return tokens, nil
+}
+
+// RevokeToken revokes the token with the given ID. It returns false if no
+// unrevoked token with the ID exists.
+func (s *SQLiteStore) RevokeToken(id int64) (bool, error) {
+	res, err := s.db.Exec("UPDATE api_tokens SET revoked_at = "+sqliteNow+" WHERE id = $1 AND revoked_at IS NULL", id)
+	if err != nil {
+		return false, fmt.Errorf("error revoking token: %s", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("error revoking token: %s", err)
+	}
+
+	return n > 0, nil
+}
+
+// LatestFrame returns the most recent frame of the device, or nil if it has
+// none.
+func (s *SQLiteStore) LatestFrame(serialNumber string) (*inverter.ETDataFrame, error) {
+	var data string
+	err := s.db.Get(&data, selectFramesSql+" ORDER BY frames.timestamp DESC LIMIT 1", serialNumber)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error fetching latest frame: %s", err)
+	}
+
+	return decodeFrame(data)
+}
+
+// Frames returns the frames of the device with timestamps in [from, to),
+// ordered by timestamp. If limit is greater than zero, at most limit frames
+// are returned.
+func (s *SQLiteStore) Frames(serialNumber string, from, to time.Time, limit int) ([]*inverter.ETDataFrame, error) {
+	query := selectFramesSql + " AND frames.timestamp >= $2 AND frames.timestamp < $3 ORDER BY frames.timestamp"
+	if limit > 0 {
+		query += " LIMIT " + strconv.Itoa(limit)
+	}
+
+	var data []string
+	if err := s.db.Select(&data, query, serialNumber, sqliteTime(from), sqliteTime(to)); err != nil {
+		return nil, fmt.Errorf("error fetching frames: %s", err)
+	}
+
+	frames := make([]*inverter.ETDataFrame, 0, len(data))
+	for _, d := range data {
+		frame, err := decodeFrame(d)
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, frame)
+	}
+
+	return frames, nil
+}
+
+// SerialNumbers returns the serial numbers of every device.
+func (s *SQLiteStore) SerialNumbers() ([]string, error) {
+	var serialNumbers []string
+	if err := s.db.Select(&serialNumbers, "SELECT serial_number FROM devices ORDER BY serial_number"); err != nil {
+		return nil, fmt.Errorf("error listing devices: %s", err)
+	}
+
+	return serialNumbers, nil
+}
+
+// Summaries returns the energy summaries of the device for the period with
+// starts in [from, to), ordered by start.
+func (s *SQLiteStore) Summaries(serialNumber string, period energy.Period, from, to time.Time) ([]energy.Summary, error) {
+	var summaries []energy.Summary
+	err := s.db.Select(&summaries, selectSummariesSql+" AND energy_summaries.start >= $3 AND energy_summaries.start < $4 ORDER BY energy_summaries.start", serialNumber, period, sqliteTime(from), sqliteTime(to))
+	if err != nil {
+		return nil, fmt.Errorf("error fetching energy summaries: %s", err)
+	}
+
+	return summaries, nil
+}
+
+// LatestSummary returns the most recent energy summary of the device for the
+// period, or nil if there is none.
+func (s *SQLiteStore) LatestSummary(serialNumber string, period energy.Period) (*energy.Summary, error) {
+	var summary energy.Summary
+	err := s.db.Get(&summary, selectSummariesSql+" ORDER BY energy_summaries.start DESC LIMIT 1", serialNumber, period)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error fetching energy summary: %s", err)
+	}
+
+	return &summary, nil
+}
+
+const sqliteSaveSummarySql = `INSERT INTO energy_summaries (device_id, period, start, generation, export, import, consumption, battery_charge, battery_discharge, self_consumption, self_sufficiency) SELECT id, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11 FROM devices WHERE serial_number = $1 ON CONFLICT (device_id, period, start) DO UPDATE SET generation = EXCLUDED.generation, export = EXCLUDED.export, import = EXCLUDED.import, consumption = EXCLUDED.consumption, battery_charge = EXCLUDED.battery_charge, battery_discharge = EXCLUDED.battery_discharge, self_consumption = EXCLUDED.self_consumption, self_sufficiency = EXCLUDED.self_sufficiency, updated_at = ` + sqliteNow
+
+// SaveSummaries creates or replaces the energy summaries of the device in a
+// single transaction.
+func (s *SQLiteStore) SaveSummaries(serialNumber string, summaries []energy.Summary) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("error beginning transaction: %s", err)
+	}
+	defer tx.Rollback()
+
+	for _, summary := range summaries {
+		_, err := tx.Exec(sqliteSaveSummarySql, serialNumber, summary.Period, sqliteTime(summary.Start), summary.Generation, summary.Export, summary.Import, summary.Consumption, summary.BatteryCharge, summary.BatteryDischarge, summary.SelfConsumption, summary.SelfSufficiency)
+		if err != nil {
+			return fmt.Errorf("error saving energy summary: %s", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %s", err)
+	}
+
+	return nil
+}
+
+// DeleteSummaries deletes every energy summary of the device.
+func (s *SQLiteStore) DeleteSummaries(serialNumber string) error {
+	_, err := s.db.Exec("DELETE FROM energy_summaries WHERE device_id = (SELECT id FROM devices WHERE serial_number = $1)", serialNumber)
+	if err != nil {
+		return fmt.Errorf("error deleting energy summaries: %s", err)
+	}
+
+	return nil
+}
+
+// Costs returns the daily costs of the device with starts in [from, to),
+// ordered by start.
+func (s *SQLiteStore) Costs(serialNumber string, from, to time.Time) ([]tariff.Cost, error) {
+	var rows []costRow
+	err := s.db.Select(&rows, selectCostsSql+" AND energy_costs.start >= $2 AND energy_costs.start < $3 ORDER BY energy_costs.start", serialNumber, sqliteTime(from), sqliteTime(to))
+	if err != nil {
+		return nil, fmt.Errorf("error fetching costs: %s", err)
+	}
+
+	return costsFromRows(rows)
+}
+
+// LatestCost returns the most recent daily cost of the device, or nil if
+// there is none.
+func (s *SQLiteStore) LatestCost(serialNumber string) (*tariff.Cost, error) {
+	var rows []costRow
+	err := s.db.Select(&rows, selectCostsSql+" ORDER BY energy_costs.start DESC LIMIT 1", serialNumber)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching cost: %s", err)
+	}
+
+	costs, err := costsFromRows(rows)
+	if err != nil || len(costs) == 0 {
+		return nil, err
+	}
+	return &costs[0], nil
+}
+
+const sqliteSaveCostSql = `INSERT INTO energy_costs (device_id, start, currency, import, export, standing_charge, savings) SELECT id, $2, $3, $4, $5, $6, $7 FROM devices WHERE serial_number = $1 ON CONFLICT (device_id, start) DO UPDATE SET currency = EXCLUDED.currency, import = EXCLUDED.import, export = EXCLUDED.export, standing_charge = EXCLUDED.standing_charge, savings = EXCLUDED.savings, updated_at = ` + sqliteNow
+
+// SaveCosts creates or replaces the daily costs of the device in a single
+// transaction.
+func (s *SQLiteStore) SaveCosts(serialNumber string, costs []tariff.Cost) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("error beginning transaction: %s", err)
+	}
+	defer tx.Rollback()
+
+	for _, c := range costs {
+		imports, exports, err := encodeCharges(c)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqliteSaveCostSql, serialNumber, sqliteTime(c.Start), c.Currency, imports, exports, c.StandingCharge, c.Savings); err != nil {
+			return fmt.Errorf("error saving cost: %s", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %s", err)
+	}
+
+	return nil
+}
+
+// DeleteCosts deletes every daily cost of the device.
+func (s *SQLiteStore) DeleteCosts(serialNumber string) error {
+	_, err := s.db.Exec("DELETE FROM energy_costs WHERE device_id = (SELECT id FROM devices WHERE serial_number = $1)", serialNumber)
+	if err != nil {
+		return fmt.Errorf("error deleting costs: %s", err)
+	}
+
+	return nil
+}
+
+// LatestRollup returns the start of the most recent rollup of the device at
+// the resolution, or false if there is none.
+func (s *SQLiteStore) LatestRollup(serialNumber string, resolution string) (time.Time, bool, error) {
+	var start time.Time
+	err := s.db.Get(&start, "SELECT rollups.start FROM rollups JOIN devices ON devices.id = rollups.device_id WHERE devices.serial_number = $1 AND rollups.resolution = $2 ORDER BY rollups.start DESC LIMIT 1", serialNumber, resolution)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, false, nil
+	} else if err != nil {
+		return time.Time{}, false, fmt.Errorf("error fetching latest rollup: %s", err)
+	}
+
+	return start, true, nil
+}
+
+// Rollups returns the rollups of the device at the resolution with starts in
+// [from, to), ordered by start.
+func (s *SQLiteStore) Rollups(serialNumber string, resolution string, from, to time.Time) ([]rollup.Rollup, error) {
+	var rows []rollupRow
+	err := s.db.Select(&rows, selectRollupsSql+" AND rollups.start >= $3 AND rollups.start < $4 ORDER BY rollups.start", serialNumber, resolution, sqliteTime(from), sqliteTime(to))
+	if err != nil {
+		return nil, fmt.Errorf("error fetching rollups: %s", err)
+	}
+
+	return rollupsFromRows(rows)
+}
+
+const sqliteSaveRollupSql = `INSERT INTO rollups (device_id, resolution, start, avg, min, max) SELECT id, $2, $3, $4, $5, $6 FROM devices WHERE serial_number = $1 ON CONFLICT (device_id, resolution, start) DO UPDATE SET avg = EXCLUDED.avg, min = EXCLUDED.min, max = EXCLUDED.max, updated_at = ` + sqliteNow
+
+// SaveRollups creates or replaces the rollups of the device in a single
+// transaction.
+func (s *SQLiteStore) SaveRollups(serialNumber string, rollups []rollup.Rollup) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("error beginning transaction: %s", err)
+	}
+	defer tx.Rollback()
+
+	for _, r := range rollups {
+		var values [3]string
+		for i, m := range []map[string]float64{r.Avg, r.Min, r.Max} {
+			p, err := json.Marshal(m)
+			if err != nil {
+				return fmt.Errorf("error encoding rollup: %s", err)
+			}
+			values[i] = string(p)
+		}
+
+		if _, err := tx.Exec(sqliteSaveRollupSql, serialNumber, r.Resolution, sqliteTime(r.Start), values[0], values[1], values[2]); err != nil {
+			return fmt.Errorf("error saving rollup: %s", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %s", err)
+	}
+
+	return nil
+}
+
+// DeleteFrames deletes the frames of the device older than before, returning
+// the number deleted.
+func (s *SQLiteStore) DeleteFrames(serialNumber string, before time.Time) (int64, error) {
+	res, err := s.db.Exec("DELETE FROM frames WHERE device_id = (SELECT id FROM devices WHERE serial_number = $1) AND timestamp < $2", serialNumber, sqliteTime(before))
+	if err != nil {
+		return 0, fmt.Errorf("error deleting frames: %s", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error deleting frames: %s", err)
+	}
+
+	return n, nil
+}
@@ -0,0 +1,300 @@
+package store_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.netflux.io/rob/solar-toolkit/gateway"
+	"git.netflux.io/rob/solar-toolkit/gateway/api"
+	"git.netflux.io/rob/solar-toolkit/gateway/energy"
+	"git.netflux.io/rob/solar-toolkit/gateway/handler"
+	"git.netflux.io/rob/solar-toolkit/gateway/rollup"
+	"git.netflux.io/rob/solar-toolkit/gateway/sql/migrations"
+	"git.netflux.io/rob/solar-toolkit/gateway/store"
+	"git.netflux.io/rob/solar-toolkit/gateway/tariff"
+	"git.netflux.io/rob/solar-toolkit/inverter"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openSQLite(t *testing.T) *sqlx.DB {
+	t.Helper()
+
+	db, err := gateway.Connect("sqlite://" + filepath.Join(t.TempDir(), "solar.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	_, err = migrations.Up(context.Background(), db)
+	require.NoError(t, err)
+
+	return db
+}
+
+func frame(serialNumber string, ts time.Time, pvPower float64) *inverter.ETDataFrame {
+	return &inverter.ETDataFrame{
+		SerialNumber:  serialNumber,
+		ETRuntimeData: &inverter.ETRuntimeData{Timestamp: ts, PVPower: inverter.Power(pvPower)},
+	}
+}
+
+func TestSQLiteMigrations(t *testing.T) {
+	db := openSQLite(t)
+	assert.Equal(t, "sqlite", db.DriverName())
+	require.NoError(t, migrations.Check(context.Background(), db))
+
+	var foreignKeys int
+	require.NoError(t, db.Get(&foreignKeys, "PRAGMA foreign_keys"))
+	assert.Equal(t, 1, foreignKeys)
+	var journalMode string
+	require.NoError(t, db.Get(&journalMode, "PRAGMA journal_mode"))
+	assert.Equal(t, "wal", journalMode)
+
+	n, err := migrations.Down(context.Background(), db, 100)
+	require.NoError(t, err)
+	assert.Greater(t, n, 0)
+
+	var tables int
+	require.NoError(t, db.Get(&tables, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name != 'schema_migrations'"))
+	assert.Zero(t, tables)
+}
+
+func TestSQLiteFrames(t *testing.T) {
+	s := store.New(openSQLite(t))
+	require.IsType(t, &store.SQLiteStore{}, s)
+
+	start := time.Date(2022, 7, 14, 10, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+	require.NoError(t, s.InsertDataFrame(frame("12345", start, 100)))
+	assert.ErrorIs(t, s.InsertDataFrame(frame("12345", start, 100)), handler.ErrDuplicate)
+
+	errs, err := s.InsertDataFrames([]*inverter.ETDataFrame{
+		frame("12345", start.Add(time.Minute), 200),
+		frame("12345", start, 100),
+		frame("12345", start.Add(2*time.Minute), 300),
+	})
+	require.NoError(t, err)
+	require.Len(t, errs, 3)
+	assert.NoError(t, errs[0])
+	assert.ErrorIs(t, errs[1], handler.ErrDuplicate)
+	assert.NoError(t, errs[2])
+
+	latest, err := s.LatestFrame("12345")
+	require.NoError(t, err)
+	require.NotNil(t, latest)
+	assert.Equal(t, inverter.Power(300), latest.PVPower)
+
+	latest, err = s.LatestFrame("67890")
+	require.NoError(t, err)
+	assert.Nil(t, latest)
+
+	frames, err := s.Frames("12345", start, start.Add(2*time.Minute), 0)
+	require.NoError(t, err)
+	require.Len(t, frames, 2)
+	assert.True(t, start.Equal(frames[0].Timestamp))
+	assert.Equal(t, inverter.Power(200), frames[1].PVPower)
+
+	frames, err = s.Frames("12345", start, start.Add(time.Hour), 1)
+	require.NoError(t, err)
+	assert.Len(t, frames, 1)
+
+	serialNumbers, err := s.SerialNumbers()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"12345"}, serialNumbers)
+
+	n, err := s.DeleteFrames("12345", start.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+
+	require.NoError(t, s.RegisterDevice(&inverter.DeviceInfo{SerialNumber: "12345", ModelName: "GW10K-ET", RatedPower: 10000}))
+	require.NoError(t, s.RegisterDevice(&inverter.DeviceInfo{SerialNumber: "67890", ModelName: "GW5K-ET", RatedPower: 5000}))
+	serialNumbers, err = s.SerialNumbers()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"12345", "67890"}, serialNumbers)
+}
+
+func TestSQLiteTokens(t *testing.T) {
+	s := store.New(openSQLite(t))
+
+	token, err := s.CreateToken("12345", "home", "hash1")
+	require.NoError(t, err)
+	assert.Equal(t, "12345", token.SerialNumber)
+	assert.Equal(t, "home", token.Name)
+	assert.WithinDuration(t, time.Now(), token.CreatedAt, time.Minute)
+	assert.Nil(t, token.RevokedAt)
+
+	found, err := s.LookupToken("hash1")
+	require.NoError(t, err)
+	require.NotNil(t, found)
+	assert.Equal(t, token.ID, found.ID)
+
+	ok, err := s.RevokeToken(token.ID)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = s.RevokeToken(token.ID)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	found, err = s.LookupToken("hash1")
+	require.NoError(t, err)
+	assert.Nil(t, found)
+
+	tokens, err := s.ListTokens()
+	require.NoError(t, err)
+	require.Len(t, tokens, 1)
+	assert.NotNil(t, tokens[0].RevokedAt)
+}
+
+func TestSQLiteIdempotentResponses(t *testing.T) {
+	s := store.New(openSQLite(t))
+
+	_, ok, err := s.IdempotentResponse("key")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	require.NoError(t, s.SaveIdempotentResponse("key", []byte("ok")))
+	require.NoError(t, s.SaveIdempotentResponse("key", []byte("other")))
+
+	response, ok, err := s.IdempotentResponse("key")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "ok", string(response))
+}
+
+func TestSQLiteSummariesAndRollups(t *testing.T) {
+	s := store.New(openSQLite(t))
+	require.NoError(t, s.InsertDataFrame(frame("12345", time.Now(), 0)))
+
+	july := time.Date(2022, 7, 14, 0, 0, 0, 0, time.UTC)
+	summaries := []energy.Summary{
+		{Period: energy.Day, Start: july, Generation: 20, Export: 5},
+		{Period: energy.Day, Start: july.AddDate(0, 0, 1), Generation: 25, SelfSufficiency: 0.5},
+		{Period: energy.Month, Start: time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC), Generation: 45},
+	}
+	require.NoError(t, s.SaveSummaries("12345", summaries))
+	summaries[1].Generation = 30
+	require.NoError(t, s.SaveSummaries("12345", summaries[1:2]))
+
+	got, err := s.Summaries("12345", energy.Day, july, july.AddDate(0, 0, 2))
+	require.NoError(t, err)
+	assert.Equal(t, summaries[:2], got)
+
+	latest, err := s.LatestSummary("12345", energy.Day)
+	require.NoError(t, err)
+	assert.Equal(t, &summaries[1], latest)
+
+	require.NoError(t, s.DeleteSummaries("12345"))
+	latest, err = s.LatestSummary("12345", energy.Day)
+	require.NoError(t, err)
+	assert.Nil(t, latest)
+
+	_, ok, err := s.LatestRollup("12345", "1h")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	require.NoError(t, s.SaveRollups("12345", []rollup.Rollup{
+		{Resolution: "1h", Start: july, Avg: map[string]float64{"pv_power": 1}},
+		{Resolution: "1h", Start: july.Add(time.Hour), Avg: map[string]float64{"pv_power": 2}},
+		{Resolution: "1h", Start: july.Add(time.Hour), Avg: map[string]float64{"pv_power": 3}},
+	}))
+	start, ok, err := s.LatestRollup("12345", "1h")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, july.Add(time.Hour), start)
+
+	rollups, err := s.Rollups("12345", "1h", july.Add(time.Hour), july.Add(2*time.Hour))
+	require.NoError(t, err)
+	require.Len(t, rollups, 1)
+	assert.Equal(t, "1h", rollups[0].Resolution)
+	assert.True(t, rollups[0].Start.Equal(july.Add(time.Hour)))
+	assert.Equal(t, map[string]float64{"pv_power": 3}, rollups[0].Avg)
+}
+
+func TestSQLiteSeriesAfterPrune(t *testing.T) {
+	s := store.New(openSQLite(t))
+
+	// One frame every five minutes over ten days.
+	start := time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 0, 10)
+	var frames []*inverter.ETDataFrame
+	for ts := start; ts.Before(end); ts = ts.Add(5 * time.Minute) {
+		frames = append(frames, frame("12345", ts, float64(ts.Hour())))
+	}
+	for i := 0; i < len(frames); i += api.MaxBatchSize {
+		_, err := s.InsertDataFrames(frames[i:min(i+api.MaxBatchSize, len(frames))])
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.SaveSummaries("12345", []energy.Summary{{Period: energy.Day, Start: end.AddDate(0, 0, -1)}}))
+
+	now := end.Add(time.Hour)
+	require.NoError(t, rollup.UpdateAll(s, time.UTC, 3*24*time.Hour, now))
+	pruned, err := s.Frames("12345", start, start.AddDate(0, 0, 1), 0)
+	require.NoError(t, err)
+	require.Empty(t, pruned)
+
+	h := handler.New(s, handler.AllowUnauthenticated())
+	get := func(path string) handler.SeriesResponse {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+		var resp handler.SeriesResponse
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		return resp
+	}
+
+	// Hourly maxima of the first, pruned, day.
+	resp := get("/api/series?device=12345&from=2022-07-01T00:00:00Z&to=2022-07-02T00:00:00Z&fields=pv_power&bucket=1h&agg=max")
+	require.Len(t, resp.Points, 24)
+	for i, p := range resp.Points {
+		assert.True(t, p.Start.Equal(start.Add(time.Duration(i)*time.Hour)))
+		assert.Equal(t, float64(i), p.Values["pv_power"])
+	}
+
+	// Daily averages over the pruned and unpruned days, the last of which
+	// is read from the frames since it has not been completely rolled up.
+	resp = get("/api/series?device=12345&from=2022-07-01T00:00:00Z&to=2022-07-11T00:00:00Z&fields=pv_power&bucket=1d")
+	require.Len(t, resp.Points, 10)
+	for _, p := range resp.Points {
+		assert.Equal(t, 11.5, p.Values["pv_power"])
+	}
+}
+
+func TestSQLiteCosts(t *testing.T) {
+	s := store.New(openSQLite(t))
+	require.NoError(t, s.InsertDataFrame(frame("12345", time.Now(), 0)))
+
+	latest, err := s.LatestCost("12345")
+	require.NoError(t, err)
+	assert.Nil(t, latest)
+
+	july := time.Date(2022, 7, 14, 0, 0, 0, 0, time.UTC)
+	costs := []tariff.Cost{
+		{Period: energy.Day, Start: july, Currency: "EUR", Days: 1, StandingCharge: 0.25, Import: []tariff.Charge{{Rate: "peak", Price: 0.3, Energy: 2, Amount: 0.6}}, Export: []tariff.Charge{}, Savings: 1.5},
+		{Period: energy.Day, Start: july.AddDate(0, 0, 1), Currency: "EUR", Days: 1, StandingCharge: 0.25, Import: []tariff.Charge{}, Export: []tariff.Charge{{Rate: "export", Price: 0.05, Energy: 10, Amount: 0.5}}},
+	}
+	for i := range costs {
+		costs[i].Derive()
+	}
+	require.NoError(t, s.SaveCosts("12345", costs))
+	costs[1].Savings = 2
+	require.NoError(t, s.SaveCosts("12345", costs[1:2]))
+
+	got, err := s.Costs("12345", july, july.AddDate(0, 0, 2))
+	require.NoError(t, err)
+	assert.Equal(t, costs, got)
+	assert.InDelta(t, -0.25, got[1].Total, 1e-9)
+
+	latest, err = s.LatestCost("12345")
+	require.NoError(t, err)
+	assert.Equal(t, &costs[1], latest)
+
+	require.NoError(t, s.DeleteCosts("12345"))
+	got, err = s.Costs("12345", july, july.AddDate(0, 0, 2))
+	require.NoError(t, err)
+	assert.Empty(t, got)
+}
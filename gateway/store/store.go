@@ -1,12 +1,44 @@
 package store
 
 import (
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strconv"
+	"time"
 
+	"git.netflux.io/rob/solar-toolkit/gateway/auth"
+	"git.netflux.io/rob/solar-toolkit/gateway/energy"
+	"git.netflux.io/rob/solar-toolkit/gateway/handler"
+	"git.netflux.io/rob/solar-toolkit/gateway/rollup"
+	"git.netflux.io/rob/solar-toolkit/gateway/tariff"
 	"git.netflux.io/rob/solar-toolkit/inverter"
 	"github.com/jmoiron/sqlx"
 )
 
+// Store is implemented by every storage backend of the gateway.
+type Store interface {
+	handler.Store
+	energy.Store
+	rollup.Store
+	tariff.Store
+
+	CreateToken(serialNumber, name, tokenHash string) (*auth.Token, error)
+	ListTokens() ([]auth.Token, error)
+	RevokeToken(id int64) (bool, error)
+}
+
+// New returns the store for the driver of the database, which must be
+// "postgres" or "sqlite".
+func New(db *sqlx.DB) Store {
+	if db.DriverName() == "sqlite" {
+		return NewSQLite(db)
+	}
+	return NewSQL(db)
+}
+
+// PostgresStore stores frames in a PostgreSQL database.
 type PostgresStore struct {
 	db *sqlx.DB
 }
@@ -15,12 +47,532 @@ func NewSQL(db *sqlx.DB) *PostgresStore {
 	return &PostgresStore{db: db}
 }
 
-const insertSql = `INSERT INTO et_runtime_data (timestamp, pv1_voltage, pv1_current, pv1_power, pv2_voltage, pv2_current, pv2_power, pv_power, pv2_mode, pv1_mode, on_grid_l1_voltage, on_grid_l1_current, on_grid_l1_frequency, on_grid_l1_power, on_grid_l2_voltage, on_grid_l2_current, on_grid_l2_frequency, on_grid_l2_power, on_grid_l3_voltage, on_grid_l3_current, on_grid_l3_frequency, on_grid_l3_power, grid_mode, total_inverter_power, active_power, reactive_power, apparent_power, backup_l1_voltage, backup_l1_current, backup_l1_frequency, load_mode_l1, backup_l1_power, backup_l2_voltage, backup_l2_current, backup_l2_frequency, load_mode_l2, backup_l2_power, backup_l3_voltage, backup_l3_current, backup_l3_frequency, load_mode_l3, backup_l3_power, load_l1, load_l2, load_l3, backup_load, load, ups_load, temperature_air, temperature_module, temperature, bus_voltage, nbus_voltage, battery_voltage, battery_current, battery_mode, warning_code, safety_country_code, work_mode, operation_code, energy_generation_total, energy_generation_today, energy_export_total, energy_export_total_hours, energy_export_today, energy_import_total, energy_import_today, energy_load_total, energy_load_day, battery_charge_total, battery_charge_today, battery_discharge_total, battery_discharge_today, house_consumption, meter_test_status, meter_comm_status, active_power_l1, active_power_l2, active_power_l3, active_power_total, reactive_power_total, meter_power_factor1, meter_power_factor2, meter_power_factor3, meter_power_factor, meter_frequency, meter_energy_export_total, meter_energy_import_total, meter_active_power1, meter_active_power2, meter_active_power3, meter_active_power_total, meter_reactive_power1, meter_reactive_power2, meter_reactive_power3, meter_reactive_power_total, meter_apparent_power1, meter_apparent_power2, meter_apparent_power3, meter_apparent_power_total, meter_software_version, created_at) VALUES (:timestamp, :pv1_voltage, :pv1_current, :pv1_power, :pv2_voltage, :pv2_current, :pv2_power, :pv_power, :pv2_mode, :pv1_mode, :on_grid_l1_voltage, :on_grid_l1_current, :on_grid_l1_frequency, :on_grid_l1_power, :on_grid_l2_voltage, :on_grid_l2_current, :on_grid_l2_frequency, :on_grid_l2_power, :on_grid_l3_voltage, :on_grid_l3_current, :on_grid_l3_frequency, :on_grid_l3_power, :grid_mode, :total_inverter_power, :active_power, :reactive_power, :apparent_power, :backup_l1_voltage, :backup_l1_current, :backup_l1_frequency, :load_mode_l1, :backup_l1_power, :backup_l2_voltage, :backup_l2_current, :backup_l2_frequency, :load_mode_l2, :backup_l2_power, :backup_l3_voltage, :backup_l3_current, :backup_l3_frequency, :load_mode_l3, :backup_l3_power, :load_l1, :load_l2, :load_l3, :backup_load, :load, :ups_load, :temperature_air, :temperature_module, :temperature, :bus_voltage, :nbus_voltage, :battery_voltage, :battery_current, :battery_mode, :warning_code, :safety_country_code, :work_mode, :operation_code, :energy_generation_total, :energy_generation_today, :energy_export_total, :energy_export_total_hours, :energy_export_today, :energy_import_total, :energy_import_today, :energy_load_total, :energy_load_day, :battery_charge_total, :battery_charge_today, :battery_discharge_total, :battery_discharge_today, :house_consumption, :meter_test_status, :meter_comm_status, :active_power_l1, :active_power_l2, :active_power_l3, :active_power_total, :reactive_power_total, :meter_power_factor1, :meter_power_factor2, :meter_power_factor3, :meter_power_factor, :meter_frequency, :meter_energy_export_total, :meter_energy_import_total, :meter_active_power1, :meter_active_power2, :meter_active_power3, :meter_active_power_total, :meter_reactive_power1, :meter_reactive_power2, :meter_reactive_power3, :meter_reactive_power_total, :meter_apparent_power1, :meter_apparent_power2, :meter_apparent_power3, :meter_apparent_power_total, :meter_software_version, NOW());`
+// insertSql inserts a frame, storing the whole frame as JSON so that new
+// fields never require a schema change.
+const insertSql = `INSERT INTO frames (device_id, timestamp, data) VALUES ((SELECT id FROM devices WHERE serial_number = $1), $2, $3) ON CONFLICT (device_id, timestamp) DO NOTHING`
 
+// InsertDataFrame inserts the frame, returning handler.ErrDuplicate if a
+// frame from the same inverter with the same timestamp already exists.
 func (s *PostgresStore) InsertDataFrame(frame *inverter.ETDataFrame) error {
-	if _, err := s.db.NamedExec(insertSql, frame); err != nil {
+	return insertDataFrame(s.db, frame)
+}
+
+func insertDataFrame(db sqlx.Ext, frame *inverter.ETDataFrame) error {
+	// Register the device on first contact. Its details are filled in once
+	// the daemon registers it with RegisterDevice.
+	if _, err := db.Exec("INSERT INTO devices (serial_number) VALUES ($1) ON CONFLICT (serial_number) DO NOTHING", frame.SerialNumber); err != nil {
+		return fmt.Errorf("error registering device: %s", err)
+	}
+
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return fmt.Errorf("error encoding frame: %s", err)
+	}
+
+	res, err := db.Exec(insertSql, frame.SerialNumber, frame.Timestamp, string(data))
+	if err != nil {
 		return fmt.Errorf("error inserting data: %s", err)
 	}
 
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error inserting data: %s", err)
+	}
+	if n == 0 {
+		return handler.ErrDuplicate
+	}
+
 	return nil
 }
+
+// InsertDataFrames inserts the frames in a single transaction. Each frame is
+// inserted within its own savepoint, so that a failing frame does not abort
+// the others.
+func (s *PostgresStore) InsertDataFrames(frames []*inverter.ETDataFrame) ([]error, error) {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("error beginning transaction: %s", err)
+	}
+	defer tx.Rollback()
+
+	errs := make([]error, len(frames))
+	for i, frame := range frames {
+		if _, err := tx.Exec("SAVEPOINT insert_frame"); err != nil {
+			return nil, fmt.Errorf("error creating savepoint: %s", err)
+		}
+
+		if err := insertDataFrame(tx, frame); err != nil {
+			errs[i] = err
+			if _, err := tx.Exec("ROLLBACK TO SAVEPOINT insert_frame"); err != nil {
+				return nil, fmt.Errorf("error rolling back savepoint: %s", err)
+			}
+			continue
+		}
+
+		if _, err := tx.Exec("RELEASE SAVEPOINT insert_frame"); err != nil {
+			return nil, fmt.Errorf("error releasing savepoint: %s", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error committing transaction: %s", err)
+	}
+
+	return errs, nil
+}
+
+const registerDeviceSql = `INSERT INTO devices (serial_number, model_name, rated_power, modbus_version, ac_output_type, dsp1_sw_version, dsp2_sw_version, dsp_svn_version, arm_sw_version, arm_svn_version, software_version, arm_version, single_phase) VALUES (:serial_number, :model_name, :rated_power, :modbus_version, :ac_output_type, :dsp1_sw_version, :dsp2_sw_version, :dsp_svn_version, :arm_sw_version, :arm_svn_version, :software_version, :arm_version, :single_phase) ON CONFLICT (serial_number) DO UPDATE SET model_name = EXCLUDED.model_name, rated_power = EXCLUDED.rated_power, modbus_version = EXCLUDED.modbus_version, ac_output_type = EXCLUDED.ac_output_type, dsp1_sw_version = EXCLUDED.dsp1_sw_version, dsp2_sw_version = EXCLUDED.dsp2_sw_version, dsp_svn_version = EXCLUDED.dsp_svn_version, arm_sw_version = EXCLUDED.arm_sw_version, arm_svn_version = EXCLUDED.arm_svn_version, software_version = EXCLUDED.software_version, arm_version = EXCLUDED.arm_version, single_phase = EXCLUDED.single_phase, updated_at = NOW();`
+
+// RegisterDevice creates or updates the device with the serial number of
+// info.
+func (s *PostgresStore) RegisterDevice(info *inverter.DeviceInfo) error {
+	if _, err := s.db.NamedExec(registerDeviceSql, info); err != nil {
+		return fmt.Errorf("error registering device: %s", err)
+	}
+
+	return nil
+}
+
+const idempotencyKeyTTL = "24 hours"
+
+// IdempotentResponse returns the response previously stored for the
+// idempotency key, if any.
+func (s *PostgresStore) IdempotentResponse(key string) ([]byte, bool, error) {
+	var response string
+	err := s.db.Get(&response, "SELECT response FROM idempotency_keys WHERE key = $1 AND created_at > NOW() - INTERVAL '"+idempotencyKeyTTL+"'", key)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, fmt.Errorf("error fetching idempotency key: %s", err)
+	}
+
+	return []byte(response), true, nil
+}
+
+// SaveIdempotentResponse stores the response for the idempotency key, and
+// expires old keys.
+func (s *PostgresStore) SaveIdempotentResponse(key string, response []byte) error {
+	if _, err := s.db.Exec("DELETE FROM idempotency_keys WHERE created_at < NOW() - INTERVAL '" + idempotencyKeyTTL + "'"); err != nil {
+		return fmt.Errorf("error expiring idempotency keys: %s", err)
+	}
+
+	if _, err := s.db.Exec("INSERT INTO idempotency_keys (key, response) VALUES ($1, $2) ON CONFLICT (key) DO NOTHING", key, string(response)); err != nil {
+		return fmt.Errorf("error saving idempotency key: %s", err)
+	}
+
+	return nil
+}
+
+// CreateToken stores the hash of a new API token bound to the device with
+// the given serial number, registering the device if needed.
+func (s *PostgresStore) CreateToken(serialNumber, name, tokenHash string) (*auth.Token, error) {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("error beginning transaction: %s", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("INSERT INTO devices (serial_number) VALUES ($1) ON CONFLICT (serial_number) DO NOTHING", serialNumber); err != nil {
+		return nil, fmt.Errorf("error registering device: %s", err)
+	}
+
+	var token auth.Token
+	err = tx.Get(&token, "INSERT INTO api_tokens (device_id, name, token_hash) SELECT id, $2, $3 FROM devices WHERE serial_number = $1 RETURNING id, name, created_at, revoked_at, $1::TEXT AS serial_number", serialNumber, name, tokenHash)
+	if err != nil {
+		return nil, fmt.Errorf("error creating token: %s", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error committing transaction: %s", err)
+	}
+
+	return &token, nil
+}
+
+const selectTokensSql = `SELECT api_tokens.id, api_tokens.name, devices.serial_number, api_tokens.created_at, api_tokens.revoked_at FROM api_tokens JOIN devices ON devices.id = api_tokens.device_id`
+
+// LookupToken returns the unrevoked token with the given hash, or nil if it
+// does not exist.
+func (s *PostgresStore) LookupToken(tokenHash string) (*auth.Token, error) {
+	var token auth.Token
+	err := s.db.Get(&token, selectTokensSql+" WHERE api_tokens.token_hash = $1 AND api_tokens.revoked_at IS NULL", tokenHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error fetching token: %s", err)
+	}
+
+	return &token, nil
+}
+
+// ListTokens returns every token, including revoked tokens.
+func (s *PostgresStore) ListTokens() ([]auth.Token, error) {
+	var tokens []auth.Token
+	if err := s.db.Select(&tokens, selectTokensSql+" ORDER BY api_tokens.id"); err != nil {
+		return nil, fmt.Errorf("error listing tokens: %s", err)
+	}
+
+	return tokens, nil
+}
+
+// RevokeToken revokes the token with the given ID. It returns false if no
+// unrevoked token with the ID exists.
+func (s *PostgresStore) RevokeToken(id int64) (bool, error) {
+	res, err := s.db.Exec("UPDATE api_tokens SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL", id)
+	if err != nil {
+		return false, fmt.Errorf("error revoking token: %s", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("error revoking token: %s", err)
+	}
+
+	return n > 0, nil
+}
+
+const selectFramesSql = `SELECT frames.data FROM frames JOIN devices ON devices.id = frames.device_id WHERE devices.serial_number = $1`
+
+// LatestFrame returns the most recent frame of the device, or nil if it has
+// none.
+func (s *PostgresStore) LatestFrame(serialNumber string) (*inverter.ETDataFrame, error) {
+	var data string
+	err := s.db.Get(&data, selectFramesSql+" ORDER BY frames.timestamp DESC LIMIT 1", serialNumber)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error fetching latest frame: %s", err)
+	}
+
+	return decodeFrame(data)
+}
+
+// Frames returns the frames of the device with timestamps in [from, to),
+// ordered by timestamp. If limit is greater than zero, at most limit frames
+// are returned.
+func (s *PostgresStore) Frames(serialNumber string, from, to time.Time, limit int) ([]*inverter.ETDataFrame, error) {
+	query := selectFramesSql + " AND frames.timestamp >= $2 AND frames.timestamp < $3 ORDER BY frames.timestamp"
+	if limit > 0 {
+		query += " LIMIT " + strconv.Itoa(limit)
+	}
+
+	rows, err := s.db.Query(query, serialNumber, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching frames: %s", err)
+	}
+	defer rows.Close()
+
+	var frames []*inverter.ETDataFrame
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, fmt.Errorf("error fetching frames: %s", err)
+		}
+		frame, err := decodeFrame(data)
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, frame)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error fetching frames: %s", err)
+	}
+
+	return frames, nil
+}
+
+func decodeFrame(data string) (*inverter.ETDataFrame, error) {
+	var frame inverter.ETDataFrame
+	if err := json.Unmarshal([]byte(data), &frame); err != nil {
+		return nil, fmt.Errorf("error decoding frame: %s", err)
+	}
+
+	return &frame, nil
+}
+
+// SerialNumbers returns the serial numbers of every device.
+func (s *PostgresStore) SerialNumbers() ([]string, error) {
+	var serialNumbers []string
+	if err := s.db.Select(&serialNumbers, "SELECT serial_number FROM devices ORDER BY serial_number"); err != nil {
+		return nil, fmt.Errorf("error listing devices: %s", err)
+	}
+
+	return serialNumbers, nil
+}
+
+const selectSummariesSql = `SELECT energy_summaries.period, energy_summaries.start, energy_summaries.generation, energy_summaries.export, energy_summaries.import, energy_summaries.consumption, energy_summaries.battery_charge, energy_summaries.battery_discharge, energy_summaries.self_consumption, energy_summaries.self_sufficiency FROM energy_summaries JOIN devices ON devices.id = energy_summaries.device_id WHERE devices.serial_number = $1 AND energy_summaries.period = $2`
+
+// Summaries returns the energy summaries of the device for the period with
+// starts in [from, to), ordered by start.
+func (s *PostgresStore) Summaries(serialNumber string, period energy.Period, from, to time.Time) ([]energy.Summary, error) {
+	var summaries []energy.Summary
+	err := s.db.Select(&summaries, selectSummariesSql+" AND energy_summaries.start >= $3 AND energy_summaries.start < $4 ORDER BY energy_summaries.start", serialNumber, period, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching energy summaries: %s", err)
+	}
+
+	return summaries, nil
+}
+
+// LatestSummary returns the most recent energy summary of the device for the
+// period, or nil if there is none.
+func (s *PostgresStore) LatestSummary(serialNumber string, period energy.Period) (*energy.Summary, error) {
+	var summary energy.Summary
+	err := s.db.Get(&summary, selectSummariesSql+" ORDER BY energy_summaries.start DESC LIMIT 1", serialNumber, period)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error fetching energy summary: %s", err)
+	}
+
+	return &summary, nil
+}
+
+const saveSummarySql = `INSERT INTO energy_summaries (device_id, period, start, generation, export, import, consumption, battery_charge, battery_discharge, self_consumption, self_sufficiency) SELECT id, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11 FROM devices WHERE serial_number = $1 ON CONFLICT (device_id, period, start) DO UPDATE SET generation = EXCLUDED.generation, export = EXCLUDED.export, import = EXCLUDED.import, consumption = EXCLUDED.consumption, battery_charge = EXCLUDED.battery_charge, battery_discharge = EXCLUDED.battery_discharge, self_consumption = EXCLUDED.self_consumption, self_sufficiency = EXCLUDED.self_sufficiency, updated_at = NOW()`
+
+// SaveSummaries creates or replaces the energy summaries of the device in a
+// single transaction.
+func (s *PostgresStore) SaveSummaries(serialNumber string, summaries []energy.Summary) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("error beginning transaction: %s", err)
+	}
+	defer tx.Rollback()
+
+	for _, summary := range summaries {
+		_, err := tx.Exec(saveSummarySql, serialNumber, summary.Period, summary.Start, summary.Generation, summary.Export, summary.Import, summary.Consumption, summary.BatteryCharge, summary.BatteryDischarge, summary.SelfConsumption, summary.SelfSufficiency)
+		if err != nil {
+			return fmt.Errorf("error saving energy summary: %s", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %s", err)
+	}
+
+	return nil
+}
+
+// DeleteSummaries deletes every energy summary of the device.
+func (s *PostgresStore) DeleteSummaries(serialNumber string) error {
+	_, err := s.db.Exec("DELETE FROM energy_summaries WHERE device_id = (SELECT id FROM devices WHERE serial_number = $1)", serialNumber)
+	if err != nil {
+		return fmt.Errorf("error deleting energy summaries: %s", err)
+	}
+
+	return nil
+}
+
+const selectCostsSql = `SELECT energy_costs.start, energy_costs.currency, energy_costs.import, energy_costs.export, energy_costs.standing_charge, energy_costs.savings FROM energy_costs JOIN devices ON devices.id = energy_costs.device_id WHERE devices.serial_number = $1`
+
+// costRow is a row of the energy_costs table. The charges are stored as JSON.
+type costRow struct {
+	Start          time.Time `db:"start"`
+	Currency       string    `db:"currency"`
+	Import         string    `db:"import"`
+	Export         string    `db:"export"`
+	StandingCharge float64   `db:"standing_charge"`
+	Savings        float64   `db:"savings"`
+}
+
+func costsFromRows(rows []costRow) ([]tariff.Cost, error) {
+	costs := make([]tariff.Cost, 0, len(rows))
+	for _, row := range rows {
+		c := tariff.Cost{Period: energy.Day, Start: row.Start, Currency: row.Currency, Days: 1, StandingCharge: row.StandingCharge, Savings: row.Savings}
+		if err := json.Unmarshal([]byte(row.Import), &c.Import); err != nil {
+			return nil, fmt.Errorf("error decoding cost: %s", err)
+		}
+		if err := json.Unmarshal([]byte(row.Export), &c.Export); err != nil {
+			return nil, fmt.Errorf("error decoding cost: %s", err)
+		}
+		c.Derive()
+		costs = append(costs, c)
+	}
+	return costs, nil
+}
+
+// encodeCharges returns the import and export charges of the cost as JSON.
+func encodeCharges(c tariff.Cost) (string, string, error) {
+	var values [2]string
+	for i, charges := range [][]tariff.Charge{c.Import, c.Export} {
+		if charges == nil {
+			charges = []tariff.Charge{}
+		}
+		p, err := json.Marshal(charges)
+		if err != nil {
+			return "", "", fmt.Errorf("error encoding cost: %s", err)
+		}
+		values[i] = string(p)
+	}
+	return values[0], values[1], nil
+}
+
+// Costs returns the daily costs of the device with starts in [from, to),
+// ordered by start.
+func (s *PostgresStore) Costs(serialNumber string, from, to time.Time) ([]tariff.Cost, error) {
+	var rows []costRow
+	err := s.db.Select(&rows, selectCostsSql+" AND energy_costs.start >= $2 AND energy_costs.start < $3 ORDER BY energy_costs.start", serialNumber, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching costs: %s", err)
+	}
+
+	return costsFromRows(rows)
+}
+
+// LatestCost returns the most recent daily cost of the device, or nil if
+// there is none.
+func (s *PostgresStore) LatestCost(serialNumber string) (*tariff.Cost, error) {
+	var rows []costRow
+	err := s.db.Select(&rows, selectCostsSql+" ORDER BY energy_costs.start DESC LIMIT 1", serialNumber)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching cost: %s", err)
+	}
+
+	costs, err := costsFromRows(rows)
+	if err != nil || len(costs) == 0 {
+		return nil, err
+	}
+	return &costs[0], nil
+}
+
+const saveCostSql = `INSERT INTO energy_costs (device_id, start, currency, import, export, standing_charge, savings) SELECT id, $2, $3, $4, $5, $6, $7 FROM devices WHERE serial_number = $1 ON CONFLICT (device_id, start) DO UPDATE SET currency = EXCLUDED.currency, import = EXCLUDED.import, export = EXCLUDED.export, standing_charge = EXCLUDED.standing_charge, savings = EXCLUDED.savings, updated_at = NOW()`
+
+// SaveCosts creates or replaces the daily costs of the device in a single
+// transaction.
+func (s *PostgresStore) SaveCosts(serialNumber string, costs []tariff.Cost) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("error beginning transaction: %s", err)
+	}
+	defer tx.Rollback()
+
+	for _, c := range costs {
+		imports, exports, err := encodeCharges(c)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(saveCostSql, serialNumber, c.Start, c.Currency, imports, exports, c.StandingCharge, c.Savings); err != nil {
+			return fmt.Errorf("error saving cost: %s", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %s", err)
+	}
+
+	return nil
+}
+
+// DeleteCosts deletes every daily cost of the device.
+func (s *PostgresStore) DeleteCosts(serialNumber string) error {
+	_, err := s.db.Exec("DELETE FROM energy_costs WHERE device_id = (SELECT id FROM devices WHERE serial_number = $1)", serialNumber)
+	if err != nil {
+		return fmt.Errorf("error deleting costs: %s", err)
+	}
+
+	return nil
+}
+
+// LatestRollup returns the start of the most recent rollup of the device at
+// the resolution, or false if there is none.
+func (s *PostgresStore) LatestRollup(serialNumber string, resolution string) (time.Time, bool, error) {
+	var start time.Time
+	err := s.db.Get(&start, "SELECT rollups.start FROM rollups JOIN devices ON devices.id = rollups.device_id WHERE devices.serial_number = $1 AND rollups.resolution = $2 ORDER BY rollups.start DESC LIMIT 1", serialNumber, resolution)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, false, nil
+	} else if err != nil {
+		return time.Time{}, false, fmt.Errorf("error fetching latest rollup: %s", err)
+	}
+
+	return start, true, nil
+}
+
+const selectRollupsSql = `SELECT rollups.resolution, rollups.start, rollups.avg, rollups.min, rollups.max FROM rollups JOIN devices ON devices.id = rollups.device_id WHERE devices.serial_number = $1 AND rollups.resolution = $2`
+
+// rollupRow is a row of the rollups table. The aggregated fields are stored
+// as JSON.
+type rollupRow struct {
+	Resolution string    `db:"resolution"`
+	Start      time.Time `db:"start"`
+	Avg        string    `db:"avg"`
+	Min        string    `db:"min"`
+	Max        string    `db:"max"`
+}
+
+func rollupsFromRows(rows []rollupRow) ([]rollup.Rollup, error) {
+	rollups := make([]rollup.Rollup, 0, len(rows))
+	for _, row := range rows {
+		r := rollup.Rollup{Resolution: row.Resolution, Start: row.Start}
+		for _, v := range []struct {
+			data string
+			m    *map[string]float64
+		}{{row.Avg, &r.Avg}, {row.Min, &r.Min}, {row.Max, &r.Max}} {
+			if err := json.Unmarshal([]byte(v.data), v.m); err != nil {
+				return nil, fmt.Errorf("error decoding rollup: %s", err)
+			}
+		}
+		rollups = append(rollups, r)
+	}
+	return rollups, nil
+}
+
+// Rollups returns the rollups of the device at the resolution with starts in
+// [from, to), ordered by start.
+func (s *PostgresStore) Rollups(serialNumber string, resolution string, from, to time.Time) ([]rollup.Rollup, error) {
+	var rows []rollupRow
+	err := s.db.Select(&rows, selectRollupsSql+" AND rollups.start >= $3 AND rollups.start < $4 ORDER BY rollups.start", serialNumber, resolution, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching rollups: %s", err)
+	}
+
+	return rollupsFromRows(rows)
+}
+
+const saveRollupSql = `INSERT INTO rollups (device_id, resolution, start, avg, min, max) SELECT id, $2, $3, $4, $5, $6 FROM devices WHERE serial_number = $1 ON CONFLICT (device_id, resolution, start) DO UPDATE SET avg = EXCLUDED.avg, min = EXCLUDED.min, max = EXCLUDED.max, updated_at = NOW()`
+
+// SaveRollups creates or replaces the rollups of the device in a single
+// transaction.
+func (s *PostgresStore) SaveRollups(serialNumber string, rollups []rollup.Rollup) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("error beginning transaction: %s", err)
+	}
+	defer tx.Rollback()
+
+	for _, r := range rollups {
+		var values [3]string
+		for i, m := range []map[string]float64{r.Avg, r.Min, r.Max} {
+			p, err := json.Marshal(m)
+			if err != nil {
+				return fmt.Errorf("error encoding rollup: %s", err)
+			}
+			values[i] = string(p)
+		}
+
+		if _, err := tx.Exec(saveRollupSql, serialNumber, r.Resolution, r.Start, values[0], values[1], values[2]); err != nil {
+			return fmt.Errorf("error saving rollup: %s", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %s", err)
+	}
+
+	return nil
+}
+
+// DeleteFrames deletes the frames of the device older than before, returning
+// the number deleted.
+func (s *PostgresStore) DeleteFrames(serialNumber string, before time.Time) (int64, error) {
+	res, err := s.db.Exec("DELETE FROM frames WHERE device_id = (SELECT id FROM devices WHERE serial_number = $1) AND timestamp < $2", serialNumber, before)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting frames: %s", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error deleting frames: %s", err)
+	}
+
+	return n, nil
+}
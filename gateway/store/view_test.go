@@ -0,0 +1,103 @@
+package store_test
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"git.netflux.io/rob/solar-toolkit/gateway"
+	"git.netflux.io/rob/solar-toolkit/gateway/sql/migrations"
+	"git.netflux.io/rob/solar-toolkit/gateway/store"
+	"git.netflux.io/rob/solar-toolkit/inverter"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// envTestDatabaseURL is the URL of a PostgreSQL database which may be used,
+// and modified, by tests.
+const envTestDatabaseURL = "SOLAR_TOOLKIT_TEST_DATABASE_URL"
+
+// unavailableBatteryFrame returns a frame decoded from runtime data in which
+// the battery voltage register holds the sentinel 0xffff.
+func unavailableBatteryFrame(t *testing.T) *inverter.ETDataFrame {
+	t.Helper()
+
+	p := make([]byte, 250)
+	copy(p, []byte{22, 7, 13, 10, 35, 1})
+	p[160], p[161] = 0xff, 0xff
+
+	runtimeData, err := inverter.ET{SerialNumber: "12345"}.DecodeRuntimeData(p)
+	require.NoError(t, err)
+	return &inverter.ETDataFrame{SerialNumber: "12345", ETRuntimeData: runtimeData}
+}
+
+// assertViewNulls asserts that the unavailable battery voltage, and the house
+// consumption derived from it, are NULL in the et_runtime_data view.
+func assertViewNulls(t *testing.T, db *sqlx.DB) {
+	t.Helper()
+
+	var row struct {
+		BatteryVoltage   sql.NullFloat64 `db:"battery_voltage"`
+		HouseConsumption sql.NullFloat64 `db:"house_consumption"`
+		PVPower          sql.NullFloat64 `db:"pv_power"`
+	}
+	require.NoError(t, db.Get(&row, "SELECT battery_voltage, house_consumption, pv_power FROM et_runtime_data WHERE serial_number = '12345'"))
+	assert.False(t, row.BatteryVoltage.Valid)
+	assert.False(t, row.HouseConsumption.Valid)
+	assert.True(t, row.PVPower.Valid)
+}
+
+func TestRuntimeDataViewUnavailable(t *testing.T) {
+	frame := unavailableBatteryFrame(t)
+	data, err := json.Marshal(frame)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"battery_voltage":null`)
+
+	t.Run("postgres", func(t *testing.T) {
+		databaseURL := os.Getenv(envTestDatabaseURL)
+		if databaseURL == "" {
+			t.Skip("set " + envTestDatabaseURL + " to run against PostgreSQL")
+		}
+
+		db, err := gateway.Connect(databaseURL)
+		require.NoError(t, err)
+		t.Cleanup(func() { db.Close() })
+		_, err = migrations.Up(context.Background(), db)
+		require.NoError(t, err)
+		_, err = db.Exec("DELETE FROM frames WHERE device_id IN (SELECT id FROM devices WHERE serial_number = '12345')")
+		require.NoError(t, err)
+
+		require.NoError(t, store.NewSQL(db).InsertDataFrame(frame))
+		assertViewNulls(t, db)
+	})
+
+	// Without PostgreSQL, the definition of the view from the latest migration
+	// is applied to SQLite, which has the same frames and devices tables.
+	t.Run("view definition", func(t *testing.T) {
+		list, err := migrations.List("postgres")
+		require.NoError(t, err)
+		var view string
+		for _, m := range list {
+			if strings.Contains(m.Up, "VIEW et_runtime_data") {
+				view = m.Up[strings.Index(m.Up, "CREATE"):]
+			}
+		}
+		require.NotEmpty(t, view)
+
+		view = strings.Replace(view, "CREATE OR REPLACE VIEW", "CREATE VIEW", 1)
+		view = regexp.MustCompile(`\((frames\.data->>'\w+')\)::DOUBLE PRECISION`).ReplaceAllString(view, "CAST($1 AS REAL)")
+		view = regexp.MustCompile(`\((frames\.data->>'\w+')\)::INT`).ReplaceAllString(view, "CAST($1 AS INTEGER)")
+
+		db := openSQLite(t)
+		_, err = db.Exec(view)
+		require.NoError(t, err)
+
+		require.NoError(t, store.NewSQLite(db).InsertDataFrame(frame))
+		assertViewNulls(t, db)
+	})
+}
@@ -0,0 +1,169 @@
+package tariff
+
+import (
+	"slices"
+	"time"
+
+	"git.netflux.io/rob/solar-toolkit/gateway/energy"
+	"git.netflux.io/rob/solar-toolkit/inverter"
+)
+
+// Cost is what a device cost and earned over a period. Amounts are in the
+// currency of the tariff.
+type Cost struct {
+	Period   energy.Period `json:"period"`
+	Start    time.Time     `json:"start"`
+	Currency string        `json:"currency"`
+	// Import and Export hold the energy imported and exported at each rate.
+	Import []Charge `json:"import"`
+	Export []Charge `json:"export"`
+	// Days is the number of days for which the standing charge applies.
+	Days           int     `json:"days"`
+	StandingCharge float64 `json:"standing_charge"`
+	ImportCost     float64 `json:"import_cost"`
+	ExportRevenue  float64 `json:"export_revenue"`
+	// Total is the standing charge plus the import cost, less the export
+	// revenue.
+	Total float64 `json:"total"`
+	// Savings is what importing all consumption at the import rates would
+	// have cost, less the import cost, plus the export revenue. The standing
+	// charge is payable either way, so is excluded.
+	Savings float64 `json:"savings"`
+}
+
+// Charge is the energy imported or exported at a rate, in kWh, and its
+// amount.
+type Charge struct {
+	Rate   string  `json:"rate"`
+	Price  float64 `json:"price"`
+	Energy float64 `json:"energy"`
+	Amount float64 `json:"amount"`
+}
+
+// addCharge adds the energy at the rate to the charges, keeping rates with
+// the same name but different prices apart.
+func addCharge(charges []Charge, c Charge) []Charge {
+	i := slices.IndexFunc(charges, func(other Charge) bool { return other.Rate == c.Rate && other.Price == c.Price })
+	if i < 0 {
+		return append(charges, c)
+	}
+	charges[i].Energy += c.Energy
+	charges[i].Amount += c.Amount
+	return charges
+}
+
+// Calculate computes the daily costs of the frames, which must be ordered by
+// timestamp, with days starting at midnight in loc. Days before the first
+// version of the tariff are skipped.
+//
+// Each increase of the import, export and load counters between two readings
+// is attributed to the rates in effect between them in proportion to time.
+// The tariff must have been validated.
+func Calculate(frames []*inverter.ETDataFrame, t Tariff, loc *time.Location) []Cost {
+	var costs []Cost
+	index := make(map[time.Time]int)
+	cost := func(start time.Time, v *Version) *Cost {
+		i, ok := index[start]
+		if !ok {
+			i = len(costs)
+			index[start] = i
+			costs = append(costs, Cost{Period: energy.Day, Start: start, Currency: t.Currency, Import: []Charge{}, Export: []Charge{}, Days: 1, StandingCharge: v.StandingCharge})
+		}
+		return &costs[i]
+	}
+
+	for _, frame := range frames {
+		if frame.ETRuntimeData == nil {
+			continue
+		}
+		ts := frame.Timestamp.In(loc)
+		if v := t.version(ts); v != nil {
+			cost(energy.Day.Start(ts, loc), v)
+		}
+	}
+
+	// Consumption is valued at the import rates, to compute the savings.
+	consumptionCost := make(map[time.Time]float64)
+	energy.Increases(frames, func(from, to time.Time, delta energy.Summary) {
+		if delta.Import == 0 && delta.Export == 0 && delta.Consumption == 0 {
+			return
+		}
+
+		for start := from.In(loc); start.Before(to); {
+			v := t.version(start)
+			if v == nil {
+				start = energy.Day.Next(energy.Day.Start(start, loc))
+				continue
+			}
+			end := v.next(start)
+			if end.After(to) {
+				end = to
+			}
+			f := float64(end.Sub(start)) / float64(to.Sub(from))
+			day := energy.Day.Start(start, loc)
+			c := cost(day, v)
+
+			if r := rate(v.Import, start); r != nil {
+				if delta.Import > 0 {
+					c.Import = addCharge(c.Import, Charge{Rate: r.Name, Price: r.Price, Energy: delta.Import * f, Amount: delta.Import * f * r.Price})
+				}
+				consumptionCost[day] += delta.Consumption * f * r.Price
+			}
+			if r := rate(v.Export, start); r != nil && delta.Export > 0 {
+				c.Export = addCharge(c.Export, Charge{Rate: r.Name, Price: r.Price, Energy: delta.Export * f, Amount: delta.Export * f * r.Price})
+			}
+
+			start = end
+		}
+	})
+
+	// Days within gaps are created after the day ending the gap.
+	slices.SortFunc(costs, func(a, b Cost) int { return a.Start.Compare(b.Start) })
+	for i := range costs {
+		costs[i].Derive()
+		costs[i].Savings = consumptionCost[costs[i].Start] - costs[i].ImportCost + costs[i].ExportRevenue
+	}
+
+	return costs
+}
+
+// Rollup combines daily costs, which must be ordered by start, into costs of
+// a longer period.
+func Rollup(days []Cost, period energy.Period, loc *time.Location) []Cost {
+	var costs []Cost
+	for _, day := range days {
+		start := period.Start(day.Start, loc)
+		if len(costs) == 0 || !costs[len(costs)-1].Start.Equal(start) {
+			costs = append(costs, Cost{Period: period, Start: start, Currency: day.Currency, Import: []Charge{}, Export: []Charge{}})
+		}
+		c := &costs[len(costs)-1]
+		for _, charge := range day.Import {
+			c.Import = addCharge(c.Import, charge)
+		}
+		for _, charge := range day.Export {
+			c.Export = addCharge(c.Export, charge)
+		}
+		c.Days += day.Days
+		c.StandingCharge += day.StandingCharge
+		c.Savings += day.Savings
+	}
+
+	for i := range costs {
+		costs[i].Derive()
+	}
+
+	return costs
+}
+
+// Derive computes the import cost, export revenue and total from the charges
+// and the standing charge.
+func (c *Cost) Derive() {
+	c.ImportCost, c.ExportRevenue = 0, 0
+	for _, charge := range c.Import {
+		c.ImportCost += charge.Amount
+	}
+	for _, charge := range c.Export {
+		c.ExportRevenue += charge.Amount
+	}
+	c.Total = c.StandingCharge + c.ImportCost - c.ExportRevenue
+}
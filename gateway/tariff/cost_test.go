@@ -0,0 +1,218 @@
+package tariff_test
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"git.netflux.io/rob/solar-toolkit/gateway/energy"
+	"git.netflux.io/rob/solar-toolkit/gateway/tariff"
+	"git.netflux.io/rob/solar-toolkit/inverter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type reading struct {
+	ts                    string
+	import_, export, load float64
+}
+
+func frames(t *testing.T, readings ...reading) []*inverter.ETDataFrame {
+	t.Helper()
+
+	var frames []*inverter.ETDataFrame
+	for _, r := range readings {
+		ts, err := time.Parse(time.RFC3339, r.ts)
+		require.NoError(t, err)
+		frames = append(frames, &inverter.ETDataFrame{
+			SerialNumber: "12345",
+			ETRuntimeData: &inverter.ETRuntimeData{
+				Timestamp:         ts,
+				EnergyImportTotal: inverter.Energy(r.import_),
+				EnergyExportTotal: inverter.Energy(r.export),
+				EnergyLoadTotal:   inverter.Energy(r.load),
+			},
+		})
+	}
+	return frames
+}
+
+func testTariff(t *testing.T) tariff.Tariff {
+	cfg, err := tariff.ParseConfig(strings.NewReader(testConfig))
+	require.NoError(t, err)
+	return cfg.Tariffs["12345"]
+}
+
+var testReadings = []reading{
+	// Before the first version of the tariff.
+	{ts: "2022-06-30T10:00:00Z"},
+	{ts: "2022-06-30T11:00:00Z", import_: 1, load: 1},
+	// Thursday.
+	{ts: "2022-07-14T07:00:00Z", import_: 1, load: 1},
+	{ts: "2022-07-14T09:00:00Z", import_: 3, load: 4},
+	{ts: "2022-07-14T12:00:00Z", import_: 3, export: 6, load: 4},
+	{ts: "2022-07-14T18:00:00Z", import_: 4, export: 6, load: 5},
+	// Spanning midnight and the second version.
+	{ts: "2022-07-15T01:00:00Z", import_: 11, export: 6, load: 12},
+}
+
+func assertCharges(t *testing.T, want, got []tariff.Charge) {
+	t.Helper()
+
+	require.Len(t, got, len(want))
+	for i := range want {
+		assert.Equal(t, want[i].Rate, got[i].Rate)
+		assert.Equal(t, want[i].Price, got[i].Price)
+		assert.InDelta(t, want[i].Energy, got[i].Energy, 1e-9, want[i].Rate)
+		assert.InDelta(t, want[i].Amount, got[i].Amount, 1e-9, want[i].Rate)
+	}
+}
+
+func TestCalculate(t *testing.T) {
+	costs := tariff.Calculate(frames(t, testReadings...), testTariff(t), time.UTC)
+	require.Len(t, costs, 2)
+
+	c := costs[0]
+	assert.Equal(t, energy.Day, c.Period)
+	assert.Equal(t, time.Date(2022, 7, 14, 0, 0, 0, 0, time.UTC), c.Start)
+	assert.Equal(t, "EUR", c.Currency)
+	assert.Equal(t, 1, c.Days)
+	assert.Equal(t, 0.25, c.StandingCharge)
+	// 07:00-08:00 off peak, 08:00-17:00 and 20:00-24:00 standard, 17:00-20:00
+	// peak.
+	assertCharges(t, []tariff.Charge{
+		{Rate: "off_peak", Price: 0.1, Energy: 1, Amount: 0.1},
+		{Rate: "standard", Price: 0.2, Energy: 1 + 5.0/6 + 4, Amount: (1 + 5.0/6 + 4) * 0.2},
+		{Rate: "peak", Price: 0.3, Energy: 1.0/6 + 2, Amount: (1.0/6 + 2) * 0.3},
+	}, c.Import)
+	assertCharges(t, []tariff.Charge{{Rate: "export", Price: 0.05, Energy: 6, Amount: 0.3}}, c.Export)
+	assert.InDelta(t, 0.1+(1+5.0/6+4)*0.2+(1.0/6+2)*0.3, c.ImportCost, 1e-9)
+	assert.InDelta(t, 0.3, c.ExportRevenue, 1e-9)
+	assert.InDelta(t, 0.25+c.ImportCost-0.3, c.Total, 1e-9)
+	// Consumption would have cost 0.45 from 07:00 to 09:00, 0.2167 from 12:00
+	// to 18:00 and 1.4 from 18:00 to 24:00.
+	assert.InDelta(t, 0.45+(5.0/6*0.2+1.0/6*0.3)+1.4-c.ImportCost+0.3, c.Savings, 1e-9)
+
+	c = costs[1]
+	assert.Equal(t, time.Date(2022, 7, 15, 0, 0, 0, 0, time.UTC), c.Start)
+	assert.Equal(t, 0.3, c.StandingCharge)
+	assertCharges(t, []tariff.Charge{{Rate: "flat", Price: 0.25, Energy: 1, Amount: 0.25}}, c.Import)
+	assert.Empty(t, c.Export)
+	assert.InDelta(t, 0.55, c.Total, 1e-9)
+	assert.InDelta(t, 0, c.Savings, 1e-9)
+}
+
+func TestCalculateTimezone(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Madrid")
+	require.NoError(t, err)
+
+	// 05:00-06:00 UTC is 07:00-08:00 in Madrid, which is off peak.
+	costs := tariff.Calculate(frames(t,
+		reading{ts: "2022-07-14T05:00:00Z"},
+		reading{ts: "2022-07-14T07:00:00Z", import_: 2},
+	), testTariff(t), loc)
+	require.Len(t, costs, 1)
+	assert.Equal(t, time.Date(2022, 7, 14, 0, 0, 0, 0, loc), costs[0].Start)
+	assertCharges(t, []tariff.Charge{
+		{Rate: "off_peak", Price: 0.1, Energy: 1, Amount: 0.1},
+		{Rate: "standard", Price: 0.2, Energy: 1, Amount: 0.2},
+	}, costs[0].Import)
+}
+
+func TestRollup(t *testing.T) {
+	days := tariff.Calculate(frames(t, testReadings...), testTariff(t), time.UTC)
+	months := tariff.Rollup(days, energy.Month, time.UTC)
+	require.Len(t, months, 1)
+
+	c := months[0]
+	assert.Equal(t, energy.Month, c.Period)
+	assert.Equal(t, time.Date(2022, 7, 1, 0, 0, 0, 0, time.UTC), c.Start)
+	assert.Equal(t, "EUR", c.Currency)
+	assert.Equal(t, 2, c.Days)
+	assert.InDelta(t, 0.55, c.StandingCharge, 1e-9)
+	assert.Equal(t, []string{"off_peak", "standard", "peak", "flat"}, rates(c.Import))
+	assert.InDelta(t, days[0].ImportCost+days[1].ImportCost, c.ImportCost, 1e-9)
+	assert.InDelta(t, days[0].Total+days[1].Total, c.Total, 1e-9)
+	assert.InDelta(t, days[0].Savings+days[1].Savings, c.Savings, 1e-9)
+}
+
+func rates(charges []tariff.Charge) []string {
+	var names []string
+	for _, c := range charges {
+		names = append(names, c.Rate)
+	}
+	return names
+}
+
+// memoryStore is an in-memory tariff.Store for a single device.
+type memoryStore struct {
+	frames []*inverter.ETDataFrame
+	costs  []tariff.Cost
+}
+
+func (s *memoryStore) Frames(_ string, from, to time.Time, limit int) ([]*inverter.ETDataFrame, error) {
+	var frames []*inverter.ETDataFrame
+	for _, f := range s.frames {
+		if !f.Timestamp.Before(from) && f.Timestamp.Before(to) && (limit <= 0 || len(frames) < limit) {
+			frames = append(frames, f)
+		}
+	}
+	return frames, nil
+}
+
+func (s *memoryStore) Costs(_ string, from, to time.Time) ([]tariff.Cost, error) {
+	var costs []tariff.Cost
+	for _, c := range s.costs {
+		if !c.Start.Before(from) && c.Start.Before(to) {
+			costs = append(costs, c)
+		}
+	}
+	return costs, nil
+}
+
+func (s *memoryStore) LatestCost(string) (*tariff.Cost, error) {
+	if len(s.costs) == 0 {
+		return nil, nil
+	}
+	return &s.costs[len(s.costs)-1], nil
+}
+
+func (s *memoryStore) SaveCosts(_ string, costs []tariff.Cost) error {
+	for _, c := range costs {
+		if i := slices.IndexFunc(s.costs, func(other tariff.Cost) bool { return other.Start.Equal(c.Start) }); i >= 0 {
+			s.costs[i] = c
+		} else {
+			s.costs = append(s.costs, c)
+		}
+	}
+	slices.SortFunc(s.costs, func(a, b tariff.Cost) int { return a.Start.Compare(b.Start) })
+	return nil
+}
+
+func (s *memoryStore) DeleteCosts(string) error {
+	s.costs = nil
+	return nil
+}
+
+func TestUpdate(t *testing.T) {
+	now := time.Date(2022, 7, 15, 12, 0, 0, 0, time.UTC)
+	tf := testTariff(t)
+	store := memoryStore{frames: frames(t, testReadings[:4]...)}
+
+	require.NoError(t, tariff.Update(&store, "12345", tf, time.UTC, now))
+	require.Len(t, store.costs, 1)
+	assert.InDelta(t, 0.25+0.1+0.2, store.costs[0].Total, 1e-9)
+
+	// The latest day is recomputed with the frames received since.
+	store.frames = frames(t, testReadings...)
+	require.NoError(t, tariff.Update(&store, "12345", tf, time.UTC, now))
+	assert.Equal(t, tariff.Calculate(store.frames, tf, time.UTC), store.costs)
+
+	// Changes to the tariff only apply to costs already computed on rebuild.
+	tf.Versions[0].StandingCharge = 0.5
+	require.NoError(t, tariff.Update(&store, "12345", tf, time.UTC, now))
+	assert.Equal(t, 0.25, store.costs[0].StandingCharge)
+	require.NoError(t, tariff.Rebuild(&store, "12345", tf, time.UTC, now))
+	assert.Equal(t, 0.5, store.costs[0].StandingCharge)
+}
@@ -0,0 +1,284 @@
+// Package tariff computes what the energy imported and exported by each
+// device costs and earns, and what it saves, according to its electricity
+// tariff.
+//
+// A tariff has date-ranged versions, each with a daily standing charge and
+// time-of-use import and export rates. Costs are computed per day from the
+// increases of the lifetime energy counters, which are attributed to the
+// rates in effect between the two readings in proportion to time.
+package tariff
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the tariffs of each device, keyed by serial number.
+type Config struct {
+	Tariffs map[string]Tariff `yaml:"tariffs"`
+}
+
+// Tariff is the electricity tariff of a device.
+type Tariff struct {
+	// Currency is the currency of the prices, e.g. EUR. It is only used for
+	// display.
+	Currency string `yaml:"currency"`
+	// Versions are the versions of the tariff, ordered by date. Each applies
+	// from its date until that of the next.
+	Versions []Version `yaml:"versions"`
+}
+
+// Version is a version of a tariff.
+type Version struct {
+	// From is the date from which the version applies, e.g. 2022-07-01.
+	From string `yaml:"from"`
+	// StandingCharge is the fixed charge per day.
+	StandingCharge float64 `yaml:"standing_charge"`
+	// Import and Export are the rates of imported and exported energy. The
+	// first rate with a matching time range applies, and the last rate,
+	// which has none, at all other times. Export may be empty if exported
+	// energy is not paid for.
+	Import []Rate `yaml:"import"`
+	Export []Rate `yaml:"export"`
+}
+
+// Rate is a price of energy which applies at certain times.
+type Rate struct {
+	Name string `yaml:"name"`
+	// Price is the price per kWh.
+	Price float64 `yaml:"price"`
+	// Times are the time ranges during which the rate applies. A rate
+	// without time ranges always applies.
+	Times []TimeRange `yaml:"times"`
+}
+
+// TimeRange is a range of local times of day, on certain days of the week.
+type TimeRange struct {
+	// Days are the days of the week, e.g. mon or sat, on which times fall
+	// within the range. Empty means every day. A range spanning midnight
+	// matches the early hours of each listed day, not of the day after.
+	Days []string `yaml:"days"`
+	// From and To are the times of day, e.g. 07:00 and 24:00. A range with
+	// From after To spans midnight.
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Validate validates the tariffs. Errors are prefixed with the key of the
+// invalid value, such as "tariffs.12345.versions[0].import[1].price", and
+// joined with errors.Join.
+func (cfg *Config) Validate() error {
+	var errs []error
+	fail := func(key, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
+	}
+
+	serialNumbers := make([]string, 0, len(cfg.Tariffs))
+	for serialNumber := range cfg.Tariffs {
+		serialNumbers = append(serialNumbers, serialNumber)
+	}
+	slices.Sort(serialNumbers)
+
+	for _, serialNumber := range serialNumbers {
+		t := cfg.Tariffs[serialNumber]
+		key := "tariffs." + serialNumber
+		if len(t.Versions) == 0 {
+			fail(key+".versions", "at least one version is required")
+		}
+
+		var prev time.Time
+		for i, v := range t.Versions {
+			key := fmt.Sprintf("%s.versions[%d]", key, i)
+			if from, err := time.Parse(time.DateOnly, v.From); err != nil {
+				fail(key+".from", "invalid date `%s`, expected e.g. 2022-07-01", v.From)
+			} else if !from.After(prev) {
+				fail(key+".from", "must be after the previous version")
+			} else {
+				prev = from
+			}
+			if v.StandingCharge < 0 {
+				fail(key+".standing_charge", "must not be negative")
+			}
+			if len(v.Import) == 0 {
+				fail(key+".import", "at least one rate is required")
+			}
+			for _, rates := range []struct {
+				key   string
+				rates []Rate
+			}{{key + ".import", v.Import}, {key + ".export", v.Export}} {
+				validateRates(rates.key, rates.rates, fail)
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func validateRates(key string, rates []Rate, fail func(key, format string, args ...any)) {
+	names := make(map[string]bool)
+	for i, r := range rates {
+		key := fmt.Sprintf("%s[%d]", key, i)
+		if r.Name == "" {
+			fail(key+".name", "required")
+		} else if names[r.Name] {
+			fail(key+".name", "duplicate rate `%s`", r.Name)
+		}
+		names[r.Name] = true
+		if r.Price < 0 {
+			fail(key+".price", "must not be negative")
+		}
+
+		last := i == len(rates)-1
+		if last && len(r.Times) > 0 {
+			fail(key+".times", "must be empty for the last rate, which applies at all other times")
+		} else if !last && len(r.Times) == 0 {
+			fail(key+".times", "required for every rate but the last")
+		}
+		for j, tr := range r.Times {
+			key := fmt.Sprintf("%s.times[%d]", key, j)
+			for _, day := range tr.Days {
+				if _, ok := weekdays[day]; !ok {
+					fail(key+".days", "unknown day `%s`, expected e.g. mon", day)
+				}
+			}
+			from, err1 := parseTimeOfDay(tr.From)
+			if err1 != nil {
+				fail(key+".from", "%s", err1)
+			}
+			to, err2 := parseTimeOfDay(tr.To)
+			if err2 != nil {
+				fail(key+".to", "%s", err2)
+			}
+			if err1 == nil && err2 == nil && from%minutesPerDay == to%minutesPerDay {
+				fail(key, "from and to must differ")
+			}
+		}
+	}
+}
+
+const minutesPerDay = 24 * 60
+
+// parseTimeOfDay parses a time of day such as 07:30 into minutes since
+// midnight. 24:00 is accepted as the end of the day.
+func parseTimeOfDay(s string) (int, error) {
+	hours, minutes, ok := strings.Cut(s, ":")
+	h, err1 := strconv.Atoi(hours)
+	m, err2 := strconv.Atoi(minutes)
+	if !ok || len(minutes) != 2 || err1 != nil || err2 != nil || h < 0 || m < 0 || m > 59 || h*60+m > minutesPerDay {
+		return 0, fmt.Errorf("invalid time `%s`, expected e.g. 07:00", s)
+	}
+	return h*60 + m, nil
+}
+
+// ParseConfig parses and validates a YAML config.
+func ParseConfig(r io.Reader) (*Config, error) {
+	var cfg Config
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("error parsing tariff config: %s", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// LoadConfig reads and validates the YAML config file at path.
+func LoadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening tariff config: %s", err)
+	}
+	defer f.Close()
+
+	cfg, err := ParseConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return cfg, nil
+}
+
+// version returns the version in effect at t, which must be in the location
+// in which the dates of the versions start, or nil if there is none. The
+// tariff must have been validated.
+func (t *Tariff) version(ts time.Time) *Version {
+	var version *Version
+	for i := range t.Versions {
+		from, _ := time.ParseInLocation(time.DateOnly, t.Versions[i].From, ts.Location())
+		if ts.Before(from) {
+			break
+		}
+		version = &t.Versions[i]
+	}
+	return version
+}
+
+// rate returns the rate in effect at t, or nil if there are no rates.
+func rate(rates []Rate, t time.Time) *Rate {
+	minute := t.Hour()*60 + t.Minute()
+	for i, r := range rates {
+		if len(r.Times) == 0 {
+			return &rates[i]
+		}
+		for _, tr := range r.Times {
+			if tr.contains(t.Weekday(), minute) {
+				return &rates[i]
+			}
+		}
+	}
+	return nil
+}
+
+// contains returns true if the range includes the minute of the day. The
+// range must have been validated.
+func (tr TimeRange) contains(day time.Weekday, minute int) bool {
+	if len(tr.Days) > 0 && !slices.ContainsFunc(tr.Days, func(s string) bool { return weekdays[s] == day }) {
+		return false
+	}
+	from, _ := parseTimeOfDay(tr.From)
+	to, _ := parseTimeOfDay(tr.To)
+	if from < to {
+		return minute >= from && minute < to
+	}
+	return minute >= from || minute < to
+}
+
+// next returns the first time after t at which the rates of the version may
+// change, which is no later than the following midnight.
+func (v *Version) next(t time.Time) time.Time {
+	y, m, d := t.Date()
+	next := time.Date(y, m, d+1, 0, 0, 0, 0, t.Location())
+	for _, rates := range [][]Rate{v.Import, v.Export} {
+		for _, r := range rates {
+			for _, tr := range r.Times {
+				for _, s := range []string{tr.From, tr.To} {
+					minute, _ := parseTimeOfDay(s)
+					boundary := time.Date(y, m, d, 0, minute, 0, 0, t.Location())
+					if boundary.After(t) && boundary.Before(next) {
+						next = boundary
+					}
+				}
+			}
+		}
+	}
+	return next
+}
@@ -0,0 +1,127 @@
+package tariff_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.netflux.io/rob/solar-toolkit/gateway/tariff"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testConfig = `
+tariffs:
+  "12345":
+    currency: EUR
+    versions:
+      - from: 2022-07-01
+        standing_charge: 0.25
+        import:
+          - name: off_peak
+            price: 0.10
+            times:
+              - from: "00:00"
+                to: "08:00"
+          - name: peak
+            price: 0.30
+            times:
+              - days: [mon, tue, wed, thu, fri]
+                from: "17:00"
+                to: "20:00"
+          - name: standard
+            price: 0.20
+        export:
+          - name: export
+            price: 0.05
+      - from: 2022-07-15
+        standing_charge: 0.30
+        import:
+          - name: flat
+            price: 0.25
+`
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := tariff.ParseConfig(strings.NewReader(testConfig))
+	require.NoError(t, err)
+	require.Contains(t, cfg.Tariffs, "12345")
+
+	tf := cfg.Tariffs["12345"]
+	assert.Equal(t, "EUR", tf.Currency)
+	require.Len(t, tf.Versions, 2)
+	assert.Equal(t, "2022-07-01", tf.Versions[0].From)
+	assert.Equal(t, []string{"mon", "tue", "wed", "thu", "fri"}, tf.Versions[0].Import[1].Times[0].Days)
+	assert.Empty(t, tf.Versions[1].Export)
+
+	cfg, err = tariff.ParseConfig(strings.NewReader(""))
+	require.NoError(t, err)
+	assert.Empty(t, cfg.Tariffs)
+}
+
+func TestParseConfigInvalid(t *testing.T) {
+	_, err := tariff.ParseConfig(strings.NewReader(`
+tariffs:
+  "12345":
+    versions:
+      - from: 2022-07-15
+        standing_charge: -1
+        import:
+          - name: night
+            price: 0.1
+            times:
+              - days: [someday]
+                from: "23:00"
+                to: "7:60"
+          - name: night
+            price: -0.2
+            times:
+              - from: "08:00"
+                to: "08:00"
+        export:
+          - name: export
+            price: 0.05
+            times:
+              - from: "10:00"
+                to: "16:00"
+      - from: 2022-07-01
+        import:
+          - name: day
+            price: 0.2
+      - from: 1 July
+  "67890":
+    currency: EUR
+`))
+	require.Error(t, err)
+	for _, want := range []string{
+		"tariffs.12345.versions[0].standing_charge: must not be negative",
+		"tariffs.12345.versions[0].import[0].times[0].days: unknown day `someday`, expected e.g. mon",
+		"tariffs.12345.versions[0].import[0].times[0].to: invalid time `7:60`, expected e.g. 07:00",
+		"tariffs.12345.versions[0].import[1].name: duplicate rate `night`",
+		"tariffs.12345.versions[0].import[1].price: must not be negative",
+		"tariffs.12345.versions[0].import[1].times: must be empty for the last rate, which applies at all other times",
+		"tariffs.12345.versions[0].import[1].times[0]: from and to must differ",
+		"tariffs.12345.versions[0].export[0].times: must be empty for the last rate",
+		"tariffs.12345.versions[1].from: must be after the previous version",
+		"tariffs.12345.versions[2].from: invalid date `1 July`, expected e.g. 2022-07-01",
+		"tariffs.12345.versions[2].import: at least one rate is required",
+		"tariffs.67890.versions: at least one version is required",
+	} {
+		assert.ErrorContains(t, err, want)
+	}
+
+	_, err = tariff.ParseConfig(strings.NewReader("tarrifs: {}"))
+	assert.ErrorContains(t, err, "error parsing tariff config")
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tariffs.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(testConfig), 0600))
+
+	cfg, err := tariff.LoadConfig(path)
+	require.NoError(t, err)
+	assert.Len(t, cfg.Tariffs, 1)
+
+	_, err = tariff.LoadConfig(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.ErrorContains(t, err, "error opening tariff config")
+}
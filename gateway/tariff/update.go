@@ -0,0 +1,109 @@
+package tariff
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"git.netflux.io/rob/solar-toolkit/gateway/energy"
+	"git.netflux.io/rob/solar-toolkit/inverter"
+)
+
+// Store persists daily costs and provides the frames to compute them from.
+type Store interface {
+	// Frames returns the frames of the device with timestamps in [from, to),
+	// ordered by timestamp. If limit is greater than zero, at most limit
+	// frames are returned.
+	Frames(serialNumber string, from, to time.Time, limit int) ([]*inverter.ETDataFrame, error)
+	// Costs returns the daily costs of the device with starts in [from, to),
+	// ordered by start.
+	Costs(serialNumber string, from, to time.Time) ([]Cost, error)
+	// LatestCost returns the most recent daily cost of the device, or nil if
+	// there is none.
+	LatestCost(serialNumber string) (*Cost, error)
+	// SaveCosts creates or replaces the daily costs of the device.
+	SaveCosts(serialNumber string, costs []Cost) error
+	// DeleteCosts deletes every daily cost of the device.
+	DeleteCosts(serialNumber string) error
+}
+
+// chunkDays is the number of days of frames costed at a time, bounding
+// memory use when catching up on a long history.
+const chunkDays = 31
+
+// Update computes the daily costs of the frames of the device received since
+// the most recent daily cost, which is itself recomputed since the day may
+// not have been complete. Days start at midnight in loc.
+//
+// Costs already computed are not affected by changes to the tariff, use
+// Rebuild for that.
+func Update(store Store, serialNumber string, t Tariff, loc *time.Location, now time.Time) error {
+	var from time.Time
+	latest, err := store.LatestCost(serialNumber)
+	if err != nil {
+		return err
+	}
+	if latest != nil {
+		from = latest.Start.In(loc)
+	} else {
+		frames, err := store.Frames(serialNumber, time.Unix(0, 0), now, 1)
+		if err != nil {
+			return err
+		}
+		if len(frames) == 0 || frames[0].ETRuntimeData == nil {
+			return nil
+		}
+		from = energy.Day.Start(frames[0].Timestamp, loc)
+	}
+
+	for start := from; start.Before(now); {
+		end := start.AddDate(0, 0, chunkDays)
+
+		// Include the days either side, so that increases spanning the edges
+		// of the chunk are split correctly.
+		frames, err := store.Frames(serialNumber, start.AddDate(0, 0, -1), end.AddDate(0, 0, 1), 0)
+		if err != nil {
+			return err
+		}
+
+		var days []Cost
+		for _, day := range Calculate(frames, t, loc) {
+			if !day.Start.Before(start) && day.Start.Before(end) {
+				days = append(days, day)
+			}
+		}
+		if err := store.SaveCosts(serialNumber, days); err != nil {
+			return err
+		}
+
+		start = end
+	}
+
+	return nil
+}
+
+// Rebuild deletes the daily costs of the device and computes them again from
+// every stored frame, e.g. after changing the tariff.
+func Rebuild(store Store, serialNumber string, t Tariff, loc *time.Location, now time.Time) error {
+	if err := store.DeleteCosts(serialNumber); err != nil {
+		return err
+	}
+	return Update(store, serialNumber, t, loc, now)
+}
+
+// UpdateAll updates the daily costs of every device with a tariff.
+func UpdateAll(store Store, cfg *Config, loc *time.Location, now time.Time) error {
+	serialNumbers := make([]string, 0, len(cfg.Tariffs))
+	for serialNumber := range cfg.Tariffs {
+		serialNumbers = append(serialNumbers, serialNumber)
+	}
+	slices.Sort(serialNumbers)
+
+	for _, serialNumber := range serialNumbers {
+		if err := Update(store, serialNumber, cfg.Tariffs[serialNumber], loc, now); err != nil {
+			return fmt.Errorf("error updating costs of %s: %s", serialNumber, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,158 @@
+// Package influx encodes inverter data frames in the InfluxDB line protocol
+// and writes them to an InfluxDB v2 write endpoint or a UDP listener.
+//
+// Each block of data is written as its own measurement, solar_runtime,
+// solar_meter and solar_integrated, tagged with the serial number of the
+// inverter. Fields of each
+// PV string or grid phase share a field key and are written as separate
+// lines, distinguished by a string or phase tag, e.g. pv1_voltage is the
+// pv_voltage field of the line tagged string=1.
+package influx
+
+import (
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"git.netflux.io/rob/solar-toolkit/inverter"
+)
+
+// Namespace prefixes the name of every measurement.
+const Namespace = "solar"
+
+// Tag is a tag of a line.
+type Tag struct {
+	Key   string
+	Value string
+}
+
+// line describes a line written for each frame, containing the fields of a
+// block which share a PV string or grid phase.
+type line struct {
+	measurement string
+	tag         *Tag
+	fields      []inverter.Field
+}
+
+var lines = buildLines()
+
+func buildLines() []*line {
+	var (
+		result []*line
+		byKey  = make(map[string]*line)
+	)
+	for _, f := range inverter.Fields() {
+		measurement := Namespace + "_" + f.Block
+		var tag *Tag
+		if f.PVString != "" {
+			tag = &Tag{"string", f.PVString}
+		} else if f.Phase != "" {
+			tag = &Tag{"phase", f.Phase}
+		}
+
+		key := measurement
+		if tag != nil {
+			key += "," + tag.Key + "=" + tag.Value
+		}
+		l, ok := byKey[key]
+		if !ok {
+			l = &line{measurement: measurement, tag: tag}
+			byKey[key] = l
+			result = append(result, l)
+		}
+		l.fields = append(l.fields, f)
+	}
+	return result
+}
+
+// AppendFrame appends the lines of the frame to b and returns the extended
+// buffer. Lines are tagged with the serial number of the frame, if any, and
+// the provided tags. Tags with empty values are omitted.
+//
+// The timestamp of each line is the time reported by the inverter clock, in
+// nanoseconds, or omitted if the frame does not include runtime data.
+func AppendFrame(b []byte, frame *inverter.ETDataFrame, tags ...Tag) []byte {
+	var ts string
+	if frame.ETRuntimeData != nil && !frame.Timestamp.IsZero() {
+		ts = strconv.FormatInt(frame.Timestamp.UnixNano(), 10)
+	}
+
+	baseTags := append([]Tag{{"serial", frame.SerialNumber}}, tags...)
+
+	for _, l := range lines {
+		var fields []byte
+		for _, f := range l.fields {
+			v, ok := f.Value(frame)
+			if !ok || math.IsNaN(v) || math.IsInf(v, 0) {
+				continue
+			}
+			if len(fields) > 0 {
+				fields = append(fields, ',')
+			}
+			fields = appendEscaped(fields, f.Base, ",= ")
+			fields = append(fields, '=')
+			if f.Integer {
+				fields = strconv.AppendInt(fields, int64(v), 10)
+				fields = append(fields, 'i')
+			} else {
+				fields = strconv.AppendFloat(fields, v, 'f', -1, 64)
+			}
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		lineTags := baseTags
+		if l.tag != nil {
+			lineTags = append(lineTags[:len(lineTags):len(lineTags)], *l.tag)
+		}
+
+		b = appendEscaped(b, l.measurement, ", ")
+		for _, t := range sortedTags(lineTags) {
+			b = append(b, ',')
+			b = appendEscaped(b, t.Key, ",= ")
+			b = append(b, '=')
+			b = appendEscaped(b, t.Value, ",= ")
+		}
+		b = append(b, ' ')
+		b = append(b, fields...)
+		if ts != "" {
+			b = append(b, ' ')
+			b = append(b, ts...)
+		}
+		b = append(b, '\n')
+	}
+
+	return b
+}
+
+// sortedTags returns the tags with non-empty values, sorted by key as
+// recommended by InfluxDB.
+func sortedTags(tags []Tag) []Tag {
+	result := make([]Tag, 0, len(tags))
+	for _, t := range tags {
+		if t.Value != "" {
+			result = append(result, t)
+		}
+	}
+	slices.SortStableFunc(result, func(a, b Tag) int { return strings.Compare(a.Key, b.Key) })
+	return result
+}
+
+// appendEscaped appends s to b, escaping the special characters with a
+// backslash. Newlines are not allowed in the line protocol, so are replaced
+// with spaces.
+func appendEscaped(b []byte, s, special string) []byte {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\n' || c == '\r' {
+			c = ' '
+		}
+		if strings.IndexByte(special, c) >= 0 {
+			b = append(b, '\\')
+		}
+		b = append(b, c)
+	}
+	return b
+}
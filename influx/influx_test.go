@@ -0,0 +1,77 @@
+package influx_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"git.netflux.io/rob/solar-toolkit/influx"
+	"git.netflux.io/rob/solar-toolkit/inverter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppendFrame(t *testing.T) {
+	ts := time.Date(2022, 7, 14, 10, 0, 0, 123456789, time.FixedZone("CEST", 2*60*60))
+	frame := inverter.ETDataFrame{
+		SerialNumber: "12345",
+		ETRuntimeData: &inverter.ETRuntimeData{
+			Timestamp:             ts,
+			PV1Voltage:            300.5,
+			PV2Voltage:            290,
+			PVPower:               2500,
+			OnGridL2Voltage:       238.4,
+			WorkMode:              1,
+			EnergyGenerationTotal: 1234.5,
+		},
+		ETMeterData: &inverter.ETMeterData{
+			MeterActivePower1: -150,
+		},
+	}
+
+	out := string(influx.AppendFrame(nil, &frame, influx.Tag{Key: "model", Value: "GW10K ET"}, influx.Tag{Key: "site", Value: ""}))
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	require.Len(t, lines, 10, out)
+
+	// Every line is tagged, with the timestamp of the inverter clock, and
+	// each field key appears once per line.
+	for _, line := range lines {
+		assert.True(t, strings.HasSuffix(line, " 1657785600123456789"), line)
+		assert.Contains(t, line, `,model=GW10K\ ET,`, line)
+		assert.Contains(t, line, ",serial=12345", line)
+		assert.NotContains(t, line, "site=", line)
+
+		keys := make(map[string]bool)
+		for _, field := range strings.Split(strings.Fields(strings.ReplaceAll(line, `\ `, "_"))[1], ",") {
+			key, _, _ := strings.Cut(field, "=")
+			assert.False(t, keys[key], "duplicate field %s", key)
+			keys[key] = true
+		}
+	}
+
+	assert.Contains(t, out, `solar_runtime,model=GW10K\ ET,serial=12345 `)
+	assert.Contains(t, out, `serial=12345 pv_power=2500,`)
+	assert.Contains(t, out, ",work_mode=1i,")
+	assert.Contains(t, out, ",energy_generation_total=1234.5,")
+	assert.Contains(t, out, `solar_runtime,model=GW10K\ ET,serial=12345,string=1 pv_voltage=300.5,`)
+	assert.Contains(t, out, `solar_runtime,model=GW10K\ ET,serial=12345,string=2 pv_voltage=290,`)
+	assert.Contains(t, out, `solar_runtime,model=GW10K\ ET,phase=L2,serial=12345 `)
+	assert.Contains(t, out, "on_grid_voltage=238.4,")
+	assert.Contains(t, out, `solar_meter,model=GW10K\ ET,phase=L1,serial=12345 `)
+	assert.Contains(t, out, "meter_active_power=-150,")
+	assert.NotContains(t, out, "pv1_voltage")
+}
+
+func TestAppendFrameWithoutRuntimeData(t *testing.T) {
+	frame := inverter.ETDataFrame{ETMeterData: &inverter.ETMeterData{MeterFrequency: 50}}
+
+	out := string(influx.AppendFrame([]byte("existing\n"), &frame))
+	require.True(t, strings.HasPrefix(out, "existing\nsolar_meter com_mode=0i,"), out)
+	assert.NotContains(t, out, "solar_runtime")
+	assert.NotContains(t, out, "serial=")
+
+	// Lines have no timestamp, so are timestamped by the server.
+	for _, line := range strings.Split(strings.TrimSuffix(out, "\n"), "\n")[1:] {
+		assert.Equal(t, 1, strings.Count(line, " "), line)
+	}
+}
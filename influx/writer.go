@@ -0,0 +1,204 @@
+package influx
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"git.netflux.io/rob/solar-toolkit/inverter"
+	"git.netflux.io/rob/solar-toolkit/output"
+)
+
+const (
+	maxAttempts      = 3
+	retryInterval    = time.Second
+	maxDatagramSize  = 8192
+	maxErrorBodySize = 1024
+	userAgent        = "solar-toolkit (git.netflux.io)"
+)
+
+// Config holds the configuration of a Writer.
+type Config struct {
+	// URL is the URL of the InfluxDB server, e.g. http://localhost:8086, or
+	// of a UDP listener, e.g. udp://localhost:8089.
+	URL string
+	// Org, Bucket and Token are sent to the InfluxDB v2 write endpoint.
+	// They are ignored by UDP listeners.
+	Org    string
+	Bucket string
+	Token  string
+}
+
+// Writer writes frames in the line protocol to an InfluxDB v2 write endpoint
+// or a UDP listener. Failed writes are retried a few times before giving up.
+type Writer struct {
+	client   *http.Client
+	cfg      Config
+	writeURL string
+	conn     net.Conn
+
+	mu     sync.Mutex
+	models map[string]string
+}
+
+// NewWriter returns a Writer which sends HTTP requests with client.
+func NewWriter(client *http.Client, cfg Config) (*Writer, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing URL: %s", err)
+	}
+
+	w := Writer{client: client, cfg: cfg, models: make(map[string]string)}
+	switch u.Scheme {
+	case "http", "https":
+		q := make(url.Values)
+		if cfg.Org != "" {
+			q.Set("org", cfg.Org)
+		}
+		q.Set("bucket", cfg.Bucket)
+		q.Set("precision", "ns")
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v2/write"
+		u.RawQuery = q.Encode()
+		w.writeURL = u.String()
+	case "udp":
+		if w.conn, err = net.Dial("udp", u.Host); err != nil {
+			return nil, fmt.Errorf("error dialing: %s", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported URL scheme `%s`", u.Scheme)
+	}
+
+	return &w, nil
+}
+
+// RegisterDevice records the model of the device, with which its lines are
+// tagged.
+func (w *Writer) RegisterDevice(_ context.Context, info *inverter.DeviceInfo) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.models[info.SerialNumber] = info.ModelName
+	return nil
+}
+
+// Write writes the lines of the frame.
+func (w *Writer) Write(ctx context.Context, frame *inverter.ETDataFrame) error {
+	_, err := w.WriteBatch(ctx, []*inverter.ETDataFrame{frame})
+	return err
+}
+
+// WriteBatch writes the lines of the frames in a single request. Frames are
+// never rejected individually, so the returned slice only contains nil
+// errors.
+func (w *Writer) WriteBatch(ctx context.Context, frames []*inverter.ETDataFrame) ([]error, error) {
+	var body []byte
+	w.mu.Lock()
+	for _, frame := range frames {
+		body = AppendFrame(body, frame, Tag{"model", w.models[frame.SerialNumber]})
+	}
+	w.mu.Unlock()
+
+	if len(body) == 0 {
+		return make([]error, len(frames)), nil
+	}
+
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if err = w.send(ctx, body); err == nil || output.IsPermanent(err) || attempt == maxAttempts {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(retryInterval << (attempt - 1)):
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return make([]error, len(frames)), nil
+}
+
+func (w *Writer) send(ctx context.Context, body []byte) error {
+	if w.conn != nil {
+		return w.sendUDP(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.writeURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error building request: %s", err)
+	}
+	req.Header.Set("content-type", "text/plain; charset=utf-8")
+	req.Header.Set("user-agent", userAgent)
+	if w.cfg.Token != "" {
+		req.Header.Set("authorization", "Token "+w.cfg.Token)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending request: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return nil
+	}
+
+	err = fmt.Errorf("unexpected HTTP response code: %d", resp.StatusCode)
+	var respBody struct {
+		Message string `json:"message"`
+	}
+	if json.NewDecoder(io.LimitReader(resp.Body, maxErrorBodySize)).Decode(&respBody) == nil && respBody.Message != "" {
+		err = fmt.Errorf("unexpected HTTP response code: %d: %s", resp.StatusCode, respBody.Message)
+	}
+
+	// Invalid lines and lines outside the retention period of the bucket
+	// can not be written by retrying.
+	switch resp.StatusCode {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return output.Permanent(err)
+	default:
+		return err
+	}
+}
+
+// sendUDP sends the lines in as few datagrams as possible. Lines are never
+// split across datagrams.
+func (w *Writer) sendUDP(body []byte) error {
+	for len(body) > 0 {
+		n := len(body)
+		if n > maxDatagramSize {
+			n = bytes.LastIndexByte(body[:maxDatagramSize], '\n') + 1
+			if n == 0 {
+				// A single line larger than the limit is sent on its own.
+				if n = bytes.IndexByte(body, '\n') + 1; n == 0 {
+					n = len(body)
+				}
+			}
+		}
+
+		if _, err := w.conn.Write(body[:n]); err != nil {
+			return fmt.Errorf("error sending datagram: %s", err)
+		}
+		body = body[n:]
+	}
+	return nil
+}
+
+// Close closes the UDP socket, if any.
+func (w *Writer) Close() error {
+	if w.conn != nil {
+		return w.conn.Close()
+	}
+	return nil
+}
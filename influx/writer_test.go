@@ -0,0 +1,118 @@
+package influx_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"git.netflux.io/rob/solar-toolkit/influx"
+	"git.netflux.io/rob/solar-toolkit/inverter"
+	"git.netflux.io/rob/solar-toolkit/output"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testFrame(serialNumber string) *inverter.ETDataFrame {
+	return &inverter.ETDataFrame{
+		SerialNumber: serialNumber,
+		ETRuntimeData: &inverter.ETRuntimeData{
+			Timestamp: time.Date(2022, 7, 14, 10, 0, 0, 0, time.UTC),
+			PVPower:   2500,
+		},
+	}
+}
+
+func TestWriterHTTP(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests int
+		bodies   []string
+		status   = []int{http.StatusServiceUnavailable, http.StatusNoContent}
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/influx/api/v2/write", r.URL.Path)
+		assert.Equal(t, "home", r.URL.Query().Get("org"))
+		assert.Equal(t, "solar", r.URL.Query().Get("bucket"))
+		assert.Equal(t, "ns", r.URL.Query().Get("precision"))
+		assert.Equal(t, "Token secret", r.Header.Get("authorization"))
+
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(status[requests])
+		requests++
+	}))
+	defer srv.Close()
+
+	writer, err := influx.NewWriter(srv.Client(), influx.Config{URL: srv.URL + "/influx/", Org: "home", Bucket: "solar", Token: "secret"})
+	require.NoError(t, err)
+	defer writer.Close()
+
+	require.NoError(t, writer.RegisterDevice(context.Background(), &inverter.DeviceInfo{SerialNumber: "12345", ModelName: "GW10K-ET"}))
+
+	// The first request fails transiently and is retried.
+	errs, err := writer.WriteBatch(context.Background(), []*inverter.ETDataFrame{testFrame("12345"), testFrame("67890")})
+	require.NoError(t, err)
+	assert.Equal(t, []error{nil, nil}, errs)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, bodies, 2)
+	assert.Equal(t, bodies[0], bodies[1])
+	assert.Contains(t, bodies[1], "solar_runtime,model=GW10K-ET,serial=12345 pv_power=2500,")
+	assert.Contains(t, bodies[1], "solar_runtime,serial=67890 pv_power=2500,")
+}
+
+func TestWriterHTTPRejected(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		requests++
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = io.WriteString(w, `{"code":"invalid","message":"unable to parse line"}`)
+	}))
+	defer srv.Close()
+
+	writer, err := influx.NewWriter(srv.Client(), influx.Config{URL: srv.URL, Bucket: "solar"})
+	require.NoError(t, err)
+	defer writer.Close()
+
+	err = writer.Write(context.Background(), testFrame("12345"))
+	assert.EqualError(t, err, "unexpected HTTP response code: 400: unable to parse line")
+	assert.True(t, output.IsPermanent(err))
+	assert.Equal(t, 1, requests)
+}
+
+func TestWriterUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	writer, err := influx.NewWriter(http.DefaultClient, influx.Config{URL: "udp://" + conn.LocalAddr().String()})
+	require.NoError(t, err)
+
+	require.NoError(t, writer.Write(context.Background(), testFrame("12345")))
+	require.NoError(t, writer.Close())
+
+	buf := make([]byte, 65536)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	n, _, err := conn.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(buf[:n]), "solar_runtime,serial=12345,string=1 "), string(buf[:n]))
+	assert.True(t, strings.HasSuffix(string(buf[:n]), "\n"))
+}
+
+func TestNewWriterInvalidScheme(t *testing.T) {
+	_, err := influx.NewWriter(http.DefaultClient, influx.Config{URL: "ftp://localhost"})
+	assert.EqualError(t, err, "unsupported URL scheme `ftp`")
+}
@@ -0,0 +1,313 @@
+// Package integrate integrates the instantaneous power of successive data
+// frames of each inverter into energy totals, for values which the inverter
+// does not count itself: battery charge and discharge, meter import and
+// export, load and the generation of each PV string.
+//
+// Power is integrated with the trapezoidal rule between consecutive frames.
+// Intervals longer than the maximum gap, or in which either frame lacks the
+// power, are skipped rather than interpolated. Daily totals reset at
+// midnight in the timezone of the frame timestamps, and an interval which
+// spans midnight is split between the two days in proportion to time.
+package integrate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"git.netflux.io/rob/solar-toolkit/inverter"
+)
+
+// DefaultMaxGap is the default maximum interval between frames which is
+// integrated.
+const DefaultMaxGap = 5 * time.Minute
+
+// SaveInterval is the minimum interval between saves of the totals by Add.
+// Totals added since the last save are saved by Close.
+const SaveInterval = time.Minute
+
+// channel is a power integrated into daily and lifetime energy totals.
+type channel struct {
+	// name prefixes the names of the fields of the totals, e.g. "load" for
+	// load_energy_today and load_energy_total.
+	name string
+	// power returns the power in W, or false if it is not available.
+	power func(*inverter.ETDataFrame) (float64, bool)
+	// fields returns the daily and lifetime totals in the block.
+	fields func(*inverter.ETIntegratedData) (today, total *inverter.Energy)
+}
+
+// batteryPower returns the battery power, positive while discharging.
+func batteryPower(frame *inverter.ETDataFrame) (float64, bool) {
+	voltage, ok1 := fieldValue(frame, "battery_voltage")
+	current, ok2 := fieldValue(frame, "battery_current")
+	return voltage * current, ok1 && ok2
+}
+
+// meterPower returns the power measured by the meter, positive while
+// exporting.
+func meterPower(frame *inverter.ETDataFrame) (float64, bool) {
+	return fieldValue(frame, "meter_active_power_total")
+}
+
+// positive returns the positive part of the power, and negative that of its
+// negation.
+func positive(power func(*inverter.ETDataFrame) (float64, bool)) func(*inverter.ETDataFrame) (float64, bool) {
+	return func(frame *inverter.ETDataFrame) (float64, bool) {
+		v, ok := power(frame)
+		return max(v, 0), ok
+	}
+}
+
+func negative(power func(*inverter.ETDataFrame) (float64, bool)) func(*inverter.ETDataFrame) (float64, bool) {
+	return func(frame *inverter.ETDataFrame) (float64, bool) {
+		v, ok := power(frame)
+		return max(-v, 0), ok
+	}
+}
+
+func field(name string) func(*inverter.ETDataFrame) (float64, bool) {
+	return func(frame *inverter.ETDataFrame) (float64, bool) { return fieldValue(frame, name) }
+}
+
+func fieldValue(frame *inverter.ETDataFrame, name string) (float64, bool) {
+	f, ok := inverter.LookupField(name)
+	if !ok {
+		panic(fmt.Sprintf("unknown field %s", name))
+	}
+	return f.Value(frame)
+}
+
+var channels = []channel{
+	{"battery_charge", negative(batteryPower), func(d *inverter.ETIntegratedData) (*inverter.Energy, *inverter.Energy) {
+		return &d.BatteryChargeEnergyToday, &d.BatteryChargeEnergyTotal
+	}},
+	{"battery_discharge", positive(batteryPower), func(d *inverter.ETIntegratedData) (*inverter.Energy, *inverter.Energy) {
+		return &d.BatteryDischargeEnergyToday, &d.BatteryDischargeEnergyTotal
+	}},
+	{"meter_import", negative(meterPower), func(d *inverter.ETIntegratedData) (*inverter.Energy, *inverter.Energy) {
+		return &d.MeterImportEnergyToday, &d.MeterImportEnergyTotal
+	}},
+	{"meter_export", positive(meterPower), func(d *inverter.ETIntegratedData) (*inverter.Energy, *inverter.Energy) {
+		return &d.MeterExportEnergyToday, &d.MeterExportEnergyTotal
+	}},
+	{"load", positive(field("house_consumption")), func(d *inverter.ETIntegratedData) (*inverter.Energy, *inverter.Energy) {
+		return &d.LoadEnergyToday, &d.LoadEnergyTotal
+	}},
+	{"pv1", positive(field("pv1_power")), func(d *inverter.ETIntegratedData) (*inverter.Energy, *inverter.Energy) {
+		return &d.PV1EnergyToday, &d.PV1EnergyTotal
+	}},
+	{"pv2", positive(field("pv2_power")), func(d *inverter.ETIntegratedData) (*inverter.Energy, *inverter.Energy) {
+		return &d.PV2EnergyToday, &d.PV2EnergyTotal
+	}},
+}
+
+// device is the integration state of an inverter. It is persisted as JSON.
+type device struct {
+	// Timestamp is the timestamp of the latest frame.
+	Timestamp time.Time `json:"timestamp"`
+	// Power holds the power of each channel in the latest frame, in W, if
+	// available.
+	Power map[string]float64 `json:"power"`
+	// Today and Total hold the daily and lifetime totals of each channel, in
+	// kWh. Channels which have never been available are absent.
+	Today map[string]float64 `json:"today"`
+	Total map[string]float64 `json:"total"`
+}
+
+// Integrator integrates the power of frames into energy totals. It is safe
+// for concurrent use.
+type Integrator struct {
+	maxGap time.Duration
+	path   string
+
+	mu      sync.Mutex
+	devices map[string]*device
+	// saved is the time of the latest save, and dirty is true if the totals
+	// have changed since.
+	saved time.Time
+	dirty bool
+}
+
+// New returns an Integrator which skips intervals longer than maxGap. If
+// path is not empty, the totals are persisted to the file at path, from
+// which they are restored if it exists. The Integrator must be closed to
+// persist the latest totals.
+func New(maxGap time.Duration, path string) (*Integrator, error) {
+	i := Integrator{maxGap: maxGap, path: path, devices: make(map[string]*device)}
+	if path == "" {
+		return &i, nil
+	}
+
+	p, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &i, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading integration state: %s", err)
+	}
+	if err := json.Unmarshal(p, &i.devices); err != nil {
+		return nil, fmt.Errorf("error decoding integration state: %s", err)
+	}
+	return &i, nil
+}
+
+// Add integrates the power of the frame since the previous frame of the same
+// inverter, and sets the ETIntegratedData of the frame to the totals. Frames
+// without runtime data, or older than the previous frame, are ignored. The
+// error, if any, is that of persisting the totals, which are updated
+// regardless.
+func (i *Integrator) Add(frame *inverter.ETDataFrame) error {
+	if frame.ETRuntimeData == nil {
+		return nil
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	d, ok := i.devices[frame.SerialNumber]
+	if !ok {
+		d = &device{Today: make(map[string]float64), Total: make(map[string]float64)}
+		i.devices[frame.SerialNumber] = d
+	}
+	ts := frame.Timestamp
+	if !ts.After(d.Timestamp) {
+		return nil
+	}
+
+	power := make(map[string]float64)
+	for _, ch := range channels {
+		if v, ok := ch.power(frame); ok {
+			power[ch.name] = v
+		}
+	}
+
+	y, m, day := ts.Date()
+	midnight := time.Date(y, m, day, 0, 0, 0, 0, ts.Location())
+	rollover := d.Timestamp.Before(midnight)
+	if rollover {
+		clear(d.Today)
+	}
+
+	dt := ts.Sub(d.Timestamp)
+	for _, ch := range channels {
+		p1, ok := power[ch.name]
+		if !ok {
+			continue
+		}
+		// Channels are listed from their first available frame.
+		d.Today[ch.name] += 0
+		d.Total[ch.name] += 0
+
+		p0, ok := d.Power[ch.name]
+		if !ok || d.Timestamp.IsZero() || dt > i.maxGap {
+			continue
+		}
+
+		energy := (p0 + p1) / 2 * dt.Hours() / 1000
+		d.Total[ch.name] += energy
+		if rollover {
+			energy *= float64(ts.Sub(midnight)) / float64(dt)
+		}
+		d.Today[ch.name] += energy
+	}
+	d.Timestamp, d.Power = ts, power
+
+	frame.ETIntegratedData = d.data()
+
+	i.dirty = true
+	if time.Since(i.saved) < SaveInterval {
+		return nil
+	}
+	return i.save()
+}
+
+// Close saves the totals if they have changed since they were last saved.
+func (i *Integrator) Close() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if !i.dirty {
+		return nil
+	}
+	return i.save()
+}
+
+// data returns the totals of the device.
+func (d *device) data() *inverter.ETIntegratedData {
+	var data inverter.ETIntegratedData
+	frame := inverter.ETDataFrame{ETIntegratedData: &data}
+
+	var omitted []inverter.Field
+	for _, ch := range channels {
+		today, total := ch.fields(&data)
+		if _, ok := d.Total[ch.name]; !ok {
+			for _, name := range []string{ch.name + "_energy_today", ch.name + "_energy_total"} {
+				f, _ := inverter.LookupField(name)
+				omitted = append(omitted, f)
+			}
+			continue
+		}
+		*today, *total = round(d.Today[ch.name]), round(d.Total[ch.name])
+	}
+	frame.Omit(omitted...)
+
+	return &data
+}
+
+// round rounds the energy to the nearest Wh.
+func round(v float64) inverter.Energy {
+	return inverter.Energy(math.Round(v*1000) / 1000)
+}
+
+// save writes the state to the file, if any, replacing it atomically.
+func (i *Integrator) save() error {
+	if i.path == "" {
+		return nil
+	}
+
+	p, err := json.Marshal(i.devices)
+	if err != nil {
+		return fmt.Errorf("error encoding integration state: %s", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(i.path), filepath.Base(i.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("error writing integration state: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(p)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), i.path)
+	}
+	if err != nil {
+		return fmt.Errorf("error writing integration state: %s", err)
+	}
+	if err := syncDir(filepath.Dir(i.path)); err != nil {
+		return fmt.Errorf("error syncing integration state directory: %s", err)
+	}
+
+	i.saved, i.dirty = time.Now(), false
+	return nil
+}
+
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
@@ -0,0 +1,155 @@
+package integrate_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.netflux.io/rob/solar-toolkit/integrate"
+	"git.netflux.io/rob/solar-toolkit/inverter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testFrame(ts time.Time, pvPower inverter.Power, batteryCurrent inverter.Current, meterPower *inverter.Power) *inverter.ETDataFrame {
+	frame := inverter.ETDataFrame{
+		SerialNumber: "12345",
+		ETRuntimeData: &inverter.ETRuntimeData{
+			Timestamp:        ts,
+			PV1Power:         pvPower,
+			PV2Power:         pvPower / 2,
+			BatteryVoltage:   50,
+			BatteryCurrent:   batteryCurrent,
+			HouseConsumption: 600,
+		},
+	}
+	if meterPower != nil {
+		frame.ETMeterData = &inverter.ETMeterData{MeterActivePowerTotal: *meterPower}
+	}
+	return &frame
+}
+
+func ptr(v inverter.Power) *inverter.Power { return &v }
+
+func TestAdd(t *testing.T) {
+	ts := time.Date(2022, 7, 14, 12, 0, 0, 0, time.UTC)
+	i, err := integrate.New(integrate.DefaultMaxGap, "")
+	require.NoError(t, err)
+
+	frame := testFrame(ts, 1000, -20, ptr(-300))
+	require.NoError(t, i.Add(frame))
+	require.NotNil(t, frame.ETIntegratedData)
+	assert.Equal(t, inverter.ETIntegratedData{}, *frame.ETIntegratedData)
+
+	// The power is averaged over each interval.
+	frame = testFrame(ts.Add(time.Minute), 2000, 20, ptr(300))
+	require.NoError(t, i.Add(frame))
+	data := frame.ETIntegratedData
+	assert.Equal(t, inverter.Energy(0.025), data.PV1EnergyToday)
+	assert.Equal(t, inverter.Energy(0.025), data.PV1EnergyTotal)
+	assert.Equal(t, inverter.Energy(0.013), data.PV2EnergyTotal)
+	assert.Equal(t, inverter.Energy(0.01), data.LoadEnergyTotal)
+	// Charging at 1 kW, then discharging at 1 kW.
+	assert.Equal(t, inverter.Energy(0.008), data.BatteryChargeEnergyTotal)
+	assert.Equal(t, inverter.Energy(0.008), data.BatteryDischargeEnergyTotal)
+	assert.Equal(t, inverter.Energy(0.003), data.MeterImportEnergyToday)
+	assert.Equal(t, inverter.Energy(0.003), data.MeterExportEnergyToday)
+
+	// Intervals longer than the maximum gap are skipped.
+	frame = testFrame(ts.Add(time.Hour), 2000, 20, nil)
+	require.NoError(t, i.Add(frame))
+	assert.Equal(t, inverter.Energy(0.025), frame.PV1EnergyTotal)
+	assert.Equal(t, inverter.Energy(0.003), frame.MeterExportEnergyTotal)
+
+	// So are intervals without the power.
+	frame = testFrame(ts.Add(time.Hour+time.Minute), 2000, 20, ptr(300))
+	require.NoError(t, i.Add(frame))
+	assert.Equal(t, inverter.Energy(0.058), frame.PV1EnergyTotal)
+	assert.Equal(t, inverter.Energy(0.003), frame.MeterExportEnergyTotal)
+
+	// Older frames are ignored.
+	frame = testFrame(ts, 2000, 20, nil)
+	require.NoError(t, i.Add(frame))
+	assert.Nil(t, frame.ETIntegratedData)
+
+	// Each inverter is integrated separately.
+	frame = testFrame(ts.Add(2*time.Hour), 2000, 20, nil)
+	frame.SerialNumber = "67890"
+	require.NoError(t, i.Add(frame))
+	assert.Equal(t, inverter.Energy(0), frame.PV1EnergyTotal)
+}
+
+func TestAddOmitted(t *testing.T) {
+	ts := time.Date(2022, 7, 14, 12, 0, 0, 0, time.UTC)
+	i, err := integrate.New(integrate.DefaultMaxGap, "")
+	require.NoError(t, err)
+
+	frame := testFrame(ts, 1000, -20, nil)
+	f, _ := inverter.LookupField("battery_current")
+	frame.Omit(f)
+	require.NoError(t, i.Add(frame))
+
+	// Totals of powers which have never been available are omitted.
+	assert.True(t, frame.Omitted("meter_import_energy_today"))
+	assert.True(t, frame.Omitted("meter_export_energy_total"))
+	assert.True(t, frame.Omitted("battery_charge_energy_total"))
+	assert.False(t, frame.Omitted("pv1_energy_total"))
+}
+
+func TestAddDayRollover(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Madrid")
+	require.NoError(t, err)
+
+	i, err := integrate.New(integrate.DefaultMaxGap, "")
+	require.NoError(t, err)
+
+	frame := testFrame(time.Date(2022, 7, 14, 23, 58, 0, 0, loc), 1200, 0, nil)
+	require.NoError(t, i.Add(frame))
+	frame = testFrame(time.Date(2022, 7, 14, 23, 59, 0, 0, loc), 1200, 0, nil)
+	require.NoError(t, i.Add(frame))
+	assert.Equal(t, inverter.Energy(0.02), frame.PV1EnergyToday)
+
+	// The interval spanning midnight is split between the days.
+	frame = testFrame(time.Date(2022, 7, 15, 0, 1, 0, 0, loc), 1200, 0, nil)
+	require.NoError(t, i.Add(frame))
+	assert.Equal(t, inverter.Energy(0.02), frame.PV1EnergyToday)
+	assert.Equal(t, inverter.Energy(0.06), frame.PV1EnergyTotal)
+
+	// Daily totals reset after a gap spanning midnight.
+	frame = testFrame(time.Date(2022, 7, 16, 8, 0, 0, 0, loc), 1200, 0, nil)
+	require.NoError(t, i.Add(frame))
+	assert.Equal(t, inverter.Energy(0), frame.PV1EnergyToday)
+	assert.Equal(t, inverter.Energy(0.06), frame.PV1EnergyTotal)
+}
+
+func TestAddPersisted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "integration.json")
+	ts := time.Date(2022, 7, 14, 12, 0, 0, 0, time.UTC)
+
+	i, err := integrate.New(integrate.DefaultMaxGap, path)
+	require.NoError(t, err)
+	require.NoError(t, i.Add(testFrame(ts, 1200, 0, nil)))
+	require.NoError(t, i.Add(testFrame(ts.Add(time.Minute), 1200, 0, nil)))
+
+	// The totals are saved at most once per SaveInterval, and on Close.
+	p, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(p), `"timestamp":"2022-07-14T12:00:00Z"`)
+	require.NoError(t, i.Close())
+	p, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(p), `"timestamp":"2022-07-14T12:01:00Z"`)
+
+	// Integration resumes after a restart, including the interval spanning
+	// it.
+	i, err = integrate.New(integrate.DefaultMaxGap, path)
+	require.NoError(t, err)
+	frame := testFrame(ts.Add(2*time.Minute), 1200, 0, nil)
+	require.NoError(t, i.Add(frame))
+	assert.Equal(t, inverter.Energy(0.04), frame.PV1EnergyToday)
+	assert.Equal(t, inverter.Energy(0.04), frame.PV1EnergyTotal)
+
+	_, err = integrate.New(integrate.DefaultMaxGap, t.TempDir())
+	assert.ErrorContains(t, err, "error reading integration state")
+}
@@ -6,7 +6,6 @@ import (
 	"context"
 	"encoding/binary"
 	"fmt"
-	"math"
 	"strings"
 	"time"
 	_ "time/tzdata"
@@ -14,7 +13,7 @@ import (
 	"git.netflux.io/rob/solar-toolkit/command"
 )
 
-// The timezone used to parse timestamps.
+// The default timezone used to parse timestamps.
 const locationName = "Europe/Madrid"
 
 // ET represents an inverter from Goodwe's ET/EH/BT/SH series.
@@ -23,6 +22,30 @@ const locationName = "Europe/Madrid"
 type ET struct {
 	SerialNumber string
 	ModelName    string
+	// Location is the timezone of the inverter clock. If nil, Europe/Madrid
+	// is assumed.
+	Location *time.Location
+	// Transport is the protocol used to communicate with the inverter. If
+	// empty, UDP is assumed.
+	Transport command.Transport
+}
+
+// location panics if Location is nil and the `locationName` constant cannot
+// be resolved to a time.Location.
+func (inv ET) location() *time.Location {
+	if inv.Location != nil {
+		return inv.Location
+	}
+
+	loc, err := time.LoadLocation(locationName)
+	if err != nil {
+		panic(fmt.Sprintf("unknown location: %s", locationName))
+	}
+	return loc
+}
+
+func (inv ET) readCommand(offset, count uint16) command.Command {
+	return command.NewModbusFor(inv.Transport, command.ModbusCommandTypeRead, offset, count)
 }
 
 func (inv ET) isSinglePhase() bool {
@@ -76,11 +99,11 @@ type etMeterData struct {
 	ActivePowerL3           int16
 	ActivePowerTotal        int16
 	ReactivePowerTotal      int16
-	MeterPowerFactor1       int16
-	MeterPowerFactor2       int16
-	MeterPowerFactor3       int16
-	MeterPowerFactor        int16
-	MeterFrequency          int16
+	MeterPowerFactor1       int16 `unavailable:"0x7fff"`
+	MeterPowerFactor2       int16 `unavailable:"0x7fff,single_phase"`
+	MeterPowerFactor3       int16 `unavailable:"0x7fff,single_phase"`
+	MeterPowerFactor        int16 `unavailable:"0x7fff"`
+	MeterFrequency          int16 `unavailable:"0xffff,0x7fff"`
 	EnergyExportTotal       float32
 	EnergyImportTotal       float32
 	MeterActivePower1       int32
@@ -100,7 +123,7 @@ type etMeterData struct {
 }
 
 func (data *etMeterData) toMeterData(singlePhase bool) *ETMeterData {
-	return &ETMeterData{
+	meterData := ETMeterData{
 		ComMode:                 int(data.ComMode),
 		RSSI:                    int(data.RSSI),
 		ManufactureCode:         int(data.ManufactureCode),
@@ -112,12 +135,12 @@ func (data *etMeterData) toMeterData(singlePhase bool) *ETMeterData {
 		ActivePowerTotal:        newPower(data.ActivePowerTotal),
 		ReactivePowerTotal:      int(data.ReactivePowerTotal),
 		MeterPowerFactor1:       float64(data.MeterPowerFactor1) / 1000.0,
-		MeterPowerFactor2:       float64(filterSinglePhase(data.MeterPowerFactor2, singlePhase)) / 1000.0,
-		MeterPowerFactor3:       float64(filterSinglePhase(data.MeterPowerFactor3, singlePhase)) / 1000.0,
+		MeterPowerFactor2:       float64(data.MeterPowerFactor2) / 1000.0,
+		MeterPowerFactor3:       float64(data.MeterPowerFactor3) / 1000.0,
 		MeterPowerFactor:        float64(data.MeterPowerFactor) / 1000.0,
 		MeterFrequency:          newFrequency(data.MeterFrequency),
-		EnergyExportTotal:       newPower(data.EnergyExportTotal),
-		EnergyImportTotal:       newPower(data.EnergyImportTotal),
+		EnergyExportTotal:       EnergyWh(data.EnergyExportTotal),
+		EnergyImportTotal:       EnergyWh(data.EnergyImportTotal),
 		MeterActivePower1:       newPower(data.MeterActivePower1),
 		MeterActivePower2:       newPower(data.MeterActivePower2),
 		MeterActivePower3:       newPower(data.MeterActivePower3),
@@ -133,6 +156,9 @@ func (data *etMeterData) toMeterData(singlePhase bool) *ETMeterData {
 		MeterType:               int(data.MeterType),
 		MeterSoftwareVersion:    int(data.MeterSoftwareVersion),
 	}
+	omitRegisters(&meterData, &meterData.omitted, unavailableRegisters(meterRegisters, data, singlePhase), nil)
+
+	return &meterData
 }
 
 // etRuntimeData is an unexported struct used for parsing binary data only.
@@ -150,61 +176,61 @@ func (data *etMeterData) toMeterData(singlePhase bool) *ETMeterData {
 // below.
 type etRuntimeData struct {
 	Timestamp              [6]byte
-	PV1Voltage             int16
-	PV1Current             int16
-	PV1Power               int32
-	PV2Voltage             int16
-	PV2Current             int16
-	PV2Power               int32
+	PV1Voltage             int16 `unavailable:"0xffff"`
+	PV1Current             int16 `unavailable:"0xffff"`
+	PV1Power               int32 `unavailable:"0xffffffff"`
+	PV2Voltage             int16 `unavailable:"0xffff"`
+	PV2Current             int16 `unavailable:"0xffff"`
+	PV2Power               int32 `unavailable:"0xffffffff"`
 	_                      [18]byte
 	PV2Mode                byte
 	PV1Mode                byte
-	OnGridL1Voltage        int16
-	OnGridL1Current        int16
-	OnGridL1Frequency      int16
-	OnGridL1Power          int32
-	OnGridL2Voltage        int16
-	OnGridL2Current        int16
-	OnGridL2Frequency      int16
-	OnGridL2Power          int32
-	OnGridL3Voltage        int16
-	OnGridL3Current        int16
-	OnGridL3Frequency      int16
-	OnGridL3Power          int32
+	OnGridL1Voltage        int16 `unavailable:"0xffff"`
+	OnGridL1Current        int16 `unavailable:"0xffff"`
+	OnGridL1Frequency      int16 `unavailable:"0xffff"`
+	OnGridL1Power          int32 `unavailable:"0x7fffffff"`
+	OnGridL2Voltage        int16 `unavailable:"0xffff,single_phase"`
+	OnGridL2Current        int16 `unavailable:"0xffff,single_phase"`
+	OnGridL2Frequency      int16 `unavailable:"0xffff,single_phase"`
+	OnGridL2Power          int32 `unavailable:"0x7fffffff,single_phase"`
+	OnGridL3Voltage        int16 `unavailable:"0xffff,single_phase"`
+	OnGridL3Current        int16 `unavailable:"0xffff,single_phase"`
+	OnGridL3Frequency      int16 `unavailable:"0xffff,single_phase"`
+	OnGridL3Power          int32 `unavailable:"0x7fffffff,single_phase"`
 	GridMode               int16
 	TotalInverterPower     int32
 	ActivePower            int32
-	ReactivePower          int32
-	ApparentPower          int32
-	BackupL1Voltage        int16
-	BackupL1Current        int16
-	BackupL1Frequency      int16
-	LoadModeL1             int16
-	BackupL1Power          int32
-	BackupL2Voltage        int16
-	BackupL2Current        int16
-	BackupL2Frequency      int16
-	LoadModeL2             int16
-	BackupL2Power          int32
-	BackupL3Voltage        int16
-	BackupL3Current        int16
-	BackupL3Frequency      int16
-	LoadModeL3             int16
-	BackupL3Power          int32
-	LoadL1                 int32
-	LoadL2                 int32
-	LoadL3                 int32
+	ReactivePower          int32 `unavailable:"0x7fffffff"`
+	ApparentPower          int32 `unavailable:"0xffffffff,0x7fffffff"`
+	BackupL1Voltage        int16 `unavailable:"0xffff"`
+	BackupL1Current        int16 `unavailable:"0xffff"`
+	BackupL1Frequency      int16 `unavailable:"0xffff"`
+	LoadModeL1             int16 `unavailable:"0xffff"`
+	BackupL1Power          int32 `unavailable:"0xffffffff,0x7fffffff"`
+	BackupL2Voltage        int16 `unavailable:"0xffff,single_phase"`
+	BackupL2Current        int16 `unavailable:"0xffff,single_phase"`
+	BackupL2Frequency      int16 `unavailable:"0xffff,single_phase"`
+	LoadModeL2             int16 `unavailable:"0xffff,single_phase"`
+	BackupL2Power          int32 `unavailable:"0xffffffff,0x7fffffff,single_phase"`
+	BackupL3Voltage        int16 `unavailable:"0xffff,single_phase"`
+	BackupL3Current        int16 `unavailable:"0xffff,single_phase"`
+	BackupL3Frequency      int16 `unavailable:"0xffff,single_phase"`
+	LoadModeL3             int16 `unavailable:"0xffff,single_phase"`
+	BackupL3Power          int32 `unavailable:"0xffffffff,0x7fffffff,single_phase"`
+	LoadL1                 int32 `unavailable:"0x80000000,0x7fffffff"`
+	LoadL2                 int32 `unavailable:"0x80000000,0x7fffffff,single_phase"`
+	LoadL3                 int32 `unavailable:"0x80000000,0x7fffffff,single_phase"`
 	BackupLoad             int32
 	Load                   int32
 	UPSLoad                int16
-	TemperatureAir         int16
-	TemperatureModule      int16
-	Temperature            int16
+	TemperatureAir         int16 `unavailable:"0xffff,0x7fff"`
+	TemperatureModule      int16 `unavailable:"0xffff,0x7fff"`
+	Temperature            int16 `unavailable:"0xffff,0x7fff"`
 	FunctionBit            int16
-	BusVoltage             int16
-	NBusVoltage            int16
-	BatteryVoltage         int16
-	BatteryCurrent         int16
+	BusVoltage             int16 `unavailable:"0xffff"`
+	NBusVoltage            int16 `unavailable:"0xffff"`
+	BatteryVoltage         int16 `unavailable:"0xffff,0x7fff"`
+	BatteryCurrent         int16 `unavailable:"0x7fff"`
 	_                      [2]byte
 	BatteryMode            int32
 	WarningCode            int16
@@ -212,45 +238,32 @@ type etRuntimeData struct {
 	WorkMode               int32
 	OperationCode          int16
 	ErrorCodes             int16
-	EnergyGenerationTotal  int32
-	EnergyGenerationToday  int32
-	EnergyExportTotal      int32
+	EnergyGenerationTotal  int32 `unavailable:"0xffffffff"`
+	EnergyGenerationToday  int32 `unavailable:"0xffffffff"`
+	EnergyExportTotal      int32 `unavailable:"0xffffffff"`
 	EnergyExportTotalHours int32
-	EnergyExportToday      int16
-	EnergyImportTotal      int32
-	EnergyImportToday      int16
-	EnergyLoadTotal        int32
-	EnergyLoadDay          int16
-	BatteryChargeTotal     int32
-	BatteryChargeToday     int16
-	BatteryDischargeTotal  int32
-	BatteryDischargeToday  int16
+	EnergyExportToday      int16 `unavailable:"0xffff"`
+	EnergyImportTotal      int32 `unavailable:"0xffffffff"`
+	EnergyImportToday      int16 `unavailable:"0xffff"`
+	EnergyLoadTotal        int32 `unavailable:"0xffffffff"`
+	EnergyLoadDay          int16 `unavailable:"0xffff"`
+	BatteryChargeTotal     int32 `unavailable:"0xffffffff"`
+	BatteryChargeToday     int16 `unavailable:"0xffff"`
+	BatteryDischargeTotal  int32 `unavailable:"0xffffffff"`
+	BatteryDischargeToday  int16 `unavailable:"0xffff"`
 	_                      [16]byte
 	DiagStatusCode         int32
 }
 
-func filterSinglePhase[T numeric](v T, singlePhase bool) T {
-	if singlePhase {
-		return 0
-	}
-	return v
-}
-
-// toRuntimeData panics if the `locationName` constant cannot be resolved to a
-// time.Location.
-func (data *etRuntimeData) toRuntimeData(singlePhase bool) *ETRuntimeData {
+func (data *etRuntimeData) toRuntimeData(singlePhase bool, loc *time.Location) *ETRuntimeData {
 	yr := data.Timestamp[0]
 	mon := data.Timestamp[1]
 	day := data.Timestamp[2]
 	hr := data.Timestamp[3]
 	min := data.Timestamp[4]
 	sec := data.Timestamp[5]
-	loc, err := time.LoadLocation(locationName)
-	if err != nil {
-		panic(fmt.Sprintf("unknown location: %s", locationName))
-	}
 
-	return &ETRuntimeData{
+	runtimeData := ETRuntimeData{
 		Timestamp:              time.Date(2000+int(yr), time.Month(mon), int(day), int(hr), int(min), int(sec), 0, loc),
 		PV1Voltage:             newVoltage(data.PV1Voltage),
 		PV1Current:             newCurrent(data.PV1Current),
@@ -265,14 +278,14 @@ func (data *etRuntimeData) toRuntimeData(singlePhase bool) *ETRuntimeData {
 		OnGridL1Current:        newCurrent(data.OnGridL1Current),
 		OnGridL1Frequency:      newFrequency(data.OnGridL1Frequency),
 		OnGridL1Power:          newPower(data.OnGridL1Power),
-		OnGridL2Voltage:        newVoltage(filterSinglePhase(data.OnGridL2Voltage, singlePhase)),
-		OnGridL2Current:        newCurrent(filterSinglePhase(data.OnGridL2Current, singlePhase)),
-		OnGridL2Frequency:      newFrequency(filterSinglePhase(data.OnGridL2Frequency, singlePhase)),
-		OnGridL2Power:          newPower(filterSinglePhase(data.OnGridL2Power, singlePhase)),
-		OnGridL3Voltage:        newVoltage(filterSinglePhase(data.OnGridL3Voltage, singlePhase)),
-		OnGridL3Current:        newCurrent(filterSinglePhase(data.OnGridL3Current, singlePhase)),
-		OnGridL3Frequency:      newFrequency(filterSinglePhase(data.OnGridL3Frequency, singlePhase)),
-		OnGridL3Power:          newPower(filterSinglePhase(data.OnGridL3Power, singlePhase)),
+		OnGridL2Voltage:        newVoltage(data.OnGridL2Voltage),
+		OnGridL2Current:        newCurrent(data.OnGridL2Current),
+		OnGridL2Frequency:      newFrequency(data.OnGridL2Frequency),
+		OnGridL2Power:          newPower(data.OnGridL2Power),
+		OnGridL3Voltage:        newVoltage(data.OnGridL3Voltage),
+		OnGridL3Current:        newCurrent(data.OnGridL3Current),
+		OnGridL3Frequency:      newFrequency(data.OnGridL3Frequency),
+		OnGridL3Power:          newPower(data.OnGridL3Power),
 		GridMode:               int(data.GridMode),
 		TotalInverterPower:     newPower(data.TotalInverterPower),
 		ActivePower:            newPower(data.ActivePower),
@@ -283,19 +296,19 @@ func (data *etRuntimeData) toRuntimeData(singlePhase bool) *ETRuntimeData {
 		BackupL1Frequency:      newFrequency(data.BackupL1Frequency),
 		LoadModeL1:             int(data.LoadModeL1),
 		BackupL1Power:          newPower(data.BackupL1Power),
-		BackupL2Voltage:        newVoltage(filterSinglePhase(data.BackupL2Voltage, singlePhase)),
-		BackupL2Current:        newCurrent(filterSinglePhase(data.BackupL2Current, singlePhase)),
-		BackupL2Frequency:      newFrequency(filterSinglePhase(data.BackupL2Frequency, singlePhase)),
-		LoadModeL2:             int(filterSinglePhase(data.LoadModeL2, singlePhase)),
-		BackupL2Power:          newPower(filterSinglePhase(data.BackupL2Power, singlePhase)),
-		BackupL3Voltage:        newVoltage(filterSinglePhase(data.BackupL3Voltage, singlePhase)),
-		BackupL3Current:        newCurrent(filterSinglePhase(data.BackupL3Current, singlePhase)),
-		BackupL3Frequency:      newFrequency(filterSinglePhase(data.BackupL3Frequency, singlePhase)),
-		LoadModeL3:             int(filterSinglePhase(data.LoadModeL3, singlePhase)),
-		BackupL3Power:          newPower(filterSinglePhase(data.BackupL3Power, singlePhase)),
+		BackupL2Voltage:        newVoltage(data.BackupL2Voltage),
+		BackupL2Current:        newCurrent(data.BackupL2Current),
+		BackupL2Frequency:      newFrequency(data.BackupL2Frequency),
+		LoadModeL2:             int(data.LoadModeL2),
+		BackupL2Power:          newPower(data.BackupL2Power),
+		BackupL3Voltage:        newVoltage(data.BackupL3Voltage),
+		BackupL3Current:        newCurrent(data.BackupL3Current),
+		BackupL3Frequency:      newFrequency(data.BackupL3Frequency),
+		LoadModeL3:             int(data.LoadModeL3),
+		BackupL3Power:          newPower(data.BackupL3Power),
 		LoadL1:                 newPower(data.LoadL1),
-		LoadL2:                 newPower(filterSinglePhase(data.LoadL2, singlePhase)),
-		LoadL3:                 newPower(filterSinglePhase(data.LoadL3, singlePhase)),
+		LoadL2:                 newPower(data.LoadL2),
+		LoadL3:                 newPower(data.LoadL3),
 		BackupLoad:             newPower(data.BackupLoad),
 		Load:                   newPower(data.Load),
 		UPSLoad:                int(data.UPSLoad),
@@ -327,8 +340,11 @@ func (data *etRuntimeData) toRuntimeData(singlePhase bool) *ETRuntimeData {
 		BatteryDischargeTotal:  int(data.BatteryDischargeTotal),
 		BatteryDischargeToday:  int(data.BatteryDischargeToday),
 		DiagStatusCode:         int(data.DiagStatusCode),
-		HouseConsumption:       Power(int32(float64(data.PV1Power) + float64(data.PV2Power) + math.Round(float64(data.BatteryVoltage)*float64(data.BatteryCurrent)) - float64(data.ActivePower))),
 	}
+	omitRegisters(&runtimeData, &runtimeData.omitted, unavailableRegisters(runtimeRegisters, data, singlePhase), runtimeDerived)
+	runtimeData.DeriveFlows()
+
+	return &runtimeData
 }
 
 func (inv ET) DecodeRuntimeData(p []byte) (*ETRuntimeData, error) {
@@ -337,7 +353,7 @@ func (inv ET) DecodeRuntimeData(p []byte) (*ETRuntimeData, error) {
 		return nil, fmt.Errorf("error parsing response: %s", err)
 	}
 
-	return runtimeData.toRuntimeData(inv.isSinglePhase()), nil
+	return runtimeData.toRuntimeData(inv.isSinglePhase(), inv.location()), nil
 }
 
 func (inv ET) DecodeMeterData(p []byte) (*ETMeterData, error) {
@@ -351,7 +367,7 @@ func (inv ET) DecodeMeterData(p []byte) (*ETMeterData, error) {
 
 // DEPRECATED
 func (inv ET) DeviceInfo(ctx context.Context, conn command.Conn) (*DeviceInfo, error) {
-	resp, err := command.Send(command.NewModbus(command.ModbusCommandTypeRead, 0x88b8, 0x0021), conn)
+	resp, err := command.Send(inv.readCommand(0x88b8, 0x0021), conn)
 	if err != nil {
 		return nil, fmt.Errorf("error sending command: %s", err)
 	}
@@ -371,7 +387,7 @@ func (inv ET) RuntimeData(ctx context.Context, conn command.Conn) (*ETRuntimeDat
 		return nil, fmt.Errorf("error fetching device info: %s", err)
 	}
 
-	resp, err := command.Send(command.NewModbus(command.ModbusCommandTypeRead, 0x891c, 0x007d), conn)
+	resp, err := command.Send(inv.readCommand(0x891c, 0x007d), conn)
 	if err != nil {
 		return nil, fmt.Errorf("error sending command: %s", err)
 	}
@@ -381,12 +397,12 @@ func (inv ET) RuntimeData(ctx context.Context, conn command.Conn) (*ETRuntimeDat
 		return nil, fmt.Errorf("error parsing response: %s", err)
 	}
 
-	return runtimeData.toRuntimeData(deviceInfo.SinglePhase), nil
+	return runtimeData.toRuntimeData(deviceInfo.SinglePhase, inv.location()), nil
 }
 
 // DEPRECATED
 func (inv ET) MeterData(ctx context.Context, conn command.Conn) (*ETMeterData, error) {
-	resp, err := command.Send(command.NewModbus(command.ModbusCommandTypeRead, 0x8ca0, 0x2d), conn)
+	resp, err := command.Send(inv.readCommand(0x8ca0, 0x2d), conn)
 	if err != nil {
 		return nil, fmt.Errorf("error sending command: %s", err)
 	}
@@ -399,3 +415,27 @@ func (inv ET) MeterData(ctx context.Context, conn command.Conn) (*ETMeterData, e
 	// TODO: wire in single phase:
 	return meterData.toMeterData(true), nil
 }
+
+// ReadRegisters reads count raw 16-bit registers starting at offset.
+func (inv ET) ReadRegisters(ctx context.Context, conn command.Conn, offset, count uint16) ([]uint16, error) {
+	resp, err := command.Send(inv.readCommand(offset, count), conn)
+	if err != nil {
+		return nil, fmt.Errorf("error sending command: %s", err)
+	}
+
+	registers := make([]uint16, len(resp)/2)
+	if err := binary.Read(bytes.NewReader(resp), binary.BigEndian, registers); err != nil {
+		return nil, fmt.Errorf("error parsing response: %s", err)
+	}
+
+	return registers, nil
+}
+
+// WriteRegister writes value to the raw 16-bit register at offset.
+func (inv ET) WriteRegister(ctx context.Context, conn command.Conn, offset, value uint16) error {
+	if _, err := command.Send(command.NewModbusFor(inv.Transport, command.ModbusCommandTypeWrite, offset, value), conn); err != nil {
+		return fmt.Errorf("error sending command: %s", err)
+	}
+
+	return nil
+}
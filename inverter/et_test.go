@@ -1,6 +1,9 @@
 package inverter_test
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"testing"
 	"time"
 
@@ -31,46 +34,46 @@ func TestDecodeDeviceInfo(t *testing.T) {
 		assert.Equal(t, inverter.Current(12.3), runtimeData.OnGridL1Current)
 		assert.Equal(t, inverter.Frequency(49.99), runtimeData.OnGridL1Frequency)
 		assert.Equal(t, inverter.Power(2945), runtimeData.OnGridL1Power)
-		assert.Equal(t, inverter.Voltage(-0.1), runtimeData.OnGridL2Voltage)
-		assert.Equal(t, inverter.Current(-0.1), runtimeData.OnGridL2Current)
-		assert.Equal(t, inverter.Frequency(-0.01), runtimeData.OnGridL2Frequency)
-		assert.Equal(t, inverter.Power(2.147483647e+09), runtimeData.OnGridL2Power)
-		assert.Equal(t, inverter.Voltage(-0.1), runtimeData.OnGridL3Voltage)
-		assert.Equal(t, inverter.Current(-0.1), runtimeData.OnGridL3Current)
-		assert.Equal(t, inverter.Frequency(-0.01), runtimeData.OnGridL3Frequency)
-		assert.Equal(t, inverter.Power(2.147483647e+09), runtimeData.OnGridL3Power)
+		assert.True(t, runtimeData.Omitted("on_grid_l2_voltage"))
+		assert.True(t, runtimeData.Omitted("on_grid_l2_current"))
+		assert.True(t, runtimeData.Omitted("on_grid_l2_frequency"))
+		assert.True(t, runtimeData.Omitted("on_grid_l2_power"))
+		assert.True(t, runtimeData.Omitted("on_grid_l3_voltage"))
+		assert.True(t, runtimeData.Omitted("on_grid_l3_current"))
+		assert.True(t, runtimeData.Omitted("on_grid_l3_frequency"))
+		assert.True(t, runtimeData.Omitted("on_grid_l3_power"))
 		assert.Equal(t, 1, runtimeData.GridMode)
 		assert.Equal(t, inverter.Power(2945), runtimeData.TotalInverterPower)
 		assert.Equal(t, inverter.Power(1005), runtimeData.ActivePower)
-		assert.Equal(t, 2147483647, runtimeData.ReactivePower)
-		assert.Equal(t, -1, runtimeData.ApparentPower)
+		assert.True(t, runtimeData.Omitted("reactive_power"))
+		assert.True(t, runtimeData.Omitted("apparent_power"))
 		assert.Equal(t, inverter.Voltage(236.6), runtimeData.BackupL1Voltage)
 		assert.Equal(t, inverter.Current(0.5), runtimeData.BackupL1Current)
 		assert.Equal(t, inverter.Frequency(49.99), runtimeData.BackupL1Frequency)
 		assert.Equal(t, 1, runtimeData.LoadModeL1)
 		assert.Equal(t, inverter.Power(0), runtimeData.BackupL1Power)
-		assert.Equal(t, inverter.Voltage(-0.1), runtimeData.BackupL2Voltage)
-		assert.Equal(t, inverter.Current(-0.1), runtimeData.BackupL2Current)
-		assert.Equal(t, inverter.Frequency(-0.01), runtimeData.BackupL2Frequency)
-		assert.Equal(t, -1, runtimeData.LoadModeL2)
-		assert.Equal(t, inverter.Power(-1), runtimeData.BackupL2Power)
-		assert.Equal(t, inverter.Voltage(-0.1), runtimeData.BackupL3Voltage)
-		assert.Equal(t, inverter.Current(-0.1), runtimeData.BackupL3Current)
-		assert.Equal(t, inverter.Frequency(-0.01), runtimeData.BackupL3Frequency)
-		assert.Equal(t, -1, runtimeData.LoadModeL3)
-		assert.Equal(t, inverter.Power(-1), runtimeData.BackupL3Power)
+		assert.True(t, runtimeData.Omitted("backup_l2_voltage"))
+		assert.True(t, runtimeData.Omitted("backup_l2_current"))
+		assert.True(t, runtimeData.Omitted("backup_l2_frequency"))
+		assert.True(t, runtimeData.Omitted("load_mode_l2"))
+		assert.True(t, runtimeData.Omitted("backup_l2_power"))
+		assert.True(t, runtimeData.Omitted("backup_l3_voltage"))
+		assert.True(t, runtimeData.Omitted("backup_l3_current"))
+		assert.True(t, runtimeData.Omitted("backup_l3_frequency"))
+		assert.True(t, runtimeData.Omitted("load_mode_l3"))
+		assert.True(t, runtimeData.Omitted("backup_l3_power"))
 		assert.Equal(t, inverter.Power(1940), runtimeData.LoadL1)
-		assert.Equal(t, inverter.Power(-2.147483648e+09), runtimeData.LoadL2)
-		assert.Equal(t, inverter.Power(-2.147483648e+09), runtimeData.LoadL3)
+		assert.True(t, runtimeData.Omitted("load_l2"))
+		assert.True(t, runtimeData.Omitted("load_l3"))
 		assert.Equal(t, inverter.Power(0), runtimeData.BackupLoad)
 		assert.Equal(t, inverter.Power(1940), runtimeData.Load)
 		assert.Equal(t, 2, runtimeData.UPSLoad)
 		assert.Equal(t, inverter.Temp(63.1), runtimeData.TemperatureAir)
-		assert.Equal(t, inverter.Temp(3276.7), runtimeData.TemperatureModule)
+		assert.True(t, runtimeData.Omitted("temperature_module"))
 		assert.Equal(t, inverter.Temp(40.4), runtimeData.Temperature)
 		assert.Equal(t, 256, runtimeData.FunctionBit)
 		assert.Equal(t, inverter.Voltage(370.2), runtimeData.BusVoltage)
-		assert.Equal(t, inverter.Voltage(-0.1), runtimeData.NBusVoltage)
+		assert.True(t, runtimeData.Omitted("nbus_voltage"))
 		assert.Equal(t, inverter.Voltage(0), runtimeData.BatteryVoltage)
 		assert.Equal(t, inverter.Current(0), runtimeData.BatteryCurrent)
 		assert.Equal(t, 0, runtimeData.BatteryMode)
@@ -96,6 +99,18 @@ func TestDecodeDeviceInfo(t *testing.T) {
 		assert.Equal(t, inverter.Power(1888), runtimeData.HouseConsumption)
 	})
 
+	t.Run("with custom location", func(t *testing.T) {
+		loc, err := time.LoadLocation("Europe/London")
+		require.NoError(t, err)
+
+		inv := inverter.ET{SerialNumber: "foo", Location: loc}
+		runtimeData, err := inv.DecodeRuntimeData(inBytes)
+		require.NoError(t, err)
+
+		assert.Equal(t, time.Date(2022, 7, 13, 10, 35, 1, 0, loc), runtimeData.Timestamp)
+		assert.Equal(t, time.Date(2022, 7, 13, 9, 35, 1, 0, time.UTC), runtimeData.Timestamp.UTC())
+	})
+
 	t.Run("with single-phase inverter", func(t *testing.T) {
 		inv := inverter.ET{SerialNumber: "EHUfoo"}
 		runtimeData, err := inv.DecodeRuntimeData(inBytes)
@@ -137,7 +152,96 @@ func TestDecodeDeviceInfo(t *testing.T) {
 		assert.Equal(t, inverter.Power(1940), runtimeData.LoadL1)
 		assert.Equal(t, inverter.Power(0), runtimeData.LoadL2)
 		assert.Equal(t, inverter.Power(0), runtimeData.LoadL3)
+
+		assert.False(t, runtimeData.Omitted("on_grid_l1_voltage"))
+		for _, name := range []string{"on_grid_l2_power", "on_grid_l3_power", "backup_l2_power", "load_mode_l3", "load_l2"} {
+			assert.True(t, runtimeData.Omitted(name), name)
+		}
 	})
+
+	t.Run("with unavailable battery voltage", func(t *testing.T) {
+		p := bytes.Clone(inBytes)
+		p[160], p[161] = 0xff, 0xff
+
+		inv := inverter.ET{SerialNumber: "foo"}
+		runtimeData, err := inv.DecodeRuntimeData(p)
+		require.NoError(t, err)
+
+		// Values derived from the battery voltage are also unavailable.
+		assert.Equal(t, inverter.Voltage(0), runtimeData.BatteryVoltage)
+		assert.True(t, runtimeData.Omitted("battery_voltage"))
+		assert.Equal(t, inverter.Power(0), runtimeData.HouseConsumption)
+		assert.True(t, runtimeData.Omitted("house_consumption"))
+		assert.Equal(t, inverter.Power(2893), runtimeData.PVPower)
+		assert.False(t, runtimeData.Omitted("pv_power"))
+
+		frame := inverter.ETDataFrame{ETRuntimeData: runtimeData}
+		data, err := json.Marshal(&frame)
+		require.NoError(t, err)
+		assert.Contains(t, string(data), `"battery_voltage":null`)
+		assert.Contains(t, string(data), `"house_consumption":null`)
+	})
+
+	// The battery power is the product of the decoded voltage and current in
+	// W, not of the raw registers which are in units of 0.1 V and 0.1 A.
+	batteryTestCases := []struct {
+		name                 string
+		current              int16
+		wantBatteryVoltage   inverter.Voltage
+		wantBatteryCurrent   inverter.Current
+		wantHouseConsumption inverter.Power
+		wantFlows            map[string]inverter.Power
+	}{
+		{
+			name:                 "with battery charging",
+			current:              -100,
+			wantBatteryVoltage:   52,
+			wantBatteryCurrent:   -10,
+			wantHouseConsumption: 1368, // 2893 W PV - 520 W charging - 1005 W exported
+			wantFlows: map[string]inverter.Power{
+				"pv_to_load":    1368,
+				"pv_to_battery": 520,
+				"pv_to_grid":    1005,
+			},
+		},
+		{
+			name:                 "with battery discharging",
+			current:              50,
+			wantBatteryVoltage:   52,
+			wantBatteryCurrent:   5,
+			wantHouseConsumption: 2148, // 2893 W PV + 260 W discharging - 1005 W exported
+			wantFlows: map[string]inverter.Power{
+				"pv_to_load":      2148,
+				"pv_to_grid":      745,
+				"battery_to_grid": 260,
+			},
+		},
+	}
+
+	for _, tc := range batteryTestCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := bytes.Clone(inBytes)
+			binary.BigEndian.PutUint16(p[160:], 520)
+			binary.BigEndian.PutUint16(p[162:], uint16(tc.current))
+
+			inv := inverter.ET{SerialNumber: "foo"}
+			runtimeData, err := inv.DecodeRuntimeData(p)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.wantBatteryVoltage, runtimeData.BatteryVoltage)
+			assert.Equal(t, tc.wantBatteryCurrent, runtimeData.BatteryCurrent)
+			assert.Equal(t, tc.wantHouseConsumption, runtimeData.HouseConsumption)
+
+			frame := inverter.ETDataFrame{ETRuntimeData: runtimeData}
+			for name, want := range tc.wantFlows {
+				f, ok := inverter.LookupField(name)
+				require.True(t, ok, name)
+				v, ok := f.Value(&frame)
+				require.True(t, ok, name)
+				assert.Equal(t, float64(want), v, name)
+			}
+		})
+	}
 }
 
 func TestDecodeMeterData(t *testing.T) {
@@ -163,8 +267,8 @@ func TestDecodeMeterData(t *testing.T) {
 		assert.Equal(t, 0.999, meterData.MeterPowerFactor3)
 		assert.Equal(t, 0.968, meterData.MeterPowerFactor)
 		assert.Equal(t, inverter.Frequency(49.96), meterData.MeterFrequency)
-		assert.Equal(t, inverter.Power(723999.375000), meterData.EnergyExportTotal)
-		assert.Equal(t, inverter.Power(100078.125000), meterData.EnergyImportTotal)
+		assert.Equal(t, inverter.EnergyWh(723999.375000), meterData.EnergyExportTotal)
+		assert.Equal(t, inverter.EnergyWh(100078.125000), meterData.EnergyImportTotal)
 		assert.Equal(t, inverter.Power(1138), meterData.MeterActivePower1)
 		assert.Equal(t, inverter.Power(0), meterData.MeterActivePower2)
 		assert.Equal(t, inverter.Power(0), meterData.MeterActivePower3)
@@ -190,5 +294,7 @@ func TestDecodeMeterData(t *testing.T) {
 		assert.Equal(t, 0.0, meterData.MeterPowerFactor2)
 		assert.Equal(t, 0.0, meterData.MeterPowerFactor3)
 		assert.Equal(t, 0.968, meterData.MeterPowerFactor)
+		assert.True(t, meterData.Omitted("meter_power_factor2"))
+		assert.False(t, meterData.Omitted("meter_power_factor1"))
 	})
 }
@@ -0,0 +1,335 @@
+package inverter
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const (
+	// BlockRuntime is the block of runtime data.
+	BlockRuntime = "runtime"
+	// BlockMeter is the block of meter data.
+	BlockMeter = "meter"
+	// BlockIntegrated is the block of energy totals integrated from power
+	// by the daemon.
+	BlockIntegrated = "integrated"
+)
+
+// Field describes a single numeric value which can be read from an
+// ETDataFrame.
+type Field struct {
+	// Name is the JSON name of the field, e.g. "pv1_voltage".
+	Name string
+	// Section is a broad grouping of related fields, e.g. "pv" or "meter".
+	Section string
+	// Unit is the unit of the field, derived from its type. It is empty for
+	// untyped values such as status codes.
+	Unit string
+	// Counter is true if the field is a cumulative counter which never
+	// decreases, as opposed to a gauge.
+	Counter bool
+	// Integer is true if the field holds whole numbers, e.g. status codes.
+	Integer bool
+	// Block is the block of data containing the field, BlockRuntime,
+	// BlockMeter or BlockIntegrated.
+	Block string
+	// Base is the name of the field without its PV string or grid phase,
+	// e.g. "pv_voltage" for pv2_voltage and "on_grid_power" for
+	// on_grid_l1_power. Fields of each string or phase share a base name.
+	Base string
+	// PVString is the PV string of per-string fields, e.g. "2" for
+	// pv2_voltage.
+	PVString string
+	// Phase is the grid phase of per-phase fields, e.g. "L1" for
+	// on_grid_l1_power or meter_active_power1.
+	Phase string
+
+	index []int
+}
+
+// Value returns the value of the field in the provided frame. The second
+// return value is false if the frame does not include the block of data
+// containing the field, or the field was omitted.
+func (f Field) Value(frame *ETDataFrame) (float64, bool) {
+	if frame == nil || (*frame.omitted(f.Block))[f.Name] {
+		return 0, false
+	}
+
+	v, err := f.field(frame)
+	if err != nil {
+		return 0, false
+	}
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	default:
+		return v.Float(), true
+	}
+}
+
+// field returns the struct field holding the value of f in the frame, or an
+// error if the frame does not include its block.
+func (f Field) field(frame *ETDataFrame) (reflect.Value, error) {
+	return reflect.ValueOf(frame).Elem().FieldByIndexErr(f.index)
+}
+
+// omitted returns the set of omitted fields of the block, which is nil if
+// the frame does not include the block.
+func (frame *ETDataFrame) omitted(block string) *map[string]bool {
+	switch {
+	case block == BlockRuntime && frame.ETRuntimeData != nil:
+		return &frame.ETRuntimeData.omitted
+	case block == BlockMeter && frame.ETMeterData != nil:
+		return &frame.ETMeterData.omitted
+	case block == BlockIntegrated && frame.ETIntegratedData != nil:
+		return &frame.ETIntegratedData.omitted
+	default:
+		return new(map[string]bool)
+	}
+}
+
+// Omit removes the fields from the frame. Their values are set to zero,
+// Field.Value reports them as absent and they are encoded in JSON as null.
+//
+// Fields which the inverter reports as unavailable, e.g. the second and third
+// phases of single-phase inverters, are omitted when decoded.
+func (frame *ETDataFrame) Omit(fields ...Field) {
+	for _, f := range fields {
+		v, err := f.field(frame)
+		if err != nil {
+			continue
+		}
+		v.SetZero()
+
+		omitted := frame.omitted(f.Block)
+		if *omitted == nil {
+			*omitted = make(map[string]bool)
+		}
+		(*omitted)[f.Name] = true
+	}
+}
+
+// Omitted returns true if the named field was omitted from the frame, or is
+// unavailable.
+func (frame *ETDataFrame) Omitted(name string) bool {
+	f, ok := LookupField(name)
+	return ok && (*frame.omitted(f.Block))[name]
+}
+
+// plainFrame is an ETDataFrame without its JSON methods.
+type plainFrame ETDataFrame
+
+// MarshalJSON encodes the frame, with omitted fields encoded as null.
+func (frame ETDataFrame) MarshalJSON() ([]byte, error) {
+	data, err := json.Marshal(plainFrame(frame))
+	blocksOmitted := []map[string]bool{*frame.omitted(BlockRuntime), *frame.omitted(BlockMeter), *frame.omitted(BlockIntegrated)}
+	if err != nil || !slices.ContainsFunc(blocksOmitted, func(m map[string]bool) bool { return len(m) > 0 }) {
+		return data, err
+	}
+
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+	for _, omitted := range blocksOmitted {
+		for name := range omitted {
+			values[name] = json.RawMessage("null")
+		}
+	}
+	return json.Marshal(values)
+}
+
+// UnmarshalJSON decodes the frame. Fields of the included blocks of data
+// which are null or missing are omitted from the frame, so that partial
+// frames are not mistaken for zero values.
+func (frame *ETDataFrame) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, (*plainFrame)(frame)); err != nil {
+		return err
+	}
+
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+
+	*frame.omitted(BlockRuntime), *frame.omitted(BlockMeter), *frame.omitted(BlockIntegrated) = nil, nil, nil
+	var omitted []Field
+	for _, f := range frameFields {
+		if v, ok := values[f.Name]; !ok || string(v) == "null" {
+			omitted = append(omitted, f)
+		}
+	}
+	frame.Omit(omitted...)
+
+	return nil
+}
+
+// sectionPrefixes maps runtime data field name prefixes to sections. The
+// first matching prefix wins.
+var sectionPrefixes = []struct{ prefix, section string }{
+	{"pv_to_", "flow"},
+	{"battery_to_", "flow"},
+	{"grid_to_", "flow"},
+	{"self_", "flow"},
+	{"pv", "pv"},
+	{"on_grid_", "grid"},
+	{"grid_", "grid"},
+	{"total_inverter_", "grid"},
+	{"active_", "grid"},
+	{"reactive_", "grid"},
+	{"apparent_", "grid"},
+	{"backup_load", "load"},
+	{"backup_", "backup"},
+	{"load_mode_", "backup"},
+	{"load", "load"},
+	{"ups_", "load"},
+	{"house_", "load"},
+	{"temperature", "temperature"},
+	{"battery_", "battery"},
+	{"energy_", "energy"},
+}
+
+func runtimeSection(name string) string {
+	for _, p := range sectionPrefixes {
+		if strings.HasPrefix(name, p.prefix) {
+			return p.section
+		}
+	}
+	return "status"
+}
+
+var (
+	stringPattern = regexp.MustCompile(`^pv(\d)_(.+)$`)
+	phasePattern  = regexp.MustCompile(`^(.+)_l([123])(_.+)?$`)
+	meterPattern  = regexp.MustCompile(`^(meter_.+[a-z])([123])$`)
+)
+
+// splitName returns the base name, PV string and phase of the field name.
+func splitName(name string) (base, pvString, phase string) {
+	if m := stringPattern.FindStringSubmatch(name); m != nil {
+		return "pv_" + m[2], m[1], ""
+	} else if m := phasePattern.FindStringSubmatch(name); m != nil {
+		return m[1] + m[3], "", "L" + m[2]
+	} else if m := meterPattern.FindStringSubmatch(name); m != nil {
+		return m[1], "", "L" + m[2]
+	}
+	return name, "", ""
+}
+
+var frameFields = buildFields()
+
+func buildFields() []Field {
+	var fields []Field
+
+	frameType := reflect.TypeOf(ETDataFrame{})
+	for i := 0; i < frameType.NumField(); i++ {
+		sf := frameType.Field(i)
+		if !sf.Anonymous || sf.Type.Kind() != reflect.Pointer {
+			continue
+		}
+
+		block, section := BlockRuntime, runtimeSection
+		switch sf.Type.Elem() {
+		case reflect.TypeOf(ETMeterData{}):
+			block, section = BlockMeter, func(string) string { return "meter" }
+		case reflect.TypeOf(ETIntegratedData{}):
+			block, section = BlockIntegrated, func(string) string { return "energy" }
+		}
+
+		blockType := sf.Type.Elem()
+		for j := 0; j < blockType.NumField(); j++ {
+			bf := blockType.Field(j)
+			name, _, _ := strings.Cut(bf.Tag.Get("json"), ",")
+			if name == "" || name == "-" || !isNumeric(bf.Type) {
+				continue
+			}
+
+			var unit string
+			if u, ok := reflect.Zero(bf.Type).Interface().(interface{ Unit() string }); ok {
+				unit = u.Unit()
+			}
+
+			base, pvString, phase := splitName(name)
+			fields = append(fields, Field{
+				Name:     name,
+				Section:  section(name),
+				Unit:     unit,
+				Counter:  bf.Tag.Get("kind") == "counter",
+				Integer:  bf.Type.Kind() != reflect.Float32 && bf.Type.Kind() != reflect.Float64,
+				Block:    block,
+				Base:     base,
+				PVString: pvString,
+				Phase:    phase,
+				index:    []int{i, j},
+			})
+		}
+	}
+
+	return fields
+}
+
+func isNumeric(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	default:
+		return false
+	}
+}
+
+// Fields returns every numeric field of an ETDataFrame, in declaration order.
+func Fields() []Field {
+	return append([]Field(nil), frameFields...)
+}
+
+// LookupField returns the field with the given name.
+func LookupField(name string) (Field, bool) {
+	for _, f := range frameFields {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return Field{}, false
+}
+
+// MatchFields returns the fields matching any of the provided patterns, in
+// declaration order. Patterns are field names optionally including shell
+// glob characters, e.g. "pv*_power". An error is returned if a pattern is
+// malformed or does not match any field.
+func MatchFields(patterns []string) ([]Field, error) {
+	matched := make([]bool, len(frameFields))
+	for _, pattern := range patterns {
+		var found bool
+		for i, f := range frameFields {
+			ok, err := path.Match(pattern, f.Name)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern `%s`: %s", pattern, err)
+			}
+			if ok {
+				matched[i] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown field `%s`", pattern)
+		}
+	}
+
+	var fields []Field
+	for i, f := range frameFields {
+		if matched[i] {
+			fields = append(fields, f)
+		}
+	}
+	return fields, nil
+}
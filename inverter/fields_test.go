@@ -0,0 +1,206 @@
+package inverter_test
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+
+	"git.netflux.io/rob/solar-toolkit/inverter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFields(t *testing.T) {
+	fields := inverter.Fields()
+	require.NotEmpty(t, fields)
+
+	names := make(map[string]bool)
+	for _, f := range fields {
+		assert.False(t, names[f.Name], "duplicate field %s", f.Name)
+		names[f.Name] = true
+	}
+	assert.False(t, names["timestamp"])
+	assert.False(t, names["rssi"])
+
+	f, ok := inverter.LookupField("pv1_voltage")
+	require.True(t, ok)
+	assert.Equal(t, "pv", f.Section)
+	assert.Equal(t, "V", f.Unit)
+	assert.False(t, f.Counter)
+	assert.False(t, f.Integer)
+	assert.Equal(t, inverter.BlockRuntime, f.Block)
+	assert.Equal(t, "pv_voltage", f.Base)
+	assert.Equal(t, "1", f.PVString)
+	assert.Empty(t, f.Phase)
+
+	f, ok = inverter.LookupField("on_grid_l2_power")
+	require.True(t, ok)
+	assert.Equal(t, "on_grid_power", f.Base)
+	assert.Equal(t, "L2", f.Phase)
+
+	f, ok = inverter.LookupField("energy_generation_total")
+	require.True(t, ok)
+	assert.Equal(t, "energy", f.Section)
+	assert.Equal(t, "kWh", f.Unit)
+	assert.True(t, f.Counter)
+
+	f, ok = inverter.LookupField("meter_frequency")
+	require.True(t, ok)
+	assert.Equal(t, "meter", f.Section)
+	assert.Equal(t, "Hz", f.Unit)
+	assert.Equal(t, inverter.BlockMeter, f.Block)
+	assert.Equal(t, "meter_frequency", f.Base)
+
+	f, ok = inverter.LookupField("meter_active_power3")
+	require.True(t, ok)
+	assert.Equal(t, "meter_active_power", f.Base)
+	assert.Equal(t, "L3", f.Phase)
+
+	f, ok = inverter.LookupField("warning_code")
+	require.True(t, ok)
+	assert.Equal(t, "status", f.Section)
+	assert.Equal(t, "", f.Unit)
+	assert.True(t, f.Integer)
+
+	_, ok = inverter.LookupField("foo")
+	assert.False(t, ok)
+}
+
+func TestFieldsCounterUnits(t *testing.T) {
+	// Counters are cumulative energy totals, so sinks can export them as
+	// such. The units of the inverter's battery totals are unknown.
+	unitless := []string{"battery_charge_total", "battery_discharge_total"}
+
+	var n int
+	for _, f := range inverter.Fields() {
+		if !f.Counter {
+			continue
+		}
+		n++
+		if slices.Contains(unitless, f.Name) {
+			assert.Empty(t, f.Unit, f.Name)
+		} else {
+			assert.Contains(t, []string{"kWh", "Wh"}, f.Unit, f.Name)
+		}
+	}
+	assert.NotZero(t, n)
+
+	f, ok := inverter.LookupField("meter_energy_export_total")
+	require.True(t, ok)
+	assert.Equal(t, "Wh", f.Unit)
+	assert.True(t, f.Counter)
+}
+
+func TestFieldValue(t *testing.T) {
+	frame := inverter.ETDataFrame{
+		ETRuntimeData: &inverter.ETRuntimeData{PV1Voltage: 316.4, PV2Mode: 2, WorkMode: -1},
+	}
+
+	f, _ := inverter.LookupField("pv1_voltage")
+	v, ok := f.Value(&frame)
+	assert.True(t, ok)
+	assert.Equal(t, 316.4, v)
+
+	f, _ = inverter.LookupField("pv2_mode")
+	v, ok = f.Value(&frame)
+	assert.True(t, ok)
+	assert.Equal(t, 2.0, v)
+
+	f, _ = inverter.LookupField("work_mode")
+	v, ok = f.Value(&frame)
+	assert.True(t, ok)
+	assert.Equal(t, -1.0, v)
+
+	f, _ = inverter.LookupField("meter_frequency")
+	_, ok = f.Value(&frame)
+	assert.False(t, ok)
+}
+
+func TestOmit(t *testing.T) {
+	frame := inverter.ETDataFrame{
+		SerialNumber:  "12345",
+		ETRuntimeData: &inverter.ETRuntimeData{PV1Voltage: 316.4, PV2Voltage: 290},
+	}
+	fields, err := inverter.MatchFields([]string{"pv2_*", "meter_frequency"})
+	require.NoError(t, err)
+	frame.Omit(fields...)
+
+	assert.Equal(t, inverter.Voltage(0), frame.PV2Voltage)
+	assert.True(t, frame.Omitted("pv2_voltage"))
+	assert.False(t, frame.Omitted("pv1_voltage"))
+	// Fields of blocks which are not included are not omitted.
+	assert.False(t, frame.Omitted("meter_frequency"))
+
+	f, _ := inverter.LookupField("pv2_voltage")
+	_, ok := f.Value(&frame)
+	assert.False(t, ok)
+
+	data, err := json.Marshal(&frame)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"pv1_voltage":316.4`)
+	assert.Contains(t, string(data), `"pv2_voltage":null`)
+	assert.NotContains(t, string(data), "meter_frequency")
+
+	var decoded inverter.ETDataFrame
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, frame, decoded)
+
+	// Missing fields of included blocks are omitted.
+	require.NoError(t, json.Unmarshal([]byte(`{"serial_number":"12345","pv1_voltage":316.4}`), &decoded))
+	assert.Equal(t, inverter.Voltage(316.4), decoded.PV1Voltage)
+	assert.True(t, decoded.Omitted("pv_power"))
+	assert.False(t, decoded.Omitted("pv1_voltage"))
+	assert.Nil(t, decoded.ETMeterData)
+}
+
+func TestMatchFields(t *testing.T) {
+	testCases := []struct {
+		name      string
+		patterns  []string
+		wantNames []string
+		wantErr   string
+	}{
+		{
+			name:      "exact names in declaration order",
+			patterns:  []string{"pv2_power", "pv1_power"},
+			wantNames: []string{"pv1_power", "pv2_power"},
+		},
+		{
+			name:      "glob",
+			patterns:  []string{"pv*_current"},
+			wantNames: []string{"pv1_current", "pv2_current"},
+		},
+		{
+			name:      "overlapping patterns",
+			patterns:  []string{"load_l*", "load_l1"},
+			wantNames: []string{"load_l1", "load_l2", "load_l3"},
+		},
+		{
+			name:     "unknown field",
+			patterns: []string{"foo"},
+			wantErr:  "unknown field `foo`",
+		},
+		{
+			name:     "malformed pattern",
+			patterns: []string{"pv["},
+			wantErr:  "invalid pattern `pv[`: syntax error in pattern",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fields, err := inverter.MatchFields(tc.patterns)
+			if tc.wantErr != "" {
+				assert.EqualError(t, err, tc.wantErr)
+				return
+			}
+
+			require.NoError(t, err)
+			var names []string
+			for _, f := range fields {
+				names = append(names, f.Name)
+			}
+			assert.Equal(t, tc.wantNames, names)
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package inverter
+
+import (
+	"math"
+	"slices"
+)
+
+// flowInputs are the fields from which the power flows are derived.
+var flowInputs = []string{"pv_power", "battery_voltage", "battery_current", "active_power"}
+
+// flowFields are the fields derived by DeriveFlows.
+var flowFields = []string{
+	"house_consumption",
+	"pv_to_load", "pv_to_battery", "pv_to_grid",
+	"battery_to_load", "battery_to_grid",
+	"grid_to_load", "grid_to_battery",
+	"self_consumption", "self_sufficiency",
+}
+
+// DeriveFlows computes the fields derived from the PV, battery and grid power
+// of the runtime data: the house consumption, the power flowing from each of
+// PV, battery and grid to each of load, battery and grid, and the
+// self-consumption and self-sufficiency ratios.
+//
+// The battery power is the product of the decoded battery voltage and
+// current in W, positive while discharging, and the active power is positive
+// while exporting. The load is the balance of the two with the PV power, and
+// is supplied first by PV, then by the battery and then by the grid. Before
+// the flows were derived, the house consumption multiplied the raw battery
+// registers, in units of 0.1 V and 0.1 A, which overstated the battery power
+// by a factor of 100 whenever the battery was charging or discharging. Surplus PV power charges the battery before it is exported, so that
+// the flows into and out of each node add up.
+//
+// Self-consumption is the fraction of the PV power which is not exported, and
+// self-sufficiency the fraction of the load which is not supplied by the
+// grid. They are omitted when there is no PV power or load respectively. All
+// the derived fields are omitted if any of the fields they are derived from
+// are.
+func (d *ETRuntimeData) DeriveFlows() {
+	d.HouseConsumption = 0
+	d.PVToLoad, d.PVToBattery, d.PVToGrid = 0, 0, 0
+	d.BatteryToLoad, d.BatteryToGrid = 0, 0
+	d.GridToLoad, d.GridToBattery = 0, 0
+	d.SelfConsumption, d.SelfSufficiency = 0, 0
+	for _, name := range flowFields {
+		delete(d.omitted, name)
+	}
+
+	if slices.ContainsFunc(flowInputs, d.Omitted) {
+		d.omit(flowFields...)
+		return
+	}
+
+	battery := math.Round(float64(d.BatteryVoltage) * float64(d.BatteryCurrent))
+	grid := float64(d.ActivePower)
+	d.HouseConsumption = Power(float64(d.PVPower) + battery - grid)
+
+	pv, load := max(float64(d.PVPower), 0), max(float64(d.HouseConsumption), 0)
+	discharge, charge := max(battery, 0), max(-battery, 0)
+	imported, exported := max(-grid, 0), max(grid, 0)
+
+	remainingPV, remainingLoad := pv, load
+	flow := func(from, to *float64) Power {
+		v := min(*from, *to)
+		*from -= v
+		*to -= v
+		return Power(v)
+	}
+	d.PVToLoad = flow(&remainingPV, &remainingLoad)
+	d.BatteryToLoad = flow(&discharge, &remainingLoad)
+	d.GridToLoad = flow(&imported, &remainingLoad)
+	d.PVToBattery = flow(&remainingPV, &charge)
+	d.GridToBattery = flow(&imported, &charge)
+	d.PVToGrid = flow(&remainingPV, &exported)
+	d.BatteryToGrid = flow(&discharge, &exported)
+
+	if pv > 0 {
+		d.SelfConsumption = ratio(pv-float64(d.PVToGrid), pv)
+	} else {
+		d.omit("self_consumption")
+	}
+	if load > 0 {
+		d.SelfSufficiency = ratio(load-float64(d.GridToLoad), load)
+	} else {
+		d.omit("self_sufficiency")
+	}
+}
+
+// ratio returns a / b, rounded to three decimal places.
+func ratio(a, b float64) float64 {
+	return math.Round(a/b*1000) / 1000
+}
+
+// omit marks the named fields as omitted. Their values must already be zero.
+func (d *ETRuntimeData) omit(names ...string) {
+	if d.omitted == nil {
+		d.omitted = make(map[string]bool)
+	}
+	for _, name := range names {
+		d.omitted[name] = true
+	}
+}
+
+// HasFlows returns true if the frame includes any of the fields derived by
+// DeriveFlows other than the house consumption. Frames sent by older
+// versions of the daemon do not.
+func (frame *ETDataFrame) HasFlows() bool {
+	if frame.ETRuntimeData == nil {
+		return false
+	}
+	return slices.ContainsFunc(flowFields[1:], func(name string) bool { return !frame.ETRuntimeData.Omitted(name) })
+}
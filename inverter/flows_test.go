@@ -0,0 +1,150 @@
+package inverter_test
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+
+	"git.netflux.io/rob/solar-toolkit/inverter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeriveFlows(t *testing.T) {
+	testCases := []struct {
+		name           string
+		pvPower        inverter.Power
+		batteryVoltage inverter.Voltage
+		batteryCurrent inverter.Current
+		activePower    inverter.Power
+		omit           string
+		want           map[string]float64
+		wantOmitted    []string
+	}{
+		{
+			name:           "PV supplying load, charging and exporting",
+			pvPower:        5000,
+			batteryVoltage: 50,
+			batteryCurrent: -20,
+			activePower:    1500,
+			want: map[string]float64{
+				"house_consumption": 2500,
+				"pv_to_load":        2500,
+				"pv_to_battery":     1000,
+				"pv_to_grid":        1500,
+				"self_consumption":  0.7,
+				"self_sufficiency":  1,
+			},
+		},
+		{
+			name:           "battery and grid supplying load at night",
+			batteryVoltage: 50,
+			batteryCurrent: 10,
+			activePower:    -300,
+			want: map[string]float64{
+				"house_consumption": 800,
+				"battery_to_load":   500,
+				"grid_to_load":      300,
+				"self_sufficiency":  0.625,
+			},
+			wantOmitted: []string{"self_consumption"},
+		},
+		{
+			name:           "grid charging battery",
+			pvPower:        1000,
+			batteryVoltage: 50,
+			batteryCurrent: -40,
+			activePower:    -1500,
+			want: map[string]float64{
+				"house_consumption": 500,
+				"pv_to_load":        500,
+				"pv_to_battery":     500,
+				"grid_to_battery":   1500,
+				"self_consumption":  1,
+				"self_sufficiency":  1,
+			},
+		},
+		{
+			name:           "battery exporting",
+			batteryVoltage: 50,
+			batteryCurrent: 60,
+			activePower:    2000,
+			want: map[string]float64{
+				"house_consumption": 1000,
+				"battery_to_load":   1000,
+				"battery_to_grid":   2000,
+				"self_sufficiency":  1,
+			},
+			wantOmitted: []string{"self_consumption"},
+		},
+		{
+			name:           "unavailable input",
+			pvPower:        5000,
+			batteryCurrent: -20,
+			activePower:    1500,
+			omit:           "battery_voltage",
+			wantOmitted: []string{
+				"house_consumption", "pv_to_load", "pv_to_battery", "pv_to_grid",
+				"battery_to_load", "battery_to_grid", "grid_to_load", "grid_to_battery",
+				"self_consumption", "self_sufficiency",
+			},
+		},
+	}
+
+	flowNames := []string{
+		"house_consumption", "pv_to_load", "pv_to_battery", "pv_to_grid",
+		"battery_to_load", "battery_to_grid", "grid_to_load", "grid_to_battery",
+		"self_consumption", "self_sufficiency",
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			frame := inverter.ETDataFrame{
+				ETRuntimeData: &inverter.ETRuntimeData{
+					PVPower:        tc.pvPower,
+					BatteryVoltage: tc.batteryVoltage,
+					BatteryCurrent: tc.batteryCurrent,
+					ActivePower:    tc.activePower,
+				},
+			}
+			if tc.omit != "" {
+				f, _ := inverter.LookupField(tc.omit)
+				frame.Omit(f)
+			}
+			frame.DeriveFlows()
+
+			for _, name := range flowNames {
+				f, ok := inverter.LookupField(name)
+				require.True(t, ok, name)
+
+				v, ok := f.Value(&frame)
+				if assert.Equal(t, !slices.Contains(tc.wantOmitted, name), ok, name) && ok {
+					assert.Equal(t, tc.want[name], v, name)
+				}
+			}
+		})
+	}
+}
+
+func TestHasFlows(t *testing.T) {
+	var frame inverter.ETDataFrame
+	require.NoError(t, json.Unmarshal([]byte(`{"timestamp":"2022-07-14T10:00:00Z","pv_power":2500,"battery_voltage":50,"battery_current":0,"active_power":1000,"house_consumption":1500}`), &frame))
+	assert.False(t, frame.HasFlows())
+
+	frame.DeriveFlows()
+	assert.True(t, frame.HasFlows())
+	assert.Equal(t, inverter.Power(1500), frame.PVToLoad)
+	assert.Equal(t, inverter.Power(1000), frame.PVToGrid)
+
+	// Flows are omitted if the battery power is unknown.
+	require.NoError(t, json.Unmarshal([]byte(`{"timestamp":"2022-07-14T10:00:00Z","pv_power":2500}`), &frame))
+	frame.DeriveFlows()
+	assert.False(t, frame.HasFlows())
+	assert.True(t, frame.Omitted("house_consumption"))
+
+	data, err := json.Marshal(&frame)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"pv_to_load":null`)
+
+	assert.False(t, (&inverter.ETDataFrame{}).HasFlows())
+}
@@ -0,0 +1,59 @@
+package inverter
+
+import (
+	"context"
+	"fmt"
+
+	"git.netflux.io/rob/solar-toolkit/command"
+)
+
+// Setting describes a single configuration register of an inverter.
+type Setting struct {
+	Name     string
+	Register uint16
+	Unit     string
+	// Divisor converts the raw register value to the setting value.
+	Divisor float64
+}
+
+// ETSettings lists the known configuration registers of the ET series.
+//
+// See: https://github.com/marcelblijleven/goodwe/blob/327c7803e8415baeb4b6252431db91e1fc6f2fb3/goodwe/et.py
+var ETSettings = []Setting{
+	{Name: "battery_capacity", Register: 45350, Unit: "Ah", Divisor: 1},
+	{Name: "battery_modules", Register: 45351, Divisor: 1},
+	{Name: "battery_charge_voltage", Register: 45352, Unit: "V", Divisor: 10},
+	{Name: "battery_charge_current", Register: 45353, Unit: "A", Divisor: 10},
+	{Name: "battery_discharge_voltage", Register: 45354, Unit: "V", Divisor: 10},
+	{Name: "battery_discharge_current", Register: 45355, Unit: "A", Divisor: 10},
+	{Name: "battery_discharge_depth", Register: 45356, Unit: "%", Divisor: 1},
+	{Name: "power_factor", Register: 45482, Divisor: 100},
+	{Name: "work_mode", Register: 47000, Divisor: 1},
+	{Name: "battery_soc_protection", Register: 47500, Divisor: 1},
+	{Name: "grid_export", Register: 47509, Divisor: 1},
+	{Name: "grid_export_limit", Register: 47510, Unit: "W", Divisor: 1},
+}
+
+// SettingValue is the current value of a setting.
+type SettingValue struct {
+	Setting
+	Value float64
+}
+
+// Settings reads the current value of each of the known settings.
+func (inv ET) Settings(ctx context.Context, conn command.Conn) ([]SettingValue, error) {
+	var result []SettingValue
+	for _, s := range ETSettings {
+		registers, err := inv.ReadRegisters(ctx, conn, s.Register, 1)
+		if err != nil {
+			return nil, fmt.Errorf("error reading setting %s: %s", s.Name, err)
+		}
+		if len(registers) != 1 {
+			return nil, fmt.Errorf("error reading setting %s: unexpected response length %d", s.Name, len(registers))
+		}
+
+		result = append(result, SettingValue{Setting: s, Value: float64(int16(registers[0])) / s.Divisor})
+	}
+
+	return result, nil
+}
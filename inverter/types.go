@@ -18,6 +18,8 @@ type (
 	Energy    float64
 	Frequency float64
 	Temp      float64
+	// EnergyWh is an energy in Wh rather than kWh, as counted by the meter.
+	EnergyWh float64
 )
 
 func newPower[T numeric](v T) Power         { return Power(float64(v)) }
@@ -25,13 +27,7 @@ func newVoltage[T numeric](v T) Voltage     { return Voltage(float64(v) / 10.0)
 func newCurrent[T numeric](v T) Current     { return Current(float64(v) / 10.0) }
 func newFrequency[T numeric](v T) Frequency { return Frequency(float64(v) / 100.0) }
 func newTemp(v int16) Temp                  { return Temp(float64(v) / 10.0) }
-func newEnergy[T numeric](v T) Energy {
-	f := float64(v)
-	if f == -1 {
-		return 0
-	}
-	return Energy(f / 10.0)
-}
+func newEnergy[T numeric](v T) Energy       { return Energy(float64(v) / 10.0) }
 
 func (v Power) String() string     { return fmt.Sprintf("%f W", v) }
 func (v Voltage) String() string   { return fmt.Sprintf("%f V", v) }
@@ -39,22 +35,31 @@ func (v Current) String() string   { return fmt.Sprintf("%f A", v) }
 func (v Energy) String() string    { return fmt.Sprintf("%f kWh", v) }
 func (v Frequency) String() string { return fmt.Sprintf("%f Hz", v) }
 func (v Temp) String() string      { return fmt.Sprintf("%f C", v) }
+func (v EnergyWh) String() string  { return fmt.Sprintf("%f Wh", v) }
+
+func (Power) Unit() string     { return "W" }
+func (Voltage) Unit() string   { return "V" }
+func (Current) Unit() string   { return "A" }
+func (Energy) Unit() string    { return "kWh" }
+func (Frequency) Unit() string { return "Hz" }
+func (Temp) Unit() string      { return "C" }
+func (EnergyWh) Unit() string  { return "Wh" }
 
 // DeviceInfo holds the static information about an inverter.
 type DeviceInfo struct {
-	ModbusVersion   int    `json:"modbus_version"`
-	RatedPower      int    `json:"rated_power"`
-	ACOutputType    int    `json:"ac_output_type"`
-	SerialNumber    string `json:"serial_number"`
-	ModelName       string `json:"model_name"`
-	DSP1SWVersion   int    `json:"dsp1_sw_version"`
-	DSP2SWVersion   int    `json:"dsp2_sw_version"`
-	DSPSVNVersion   int    `json:"dsp_svn_version"`
-	ArmSWVersion    int    `json:"arm_sw_version"`
-	ArmSVNVersion   int    `json:"arm_svn_version"`
-	SoftwareVersion string `json:"software_version"`
-	ArmVersion      string `json:"arm_version"`
-	SinglePhase     bool   `json:"single_phase"`
+	ModbusVersion   int    `json:"modbus_version" db:"modbus_version"`
+	RatedPower      int    `json:"rated_power" db:"rated_power"`
+	ACOutputType    int    `json:"ac_output_type" db:"ac_output_type"`
+	SerialNumber    string `json:"serial_number" db:"serial_number"`
+	ModelName       string `json:"model_name" db:"model_name"`
+	DSP1SWVersion   int    `json:"dsp1_sw_version" db:"dsp1_sw_version"`
+	DSP2SWVersion   int    `json:"dsp2_sw_version" db:"dsp2_sw_version"`
+	DSPSVNVersion   int    `json:"dsp_svn_version" db:"dsp_svn_version"`
+	ArmSWVersion    int    `json:"arm_sw_version" db:"arm_sw_version"`
+	ArmSVNVersion   int    `json:"arm_svn_version" db:"arm_svn_version"`
+	SoftwareVersion string `json:"software_version" db:"software_version"`
+	ArmVersion      string `json:"arm_version" db:"arm_version"`
+	SinglePhase     bool   `json:"single_phase" db:"single_phase"`
 }
 
 // ETRuntimeData holds parsed runtime data for the ET series of inverters.
@@ -121,21 +126,39 @@ type ETRuntimeData struct {
 	WorkMode               int       `json:"work_mode" db:"work_mode"`
 	OperationCode          int       `json:"operation_code" db:"operation_code"`
 	ErrorCodes             int       `json:"-" db:"-"`
-	EnergyGenerationTotal  Energy    `json:"energy_generation_total" db:"energy_generation_total"`
+	EnergyGenerationTotal  Energy    `json:"energy_generation_total" db:"energy_generation_total" kind:"counter"`
 	EnergyGenerationToday  Energy    `json:"energy_generation_today" db:"energy_generation_today"`
-	EnergyExportTotal      Energy    `json:"energy_export_total" db:"energy_export_total"`
+	EnergyExportTotal      Energy    `json:"energy_export_total" db:"energy_export_total" kind:"counter"`
 	EnergyExportTotalHours int       `json:"energy_export_total_hours" db:"energy_export_total_hours"`
 	EnergyExportToday      Energy    `json:"energy_export_today" db:"energy_export_today"`
-	EnergyImportTotal      Energy    `json:"energy_import_total" db:"energy_import_total"`
+	EnergyImportTotal      Energy    `json:"energy_import_total" db:"energy_import_total" kind:"counter"`
 	EnergyImportToday      Energy    `json:"energy_import_today" db:"energy_import_today"`
-	EnergyLoadTotal        Energy    `json:"energy_load_total" db:"energy_load_total"`
+	EnergyLoadTotal        Energy    `json:"energy_load_total" db:"energy_load_total" kind:"counter"`
 	EnergyLoadDay          Energy    `json:"energy_load_day" db:"energy_load_day"`
-	BatteryChargeTotal     int       `json:"battery_charge_total" db:"battery_charge_total"`
+	BatteryChargeTotal     int       `json:"battery_charge_total" db:"battery_charge_total" kind:"counter"`
 	BatteryChargeToday     int       `json:"battery_charge_today" db:"battery_charge_today"`
-	BatteryDischargeTotal  int       `json:"battery_discharge_total" db:"battery_discharge_total"`
+	BatteryDischargeTotal  int       `json:"battery_discharge_total" db:"battery_discharge_total" kind:"counter"`
 	BatteryDischargeToday  int       `json:"battery_discharge_today" db:"battery_discharge_today"`
 	DiagStatusCode         int       `json:"-" db:"-"`
 	HouseConsumption       Power     `json:"house_consumption" db:"house_consumption"`
+	PVToLoad               Power     `json:"pv_to_load" db:"pv_to_load"`
+	PVToBattery            Power     `json:"pv_to_battery" db:"pv_to_battery"`
+	PVToGrid               Power     `json:"pv_to_grid" db:"pv_to_grid"`
+	BatteryToLoad          Power     `json:"battery_to_load" db:"battery_to_load"`
+	BatteryToGrid          Power     `json:"battery_to_grid" db:"battery_to_grid"`
+	GridToLoad             Power     `json:"grid_to_load" db:"grid_to_load"`
+	GridToBattery          Power     `json:"grid_to_battery" db:"grid_to_battery"`
+	SelfConsumption        float64   `json:"self_consumption" db:"self_consumption"`
+	SelfSufficiency        float64   `json:"self_sufficiency" db:"self_sufficiency"`
+
+	// omitted holds the names of the fields which are absent, see
+	// ETDataFrame.Omit.
+	omitted map[string]bool
+}
+
+// Omitted returns true if the named field was omitted, or is unavailable.
+func (d *ETRuntimeData) Omitted(name string) bool {
+	return d != nil && d.omitted[name]
 }
 
 // ETMeterData holds parsed meter data for the ET series of inverters.
@@ -155,8 +178,8 @@ type ETMeterData struct {
 	MeterPowerFactor3       float64   `json:"meter_power_factor3" db:"meter_power_factor3"`
 	MeterPowerFactor        float64   `json:"meter_power_factor" db:"meter_power_factor"`
 	MeterFrequency          Frequency `json:"meter_frequency" db:"meter_frequency"`
-	EnergyExportTotal       Power     `json:"meter_energy_export_total" db:"meter_energy_export_total"`
-	EnergyImportTotal       Power     `json:"meter_energy_import_total" db:"meter_energy_import_total"`
+	EnergyExportTotal       EnergyWh  `json:"meter_energy_export_total" db:"meter_energy_export_total" kind:"counter"`
+	EnergyImportTotal       EnergyWh  `json:"meter_energy_import_total" db:"meter_energy_import_total" kind:"counter"`
 	MeterActivePower1       Power     `json:"meter_active_power1" db:"meter_active_power1"`
 	MeterActivePower2       Power     `json:"meter_active_power2" db:"meter_active_power2"`
 	MeterActivePower3       Power     `json:"meter_active_power3" db:"meter_active_power3"`
@@ -171,9 +194,56 @@ type ETMeterData struct {
 	MeterApparentPowerTotal int       `json:"meter_apparent_power_total" db:"meter_apparent_power_total"`
 	MeterType               int       `json:"meter_type" db:"-"`
 	MeterSoftwareVersion    int       `json:"meter_software_version" db:"meter_software_version"`
+
+	// omitted holds the names of the fields which are absent, see
+	// ETDataFrame.Omit.
+	omitted map[string]bool
+}
+
+// Omitted returns true if the named field was omitted, or is unavailable.
+func (d *ETMeterData) Omitted(name string) bool {
+	return d != nil && d.omitted[name]
+}
+
+// ETIntegratedData holds energy totals integrated by the daemon from the
+// instantaneous power of successive frames, for values which the inverter
+// does not count itself. Daily totals reset at midnight in the timezone of
+// the inverter.
+type ETIntegratedData struct {
+	BatteryChargeEnergyToday    Energy `json:"battery_charge_energy_today" db:"-"`
+	BatteryChargeEnergyTotal    Energy `json:"battery_charge_energy_total" db:"-" kind:"counter"`
+	BatteryDischargeEnergyToday Energy `json:"battery_discharge_energy_today" db:"-"`
+	BatteryDischargeEnergyTotal Energy `json:"battery_discharge_energy_total" db:"-" kind:"counter"`
+	MeterImportEnergyToday      Energy `json:"meter_import_energy_today" db:"-"`
+	MeterImportEnergyTotal      Energy `json:"meter_import_energy_total" db:"-" kind:"counter"`
+	MeterExportEnergyToday      Energy `json:"meter_export_energy_today" db:"-"`
+	MeterExportEnergyTotal      Energy `json:"meter_export_energy_total" db:"-" kind:"counter"`
+	LoadEnergyToday             Energy `json:"load_energy_today" db:"-"`
+	LoadEnergyTotal             Energy `json:"load_energy_total" db:"-" kind:"counter"`
+	PV1EnergyToday              Energy `json:"pv1_energy_today" db:"-"`
+	PV1EnergyTotal              Energy `json:"pv1_energy_total" db:"-" kind:"counter"`
+	PV2EnergyToday              Energy `json:"pv2_energy_today" db:"-"`
+	PV2EnergyTotal              Energy `json:"pv2_energy_total" db:"-" kind:"counter"`
+
+	// omitted holds the names of the fields which are absent, see
+	// ETDataFrame.Omit.
+	omitted map[string]bool
+}
+
+// Omitted returns true if the named field was omitted.
+func (d *ETIntegratedData) Omitted(name string) bool {
+	return d != nil && d.omitted[name]
 }
 
 type ETDataFrame struct {
+	// SerialNumber identifies the inverter the frame was read from. It may be
+	// empty for frames sent by older daemons.
+	SerialNumber string `json:"serial_number,omitempty" db:"serial_number"`
+	// Flagged holds the names of fields with implausible values, which were
+	// kept but flagged by validation.
+	Flagged []string `json:"flagged,omitempty" db:"-"`
+
 	*ETRuntimeData
 	*ETMeterData
+	*ETIntegratedData
 }
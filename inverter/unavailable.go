@@ -0,0 +1,121 @@
+package inverter
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Registers of the raw structs used for parsing binary data may be tagged
+// with the raw values which the inverter reports when a reading is not
+// available, as unsigned numbers of the width of the register, e.g.
+// `unavailable:"0xffff,0x7fff"`. Registers tagged with "single_phase" are not
+// available on single-phase inverters.
+//
+// Unavailable readings are omitted from the decoded data rather than decoded
+// as zero or as implausibly large values.
+
+// registerRule describes when a register reports its reading as unavailable.
+type registerRule struct {
+	index       int
+	name        string
+	values      []uint64
+	singlePhase bool
+}
+
+var (
+	runtimeRegisters = registerRules(reflect.TypeOf(etRuntimeData{}))
+	meterRegisters   = registerRules(reflect.TypeOf(etMeterData{}))
+)
+
+// runtimeDerived maps runtime data fields derived from other registers to
+// those registers. A derived field is unavailable if any of them are. The
+// power flows are derived afterwards, see DeriveFlows.
+var runtimeDerived = map[string][]string{
+	"PVPower": {"PV1Power", "PV2Power"},
+}
+
+// registerRules returns the rules of the tagged registers of the raw struct
+// type. It panics if a tag is malformed.
+func registerRules(t reflect.Type) []registerRule {
+	var rules []registerRule
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag, ok := sf.Tag.Lookup("unavailable")
+		if !ok {
+			continue
+		}
+
+		rule := registerRule{index: i, name: sf.Name}
+		for _, s := range strings.Split(tag, ",") {
+			if s == "single_phase" {
+				rule.singlePhase = true
+				continue
+			}
+			v, err := strconv.ParseUint(s, 0, sf.Type.Bits())
+			if err != nil {
+				panic(fmt.Sprintf("invalid unavailable tag of %s: %s", sf.Name, err))
+			}
+			rule.values = append(rule.values, v)
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// unavailableRegisters returns the names of the registers of raw, a pointer
+// to a raw struct, which report their reading as unavailable.
+func unavailableRegisters(rules []registerRule, raw any, singlePhase bool) []string {
+	v := reflect.ValueOf(raw).Elem()
+
+	var names []string
+	for _, rule := range rules {
+		fv := v.Field(rule.index)
+
+		var u uint64
+		switch fv.Kind() {
+		case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			u = uint64(fv.Int()) & (uint64(1)<<fv.Type().Bits() - 1)
+		default:
+			u = fv.Uint()
+		}
+
+		if (rule.singlePhase && singlePhase) || slices.Contains(rule.values, u) {
+			names = append(names, rule.name)
+		}
+	}
+	return names
+}
+
+// omitRegisters omits the fields of block, a pointer to a decoded data block
+// with the set of omitted fields omitted, which are named after the
+// registers, along with the fields derived from them.
+func omitRegisters(block any, omitted *map[string]bool, registers []string, derived map[string][]string) {
+	if len(registers) == 0 {
+		return
+	}
+
+	names := slices.Clone(registers)
+	for name, deps := range derived {
+		if slices.ContainsFunc(deps, func(dep string) bool { return slices.Contains(registers, dep) }) {
+			names = append(names, name)
+		}
+	}
+
+	v := reflect.ValueOf(block).Elem()
+	for _, name := range names {
+		sf, ok := v.Type().FieldByName(name)
+		if !ok {
+			panic(fmt.Sprintf("unknown field %s", name))
+		}
+		v.FieldByIndex(sf.Index).SetZero()
+
+		jsonName, _, _ := strings.Cut(sf.Tag.Get("json"), ",")
+		if *omitted == nil {
+			*omitted = make(map[string]bool)
+		}
+		(*omitted)[jsonName] = true
+	}
+}
@@ -0,0 +1,318 @@
+// Package mqtt publishes inverter data frames to an MQTT broker, along with
+// Home Assistant discovery configs so that each field appears as a sensor.
+//
+// For each frame, the value of every field is published to
+// <prefix>/<serial>/<field>, and the whole frame as a JSON object to
+// <prefix>/<serial>/state. The availability of the publisher is published
+// to <prefix>/status, as "online" or, by the broker once the connection is
+// lost, "offline".
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.netflux.io/rob/solar-toolkit/format"
+	"git.netflux.io/rob/solar-toolkit/inverter"
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	// DefaultTopicPrefix is the default prefix of every state topic.
+	DefaultTopicPrefix = "solar-toolkit"
+	// DefaultDiscoveryPrefix is the default discovery prefix of Home
+	// Assistant.
+	DefaultDiscoveryPrefix = "homeassistant"
+
+	connectTimeout = time.Second * 10
+	publishTimeout = time.Second * 10
+)
+
+// Config holds the configuration of a Publisher.
+type Config struct {
+	// Broker is the URL of the broker, e.g. tcp://localhost:1883 or
+	// ssl://broker.example.com:8883.
+	Broker   string
+	Username string
+	Password string
+	// ClientID identifies the client to the broker. It must be unique among
+	// the clients of the broker.
+	ClientID string
+	// TopicPrefix defaults to DefaultTopicPrefix.
+	TopicPrefix string
+	// DiscoveryPrefix defaults to DefaultDiscoveryPrefix.
+	DiscoveryPrefix string
+	// Retain sets the retain flag of state messages, so that the latest
+	// values are available to subscribers as soon as they connect.
+	Retain bool
+}
+
+// Publisher publishes frames to an MQTT broker.
+type Publisher struct {
+	cfg    Config
+	client paho.Client
+
+	mu         sync.Mutex
+	discovered map[string]bool
+	devices    map[string]*inverter.DeviceInfo
+}
+
+// Connect returns a Publisher connected to the broker. If the broker can not
+// be reached, the connection is retried in the background and frames
+// published in the meantime are dropped.
+func Connect(cfg Config) (*Publisher, error) {
+	if cfg.TopicPrefix == "" {
+		cfg.TopicPrefix = DefaultTopicPrefix
+	}
+	if cfg.DiscoveryPrefix == "" {
+		cfg.DiscoveryPrefix = DefaultDiscoveryPrefix
+	}
+
+	p := Publisher{cfg: cfg, discovered: make(map[string]bool), devices: make(map[string]*inverter.DeviceInfo)}
+	statusTopic := p.statusTopic()
+
+	opts := paho.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(cfg.ClientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetConnectTimeout(connectTimeout).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetWill(statusTopic, "offline", 1, true).
+		SetOnConnectHandler(func(c paho.Client) {
+			c.Publish(statusTopic, 1, true, "online")
+
+			// Discovery configs are resent after reconnecting, in case
+			// the broker lost them.
+			p.mu.Lock()
+			clear(p.discovered)
+			p.mu.Unlock()
+		})
+
+	p.client = paho.NewClient(opts)
+	token := p.client.Connect()
+	if token.WaitTimeout(connectTimeout) && token.Error() != nil {
+		return nil, fmt.Errorf("error connecting to MQTT broker: %s", token.Error())
+	}
+
+	return &p, nil
+}
+
+// Close publishes the offline status and disconnects from the broker.
+func (p *Publisher) Close() error {
+	if p.client.IsConnected() {
+		p.client.Publish(p.statusTopic(), 1, true, "offline").WaitTimeout(publishTimeout)
+	}
+	p.client.Disconnect(250)
+	return nil
+}
+
+// RegisterDevice records the device info, which is included in the
+// discovery configs of the device. If they were already published, they are
+// published again with the info on the next frame.
+func (p *Publisher) RegisterDevice(_ context.Context, info *inverter.DeviceInfo) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.devices[info.SerialNumber] = info
+	delete(p.discovered, info.SerialNumber)
+	return nil
+}
+
+// Write publishes the frame, with the device info recorded by
+// RegisterDevice, if any.
+func (p *Publisher) Write(_ context.Context, frame *inverter.ETDataFrame) error {
+	p.mu.Lock()
+	info := p.devices[frame.SerialNumber]
+	p.mu.Unlock()
+
+	return p.Publish(frame, info)
+}
+
+func (p *Publisher) statusTopic() string {
+	return p.cfg.TopicPrefix + "/status"
+}
+
+func (p *Publisher) deviceTopic(serialNumber string) string {
+	return p.cfg.TopicPrefix + "/" + topicSegment(serialNumber)
+}
+
+// Publish publishes the fields of the frame, preceded by the discovery
+// configs of its device the first time it is seen. info may be nil if the
+// device info is not known.
+func (p *Publisher) Publish(frame *inverter.ETDataFrame, info *inverter.DeviceInfo) error {
+	if !p.client.IsConnectionOpen() {
+		return errors.New("not connected to MQTT broker")
+	}
+
+	fields := frameFields(frame)
+
+	p.mu.Lock()
+	discovered := p.discovered[frame.SerialNumber]
+	p.mu.Unlock()
+	if !discovered {
+		for _, f := range fields {
+			topic, payload, err := p.DiscoveryConfig(frame.SerialNumber, info, f)
+			if err != nil {
+				return err
+			}
+			if err := p.publish(topic, true, payload); err != nil {
+				return err
+			}
+		}
+
+		p.mu.Lock()
+		p.discovered[frame.SerialNumber] = true
+		p.mu.Unlock()
+	}
+
+	deviceTopic := p.deviceTopic(frame.SerialNumber)
+	for _, f := range fields {
+		v, _ := f.Value(frame)
+		if err := p.publish(deviceTopic+"/"+f.Name, p.cfg.Retain, []byte(strconv.FormatFloat(v, 'f', -1, 64))); err != nil {
+			return err
+		}
+	}
+
+	var state bytes.Buffer
+	if err := format.Write(&state, format.JSON, frame, fields); err != nil {
+		return fmt.Errorf("error encoding frame: %s", err)
+	}
+	return p.publish(deviceTopic+"/state", p.cfg.Retain, state.Bytes())
+}
+
+func (p *Publisher) publish(topic string, retain bool, payload []byte) error {
+	token := p.client.Publish(topic, 0, retain, payload)
+	if !token.WaitTimeout(publishTimeout) {
+		return fmt.Errorf("error publishing to %s: timed out", topic)
+	}
+	if err := token.Error(); err != nil {
+		return fmt.Errorf("error publishing to %s: %s", topic, err)
+	}
+	return nil
+}
+
+// frameFields returns the fields included in the frame.
+func frameFields(frame *inverter.ETDataFrame) []inverter.Field {
+	var fields []inverter.Field
+	for _, f := range inverter.Fields() {
+		if _, ok := f.Value(frame); ok {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// sensorClasses maps field units to Home Assistant device classes and
+// units.
+var sensorClasses = map[string]struct{ deviceClass, unit string }{
+	"W":   {"power", "W"},
+	"V":   {"voltage", "V"},
+	"A":   {"current", "A"},
+	"kWh": {"energy", "kWh"},
+	"Wh":  {"energy", "Wh"},
+	"Hz":  {"frequency", "Hz"},
+	"C":   {"temperature", "°C"},
+}
+
+type discoveryDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model,omitempty"`
+	SerialNumber string   `json:"serial_number,omitempty"`
+	SWVersion    string   `json:"sw_version,omitempty"`
+}
+
+type discoveryConfig struct {
+	Name              string          `json:"name"`
+	UniqueID          string          `json:"unique_id"`
+	StateTopic        string          `json:"state_topic"`
+	AvailabilityTopic string          `json:"availability_topic"`
+	DeviceClass       string          `json:"device_class,omitempty"`
+	StateClass        string          `json:"state_class,omitempty"`
+	Unit              string          `json:"unit_of_measurement,omitempty"`
+	EntityCategory    string          `json:"entity_category,omitempty"`
+	Device            discoveryDevice `json:"device"`
+}
+
+// DiscoveryConfig returns the topic and payload of the Home Assistant
+// discovery config of the field of the device. info may be nil if the
+// device info is not known.
+//
+// Lifetime counters and daily energy totals have the total_increasing state
+// class, so that they can be used in the energy dashboard, and other fields
+// with a unit are measurements. Fields without a unit, such as status
+// codes, are diagnostic.
+func (p *Publisher) DiscoveryConfig(serialNumber string, info *inverter.DeviceInfo, f inverter.Field) (string, []byte, error) {
+	id := "solar_toolkit_" + topicSegment(serialNumber)
+	cfg := discoveryConfig{
+		Name:              fieldName(f.Name),
+		UniqueID:          id + "_" + f.Name,
+		StateTopic:        p.deviceTopic(serialNumber) + "/" + f.Name,
+		AvailabilityTopic: p.statusTopic(),
+		Device: discoveryDevice{
+			Identifiers:  []string{id},
+			Name:         "Inverter " + serialNumber,
+			Manufacturer: "GoodWe",
+			SerialNumber: serialNumber,
+		},
+	}
+	if info != nil {
+		cfg.Device.Name = info.ModelName + " " + serialNumber
+		cfg.Device.Model = info.ModelName
+		cfg.Device.SWVersion = info.SoftwareVersion
+	}
+
+	if class, ok := sensorClasses[f.Unit]; ok {
+		cfg.DeviceClass, cfg.Unit = class.deviceClass, class.unit
+		cfg.StateClass = "measurement"
+		if f.Counter || class.deviceClass == "energy" {
+			cfg.StateClass = "total_increasing"
+		}
+	} else if f.Counter {
+		cfg.StateClass = "total_increasing"
+	} else {
+		cfg.EntityCategory = "diagnostic"
+	}
+
+	payload, err := json.Marshal(cfg)
+	if err != nil {
+		return "", nil, fmt.Errorf("error encoding discovery config: %s", err)
+	}
+
+	return p.cfg.DiscoveryPrefix + "/sensor/" + id + "/" + f.Name + "/config", payload, nil
+}
+
+var acronymPattern = regexp.MustCompile(`^(pv|l|ups|nbus)\d*$`)
+
+// fieldName returns the human-readable name of the field, e.g. "PV1 voltage"
+// for pv1_voltage.
+func fieldName(name string) string {
+	words := strings.Split(name, "_")
+	for i, w := range words {
+		if acronymPattern.MatchString(w) {
+			words[i] = strings.ToUpper(w)
+		}
+	}
+	s := strings.Join(words, " ")
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+// topicSegment replaces the characters of s which are not allowed in a
+// single topic level.
+func topicSegment(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return strings.NewReplacer("/", "_", "+", "_", "#", "_", " ", "_").Replace(s)
+}
@@ -0,0 +1,226 @@
+package mqtt_test
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"git.netflux.io/rob/solar-toolkit/inverter"
+	"git.netflux.io/rob/solar-toolkit/mqtt"
+	mqttserver "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startBroker starts an in-process broker and returns its URL, and a
+// function returning the latest message received on each topic.
+func startBroker(t *testing.T) (string, func() map[string]string) {
+	t.Helper()
+
+	server := mqttserver.New(&mqttserver.Options{InlineClient: true})
+	require.NoError(t, server.AddHook(new(auth.AllowHook), nil))
+
+	l := listeners.NewTCP(listeners.Config{ID: "tcp", Address: "127.0.0.1:0"})
+	require.NoError(t, server.AddListener(l))
+	require.NoError(t, server.Serve())
+	t.Cleanup(func() { server.Close() })
+
+	var mu sync.Mutex
+	messages := make(map[string]string)
+	require.NoError(t, server.Subscribe("#", 1, func(_ *mqttserver.Client, _ packets.Subscription, pk packets.Packet) {
+		mu.Lock()
+		defer mu.Unlock()
+		messages[pk.TopicName] = string(pk.Payload)
+	}))
+
+	return "tcp://" + l.Address(), func() map[string]string {
+		mu.Lock()
+		defer mu.Unlock()
+		m := make(map[string]string, len(messages))
+		for k, v := range messages {
+			m[k] = v
+		}
+		return m
+	}
+}
+
+func TestPublish(t *testing.T) {
+	broker, messages := startBroker(t)
+
+	pub, err := mqtt.Connect(mqtt.Config{Broker: broker, ClientID: "test"})
+	require.NoError(t, err)
+
+	frame := inverter.ETDataFrame{
+		SerialNumber: "12345",
+		ETRuntimeData: &inverter.ETRuntimeData{
+			Timestamp:             time.Date(2022, 7, 14, 10, 0, 0, 0, time.UTC),
+			PV1Voltage:            300.5,
+			PVPower:               2500,
+			EnergyGenerationTotal: 1234.5,
+		},
+	}
+	info := inverter.DeviceInfo{SerialNumber: "12345", ModelName: "GW10K-ET", SoftwareVersion: "04029-06-S11"}
+	require.NoError(t, pub.Publish(&frame, &info))
+
+	const stateTopic = "solar-toolkit/12345/state"
+	require.Eventually(t, func() bool { _, ok := messages()[stateTopic]; return ok }, 5*time.Second, 10*time.Millisecond)
+
+	pub.Close()
+	require.Eventually(t, func() bool { return messages()["solar-toolkit/status"] == "offline" }, 5*time.Second, 10*time.Millisecond)
+
+	got := messages()
+	assert.Equal(t, "300.5", got["solar-toolkit/12345/pv1_voltage"])
+	assert.Equal(t, "2500", got["solar-toolkit/12345/pv_power"])
+	assert.NotContains(t, got, "solar-toolkit/12345/meter_active_power_total", "meter data was not included in the frame")
+
+	var state map[string]any
+	require.NoError(t, json.Unmarshal([]byte(got[stateTopic]), &state))
+	assert.Equal(t, 300.5, state["pv1_voltage"])
+	assert.Equal(t, 1234.5, state["energy_generation_total"])
+
+	var discovery map[string]any
+	require.NoError(t, json.Unmarshal([]byte(got["homeassistant/sensor/solar_toolkit_12345/energy_generation_total/config"]), &discovery))
+	assert.Equal(t, "Energy generation total", discovery["name"])
+	assert.Equal(t, "solar_toolkit_12345_energy_generation_total", discovery["unique_id"])
+	assert.Equal(t, "solar-toolkit/12345/energy_generation_total", discovery["state_topic"])
+	assert.Equal(t, "solar-toolkit/status", discovery["availability_topic"])
+	assert.Equal(t, "energy", discovery["device_class"])
+	assert.Equal(t, "total_increasing", discovery["state_class"])
+	assert.Equal(t, "kWh", discovery["unit_of_measurement"])
+	assert.Equal(t, map[string]any{
+		"identifiers":   []any{"solar_toolkit_12345"},
+		"name":          "GW10K-ET 12345",
+		"manufacturer":  "GoodWe",
+		"model":         "GW10K-ET",
+		"serial_number": "12345",
+		"sw_version":    "04029-06-S11",
+	}, discovery["device"])
+}
+
+func TestDiscoveryConfig(t *testing.T) {
+	testCases := []struct {
+		field           string
+		wantTopic       string
+		wantName        string
+		wantDeviceClass string
+		wantStateClass  string
+		wantUnit        string
+		wantCategory    string
+	}{
+		{
+			field:           "pv1_voltage",
+			wantTopic:       "ha/sensor/solar_toolkit_12345/pv1_voltage/config",
+			wantName:        "PV1 voltage",
+			wantDeviceClass: "voltage",
+			wantStateClass:  "measurement",
+			wantUnit:        "V",
+		},
+		{
+			field:           "on_grid_l2_power",
+			wantTopic:       "ha/sensor/solar_toolkit_12345/on_grid_l2_power/config",
+			wantName:        "On grid L2 power",
+			wantDeviceClass: "power",
+			wantStateClass:  "measurement",
+			wantUnit:        "W",
+		},
+		{
+			field:           "temperature",
+			wantTopic:       "ha/sensor/solar_toolkit_12345/temperature/config",
+			wantName:        "Temperature",
+			wantDeviceClass: "temperature",
+			wantStateClass:  "measurement",
+			wantUnit:        "°C",
+		},
+		{
+			field:           "energy_generation_today",
+			wantTopic:       "ha/sensor/solar_toolkit_12345/energy_generation_today/config",
+			wantName:        "Energy generation today",
+			wantDeviceClass: "energy",
+			wantStateClass:  "total_increasing",
+			wantUnit:        "kWh",
+		},
+		{
+			field:           "meter_energy_export_total",
+			wantTopic:       "ha/sensor/solar_toolkit_12345/meter_energy_export_total/config",
+			wantName:        "Meter energy export total",
+			wantDeviceClass: "energy",
+			wantStateClass:  "total_increasing",
+			wantUnit:        "Wh",
+		},
+		{
+			field:        "work_mode",
+			wantTopic:    "ha/sensor/solar_toolkit_12345/work_mode/config",
+			wantName:     "Work mode",
+			wantCategory: "diagnostic",
+		},
+	}
+
+	broker, _ := startBroker(t)
+	pub, err := mqtt.Connect(mqtt.Config{Broker: broker, ClientID: "test", TopicPrefix: "solar", DiscoveryPrefix: "ha"})
+	require.NoError(t, err)
+	defer pub.Close()
+
+	for _, tc := range testCases {
+		t.Run(tc.field, func(t *testing.T) {
+			field, ok := inverter.LookupField(tc.field)
+			require.True(t, ok)
+
+			topic, payload, err := pub.DiscoveryConfig("12345", nil, field)
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantTopic, topic)
+
+			var cfg struct {
+				Name           string `json:"name"`
+				StateTopic     string `json:"state_topic"`
+				DeviceClass    string `json:"device_class"`
+				StateClass     string `json:"state_class"`
+				Unit           string `json:"unit_of_measurement"`
+				EntityCategory string `json:"entity_category"`
+				Device         struct {
+					Name string `json:"name"`
+				} `json:"device"`
+			}
+			require.NoError(t, json.Unmarshal(payload, &cfg))
+			assert.Equal(t, tc.wantName, cfg.Name)
+			assert.Equal(t, "solar/12345/"+tc.field, cfg.StateTopic)
+			assert.Equal(t, tc.wantDeviceClass, cfg.DeviceClass)
+			assert.Equal(t, tc.wantStateClass, cfg.StateClass)
+			assert.Equal(t, tc.wantUnit, cfg.Unit)
+			assert.Equal(t, tc.wantCategory, cfg.EntityCategory)
+			assert.Equal(t, "Inverter 12345", cfg.Device.Name)
+		})
+	}
+}
+
+func TestDiscoveryConfigCounters(t *testing.T) {
+	broker, _ := startBroker(t)
+	pub, err := mqtt.Connect(mqtt.Config{Broker: broker, ClientID: "test", TopicPrefix: "solar", DiscoveryPrefix: "ha"})
+	require.NoError(t, err)
+	defer pub.Close()
+
+	// Every counter with a unit is an energy total, which the energy
+	// dashboard only accepts with the energy device class.
+	var n int
+	for _, field := range inverter.Fields() {
+		if !field.Counter || field.Unit == "" {
+			continue
+		}
+		n++
+
+		_, payload, err := pub.DiscoveryConfig("12345", nil, field)
+		require.NoError(t, err)
+
+		var cfg struct {
+			DeviceClass string `json:"device_class"`
+			StateClass  string `json:"state_class"`
+		}
+		require.NoError(t, json.Unmarshal(payload, &cfg))
+		assert.Equal(t, "energy", cfg.DeviceClass, field.Name)
+		assert.Equal(t, "total_increasing", cfg.StateClass, field.Name)
+	}
+	assert.NotZero(t, n)
+}
@@ -0,0 +1,271 @@
+package output
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"git.netflux.io/rob/solar-toolkit/inverter"
+	"git.netflux.io/rob/solar-toolkit/spool"
+)
+
+const (
+	spoolPeekSize    = 100
+	memoryQueueLen   = 64
+	minRetryInterval = time.Second * 5
+	maxRetryInterval = time.Minute * 5
+)
+
+// BufferConfig holds the configuration of a Buffer.
+type BufferConfig struct {
+	// SpoolDir is the directory of the on-disk spool. If it is empty, frames
+	// are buffered in memory instead, and dropped if the sink fails.
+	SpoolDir      string
+	SpoolMaxBytes int64
+	SpoolMaxAge   time.Duration
+	// BatchSize is the maximum number of buffered frames written at once to
+	// sinks which implement BatchWriter. If it is zero, frames are written
+	// one at a time.
+	BatchSize int
+}
+
+// Buffer writes frames to a sink in the background, so that a slow or
+// unreachable sink does not block the writer.
+//
+// If the spool is enabled, frames are appended to it and only removed once
+// the sink has accepted or permanently rejected them. While the sink fails,
+// writes are retried with exponential backoff, oldest frame first, including
+// after a restart.
+type Buffer struct {
+	name   string
+	sink   Sink
+	cfg    BufferConfig
+	spool  *spool.Spool
+	queue  chan *inverter.ETDataFrame
+	notify chan struct{}
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewBuffer returns a Buffer writing to sink, which must be closed after
+// use. name identifies the sink in logs.
+func NewBuffer(name string, sink Sink, cfg BufferConfig) (*Buffer, error) {
+	b := Buffer{
+		name:   name,
+		sink:   sink,
+		cfg:    cfg,
+		notify: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+
+	if cfg.SpoolDir != "" {
+		var err error
+		if b.spool, err = spool.Open(cfg.SpoolDir, cfg.SpoolMaxBytes, cfg.SpoolMaxAge); err != nil {
+			return nil, err
+		}
+		if n := b.spool.Len(); n > 0 {
+			log.Printf("%s: replaying %d spooled frame(s)", name, n)
+		}
+	} else {
+		b.queue = make(chan *inverter.ETDataFrame, memoryQueueLen)
+	}
+
+	var ctx context.Context
+	ctx, b.cancel = context.WithCancel(context.Background())
+	go b.run(ctx)
+
+	return &b, nil
+}
+
+// Write queues the frame for writing to the sink.
+func (b *Buffer) Write(_ context.Context, frame *inverter.ETDataFrame) error {
+	if b.spool == nil {
+		select {
+		case b.queue <- frame:
+			return nil
+		default:
+			return errors.New("buffer full, dropping frame")
+		}
+	}
+
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return Permanent(err)
+	}
+	if err := b.spool.Append(data); err != nil {
+		return err
+	}
+
+	select {
+	case b.notify <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// RegisterDevice sends the device info to the sink directly, if it accepts
+// it.
+func (b *Buffer) RegisterDevice(ctx context.Context, info *inverter.DeviceInfo) error {
+	if r, ok := b.sink.(DeviceRegistrar); ok {
+		return r.RegisterDevice(ctx, info)
+	}
+	return nil
+}
+
+// Close stops writing, leaving any spooled frames for the next run, and
+// closes the sink.
+func (b *Buffer) Close() error {
+	b.cancel()
+	<-b.done
+	return b.sink.Close()
+}
+
+func (b *Buffer) run(ctx context.Context) {
+	defer close(b.done)
+
+	if b.spool == nil {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case frame := <-b.queue:
+				if err := b.writeQueued(ctx, frame); err != nil && ctx.Err() == nil {
+					log.Printf("%s: %s", b.name, err)
+				}
+			}
+		}
+	}
+
+	backoff := minRetryInterval
+	for {
+		var retry <-chan time.Time
+		if err := b.flush(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("%s: %s (%d frame(s) spooled, retrying in %s)", b.name, err, b.spool.Len(), backoff)
+			retry = time.After(backoff)
+			backoff = min(backoff*2, maxRetryInterval)
+		} else {
+			backoff = minRetryInterval
+		}
+
+		if retry != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-retry:
+			}
+		} else {
+			select {
+			case <-ctx.Done():
+				return
+			case <-b.notify:
+			}
+		}
+	}
+}
+
+// batchWriter returns the sink as a BatchWriter, if batches are enabled and
+// supported by the sink.
+func (b *Buffer) batchWriter() (BatchWriter, bool) {
+	bw, ok := b.sink.(BatchWriter)
+	return bw, ok && b.cfg.BatchSize > 0
+}
+
+// writeQueued writes the frame, along with any other frames waiting in the
+// queue if batches are enabled.
+func (b *Buffer) writeQueued(ctx context.Context, frame *inverter.ETDataFrame) error {
+	bw, ok := b.batchWriter()
+	if !ok {
+		return b.sink.Write(ctx, frame)
+	}
+
+	frames := []*inverter.ETDataFrame{frame}
+drain:
+	for len(frames) < b.cfg.BatchSize {
+		select {
+		case frame := <-b.queue:
+			frames = append(frames, frame)
+		default:
+			break drain
+		}
+	}
+
+	errs, err := bw.WriteBatch(ctx, frames)
+	if err != nil {
+		return err
+	}
+	return errors.Join(errs...)
+}
+
+// flush writes spooled frames, oldest first, until the spool is empty or a
+// write fails.
+func (b *Buffer) flush(ctx context.Context) error {
+	bw, batch := b.batchWriter()
+	n := spoolPeekSize
+	if batch {
+		n = b.cfg.BatchSize
+	}
+
+	for {
+		entries, err := b.spool.Peek(n)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			return nil
+		}
+
+		var (
+			ids    []uint64
+			frames []*inverter.ETDataFrame
+		)
+		for _, e := range entries {
+			var frame inverter.ETDataFrame
+			if err := json.Unmarshal(e.Data, &frame); err != nil {
+				log.Printf("%s: discarding invalid spooled frame: %s", b.name, err)
+				if err := b.spool.Remove(e.ID); err != nil {
+					return err
+				}
+				continue
+			}
+			ids = append(ids, e.ID)
+			frames = append(frames, &frame)
+		}
+
+		if batch && len(frames) > 0 {
+			errs, err := bw.WriteBatch(ctx, frames)
+			if err != nil && !IsPermanent(err) {
+				return err
+			} else if err != nil {
+				log.Printf("%s: discarding %d rejected frame(s): %s", b.name, len(frames), err)
+			}
+			for _, err := range errs {
+				if err != nil {
+					log.Printf("%s: discarding rejected frame: %s", b.name, err)
+				}
+			}
+			if err := b.spool.Remove(ids...); err != nil {
+				return err
+			}
+			continue
+		}
+
+		for i, frame := range frames {
+			if err := b.sink.Write(ctx, frame); err != nil {
+				if !IsPermanent(err) {
+					return err
+				}
+				log.Printf("%s: discarding rejected frame: %s", b.name, err)
+			}
+
+			if err := b.spool.Remove(ids[i]); err != nil {
+				return err
+			}
+		}
+	}
+}
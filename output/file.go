@@ -0,0 +1,162 @@
+package output
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+
+	"git.netflux.io/rob/solar-toolkit/inverter"
+)
+
+// NDJSON writes frames to a writer as newline-delimited JSON, in the format
+// accepted by the gateway. It is safe for concurrent use.
+type NDJSON struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewNDJSON returns an NDJSON sink writing to w, e.g. os.Stdout. Closing the
+// sink does not close w.
+func NewNDJSON(w io.Writer) *NDJSON {
+	return &NDJSON{w: w}
+}
+
+// Write writes the frame as a single line.
+func (s *NDJSON) Write(_ context.Context, frame *inverter.ETDataFrame) error {
+	line, err := encodeLine(frame)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.w.Write(line); err != nil {
+		return fmt.Errorf("error writing frame: %s", err)
+	}
+	return nil
+}
+
+// Close does nothing.
+func (s *NDJSON) Close() error {
+	return nil
+}
+
+func encodeLine(frame *inverter.ETDataFrame) ([]byte, error) {
+	line, err := json.Marshal(frame)
+	if err != nil {
+		return nil, Permanent(fmt.Errorf("error encoding frame: %s", err))
+	}
+	return append(line, '\n'), nil
+}
+
+// File writes frames to a local file as newline-delimited JSON, rotating it
+// once it reaches a maximum size. Rotated files are renamed with a numeric
+// suffix, e.g. frames.ndjson.1 for the most recent, and the oldest are
+// removed. It is safe for concurrent use.
+type File struct {
+	path     string
+	maxBytes int64
+	maxFiles int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// OpenFile opens the file at path for appending, creating it if needed. If
+// maxBytes is zero, the file is never rotated, otherwise up to maxFiles
+// rotated files are kept.
+func OpenFile(path string, maxBytes int64, maxFiles int) (*File, error) {
+	s := File{path: path, maxBytes: maxBytes, maxFiles: maxFiles}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (s *File) open() error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening file: %s", err)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("error opening file: %s", err)
+	}
+
+	s.f, s.size = f, fi.Size()
+	return nil
+}
+
+// rotate renames the current file and opens a new one.
+func (s *File) rotate() error {
+	if err := s.f.Close(); err != nil {
+		return fmt.Errorf("error closing file: %s", err)
+	}
+	s.f = nil
+
+	os.Remove(s.path + "." + strconv.Itoa(s.maxFiles))
+	for i := s.maxFiles - 1; i >= 1; i-- {
+		os.Rename(s.path+"."+strconv.Itoa(i), s.path+"."+strconv.Itoa(i+1))
+	}
+	if s.maxFiles > 0 {
+		if err := os.Rename(s.path, s.path+".1"); err != nil {
+			return fmt.Errorf("error rotating file: %s", err)
+		}
+	} else if err := os.Remove(s.path); err != nil {
+		return fmt.Errorf("error rotating file: %s", err)
+	}
+
+	return s.open()
+}
+
+// Write appends the frame as a single line, rotating the file first if the
+// line would take it over the maximum size.
+func (s *File) Write(_ context.Context, frame *inverter.ETDataFrame) error {
+	line, err := encodeLine(frame)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.f == nil {
+		// A previous rotation failed.
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	if s.maxBytes > 0 && s.size > 0 && s.size+int64(len(line)) > s.maxBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.f.Write(line)
+	s.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("error writing frame: %s", err)
+	}
+	return nil
+}
+
+// Close closes the file.
+func (s *File) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
@@ -0,0 +1,65 @@
+package output_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"git.netflux.io/rob/solar-toolkit/output"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "frames.ndjson")
+
+	line, err := os.ReadFile(writeFrame(t, filepath.Join(dir, "line.ndjson")))
+	require.NoError(t, err)
+
+	// Room for two lines per file.
+	sink, err := output.OpenFile(path, int64(2*len(line)), 2)
+	require.NoError(t, err)
+	for range 7 {
+		require.NoError(t, sink.Write(context.Background(), frame("12345", 100)))
+	}
+	require.NoError(t, sink.Close())
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	assert.Equal(t, []string{"frames.ndjson", "frames.ndjson.1", "frames.ndjson.2", "line.ndjson"}, names)
+
+	for name, wantLines := range map[string]int{"frames.ndjson": 1, "frames.ndjson.1": 2, "frames.ndjson.2": 2} {
+		p, err := os.ReadFile(filepath.Join(dir, name))
+		require.NoError(t, err)
+		assert.Equal(t, wantLines, bytes.Count(p, []byte("\n")), name)
+	}
+
+	// Reopening appends to the existing file.
+	sink, err = output.OpenFile(path, 0, 0)
+	require.NoError(t, err)
+	require.NoError(t, sink.Write(context.Background(), frame("12345", 100)))
+	require.NoError(t, sink.Close())
+
+	p, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, append(bytes.Clone(line), line...), p)
+}
+
+// writeFrame writes a single frame to a new file at path.
+func writeFrame(t *testing.T, path string) string {
+	t.Helper()
+
+	sink, err := output.OpenFile(path, 0, 0)
+	require.NoError(t, err)
+	require.NoError(t, sink.Write(context.Background(), frame("12345", 100)))
+	require.NoError(t, sink.Close())
+
+	return path
+}
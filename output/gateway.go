@@ -0,0 +1,192 @@
+package output
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"git.netflux.io/rob/solar-toolkit/gateway/api"
+	"git.netflux.io/rob/solar-toolkit/inverter"
+)
+
+const userAgent = "solar-toolkit (git.netflux.io)"
+
+// statusError is returned when a gateway responds with an unexpected HTTP
+// status code.
+type statusError struct {
+	code int
+}
+
+func (e *statusError) Error() string {
+	switch e.code {
+	case http.StatusUnauthorized:
+		return "authentication failed (401): check the gateway token"
+	case http.StatusForbidden:
+		return "permission denied (403): the gateway token is not valid for this inverter"
+	default:
+		return fmt.Sprintf("unexpected HTTP response code: %d", e.code)
+	}
+}
+
+// permanent returns true if retrying the request can not succeed, e.g.
+// because the gateway rejected the frame as invalid.
+func (e *statusError) permanent() bool {
+	switch e.code {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	default:
+		return e.code >= 400 && e.code < 500
+	}
+}
+
+// GatewayConfig holds the configuration of a Gateway.
+type GatewayConfig struct {
+	Endpoint string
+	Username string
+	Password string
+	// Token is the gateway API token, sent as a bearer token. It takes
+	// precedence over Username and Password.
+	Token string
+}
+
+// Gateway posts frames to a solar-toolkit gateway.
+type Gateway struct {
+	client *http.Client
+	cfg    GatewayConfig
+}
+
+// NewGateway returns a Gateway which sends requests with client.
+func NewGateway(client *http.Client, cfg GatewayConfig) *Gateway {
+	return &Gateway{client: client, cfg: cfg}
+}
+
+// Write posts the frame to the gateway's endpoint.
+func (g *Gateway) Write(ctx context.Context, frame *inverter.ETDataFrame) error {
+	reqBody, err := json.Marshal(frame)
+	if err != nil {
+		return Permanent(fmt.Errorf("error encoding frame: %s", err))
+	}
+
+	resp, err := g.do(ctx, g.cfg.Endpoint, reqBody)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// WriteBatch posts the frames in a single request to the gateway's batch
+// endpoint.
+func (g *Gateway) WriteBatch(ctx context.Context, frames []*inverter.ETDataFrame) ([]error, error) {
+	reqBody, err := json.Marshal(frames)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding frames: %s", err)
+	}
+
+	resp, err := g.do(ctx, strings.TrimSuffix(g.cfg.Endpoint, "/")+"/batch", reqBody)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var batchResp api.BatchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&batchResp); err != nil {
+		return nil, fmt.Errorf("error decoding batch response: %s", err)
+	}
+	if len(batchResp.Results) != len(frames) {
+		return nil, fmt.Errorf("unexpected number of batch results: %d", len(batchResp.Results))
+	}
+
+	errs := make([]error, len(frames))
+	for i, result := range batchResp.Results {
+		if result.Status == api.StatusRejected {
+			errs[i] = Permanent(errors.New(result.Error))
+		}
+	}
+
+	return errs, nil
+}
+
+// RegisterDevice posts the device info to the gateway. Gateways which do not
+// support device registration are ignored.
+func (g *Gateway) RegisterDevice(ctx context.Context, info *inverter.DeviceInfo) error {
+	reqBody, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("error encoding device info: %s", err)
+	}
+
+	resp, err := g.do(ctx, devicesURL(g.cfg.Endpoint), reqBody)
+	var statusErr *statusError
+	if errors.As(err, &statusErr) && statusErr.code == http.StatusNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// Close does nothing.
+func (g *Gateway) Close() error {
+	return nil
+}
+
+// devicesURL returns the URL of the gateway's device registration endpoint,
+// which is a sibling of the frame endpoint, e.g. /gateway/devices for
+// /gateway/et_runtime_data.
+func devicesURL(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return endpoint
+	}
+	u.Path = path.Join(path.Dir(strings.TrimSuffix(u.Path, "/")), "devices")
+	return u.String()
+}
+
+// do sends a request to the gateway, returning an error unless the response
+// status is 200 OK. Errors which can not be fixed by retrying are marked
+// with Permanent.
+func (g *Gateway) do(ctx context.Context, url string, reqBody []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, fmt.Errorf("error building request: %s", err)
+	}
+
+	// The key is derived from the body, so that a retried request is
+	// recognised by the gateway even after a restart.
+	sum := sha256.Sum256(reqBody)
+	req.Header.Set(api.IdempotencyKeyHeader, hex.EncodeToString(sum[:16]))
+	req.Header.Set("content-type", "application/json")
+	req.Header.Set("user-agent", userAgent)
+	if g.cfg.Token != "" {
+		req.Header.Set("authorization", "Bearer "+g.cfg.Token)
+	} else if g.cfg.Password != "" {
+		req.SetBasicAuth(g.cfg.Username, g.cfg.Password)
+	}
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending request: %s", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		statusErr := &statusError{code: resp.StatusCode}
+		if statusErr.permanent() {
+			return nil, Permanent(statusErr)
+		}
+		return nil, statusErr
+	}
+
+	return resp, nil
+}
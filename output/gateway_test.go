@@ -0,0 +1,68 @@
+package output_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"git.netflux.io/rob/solar-toolkit/gateway/api"
+	"git.netflux.io/rob/solar-toolkit/inverter"
+	"git.netflux.io/rob/solar-toolkit/output"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGateway(t *testing.T) {
+	var (
+		keys        []string
+		statusCode  = http.StatusOK
+		batchResult []api.BatchResult
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /gateway/et_runtime_data", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer secret", r.Header.Get("authorization"))
+		keys = append(keys, r.Header.Get(api.IdempotencyKeyHeader))
+		w.WriteHeader(statusCode)
+	})
+	mux.HandleFunc("POST /gateway/et_runtime_data/batch", func(w http.ResponseWriter, r *http.Request) {
+		var frames []inverter.ETDataFrame
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&frames))
+		assert.Len(t, frames, len(batchResult))
+		json.NewEncoder(w).Encode(api.BatchResponse{Results: batchResult})
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	sink := output.NewGateway(srv.Client(), output.GatewayConfig{Endpoint: srv.URL + "/gateway/et_runtime_data", Token: "secret"})
+	ctx := context.Background()
+
+	require.NoError(t, sink.Write(ctx, frame("12345", 100)))
+	require.NoError(t, sink.Write(ctx, frame("12345", 100)))
+	require.NoError(t, sink.Write(ctx, frame("12345", 200)))
+	require.Len(t, keys, 3)
+	assert.Equal(t, keys[0], keys[1], "idempotency keys are derived from the frame")
+	assert.NotEqual(t, keys[0], keys[2])
+
+	statusCode = http.StatusBadRequest
+	err := sink.Write(ctx, frame("12345", 100))
+	assert.EqualError(t, err, "unexpected HTTP response code: 400")
+	assert.True(t, output.IsPermanent(err))
+
+	statusCode = http.StatusUnauthorized
+	err = sink.Write(ctx, frame("12345", 100))
+	assert.EqualError(t, err, "authentication failed (401): check the gateway token")
+	assert.False(t, output.IsPermanent(err))
+
+	batchResult = []api.BatchResult{{Status: api.StatusAccepted}, {Status: api.StatusRejected, Error: "invalid timestamp"}}
+	errs, err := sink.WriteBatch(ctx, []*inverter.ETDataFrame{frame("12345", 100), frame("12345", 200)})
+	require.NoError(t, err)
+	require.Len(t, errs, 2)
+	assert.NoError(t, errs[0])
+	assert.EqualError(t, errs[1], "invalid timestamp")
+	assert.True(t, output.IsPermanent(errs[1]))
+
+	// Gateways without device registration are ignored.
+	require.NoError(t, sink.RegisterDevice(ctx, &inverter.DeviceInfo{SerialNumber: "12345"}))
+}
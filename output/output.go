@@ -0,0 +1,180 @@
+// Package output implements the sinks to which the daemon writes data
+// frames: the gateway, stdout, rotating local files, webhooks and, via the
+// mqtt package, MQTT brokers.
+//
+// Sinks are typically wrapped in a Buffer, so that a slow or unreachable
+// sink does not delay the others, and combined with a Fanout.
+package output
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+
+	"git.netflux.io/rob/solar-toolkit/inverter"
+)
+
+// Sink is a destination for data frames.
+type Sink interface {
+	// Write writes the frame to the sink. Errors which can not be fixed by
+	// retrying, e.g. because the sink rejected the frame as invalid, are
+	// marked with Permanent.
+	Write(ctx context.Context, frame *inverter.ETDataFrame) error
+	// Close flushes and closes the sink.
+	Close() error
+}
+
+// DeviceRegistrar is implemented by sinks which accept the device info of
+// each inverter, sent before its first frame.
+type DeviceRegistrar interface {
+	RegisterDevice(ctx context.Context, info *inverter.DeviceInfo) error
+}
+
+// BatchWriter is implemented by sinks which can write several frames at
+// once.
+type BatchWriter interface {
+	// WriteBatch writes the frames, returning an error for each frame
+	// rejected by the sink, or an error if the batch as a whole failed.
+	WriteBatch(ctx context.Context, frames []*inverter.ETDataFrame) ([]error, error)
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent marks err as permanent, i.e. retrying the write can not succeed.
+func Permanent(err error) error {
+	return permanentError{err: err}
+}
+
+// IsPermanent returns true if err was marked with Permanent.
+func IsPermanent(err error) bool {
+	var permanent permanentError
+	return errors.As(err, &permanent)
+}
+
+// Fanout writes frames to a set of named sinks, each of which fails
+// independently. It is safe for concurrent use.
+//
+// Device info is remembered and sent to sinks added later, so that they do
+// not have to wait for the inverter to be registered again.
+type Fanout struct {
+	mu      sync.Mutex
+	sinks   map[string]Sink
+	devices map[string]*inverter.DeviceInfo
+}
+
+// NewFanout returns an empty Fanout.
+func NewFanout() *Fanout {
+	return &Fanout{sinks: make(map[string]Sink), devices: make(map[string]*inverter.DeviceInfo)}
+}
+
+// Names returns the names of the sinks, in order.
+func (f *Fanout) Names() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Sorted(maps.Keys(f.sinks))
+}
+
+// Add adds the sink, closing any existing sink with the same name, and
+// sends it the info of every known device.
+func (f *Fanout) Add(ctx context.Context, name string, sink Sink) error {
+	f.mu.Lock()
+	old := f.sinks[name]
+	f.sinks[name] = sink
+	devices := slices.Collect(maps.Values(f.devices))
+	f.mu.Unlock()
+
+	var errs []error
+	if old != nil {
+		if err := old.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", name, err))
+		}
+	}
+	if r, ok := sink.(DeviceRegistrar); ok {
+		for _, info := range devices {
+			if err := r.RegisterDevice(ctx, info); err != nil {
+				errs = append(errs, fmt.Errorf("%s: error registering device: %s", name, err))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Remove removes and closes the sink with the name, if any.
+func (f *Fanout) Remove(name string) error {
+	f.mu.Lock()
+	sink, ok := f.sinks[name]
+	delete(f.sinks, name)
+	f.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+	if err := sink.Close(); err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+	return nil
+}
+
+// each calls fn for every sink, in order of name, returning the joined
+// errors prefixed with the name of the sink.
+func (f *Fanout) each(fn func(Sink) error) error {
+	f.mu.Lock()
+	names := slices.Sorted(maps.Keys(f.sinks))
+	sinks := make([]Sink, len(names))
+	for i, name := range names {
+		sinks[i] = f.sinks[name]
+	}
+	f.mu.Unlock()
+
+	var errs []error
+	for i, sink := range sinks {
+		if err := fn(sink); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", names[i], err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Write writes the frame to every sink.
+func (f *Fanout) Write(ctx context.Context, frame *inverter.ETDataFrame) error {
+	return f.each(func(s Sink) error { return s.Write(ctx, frame) })
+}
+
+// RegisterDevice sends the device info to every sink which accepts it.
+func (f *Fanout) RegisterDevice(ctx context.Context, info *inverter.DeviceInfo) error {
+	f.mu.Lock()
+	f.devices[info.SerialNumber] = info
+	f.mu.Unlock()
+
+	return f.each(func(s Sink) error {
+		if r, ok := s.(DeviceRegistrar); ok {
+			return r.RegisterDevice(ctx, info)
+		}
+		return nil
+	})
+}
+
+// Close closes and removes every sink.
+func (f *Fanout) Close() error {
+	f.mu.Lock()
+	sinks := f.sinks
+	f.sinks = make(map[string]Sink)
+	f.mu.Unlock()
+
+	var errs []error
+	for _, name := range slices.Sorted(maps.Keys(sinks)) {
+		if err := sinks[name].Close(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,228 @@
+package output_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"git.netflux.io/rob/solar-toolkit/inverter"
+	"git.netflux.io/rob/solar-toolkit/output"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func frame(serialNumber string, pvPower float64) *inverter.ETDataFrame {
+	return &inverter.ETDataFrame{
+		SerialNumber: serialNumber,
+		ETRuntimeData: &inverter.ETRuntimeData{
+			Timestamp: time.Date(2022, 7, 14, 10, 0, 0, 0, time.UTC),
+			PVPower:   inverter.Power(pvPower),
+		},
+	}
+}
+
+// fakeSink records the frames written to it. Writes fail with err while it
+// is set.
+type fakeSink struct {
+	mu       sync.Mutex
+	err      error
+	attempts int
+	frames   []*inverter.ETDataFrame
+	devices  []string
+	closed   bool
+}
+
+func (s *fakeSink) Write(_ context.Context, frame *inverter.ETDataFrame) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attempts++
+	if s.err != nil {
+		return s.err
+	}
+	s.frames = append(s.frames, frame)
+	return nil
+}
+
+func (s *fakeSink) RegisterDevice(_ context.Context, info *inverter.DeviceInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.devices = append(s.devices, info.SerialNumber)
+	return s.err
+}
+
+func (s *fakeSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *fakeSink) setErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+func (s *fakeSink) pvPowers() []inverter.Power {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var powers []inverter.Power
+	for _, f := range s.frames {
+		powers = append(powers, f.PVPower)
+	}
+	return powers
+}
+
+func TestFanout(t *testing.T) {
+	ctx := context.Background()
+	fanout := output.NewFanout()
+
+	var failing, ok fakeSink
+	failing.err = errors.New("unreachable")
+	require.NoError(t, fanout.Add(ctx, "b", &failing))
+	require.NoError(t, fanout.Add(ctx, "a", &ok))
+	assert.Equal(t, []string{"a", "b"}, fanout.Names())
+
+	assert.EqualError(t, fanout.Write(ctx, frame("12345", 100)), "b: unreachable")
+	assert.Equal(t, []inverter.Power{100}, ok.pvPowers())
+
+	assert.EqualError(t, fanout.RegisterDevice(ctx, &inverter.DeviceInfo{SerialNumber: "12345"}), "b: unreachable")
+	assert.Equal(t, []string{"12345"}, ok.devices)
+
+	// Known devices are registered with sinks added later.
+	var added fakeSink
+	require.NoError(t, fanout.Add(ctx, "c", &added))
+	assert.Equal(t, []string{"12345"}, added.devices)
+
+	var replacement fakeSink
+	require.NoError(t, fanout.Add(ctx, "a", &replacement))
+	assert.True(t, ok.closed)
+
+	require.NoError(t, fanout.Remove("b"))
+	assert.True(t, failing.closed)
+	require.NoError(t, fanout.Remove("b"))
+
+	require.NoError(t, fanout.Close())
+	assert.True(t, replacement.closed)
+	assert.True(t, added.closed)
+	assert.Empty(t, fanout.Names())
+}
+
+func TestPermanent(t *testing.T) {
+	err := errors.New("rejected")
+	assert.False(t, output.IsPermanent(err))
+	assert.True(t, output.IsPermanent(output.Permanent(err)))
+	assert.True(t, output.IsPermanent(errors.Join(errors.New("other"), output.Permanent(err))))
+	assert.ErrorIs(t, output.Permanent(err), err)
+}
+
+func TestBufferMemory(t *testing.T) {
+	sink := fakeSink{err: errors.New("unreachable")}
+	buffer, err := output.NewBuffer("test", &sink, output.BufferConfig{})
+	require.NoError(t, err)
+
+	// Frames which fail are dropped rather than retried.
+	require.NoError(t, buffer.Write(context.Background(), frame("12345", 100)))
+	require.Eventually(t, func() bool {
+		sink.mu.Lock()
+		defer sink.mu.Unlock()
+		return sink.attempts == 1
+	}, time.Second, 10*time.Millisecond)
+	sink.setErr(nil)
+
+	require.NoError(t, buffer.Write(context.Background(), frame("12345", 200)))
+	require.Eventually(t, func() bool { return len(sink.pvPowers()) > 0 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []inverter.Power{200}, sink.pvPowers())
+
+	require.NoError(t, buffer.Close())
+	assert.True(t, sink.closed)
+}
+
+func TestBufferSpool(t *testing.T) {
+	dir := t.TempDir()
+	cfg := output.BufferConfig{SpoolDir: dir}
+
+	// Frames are kept in the spool while the sink fails, including across
+	// restarts.
+	sink := fakeSink{err: errors.New("unreachable")}
+	buffer, err := output.NewBuffer("test", &sink, cfg)
+	require.NoError(t, err)
+	require.NoError(t, buffer.Write(context.Background(), frame("12345", 100)))
+	require.NoError(t, buffer.Write(context.Background(), frame("12345", 200)))
+	require.NoError(t, buffer.Close())
+	assert.Empty(t, sink.pvPowers())
+
+	// Frames rejected permanently are discarded, and the others are written
+	// in order.
+	var rejecting rejectingSink
+	buffer, err = output.NewBuffer("test", &rejecting, cfg)
+	require.NoError(t, err)
+	require.NoError(t, buffer.Write(context.Background(), frame("12345", 300)))
+	require.Eventually(t, func() bool { return len(rejecting.pvPowers()) == 2 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []inverter.Power{100, 300}, rejecting.pvPowers())
+	require.NoError(t, buffer.Close())
+}
+
+// rejectingSink permanently rejects frames with a PV power of 200.
+type rejectingSink struct {
+	fakeSink
+}
+
+func (s *rejectingSink) Write(ctx context.Context, frame *inverter.ETDataFrame) error {
+	if frame.PVPower == 200 {
+		return output.Permanent(errors.New("invalid frame"))
+	}
+	return s.fakeSink.Write(ctx, frame)
+}
+
+// batchSink records the size of each batch written to it.
+type batchSink struct {
+	fakeSink
+	batches []int
+}
+
+func (s *batchSink) WriteBatch(_ context.Context, frames []*inverter.ETDataFrame) ([]error, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches = append(s.batches, len(frames))
+	s.frames = append(s.frames, frames...)
+	return make([]error, len(frames)), nil
+}
+
+func TestBufferBatch(t *testing.T) {
+	dir := t.TempDir()
+
+	// Frames are spooled while the sink is unreachable.
+	buffer, err := output.NewBuffer("test", &fakeSink{err: errors.New("unreachable")}, output.BufferConfig{SpoolDir: dir})
+	require.NoError(t, err)
+	for i := range 5 {
+		require.NoError(t, buffer.Write(context.Background(), frame("12345", float64(i))))
+	}
+	require.NoError(t, buffer.Close())
+
+	var sink batchSink
+	buffer, err = output.NewBuffer("test", &sink, output.BufferConfig{SpoolDir: dir, BatchSize: 2})
+	require.NoError(t, err)
+	defer buffer.Close()
+	require.Eventually(t, func() bool { return len(sink.pvPowers()) == 5 }, time.Second, 10*time.Millisecond)
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	assert.Equal(t, []int{2, 2, 1}, sink.batches)
+}
+
+func TestNDJSON(t *testing.T) {
+	var buf bytes.Buffer
+	sink := output.NewNDJSON(&buf)
+	require.NoError(t, sink.Write(context.Background(), frame("12345", 100)))
+	require.NoError(t, sink.Write(context.Background(), frame("67890", 200)))
+	require.NoError(t, sink.Close())
+
+	lines := bytes.Split(bytes.TrimSuffix(buf.Bytes(), []byte("\n")), []byte("\n"))
+	require.Len(t, lines, 2)
+	assert.Contains(t, string(lines[0]), `"serial_number":"12345"`)
+	assert.Contains(t, string(lines[1]), `"serial_number":"67890"`)
+}
@@ -0,0 +1,134 @@
+package output
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"text/template"
+	"time"
+
+	"git.netflux.io/rob/solar-toolkit/inverter"
+)
+
+// DefaultWebhookTemplate is the template of webhook requests if none is
+// configured, which posts the frame in the format accepted by the gateway.
+const DefaultWebhookTemplate = "{{json .Frame}}"
+
+// WebhookData is the data passed to webhook templates.
+type WebhookData struct {
+	SerialNumber string
+	Timestamp    time.Time
+	// Fields holds the value of each field included in the frame, by name,
+	// e.g. {{.Fields.pv_power}}.
+	Fields map[string]float64
+	// Frame is the whole frame, e.g. {{json .Frame}}.
+	Frame *inverter.ETDataFrame
+}
+
+var templateFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		p, err := json.Marshal(v)
+		return string(p), err
+	},
+}
+
+// ParseWebhookTemplate parses a webhook template. In addition to the
+// built-in functions, templates may use json, which encodes its argument as
+// JSON, e.g. {{json .SerialNumber}} for a quoted string.
+func ParseWebhookTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		text = DefaultWebhookTemplate
+	}
+	tmpl, err := template.New("webhook").Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing template: %s", err)
+	}
+	return tmpl, nil
+}
+
+// WebhookConfig holds the configuration of a Webhook.
+type WebhookConfig struct {
+	URL string
+	// Template is the template of the JSON request body, executed with
+	// WebhookData. It defaults to DefaultWebhookTemplate.
+	Template string
+	// Headers are added to every request, e.g. for authentication.
+	Headers map[string]string
+}
+
+// Webhook posts each frame to a URL as a JSON document rendered from a
+// template.
+type Webhook struct {
+	client *http.Client
+	cfg    WebhookConfig
+	tmpl   *template.Template
+}
+
+// NewWebhook returns a Webhook which sends requests with client.
+func NewWebhook(client *http.Client, cfg WebhookConfig) (*Webhook, error) {
+	tmpl, err := ParseWebhookTemplate(cfg.Template)
+	if err != nil {
+		return nil, err
+	}
+	return &Webhook{client: client, cfg: cfg, tmpl: tmpl}, nil
+}
+
+// Write renders the template for the frame and posts the result. Frames for
+// which the template does not render valid JSON are rejected.
+func (w *Webhook) Write(ctx context.Context, frame *inverter.ETDataFrame) error {
+	data := WebhookData{
+		SerialNumber: frame.SerialNumber,
+		Fields:       make(map[string]float64),
+		Frame:        frame,
+	}
+	if frame.ETRuntimeData != nil {
+		data.Timestamp = frame.Timestamp
+	}
+	for _, f := range inverter.Fields() {
+		if v, ok := f.Value(frame); ok {
+			data.Fields[f.Name] = v
+		}
+	}
+
+	var body bytes.Buffer
+	if err := w.tmpl.Execute(&body, data); err != nil {
+		return Permanent(fmt.Errorf("error rendering template: %s", err))
+	}
+	if !json.Valid(body.Bytes()) {
+		return Permanent(errors.New("template did not render valid JSON"))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.cfg.URL, &body)
+	if err != nil {
+		return fmt.Errorf("error building request: %s", err)
+	}
+	req.Header.Set("content-type", "application/json")
+	req.Header.Set("user-agent", userAgent)
+	for k, v := range w.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending request: %s", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err := fmt.Errorf("unexpected HTTP response code: %d", resp.StatusCode)
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+			return Permanent(err)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Close does nothing.
+func (w *Webhook) Close() error {
+	return nil
+}
@@ -0,0 +1,94 @@
+package output_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"git.netflux.io/rob/solar-toolkit/output"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhook(t *testing.T) {
+	testCases := []struct {
+		name       string
+		template   string
+		statusCode int
+		wantBody   string
+		wantErr    string
+		permanent  bool
+	}{
+		{
+			name:       "default template",
+			statusCode: http.StatusOK,
+			wantBody:   `{"serial_number":"12345","timestamp":"2022-07-14T10:00:00Z"`,
+		},
+		{
+			name:       "custom template",
+			template:   `{"serial": {{json .SerialNumber}}, "time": {{.Timestamp.Unix}}, "power": {{.Fields.pv_power}}}`,
+			statusCode: http.StatusNoContent,
+			wantBody:   `{"serial": "12345", "time": 1657792800, "power": 2500}`,
+		},
+		{
+			name:      "missing field",
+			template:  `{"power": {{.Fields.meter_active_power_total}}}`,
+			wantErr:   "error rendering template",
+			permanent: true,
+		},
+		{
+			name:      "invalid JSON",
+			template:  `power={{.Fields.pv_power}}`,
+			wantErr:   "template did not render valid JSON",
+			permanent: true,
+		},
+		{
+			name:       "rejected",
+			statusCode: http.StatusBadRequest,
+			wantErr:    "unexpected HTTP response code: 400",
+			permanent:  true,
+		},
+		{
+			name:       "server error",
+			statusCode: http.StatusBadGateway,
+			wantErr:    "unexpected HTTP response code: 502",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var body, auth string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				p, _ := io.ReadAll(r.Body)
+				body, auth = string(p), r.Header.Get("authorization")
+				assert.Equal(t, "application/json", r.Header.Get("content-type"))
+				w.WriteHeader(tc.statusCode)
+			}))
+			defer srv.Close()
+
+			sink, err := output.NewWebhook(srv.Client(), output.WebhookConfig{
+				URL:      srv.URL,
+				Template: tc.template,
+				Headers:  map[string]string{"Authorization": "Bearer secret"},
+			})
+			require.NoError(t, err)
+
+			err = sink.Write(context.Background(), frame("12345", 2500))
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				assert.Equal(t, tc.permanent, output.IsPermanent(err))
+				return
+			}
+			require.NoError(t, err)
+			assert.Contains(t, body, tc.wantBody)
+			assert.Equal(t, "Bearer secret", auth)
+		})
+	}
+}
+
+func TestParseWebhookTemplate(t *testing.T) {
+	_, err := output.ParseWebhookTemplate(`{"power": {{.Fields.pv_power}`)
+	assert.ErrorContains(t, err, "error parsing template")
+}
@@ -0,0 +1,242 @@
+// Package prometheus writes metrics in the Prometheus text exposition
+// format, including a metric for every field of an inverter data frame.
+package prometheus
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"git.netflux.io/rob/solar-toolkit/inverter"
+)
+
+// Namespace prefixes the name of every inverter metric.
+const Namespace = "solar"
+
+// ContentType is the content type of the text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Type is the type of a metric.
+type Type string
+
+const (
+	Gauge   Type = "gauge"
+	Counter Type = "counter"
+)
+
+// Label is a metric label.
+type Label struct {
+	Name  string
+	Value string
+}
+
+type sample struct {
+	labels []Label
+	value  float64
+}
+
+type family struct {
+	name    string
+	typ     Type
+	help    string
+	samples []sample
+}
+
+// Set is a set of metric families, written in the order in which they were
+// first added. The zero value is an empty set.
+type Set struct {
+	families []*family
+	byName   map[string]*family
+}
+
+// Add adds a sample to the metric family with the name, creating it if
+// needed. The type and help of an existing family are not changed.
+func (s *Set) Add(name string, typ Type, help string, value float64, labels ...Label) {
+	if s.byName == nil {
+		s.byName = make(map[string]*family)
+	}
+
+	f, ok := s.byName[name]
+	if !ok {
+		f = &family{name: name, typ: typ, help: help}
+		s.byName[name] = f
+		s.families = append(s.families, f)
+	}
+	f.samples = append(f.samples, sample{labels: labels, value: value})
+}
+
+// AddFrame adds a sample for every field included in the frame, with the
+// labels followed by the phase or string labels of the field.
+func (s *Set) AddFrame(frame *inverter.ETDataFrame, labels ...Label) {
+	for i := range fieldMetrics {
+		s.addField(frame, &fieldMetrics[i], labels)
+	}
+}
+
+// AddFields is like AddFrame, but only adds samples for the provided fields.
+func (s *Set) AddFields(frame *inverter.ETDataFrame, fields []inverter.Field, labels ...Label) {
+	for _, f := range fields {
+		if i, ok := fieldMetricIndex[f.Name]; ok {
+			s.addField(frame, &fieldMetrics[i], labels)
+		}
+	}
+}
+
+func (s *Set) addField(frame *inverter.ETDataFrame, m *fieldMetric, labels []Label) {
+	v, ok := m.field.Value(frame)
+	if !ok {
+		return
+	}
+	s.Add(m.name, m.typ, m.help, v, append(labels[:len(labels):len(labels)], m.labels...)...)
+}
+
+// WriteTo writes the set in the text exposition format.
+func (s *Set) WriteTo(w io.Writer) (int64, error) {
+	cw := countingWriter{w: w}
+	bw := bufio.NewWriter(&cw)
+
+	for _, f := range s.families {
+		fmt.Fprintf(bw, "# HELP %s %s\n", f.name, escape(f.help, false))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", f.name, f.typ)
+		for _, smp := range f.samples {
+			bw.WriteString(f.name)
+			if len(smp.labels) > 0 {
+				bw.WriteByte('{')
+				for i, l := range smp.labels {
+					if i > 0 {
+						bw.WriteByte(',')
+					}
+					fmt.Fprintf(bw, "%s=\"%s\"", l.Name, escape(l.Value, true))
+				}
+				bw.WriteByte('}')
+			}
+			bw.WriteByte(' ')
+			bw.WriteString(formatValue(smp.value))
+			bw.WriteByte('\n')
+		}
+	}
+
+	err := bw.Flush()
+	return cw.n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func escape(s string, quoted bool) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	if quoted {
+		s = strings.ReplaceAll(s, `"`, `\"`)
+	}
+	return s
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+// unitSuffixes maps field units to the suffixes of metric names.
+var unitSuffixes = map[string]string{
+	"W":   "watts",
+	"V":   "volts",
+	"A":   "amperes",
+	"kWh": "kilowatt_hours",
+	"Wh":  "watt_hours",
+	"Hz":  "hertz",
+	"C":   "celsius",
+}
+
+type fieldMetric struct {
+	field  inverter.Field
+	name   string
+	typ    Type
+	help   string
+	labels []Label
+}
+
+var (
+	fieldMetrics     = buildFieldMetrics()
+	fieldMetricIndex = buildFieldMetricIndex()
+)
+
+func buildFieldMetricIndex() map[string]int {
+	index := make(map[string]int, len(fieldMetrics))
+	for i, m := range fieldMetrics {
+		index[m.field.Name] = i
+	}
+	return index
+}
+
+func buildFieldMetrics() []fieldMetric {
+	fields := inverter.Fields()
+	metrics := make([]fieldMetric, 0, len(fields))
+	for _, f := range fields {
+		name, labels := FieldMetric(f)
+		m := fieldMetric{field: f, name: name, typ: Gauge, labels: labels}
+		if f.Counter {
+			m.typ = Counter
+		}
+
+		base := strings.TrimPrefix(name, Namespace+"_")
+		if f.Counter {
+			base = strings.TrimSuffix(base, "_total")
+		}
+		base = strings.TrimSuffix(base, "_"+unitSuffixes[f.Unit])
+		m.help = "Inverter " + strings.ReplaceAll(base, "_", " ")
+		if f.Unit != "" {
+			m.help += " in " + f.Unit
+		}
+		m.help += "."
+
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
+
+// FieldMetric returns the metric name and labels of the field. Fields of
+// each PV string or grid phase share a metric, distinguished by a string or
+// phase label, e.g. pv1_voltage is solar_pv_voltage_volts{string="1"} and
+// on_grid_l2_power is solar_on_grid_power_watts{phase="L2"}. Names end with
+// the unit of the field, and counters with _total.
+func FieldMetric(f inverter.Field) (string, []Label) {
+	name := f.Base
+	var labels []Label
+
+	if f.PVString != "" {
+		labels = append(labels, Label{"string", f.PVString})
+	} else if f.Phase != "" {
+		labels = append(labels, Label{"phase", f.Phase})
+	}
+
+	// Only counters may end with _total, so it is moved after the unit.
+	if f.Counter {
+		name = strings.TrimSuffix(name, "_total")
+	}
+	if suffix, ok := unitSuffixes[f.Unit]; ok {
+		name += "_" + suffix
+	}
+	if f.Counter {
+		name += "_total"
+	}
+
+	return Namespace + "_" + name, labels
+}
@@ -0,0 +1,103 @@
+package prometheus_test
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"git.netflux.io/rob/solar-toolkit/inverter"
+	"git.netflux.io/rob/solar-toolkit/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFieldMetric(t *testing.T) {
+	testCases := []struct {
+		field      string
+		wantName   string
+		wantLabels []prometheus.Label
+	}{
+		{field: "pv_power", wantName: "solar_pv_power_watts"},
+		{field: "pv2_voltage", wantName: "solar_pv_voltage_volts", wantLabels: []prometheus.Label{{Name: "string", Value: "2"}}},
+		{field: "on_grid_l3_frequency", wantName: "solar_on_grid_frequency_hertz", wantLabels: []prometheus.Label{{Name: "phase", Value: "L3"}}},
+		{field: "load_mode_l1", wantName: "solar_load_mode", wantLabels: []prometheus.Label{{Name: "phase", Value: "L1"}}},
+		{field: "meter_active_power2", wantName: "solar_meter_active_power_watts", wantLabels: []prometheus.Label{{Name: "phase", Value: "L2"}}},
+		{field: "meter_active_power_total", wantName: "solar_meter_active_power_total_watts"},
+		{field: "temperature", wantName: "solar_temperature_celsius"},
+		{field: "energy_generation_total", wantName: "solar_energy_generation_kilowatt_hours_total"},
+		{field: "energy_generation_today", wantName: "solar_energy_generation_today_kilowatt_hours"},
+		{field: "work_mode", wantName: "solar_work_mode"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.field, func(t *testing.T) {
+			field, ok := inverter.LookupField(tc.field)
+			require.True(t, ok)
+
+			name, labels := prometheus.FieldMetric(field)
+			assert.Equal(t, tc.wantName, name)
+			assert.Equal(t, tc.wantLabels, labels)
+		})
+	}
+}
+
+func TestFieldMetricUnique(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, f := range inverter.Fields() {
+		name, labels := prometheus.FieldMetric(f)
+		for _, l := range labels {
+			name += "," + l.Name + "=" + l.Value
+		}
+		assert.False(t, seen[name], "duplicate metric %s", name)
+		seen[name] = true
+	}
+}
+
+func TestSet(t *testing.T) {
+	frame := inverter.ETDataFrame{
+		SerialNumber: "12345",
+		ETRuntimeData: &inverter.ETRuntimeData{
+			PV1Voltage:            300.5,
+			PV2Voltage:            290,
+			PVPower:               2500,
+			EnergyGenerationTotal: 1234.5,
+		},
+	}
+
+	var set prometheus.Set
+	set.AddFrame(&frame, prometheus.Label{Name: "serial", Value: "12345"}, prometheus.Label{Name: "model", Value: `GW10K "ET"`})
+	set.Add("solar_daemon_poll_duration_seconds", prometheus.Gauge, "Duration of the last poll.", math.Inf(1))
+
+	var b strings.Builder
+	n, err := set.WriteTo(&b)
+	require.NoError(t, err)
+	assert.Equal(t, int64(b.Len()), n)
+
+	out := b.String()
+	assert.Contains(t, out, "# HELP solar_pv_voltage_volts Inverter pv voltage in V.\n# TYPE solar_pv_voltage_volts gauge\n"+
+		`solar_pv_voltage_volts{serial="12345",model="GW10K \"ET\"",string="1"} 300.5`+"\n"+
+		`solar_pv_voltage_volts{serial="12345",model="GW10K \"ET\"",string="2"} 290`+"\n")
+	assert.Contains(t, out, "# TYPE solar_energy_generation_kilowatt_hours_total counter\n"+
+		`solar_energy_generation_kilowatt_hours_total{serial="12345",model="GW10K \"ET\""} 1234.5`+"\n")
+	assert.Contains(t, out, "# TYPE solar_daemon_poll_duration_seconds gauge\nsolar_daemon_poll_duration_seconds +Inf\n")
+	assert.Equal(t, 1, strings.Count(out, "# TYPE solar_pv_voltage_volts "))
+	assert.NotContains(t, out, "solar_meter_", "meter data was not included in the frame")
+}
+
+func TestSetAddFields(t *testing.T) {
+	frame := inverter.ETDataFrame{
+		ETRuntimeData: &inverter.ETRuntimeData{PV1Voltage: 300.5, PV2Voltage: 290, PVPower: 2500},
+	}
+	fields, err := inverter.MatchFields([]string{"pv2_voltage", "meter_frequency"})
+	require.NoError(t, err)
+
+	var set prometheus.Set
+	set.AddFields(&frame, fields)
+
+	var b strings.Builder
+	_, err = set.WriteTo(&b)
+	require.NoError(t, err)
+	assert.Equal(t, "# HELP solar_pv_voltage_volts Inverter pv voltage in V.\n"+
+		"# TYPE solar_pv_voltage_volts gauge\n"+
+		`solar_pv_voltage_volts{string="2"} 290`+"\n", b.String())
+}
@@ -0,0 +1,285 @@
+// Package spool implements a durable, bounded, on-disk FIFO queue of frames
+// awaiting upload.
+//
+// Each frame is stored in its own file, named after its sequence number and
+// prefixed with a CRC-32 checksum. Files are written to a temporary name,
+// synced and atomically renamed, so that a power cut leaves either the whole
+// frame or nothing. Corrupt files found on replay are discarded.
+package spool
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	fileExt     = ".frame"
+	tmpExt      = ".tmp"
+	checksumLen = 4
+)
+
+// Entry is a spooled frame.
+type Entry struct {
+	ID   uint64
+	Data []byte
+}
+
+type entry struct {
+	id        uint64
+	size      int64
+	createdAt time.Time
+}
+
+// Spool is a durable on-disk FIFO queue. It is safe for concurrent use.
+type Spool struct {
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+
+	mu      sync.Mutex
+	entries []entry
+	size    int64
+	nextID  uint64
+}
+
+// Open opens the spool in dir, creating the directory if needed. Frames
+// already in the directory are queued for replay. If maxBytes or maxAge are
+// non-zero, the oldest frames are dropped as required to stay within them.
+func Open(dir string, maxBytes int64, maxAge time.Duration) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating spool directory: %s", err)
+	}
+
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading spool directory: %s", err)
+	}
+
+	s := Spool{dir: dir, maxBytes: maxBytes, maxAge: maxAge, nextID: 1}
+	for _, de := range dirEntries {
+		name := de.Name()
+		if strings.HasSuffix(name, tmpExt) {
+			// Left over from an interrupted write.
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, fileExt), 10, 64)
+		if err != nil || !strings.HasSuffix(name, fileExt) {
+			continue
+		}
+
+		info, err := de.Info()
+		if err != nil {
+			return nil, fmt.Errorf("error reading spool file: %s", err)
+		}
+
+		s.entries = append(s.entries, entry{id: id, size: info.Size(), createdAt: info.ModTime()})
+		s.size += info.Size()
+		if id >= s.nextID {
+			s.nextID = id + 1
+		}
+	}
+	sort.Slice(s.entries, func(i, j int) bool { return s.entries[i].id < s.entries[j].id })
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.enforceLimits(time.Now())
+
+	return &s, nil
+}
+
+// Pending returns the number of frames in the spool in dir, without opening
+// it.
+func Pending(dir string) (int, error) {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, fmt.Errorf("error reading spool directory: %s", err)
+	}
+
+	var n int
+	for _, de := range dirEntries {
+		if _, err := strconv.ParseUint(strings.TrimSuffix(de.Name(), fileExt), 10, 64); err == nil && strings.HasSuffix(de.Name(), fileExt) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Len returns the number of frames in the spool.
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
+
+// Size returns the size of the spool on disk, in bytes.
+func (s *Spool) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// Append durably adds a frame to the end of the spool. When it returns
+// without error, the frame will survive a crash or power cut.
+func (s *Spool) Append(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := s.nextID
+	p := make([]byte, checksumLen+len(data))
+	binary.BigEndian.PutUint32(p, crc32.ChecksumIEEE(data))
+	copy(p[checksumLen:], data)
+
+	path := s.path(id)
+	if err := writeFileSync(path+tmpExt, p); err != nil {
+		os.Remove(path + tmpExt)
+		return fmt.Errorf("error writing spool file: %s", err)
+	}
+	if err := os.Rename(path+tmpExt, path); err != nil {
+		os.Remove(path + tmpExt)
+		return fmt.Errorf("error renaming spool file: %s", err)
+	}
+	if err := syncDir(s.dir); err != nil {
+		return fmt.Errorf("error syncing spool directory: %s", err)
+	}
+
+	s.nextID++
+	now := time.Now()
+	s.entries = append(s.entries, entry{id: id, size: int64(len(p)), createdAt: now})
+	s.size += int64(len(p))
+	s.enforceLimits(now)
+
+	return nil
+}
+
+// Peek returns up to n of the oldest frames in the spool, without removing
+// them. Corrupt frames are removed and skipped.
+func (s *Spool) Peek(n int) ([]Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var result []Entry
+	for i := 0; i < len(s.entries) && len(result) < n; {
+		e := s.entries[i]
+		data, err := s.read(e.id)
+		if errors.Is(err, errCorrupt) {
+			log.Printf("spool: discarding corrupt frame %d", e.id)
+			s.removeAt(i)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, Entry{ID: e.id, Data: data})
+		i++
+	}
+
+	return result, nil
+}
+
+// Remove deletes the frames with the given IDs from the spool. Unknown IDs
+// are ignored.
+func (s *Spool) Remove(ids ...uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, id := range ids {
+		i := sort.Search(len(s.entries), func(i int) bool { return s.entries[i].id >= id })
+		if i == len(s.entries) || s.entries[i].id != id {
+			continue
+		}
+		if err := s.removeAt(i); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+var errCorrupt = errors.New("corrupt spool file")
+
+func (s *Spool) read(id uint64) ([]byte, error) {
+	p, err := os.ReadFile(s.path(id))
+	if err != nil {
+		return nil, fmt.Errorf("error reading spool file: %s", err)
+	}
+	if len(p) < checksumLen || binary.BigEndian.Uint32(p) != crc32.ChecksumIEEE(p[checksumLen:]) {
+		return nil, errCorrupt
+	}
+	return p[checksumLen:], nil
+}
+
+// removeAt removes the entry at index i. The caller must hold the lock.
+func (s *Spool) removeAt(i int) error {
+	e := s.entries[i]
+	if err := os.Remove(s.path(e.id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error removing spool file: %s", err)
+	}
+	s.entries = append(s.entries[:i], s.entries[i+1:]...)
+	s.size -= e.size
+	return nil
+}
+
+// enforceLimits drops the oldest entries until the spool is within its
+// limits. The newest entry is always kept. The caller must hold the lock.
+func (s *Spool) enforceLimits(now time.Time) {
+	var dropped int
+	for len(s.entries) > 1 {
+		oldest := s.entries[0]
+		overSize := s.maxBytes > 0 && s.size > s.maxBytes
+		overAge := s.maxAge > 0 && now.Sub(oldest.createdAt) > s.maxAge
+		if !overSize && !overAge {
+			break
+		}
+		if err := s.removeAt(0); err != nil {
+			log.Printf("spool: %s", err)
+			break
+		}
+		dropped++
+	}
+
+	if dropped > 0 {
+		log.Printf("spool: dropped %d frame(s) exceeding limits", dropped)
+	}
+}
+
+func (s *Spool) path(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", id, fileExt))
+}
+
+func writeFileSync(path string, p []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(p); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
@@ -0,0 +1,147 @@
+package spool_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.netflux.io/rob/solar-toolkit/spool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func data(entries []spool.Entry) []string {
+	var result []string
+	for _, e := range entries {
+		result = append(result, string(e.Data))
+	}
+	return result
+}
+
+func TestSpool(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := spool.Open(dir, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 0, s.Len())
+
+	for _, frame := range []string{"one", "two", "three"} {
+		require.NoError(t, s.Append([]byte(frame)))
+	}
+	assert.Equal(t, 3, s.Len())
+
+	entries, err := s.Peek(2)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"one", "two"}, data(entries))
+
+	require.NoError(t, s.Remove(entries[0].ID))
+	assert.Equal(t, 2, s.Len())
+
+	// Reopening replays the remaining frames in order, and new frames are
+	// appended after them.
+	s, err = spool.Open(dir, 0, 0)
+	require.NoError(t, err)
+	require.NoError(t, s.Append([]byte("four")))
+
+	entries, err = s.Peek(10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"two", "three", "four"}, data(entries))
+
+	var ids []uint64
+	for _, e := range entries {
+		ids = append(ids, e.ID)
+	}
+	require.NoError(t, s.Remove(ids...))
+	assert.Equal(t, 0, s.Len())
+	assert.Equal(t, int64(0), s.Size())
+
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestPending(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := spool.Open(dir, 0, 0)
+	require.NoError(t, err)
+	for _, frame := range []string{"one", "two"} {
+		require.NoError(t, s.Append([]byte(frame)))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "3.tmp"), []byte("three"), 0600))
+
+	n, err := spool.Pending(dir)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	_, err = spool.Pending(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
+
+func TestSpoolCorruption(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := spool.Open(dir, 0, 0)
+	require.NoError(t, err)
+	require.NoError(t, s.Append([]byte("one")))
+	require.NoError(t, s.Append([]byte("two")))
+
+	// Simulate an interrupted write and a damaged file.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "00000000000000000003.frame.tmp"), []byte("partial"), 0600))
+	files, err := filepath.Glob(filepath.Join(dir, "*.frame"))
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+	require.NoError(t, os.WriteFile(files[0], []byte("garbage"), 0600))
+
+	s, err = spool.Open(dir, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 2, s.Len())
+
+	entries, err := s.Peek(10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"two"}, data(entries))
+	assert.Equal(t, 1, s.Len())
+
+	tmpFiles, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	require.NoError(t, err)
+	assert.Empty(t, tmpFiles)
+}
+
+func TestSpoolLimits(t *testing.T) {
+	t.Run("size", func(t *testing.T) {
+		// Each frame takes 4 bytes of checksum plus 3 bytes of data.
+		s, err := spool.Open(t.TempDir(), 15, 0)
+		require.NoError(t, err)
+
+		for _, frame := range []string{"one", "two", "six", "ten"} {
+			require.NoError(t, s.Append([]byte(frame)))
+		}
+
+		entries, err := s.Peek(10)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"six", "ten"}, data(entries))
+		assert.Equal(t, int64(14), s.Size())
+	})
+
+	t.Run("age", func(t *testing.T) {
+		dir := t.TempDir()
+		s, err := spool.Open(dir, 0, time.Hour)
+		require.NoError(t, err)
+		require.NoError(t, s.Append([]byte("old")))
+		require.NoError(t, s.Append([]byte("new")))
+
+		files, err := filepath.Glob(filepath.Join(dir, "*.frame"))
+		require.NoError(t, err)
+		require.Len(t, files, 2)
+		old := time.Now().Add(-2 * time.Hour)
+		require.NoError(t, os.Chtimes(files[0], old, old))
+
+		s, err = spool.Open(dir, 0, time.Hour)
+		require.NoError(t, err)
+
+		entries, err := s.Peek(10)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"new"}, data(entries))
+	})
+}
@@ -0,0 +1,71 @@
+package validate
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is a set of rules, which apply after the default rules unless
+// DisableDefaults is set.
+type Config struct {
+	DisableDefaults bool   `yaml:"disable_defaults"`
+	Rules           []Rule `yaml:"rules"`
+}
+
+// Validate validates the rules. Errors are returned as RuleErrors, with keys
+// such as "rules[0].fields", joined with errors.Join.
+func (cfg *Config) Validate() error {
+	var errs []error
+	for i := range cfg.Rules {
+		if err := cfg.Rules[i].Validate(); err != nil {
+			var ruleErr *RuleError
+			if errors.As(err, &ruleErr) {
+				err = &RuleError{Key: fmt.Sprintf("rules[%d].%s", i, ruleErr.Key), Err: ruleErr.Err}
+			}
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// AllRules returns the rules which frames are checked against, including the
+// default rules. The config must have been validated.
+func (cfg *Config) AllRules() []Rule {
+	if cfg.DisableDefaults {
+		return cfg.Rules
+	}
+	return append(DefaultRules(), cfg.Rules...)
+}
+
+// ParseConfig parses and validates a YAML config.
+func ParseConfig(r io.Reader) (*Config, error) {
+	var cfg Config
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("error parsing validation config: %s", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// LoadConfig reads and validates the YAML config file at path.
+func LoadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening validation config: %s", err)
+	}
+	defer f.Close()
+
+	cfg, err := ParseConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return cfg, nil
+}
@@ -0,0 +1,48 @@
+package validate_test
+
+import (
+	"strings"
+	"testing"
+
+	"git.netflux.io/rob/solar-toolkit/validate"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := validate.ParseConfig(strings.NewReader(`
+rules:
+  - fields: [battery_voltage]
+    min: 40
+    max: 60
+    policy: flag
+`))
+	require.NoError(t, err)
+	require.Len(t, cfg.Rules, 1)
+	assert.Equal(t, validate.Flag, cfg.Rules[0].Policy)
+	assert.Len(t, cfg.AllRules(), len(validate.DefaultRules())+1)
+
+	cfg.DisableDefaults = true
+	assert.Len(t, cfg.AllRules(), 1)
+
+	// An empty config applies the default rules.
+	cfg, err = validate.ParseConfig(strings.NewReader(""))
+	require.NoError(t, err)
+	assert.Len(t, cfg.AllRules(), len(validate.DefaultRules()))
+
+	_, err = validate.ParseConfig(strings.NewReader(`
+rules:
+  - fields: [pv1_voltage]
+    max: 1000
+  - fields: [foo]
+    max: 1
+  - fields: [pv1_voltage]
+    monotonic: true
+    policy: ignore
+`))
+	assert.EqualError(t, err, "rules[1].fields: unknown field `foo`\nrules[2].policy: unknown policy `ignore`")
+
+	_, err = validate.ParseConfig(strings.NewReader("rule: []"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "field rule not found")
+}
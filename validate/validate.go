@@ -0,0 +1,388 @@
+// Package validate checks inverter data frames for implausible values, such
+// as garbage which passed the CRC check, before they are written or stored.
+//
+// Each Rule applies to a set of fields, and rejects values outside a range or
+// cumulative counters lower than their last known value. Rejected values are
+// handled according to the policy of the rule: the field is dropped, the
+// whole frame is dropped, or the frame is kept and flagged.
+package validate
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"git.netflux.io/rob/solar-toolkit/inverter"
+)
+
+// Policy determines how a value rejected by a rule is handled.
+type Policy string
+
+const (
+	// DropField omits the field from the frame.
+	DropField Policy = "drop_field"
+	// DropFrame drops the whole frame.
+	DropFrame Policy = "drop_frame"
+	// Flag keeps the value, and adds the field to the Flagged fields of the
+	// frame.
+	Flag Policy = "flag"
+)
+
+// Rule is a plausibility rule for a set of fields.
+type Rule struct {
+	// Fields are the names of the fields, optionally including shell glob
+	// characters, e.g. "pv*_voltage".
+	Fields []string `yaml:"fields"`
+	// Min and Max are the bounds of plausible values, if set.
+	Min *float64 `yaml:"min"`
+	Max *float64 `yaml:"max"`
+	// Monotonic rejects values lower than the last known value of the field
+	// for the same inverter, for cumulative counters. After ResetReadings
+	// consecutive lower values the counter is assumed to have been reset, and
+	// the lower value is accepted as the new last known value.
+	Monotonic bool `yaml:"monotonic"`
+	// Policy defaults to DropField.
+	Policy Policy `yaml:"policy"`
+
+	// fields is resolved from Fields.
+	fields []inverter.Field
+}
+
+// RuleError is an error in the value of a key of a rule.
+type RuleError struct {
+	// Key is the offending key, e.g. "fields".
+	Key string
+	Err error
+}
+
+func (e *RuleError) Error() string { return e.Key + ": " + e.Err.Error() }
+
+func (e *RuleError) Unwrap() error { return e.Err }
+
+// Validate checks the rule, resolves its fields and applies defaults. Errors
+// are returned as a RuleError.
+func (r *Rule) Validate() error {
+	if len(r.Fields) == 0 {
+		return &RuleError{Key: "fields", Err: fmt.Errorf("required")}
+	}
+	fields, err := inverter.MatchFields(r.Fields)
+	if err != nil {
+		return &RuleError{Key: "fields", Err: err}
+	}
+	r.fields = fields
+
+	if r.Min == nil && r.Max == nil && !r.Monotonic {
+		return &RuleError{Key: "fields", Err: fmt.Errorf("min, max or monotonic is required")}
+	}
+	if r.Min != nil && r.Max != nil && *r.Min > *r.Max {
+		return &RuleError{Key: "max", Err: fmt.Errorf("must not be less than min")}
+	}
+
+	switch r.Policy {
+	case "":
+		r.Policy = DropField
+	case DropField, DropFrame, Flag:
+	default:
+		return &RuleError{Key: "policy", Err: fmt.Errorf("unknown policy `%s`", r.Policy)}
+	}
+
+	return nil
+}
+
+// DefaultRules returns rules rejecting physically implausible readings and
+// lifetime counters which go backwards, with the DropField policy.
+func DefaultRules() []Rule {
+	rule := func(min, max float64, fields ...string) Rule {
+		return Rule{Fields: fields, Min: &min, Max: &max}
+	}
+
+	rules := []Rule{
+		rule(0, 1000, "pv*_voltage", "bus_voltage", "nbus_voltage", "battery_voltage"),
+		rule(0, 500, "on_grid_l*_voltage", "backup_l*_voltage"),
+		rule(0, 100, "pv*_current"),
+		rule(-500, 500, "battery_current"),
+		rule(0, 70, "*_frequency"),
+		rule(-40, 150, "temperature*"),
+		rule(-1, 1, "meter_power_factor*"),
+	}
+
+	zero := 0.0
+	counters := Rule{Min: &zero, Monotonic: true}
+	for _, f := range inverter.Fields() {
+		if f.Counter {
+			counters.Fields = append(counters.Fields, f.Name)
+		}
+	}
+	rules = append(rules, counters)
+
+	for i := range rules {
+		if err := rules[i].Validate(); err != nil {
+			panic(fmt.Sprintf("invalid default rule: %s", err))
+		}
+	}
+	return rules
+}
+
+// Violation is a value rejected by a rule.
+type Violation struct {
+	Field  string
+	Value  float64
+	Policy Policy
+	// Reason describes the rule, e.g. "above 1000".
+	Reason string
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("%s=%g is %s (%s)", v.Field, v.Value, v.Reason, v.Policy)
+}
+
+// Result is the outcome of checking a frame.
+type Result struct {
+	// Drop is true if the frame must be dropped.
+	Drop bool
+	// Violations are the values rejected by the rules.
+	Violations []Violation
+}
+
+// String returns the violations, separated by commas.
+func (r Result) String() string {
+	s := make([]string, len(r.Violations))
+	for i, v := range r.Violations {
+		s[i] = v.String()
+	}
+	return strings.Join(s, ", ")
+}
+
+// Count is the number of values of a field of an inverter rejected with a
+// policy.
+type Count struct {
+	SerialNumber string
+	Field        string
+	Policy       Policy
+	N            uint64
+}
+
+// countKey identifies a Count.
+type countKey struct {
+	serialNumber string
+	field        string
+	policy       Policy
+}
+
+// ResetReadings is the number of consecutive values lower than the last
+// known value after which a monotonic counter is assumed to have been reset.
+const ResetReadings = 3
+
+// reading is the last known value of a field.
+type reading struct {
+	value     float64
+	timestamp time.Time
+	// lower is the number of consecutive values rejected for being lower.
+	lower int
+}
+
+// Option configures a Validator.
+type Option func(*Validator)
+
+// WithHistory seeds the last known values of each inverter from its latest
+// frame, returned by fn, when the first frame of the inverter is checked.
+// fn returns nil if the inverter has no frames. It is called without holding
+// the lock of the Validator, so a slow lookup only delays the frame being
+// checked.
+func WithHistory(fn func(serialNumber string) (*inverter.ETDataFrame, error)) Option {
+	return func(v *Validator) { v.history = fn }
+}
+
+// Validator checks frames against a set of rules. It is safe for concurrent
+// use.
+type Validator struct {
+	history func(serialNumber string) (*inverter.ETDataFrame, error)
+
+	mu       sync.Mutex
+	rules    []Rule
+	last     map[string]map[string]reading
+	rejected map[countKey]uint64
+}
+
+// New returns a Validator checking frames against the rules, which must
+// have been validated.
+func New(rules []Rule, opts ...Option) *Validator {
+	v := Validator{
+		rules:    rules,
+		last:     make(map[string]map[string]reading),
+		rejected: make(map[countKey]uint64),
+	}
+	for _, opt := range opts {
+		opt(&v)
+	}
+	return &v
+}
+
+// SetRules replaces the rules, keeping the last known values and counts. The
+// rules must have been validated.
+func (v *Validator) SetRules(rules []Rule) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.rules = rules
+}
+
+// Check checks the frame, omitting or flagging rejected values according to
+// their policies. If the returned result has Drop set, the frame must be
+// dropped.
+//
+// Monotonic rules compare values with the last known values of the inverter,
+// from earlier frames which were not dropped. Frames older than the last
+// known value are not compared, nor are frames without a serial number,
+// since they cannot be told apart from those of other inverters.
+func (v *Validator) Check(frame *inverter.ETDataFrame) Result {
+	seeded := v.seed(frame.SerialNumber)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	var last map[string]reading
+	if frame.SerialNumber != "" {
+		var ok bool
+		if last, ok = v.last[frame.SerialNumber]; !ok {
+			last = make(map[string]reading)
+			if seeded {
+				v.last[frame.SerialNumber] = last
+			}
+		}
+	}
+	ts := frameTimestamp(frame)
+
+	var result Result
+	for _, rule := range v.rules {
+		for _, f := range rule.fields {
+			value, ok := f.Value(frame)
+			if !ok {
+				continue
+			}
+
+			var reason string
+			prev, hasPrev := last[f.Name]
+			switch {
+			case rule.Min != nil && value < *rule.Min:
+				reason = fmt.Sprintf("below %g", *rule.Min)
+			case rule.Max != nil && value > *rule.Max:
+				reason = fmt.Sprintf("above %g", *rule.Max)
+			case rule.Monotonic && hasPrev && prev.timestamp.Before(ts) && value < prev.value:
+				if prev.lower+1 >= ResetReadings {
+					log.Printf("%s of %s reset from %g to %g", f.Name, frame.SerialNumber, prev.value, value)
+					last[f.Name] = reading{value: value, timestamp: ts}
+					continue
+				}
+				prev.lower++
+				last[f.Name] = prev
+				reason = fmt.Sprintf("less than the last known value %g", prev.value)
+			default:
+				continue
+			}
+
+			result.Violations = append(result.Violations, Violation{Field: f.Name, Value: value, Policy: rule.Policy, Reason: reason})
+			v.rejected[countKey{frame.SerialNumber, f.Name, rule.Policy}]++
+
+			switch rule.Policy {
+			case DropField:
+				frame.Omit(f)
+			case DropFrame:
+				result.Drop = true
+			case Flag:
+				if !slices.Contains(frame.Flagged, f.Name) {
+					frame.Flagged = append(frame.Flagged, f.Name)
+				}
+			}
+		}
+	}
+
+	if !result.Drop && last != nil {
+		v.remember(last, frame, ts)
+	}
+
+	return result
+}
+
+// seed seeds the last known values of the inverter from its history on
+// first use. It returns false if the history could not be fetched, in which
+// case seeding is retried with the next frame.
+func (v *Validator) seed(serialNumber string) bool {
+	if v.history == nil || serialNumber == "" {
+		return true
+	}
+
+	v.mu.Lock()
+	_, ok := v.last[serialNumber]
+	v.mu.Unlock()
+	if ok {
+		return true
+	}
+
+	frame, err := v.history(serialNumber)
+	if err != nil {
+		log.Printf("error fetching latest frame of %s: %s", serialNumber, err)
+		return false
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	// Another frame of the inverter may have been checked meanwhile.
+	if _, ok := v.last[serialNumber]; ok {
+		return true
+	}
+	last := make(map[string]reading)
+	if frame != nil {
+		v.remember(last, frame, frameTimestamp(frame))
+	}
+	v.last[serialNumber] = last
+	return true
+}
+
+// remember records the values of the frame checked by monotonic rules, if
+// they are newer than the last known values.
+func (v *Validator) remember(last map[string]reading, frame *inverter.ETDataFrame, ts time.Time) {
+	for _, rule := range v.rules {
+		if !rule.Monotonic {
+			continue
+		}
+		for _, f := range rule.fields {
+			value, ok := f.Value(frame)
+			if prev, hasPrev := last[f.Name]; ok && (!hasPrev || !ts.Before(prev.timestamp)) {
+				last[f.Name] = reading{value: value, timestamp: ts}
+			}
+		}
+	}
+}
+
+// Rejected returns the number of values rejected by each policy, for each
+// field of each inverter, sorted by serial number and field.
+func (v *Validator) Rejected() []Count {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	counts := make([]Count, 0, len(v.rejected))
+	for key, n := range v.rejected {
+		counts = append(counts, Count{SerialNumber: key.serialNumber, Field: key.field, Policy: key.policy, N: n})
+	}
+	slices.SortFunc(counts, func(a, b Count) int {
+		return cmp.Or(
+			strings.Compare(a.SerialNumber, b.SerialNumber),
+			strings.Compare(a.Field, b.Field),
+			strings.Compare(string(a.Policy), string(b.Policy)),
+		)
+	})
+	return counts
+}
+
+func frameTimestamp(frame *inverter.ETDataFrame) time.Time {
+	if frame.ETRuntimeData == nil {
+		return time.Time{}
+	}
+	return frame.Timestamp
+}
@@ -0,0 +1,314 @@
+package validate_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"git.netflux.io/rob/solar-toolkit/inverter"
+	"git.netflux.io/rob/solar-toolkit/validate"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func ptr(v float64) *float64 { return &v }
+
+func testFrame(ts time.Time, pvVoltage float64, generation float64) *inverter.ETDataFrame {
+	return &inverter.ETDataFrame{
+		SerialNumber: "12345",
+		ETRuntimeData: &inverter.ETRuntimeData{
+			Timestamp:             ts,
+			PV1Voltage:            inverter.Voltage(pvVoltage),
+			Temperature:           45,
+			EnergyGenerationTotal: inverter.Energy(generation),
+		},
+	}
+}
+
+func validRules(t *testing.T, rules ...validate.Rule) []validate.Rule {
+	t.Helper()
+	for i := range rules {
+		require.NoError(t, rules[i].Validate())
+	}
+	return rules
+}
+
+func TestCheck(t *testing.T) {
+	ts := time.Date(2022, 7, 14, 10, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name          string
+		policy        validate.Policy
+		wantDrop      bool
+		wantOmitted   bool
+		wantFlagged   []string
+		wantViolation string
+	}{
+		{
+			name:          "drop field",
+			policy:        "",
+			wantOmitted:   true,
+			wantViolation: "pv1_voltage=65535 is above 1000 (drop_field)",
+		},
+		{
+			name:          "drop frame",
+			policy:        validate.DropFrame,
+			wantDrop:      true,
+			wantViolation: "pv1_voltage=65535 is above 1000 (drop_frame)",
+		},
+		{
+			name:          "flag",
+			policy:        validate.Flag,
+			wantFlagged:   []string{"pv1_voltage"},
+			wantViolation: "pv1_voltage=65535 is above 1000 (flag)",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			v := validate.New(validRules(t, validate.Rule{Fields: []string{"pv*_voltage"}, Min: ptr(0), Max: ptr(1000), Policy: tc.policy}))
+
+			frame := testFrame(ts, 65535, 100)
+			result := v.Check(frame)
+			assert.Equal(t, tc.wantDrop, result.Drop)
+			assert.Equal(t, tc.wantViolation, result.String())
+			assert.Equal(t, tc.wantOmitted, frame.Omitted("pv1_voltage"))
+			assert.Equal(t, tc.wantFlagged, frame.Flagged)
+			assert.False(t, frame.Omitted("temperature"))
+
+			frame = testFrame(ts.Add(time.Minute), 316.4, 100)
+			result = v.Check(frame)
+			assert.False(t, result.Drop)
+			assert.Empty(t, result.Violations)
+			assert.False(t, frame.Omitted("pv1_voltage"))
+			assert.Empty(t, frame.Flagged)
+		})
+	}
+}
+
+func TestCheckMonotonic(t *testing.T) {
+	ts := time.Date(2022, 7, 14, 10, 0, 0, 0, time.UTC)
+	v := validate.New(validRules(t, validate.Rule{Fields: []string{"energy_generation_total"}, Monotonic: true, Policy: validate.DropFrame}))
+
+	assert.False(t, v.Check(testFrame(ts, 300, 1234.5)).Drop)
+
+	result := v.Check(testFrame(ts.Add(time.Minute), 300, 5))
+	assert.True(t, result.Drop)
+	assert.Equal(t, "energy_generation_total=5 is less than the last known value 1234.5 (drop_frame)", result.String())
+
+	// The dropped frame is not remembered.
+	assert.False(t, v.Check(testFrame(ts.Add(2*time.Minute), 300, 1234.6)).Drop)
+
+	// Older frames, e.g. uploaded late, are not compared.
+	assert.False(t, v.Check(testFrame(ts.Add(-time.Hour), 300, 1200)).Drop)
+	assert.True(t, v.Check(testFrame(ts.Add(3*time.Minute), 300, 1234.5)).Drop)
+
+	// Other inverters are compared with their own values.
+	other := testFrame(ts.Add(3*time.Minute), 300, 10)
+	other.SerialNumber = "67890"
+	assert.False(t, v.Check(other).Drop)
+
+	assert.Equal(t, []validate.Count{
+		{SerialNumber: "12345", Field: "energy_generation_total", Policy: validate.DropFrame, N: 2},
+	}, v.Rejected())
+}
+
+func TestCheckMonotonicReset(t *testing.T) {
+	ts := time.Date(2022, 7, 14, 10, 0, 0, 0, time.UTC)
+	v := validate.New(validRules(t, validate.Rule{Fields: []string{"energy_generation_total"}, Monotonic: true}))
+	check := func(minutes int, generation float64) bool {
+		frame := testFrame(ts.Add(time.Duration(minutes)*time.Minute), 300, generation)
+		v.Check(frame)
+		return frame.Omitted("energy_generation_total")
+	}
+
+	assert.False(t, check(0, 1234.5))
+
+	// A single lower value, e.g. garbage, is dropped without affecting the
+	// count of consecutive lower values.
+	assert.True(t, check(1, 5))
+	assert.False(t, check(2, 1234.6))
+
+	// After a reset, the lower values are dropped until there have been
+	// ResetReadings of them in a row, and the last is the new baseline.
+	for i := 1; i < validate.ResetReadings; i++ {
+		assert.True(t, check(2+i, float64(i)), i)
+	}
+	assert.False(t, check(2+validate.ResetReadings, validate.ResetReadings))
+	assert.False(t, check(3+validate.ResetReadings, validate.ResetReadings+0.1))
+	assert.True(t, check(4+validate.ResetReadings, 1))
+}
+
+func TestCheckMonotonicWithoutSerialNumber(t *testing.T) {
+	ts := time.Date(2022, 7, 14, 10, 0, 0, 0, time.UTC)
+	history := func(string) (*inverter.ETDataFrame, error) {
+		t.Error("history must not be fetched without a serial number")
+		return nil, nil
+	}
+	v := validate.New(validRules(t, validate.Rule{Fields: []string{"energy_generation_total"}, Monotonic: true}), validate.WithHistory(history))
+
+	// Frames without a serial number may be from different inverters.
+	for i, generation := range []float64{1234.5, 5} {
+		frame := testFrame(ts.Add(time.Duration(i)*time.Minute), 300, generation)
+		frame.SerialNumber = ""
+		assert.Empty(t, v.Check(frame).Violations)
+	}
+}
+
+func TestCheckHistoryWithoutLock(t *testing.T) {
+	ts := time.Date(2022, 7, 14, 10, 0, 0, 0, time.UTC)
+
+	fetching := make(chan struct{})
+	release := make(chan struct{})
+	history := func(serialNumber string) (*inverter.ETDataFrame, error) {
+		if serialNumber == "12345" {
+			close(fetching)
+			<-release
+		}
+		return nil, nil
+	}
+	v := validate.New(validRules(t, validate.Rule{Fields: []string{"energy_generation_total"}, Monotonic: true}), validate.WithHistory(history))
+
+	done := make(chan struct{})
+	go func() {
+		v.Check(testFrame(ts, 300, 1234.5))
+		close(done)
+	}()
+	<-fetching
+
+	// Frames of other inverters are checked while the history is fetched.
+	checked := make(chan struct{})
+	go func() {
+		other := testFrame(ts, 300, 10)
+		other.SerialNumber = "67890"
+		v.Check(other)
+		close(checked)
+	}()
+	select {
+	case <-checked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("check blocked by a history lookup of another inverter")
+	}
+
+	close(release)
+	<-done
+}
+
+func TestCheckWithHistory(t *testing.T) {
+	ts := time.Date(2022, 7, 14, 10, 0, 0, 0, time.UTC)
+
+	var calls int
+	history := func(serialNumber string) (*inverter.ETDataFrame, error) {
+		calls++
+		switch {
+		case calls == 1:
+			return nil, errors.New("database is locked")
+		case serialNumber == "12345":
+			return testFrame(ts, 300, 1234.5), nil
+		default:
+			return nil, nil
+		}
+	}
+	v := validate.New(validRules(t, validate.Rule{Fields: []string{"energy_generation_total"}, Monotonic: true}), validate.WithHistory(history))
+
+	// Seeding fails, and is retried with the next frame.
+	frame := testFrame(ts.Add(time.Minute), 300, 5)
+	assert.Empty(t, v.Check(frame).Violations)
+
+	frame = testFrame(ts.Add(2*time.Minute), 300, 5)
+	result := v.Check(frame)
+	assert.False(t, result.Drop)
+	assert.Len(t, result.Violations, 1)
+	assert.True(t, frame.Omitted("energy_generation_total"))
+
+	frame = testFrame(ts.Add(2*time.Minute), 300, 5)
+	frame.SerialNumber = "67890"
+	assert.Empty(t, v.Check(frame).Violations)
+	assert.Equal(t, 3, calls)
+}
+
+func TestRejected(t *testing.T) {
+	ts := time.Date(2022, 7, 14, 10, 0, 0, 0, time.UTC)
+	v := validate.New(validate.DefaultRules())
+
+	frame := testFrame(ts, 65535, -1)
+	frame.Temperature = 6553.5
+	v.Check(frame)
+	v.Check(testFrame(ts.Add(time.Minute), 65535, 100))
+
+	assert.Equal(t, []validate.Count{
+		{SerialNumber: "12345", Field: "energy_generation_total", Policy: validate.DropField, N: 1},
+		{SerialNumber: "12345", Field: "pv1_voltage", Policy: validate.DropField, N: 2},
+		{SerialNumber: "12345", Field: "temperature", Policy: validate.DropField, N: 1},
+	}, v.Rejected())
+}
+
+func TestDefaultRules(t *testing.T) {
+	ts := time.Date(2022, 7, 14, 10, 0, 0, 0, time.UTC)
+	v := validate.New(validate.DefaultRules())
+
+	frame := testFrame(ts, 316.4, 1234.5)
+	frame.BatteryVoltage = 52.1
+	frame.BatteryCurrent = -10.5
+	frame.OnGridL1Frequency = 50.01
+	frame.ETMeterData = &inverter.ETMeterData{MeterPowerFactor: -0.98, MeterFrequency: 50.01}
+	assert.Empty(t, v.Check(frame).Violations)
+
+	frame = testFrame(ts.Add(time.Minute), 316.4, 1234.5)
+	frame.ETMeterData = &inverter.ETMeterData{MeterPowerFactor: 6.5}
+	result := v.Check(frame)
+	assert.Equal(t, "meter_power_factor=6.5 is above 1 (drop_field)", result.String())
+}
+
+func TestRuleValidate(t *testing.T) {
+	testCases := []struct {
+		name    string
+		rule    validate.Rule
+		wantErr string
+	}{
+		{
+			name: "valid",
+			rule: validate.Rule{Fields: []string{"pv*_voltage"}, Max: ptr(1000)},
+		},
+		{
+			name:    "no fields",
+			rule:    validate.Rule{Max: ptr(1000)},
+			wantErr: "fields: required",
+		},
+		{
+			name:    "unknown field",
+			rule:    validate.Rule{Fields: []string{"foo"}, Max: ptr(1000)},
+			wantErr: "fields: unknown field `foo`",
+		},
+		{
+			name:    "no checks",
+			rule:    validate.Rule{Fields: []string{"pv1_voltage"}},
+			wantErr: "fields: min, max or monotonic is required",
+		},
+		{
+			name:    "max less than min",
+			rule:    validate.Rule{Fields: []string{"pv1_voltage"}, Min: ptr(10), Max: ptr(1)},
+			wantErr: "max: must not be less than min",
+		},
+		{
+			name:    "unknown policy",
+			rule:    validate.Rule{Fields: []string{"pv1_voltage"}, Max: ptr(1000), Policy: "ignore"},
+			wantErr: "policy: unknown policy `ignore`",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.rule.Validate()
+			if tc.wantErr != "" {
+				assert.EqualError(t, err, tc.wantErr)
+				var ruleErr *validate.RuleError
+				assert.ErrorAs(t, err, &ruleErr)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, validate.DropField, tc.rule.Policy)
+		})
+	}
+}